@@ -13,13 +13,18 @@ const (
 	deleteCommand = byte(3)
 
 	statusCommand = byte(4)
+
+	getManyCommand = byte(9)
+
+	setManyCommand = byte(10)
+
+	deleteManyCommand = byte(11)
 )
 
+// AsyncClient 的每个请求都在单独的 goroutine 中执行，vex.Client 使用第二版协议时会在同一个连接上同时发送这些请求
 type AsyncClient struct {
 	// 用于内部执行命令，
 	client *vex.Client
-	// 用于接收请求
-	requestChan chan *request
 }
 
 func NewAsyncClient(address string) (*AsyncClient, error) {
@@ -27,34 +32,21 @@ func NewAsyncClient(address string) (*AsyncClient, error) {
 	if err != nil {
 		return nil, err
 	}
-	c := &AsyncClient{
-		client:      client,
-		requestChan: make(chan *request, 163840),
-	}
-	c.handleRequests()
-	return c, nil
-}
-
-func (ac *AsyncClient) handleRequests() {
-	go func() {
-		for request := range ac.requestChan {
-			body, err := ac.client.Do(request.command, request.args)
-			request.resultChan <- &Response{
-				Body: body,
-				Err:  err,
-			}
-		}
-	}()
+	return &AsyncClient{
+		client: client,
+	}, nil
 }
 
 func (ac *AsyncClient) do(command byte, args [][]byte) <-chan *Response {
 	// 设置一个缓冲位置放响应
 	resultChan := make(chan *Response, 1)
-	ac.requestChan <- &request{
-		command:    command,
-		args:       args,
-		resultChan: resultChan,
-	}
+	go func() {
+		body, err := ac.client.Do(command, args)
+		resultChan <- &Response{
+			Body: body,
+			Err:  err,
+		}
+	}()
 	return resultChan
 }
 
@@ -72,11 +64,40 @@ func (ac *AsyncClient) Delete(key string) <-chan *Response {
 	return ac.do(deleteCommand, [][]byte{[]byte(key)})
 }
 
+// GetMany 批量获取 keys 对应的值，使用 Response.ToValues 解析结果
+func (ac *AsyncClient) GetMany(keys []string) <-chan *Response {
+	return ac.do(getManyCommand, keyArgsOf(keys))
+}
+
+// SetMany 使用同样的有效期批量设置 entries 中的键值对
+func (ac *AsyncClient) SetMany(entries map[string][]byte, ttl int64) <-chan *Response {
+	ttlBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttlBytes, uint64(ttl))
+	args := make([][]byte, 0, 1+2*len(entries))
+	args = append(args, ttlBytes)
+	for key, value := range entries {
+		args = append(args, []byte(key), value)
+	}
+	return ac.do(setManyCommand, args)
+}
+
+// DeleteMany 批量删除 keys
+func (ac *AsyncClient) DeleteMany(keys []string) <-chan *Response {
+	return ac.do(deleteManyCommand, keyArgsOf(keys))
+}
+
+func keyArgsOf(keys []string) [][]byte {
+	args := make([][]byte, len(keys))
+	for i, key := range keys {
+		args[i] = []byte(key)
+	}
+	return args
+}
+
 func (ac *AsyncClient) Status() <-chan *Response {
 	return ac.do(statusCommand, nil)
 }
 
 func (ac *AsyncClient) Close() error {
-	close(ac.requestChan)
 	return ac.client.Close()
 }
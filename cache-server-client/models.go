@@ -1,23 +1,21 @@
 package cache_server_client
 
 import (
+	"encoding/binary"
 	"encoding/json"
+	"errors"
+)
+
+var (
+	// malformedValuesErr 意味着批量获取的响应格式不正确
+	malformedValuesErr = errors.New("malformed values in response")
 )
 
 type Status struct {
 	Count     int   `json:"count"`
 	KeySize   int64 `json:"keySize"`
 	ValueSize int64 `json:"valueSize"`
-}
-
-// request 请求结构体
-type request struct {
-	// 命令
-	command byte
-	// 执行的参数
-	args [][]byte
-	// 用于接收结果的管道
-	resultChan chan *Response
+	Evictions int64 `json:"evictions"`
 }
 
 type Response struct {
@@ -34,3 +32,33 @@ func (r *Response) ToStatus() (*Status, error) {
 	status := &Status{}
 	return status, json.Unmarshal(r.Body, status)
 }
+
+// ToValues 解析批量获取的响应，keys 需要和请求时的顺序一致，返回值中只包含存在的 key
+func (r *Response) ToValues(keys []string) (map[string][]byte, error) {
+	if r.Err != nil {
+		return nil, r.Err
+	}
+	body := r.Body
+	values := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		if len(body) < 1 {
+			return nil, malformedValuesErr
+		}
+		found := body[0]
+		body = body[1:]
+		if found == 0 {
+			continue
+		}
+		if len(body) < 4 {
+			return nil, malformedValuesErr
+		}
+		length := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint32(len(body)) < length {
+			return nil, malformedValuesErr
+		}
+		values[key] = body[:length]
+		body = body[length:]
+	}
+	return values, nil
+}
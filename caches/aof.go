@@ -0,0 +1,460 @@
+package caches
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// FsyncAlways 每次写入日志都同步到磁盘，最安全但是最慢
+	FsyncAlways = "always"
+	// FsyncEverySecond 每秒同步一次日志，崩溃时最多丢失一秒的数据
+	FsyncEverySecond = "everysec"
+	// FsyncNever 不主动同步日志，什么时候落盘交给操作系统决定
+	FsyncNever = "never"
+
+	// aofSetOperation 和 aofDeleteOperation 是日志中记录的操作类型
+	aofSetOperation    = byte(1)
+	aofDeleteOperation = byte(2)
+	// aofSelectOperation 切换后面的记录所属的命名空间，日志开头的记录属于默认命名空间
+	aofSelectOperation = byte(3)
+	// aofFlushOperation 清空当前命名空间
+	aofFlushOperation = byte(4)
+	// aofSetWithExpirationOperation 是带有有效期方式和毫秒精度的设置记录，新的设置操作都使用这个记录
+	// aofSetOperation 是旧格式的设置记录，有效期和写入时间都以秒为单位，回放时仍然支持
+	aofSetWithExpirationOperation = byte(5)
+	// aofKeyOperation 记录之后的加密记录使用的密钥编号和 nonce 前缀，格式和 sealer 的头部相同
+	aofKeyOperation = byte(6)
+	// aofSealedOperation 是加密之后的记录：密文长度 (4) | 密文，解密之后是一条或者多条普通的记录
+	aofSealedOperation = byte(7)
+
+	// rotatedAofSuffix 是重写时旧日志文件的后缀，新的持久化文件写入成功之后旧日志就会被删除
+	rotatedAofSuffix = ".old"
+)
+
+var (
+	// unknownAofOperationErr 意味着日志文件中出现了不认识的操作类型，日志文件很可能已经损坏
+	unknownAofOperationErr = errors.New("unknown operation in append only file")
+	// missingAofKeyErr 意味着加密的记录之前没有记录密钥编号，日志文件很可能已经损坏
+	missingAofKeyErr = errors.New("sealed record without key in append only file")
+)
+
+// aof 是只追加的命令日志，记录所有修改操作执行之后的结果
+// 日志中记录的都是结果而不是命令本身，所以重复回放同一段日志是安全的，这也是重写时可以直接以快照为基础的原因
+type aof struct {
+	// path 日志文件路径
+	path string
+	// fsync 日志同步到磁盘的策略
+	fsync string
+	// file 和 writer 是当前正在写入的日志文件
+	file   *os.File
+	writer *bufio.Writer
+	// size 当前日志文件的大小
+	size int64
+	// rewriteSize 日志文件超过这个大小就需要重写，为 0 时表示不根据大小重写
+	rewriteSize int64
+	// namespace 是日志文件中最后一次切换到的命名空间，为空时表示不确定，下一条记录之前需要先切换
+	namespace string
+	lock      *sync.Mutex
+	// closed 用于停止后台的同步任务
+	closed chan struct{}
+	// keyring 不为 nil 时所有记录都会加密之后再写入，sealer 是当前文件中正在使用的 sealer，为 nil 时需要先写入密钥记录
+	keyring *keyring
+	sealer  *sealer
+}
+
+// IsValidAofFsync 判断 fsync 是否是支持的日志同步策略
+func IsValidAofFsync(fsync string) bool {
+	return fsync == FsyncAlways || fsync == FsyncEverySecond || fsync == FsyncNever
+}
+
+// openAof 打开 path 对应的日志文件，不存在则创建
+// validSize 是日志文件中完整记录的长度，崩溃时最后一条记录可能没有写完，需要截断掉
+// keyring 不为 nil 时之后的记录都会加密，已有的记录不管有没有加密都会保留，回放时两种记录都支持
+func openAof(path string, fsync string, validSize int64, keyring *keyring) (*aof, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err = file.Truncate(validSize); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err = file.Seek(validSize, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	a := &aof{
+		path:    path,
+		fsync:   fsync,
+		file:    file,
+		writer:  bufio.NewWriter(file),
+		size:    validSize,
+		lock:    &sync.Mutex{},
+		closed:  make(chan struct{}),
+		keyring: keyring,
+	}
+	a.autoSync()
+	return a, nil
+}
+
+// appendSet 记录 namespace 中的 key 被设置成 v，a 为 nil 时表示没有开启日志
+func (a *aof) appendSet(namespace string, key string, v *value) error {
+	if a == nil {
+		return nil
+	}
+	record := make([]byte, 0, 1+4+len(key)+1+8+8+4+len(v.Data))
+	record = append(record, aofSetWithExpirationOperation)
+	record = appendBytes(record, []byte(key))
+	record = appendExpiration(record, v)
+	record = appendBytes(record, v.Data)
+	return a.append(namespace, record)
+}
+
+// appendDelete 记录 namespace 中的 key 被删除，a 为 nil 时表示没有开启日志
+func (a *aof) appendDelete(namespace string, key string) error {
+	if a == nil {
+		return nil
+	}
+	return a.append(namespace, nameRecordOf(aofDeleteOperation, key))
+}
+
+// appendFlush 记录 namespace 被清空，a 为 nil 时表示没有开启日志
+func (a *aof) appendFlush(namespace string) error {
+	if a == nil {
+		return nil
+	}
+	return a.append(namespace, nameRecordOf(aofFlushOperation, ""))
+}
+
+// nameRecordOf 返回只有一个名字的记录：操作类型 (1) | 名字长度 (4) | 名字
+func nameRecordOf(operation byte, name string) []byte {
+	record := make([]byte, 0, 1+4+len(name))
+	record = append(record, operation)
+	return appendBytes(record, []byte(name))
+}
+
+// append 写入属于 namespace 的记录，和上一条记录的命名空间不同时需要先写入切换命名空间的记录
+// 开启加密时，切换命名空间的记录和 record 会一起加密成一条记录，所以命名空间的名字也不会泄露
+func (a *aof) append(namespace string, record []byte) error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.namespace != namespace {
+		record = append(nameRecordOf(aofSelectOperation, namespace), record...)
+	}
+	if a.keyring != nil {
+		sealed, err := a.seal(record)
+		if err != nil {
+			return err
+		}
+		record = sealed
+	}
+	n, err := a.writer.Write(record)
+	a.size += int64(n)
+	if err != nil {
+		return err
+	}
+	a.namespace = namespace
+	if a.fsync == FsyncAlways {
+		return a.sync()
+	}
+	return nil
+}
+
+// seal 将 record 加密成一条加密记录，当前文件还没有使用过 sealer 或者 nonce 已经用完时，会在前面加上新的密钥记录
+func (a *aof) seal(record []byte) ([]byte, error) {
+	var result []byte
+	if a.sealer == nil || a.sealer.counter == ^uint32(0) {
+		sealer, err := a.keyring.newSealer()
+		if err != nil {
+			return nil, err
+		}
+		a.sealer = sealer
+		result = append([]byte{aofKeyOperation}, sealer.header()...)
+	}
+	sealed, err := a.sealer.seal(record)
+	if err != nil {
+		return nil, err
+	}
+	result = append(result, aofSealedOperation)
+	return appendBytes(result, sealed), nil
+}
+
+// sync 将缓冲区的数据写入文件，除了 FsyncNever 之外都会同步到磁盘，调用方需要持有锁
+func (a *aof) sync() error {
+	if err := a.writer.Flush(); err != nil {
+		return err
+	}
+	if a.fsync == FsyncNever {
+		return nil
+	}
+	return a.file.Sync()
+}
+
+// autoSync 开启定时任务，每秒将缓冲区的数据写入文件
+func (a *aof) autoSync() {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				a.lock.Lock()
+				a.sync()
+				a.lock.Unlock()
+			case <-a.closed:
+				return
+			}
+		}
+	}()
+}
+
+// currentSize 返回当前日志文件的大小
+func (a *aof) currentSize() int64 {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	return a.size
+}
+
+// needsRewrite 判断日志是否已经大到需要重写了
+func (a *aof) needsRewrite() bool {
+	return a.rewriteSize > 0 && a.currentSize() > a.rewriteSize
+}
+
+// rotate 将当前的日志转移到旧日志文件中，并开始写入一个新的空日志
+// 如果上一次重写失败了，旧日志文件还存在，那么当前日志会追加到旧日志的末尾，保证日志的顺序
+func (a *aof) rotate() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if err := a.sync(); err != nil {
+		return err
+	}
+
+	rotatedPath := a.path + rotatedAofSuffix
+	if _, err := os.Stat(rotatedPath); os.IsNotExist(err) {
+		a.file.Close()
+		if err = os.Rename(a.path, rotatedPath); err != nil {
+			return err
+		}
+		file, err := os.OpenFile(a.path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+		if err = syncDir(filepath.Dir(a.path)); err != nil {
+			file.Close()
+			return err
+		}
+		a.file = file
+		a.writer.Reset(file)
+		a.size = 0
+		a.namespace = ""
+		a.sealer = nil
+		return nil
+	}
+
+	if err := appendFileTo(a.path, rotatedPath); err != nil {
+		return err
+	}
+	if err := a.file.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := a.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	a.size = 0
+	a.namespace = ""
+	a.sealer = nil
+	return nil
+}
+
+// removeRotated 删除旧日志文件，只有在新的持久化文件写入成功之后才能调用
+func (a *aof) removeRotated() error {
+	err := os.Remove(a.path + rotatedAofSuffix)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// close 停止后台的同步任务并关闭日志文件
+func (a *aof) close() error {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	close(a.closed)
+	if err := a.writer.Flush(); err != nil {
+		a.file.Close()
+		return err
+	}
+	if err := a.file.Sync(); err != nil {
+		a.file.Close()
+		return err
+	}
+	return a.file.Close()
+}
+
+// appendFileTo 将 src 文件的内容追加到 dst 文件的末尾
+func appendFileTo(src string, dst string) error {
+	srcFile, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer srcFile.Close()
+
+	dstFile, err := os.OpenFile(dst, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dstFile, srcFile); err != nil {
+		dstFile.Close()
+		return err
+	}
+	if err = dstFile.Sync(); err != nil {
+		dstFile.Close()
+		return err
+	}
+	return dstFile.Close()
+}
+
+// replayAof 依次读取 path 日志中的记录，并交给 apply 处理，namespace 是记录所属的命名空间
+// 返回值是完整记录的长度，最后一条记录不完整说明写入时发生了崩溃，这条记录会被忽略
+// 加密的记录使用 keyring 中对应编号的密钥解密，日志中可以同时有加密和没有加密的记录
+func replayAof(path string, kr *keyring, apply func(operation byte, namespace string, key string, v *value)) (int64, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	validSize := int64(0)
+	namespace := DefaultNamespace
+	handle := func(operation byte, key string, v *value) {
+		if operation == aofSelectOperation {
+			namespace = key
+		} else {
+			apply(operation, namespace, key, v)
+		}
+	}
+	var sealer *sealer
+	for {
+		operation, err := reader.ReadByte()
+		if err == io.EOF {
+			return validSize, nil
+		}
+		if err != nil {
+			return validSize, err
+		}
+
+		switch operation {
+		case aofKeyOperation:
+			sealer, err = readSealerHeader(reader, kr)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return validSize, nil
+			}
+			if err != nil {
+				return validSize, err
+			}
+			validSize += int64(1 + len(sealer.header()))
+		case aofSealedOperation:
+			sealed, err := readBytes(reader)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return validSize, nil
+			}
+			if err != nil {
+				return validSize, err
+			}
+			if sealer == nil {
+				return validSize, missingAofKeyErr
+			}
+			if err = replaySealedRecord(sealer, sealed, handle); err != nil {
+				return validSize, err
+			}
+			validSize += int64(1 + 4 + len(sealed))
+		default:
+			reader.UnreadByte()
+			operation, key, v, n, err := readAofRecord(reader)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return validSize, nil
+			}
+			if err != nil {
+				return validSize, err
+			}
+			handle(operation, key, v)
+			validSize += n
+		}
+	}
+}
+
+// replaySealedRecord 解密加密记录，并将其中的每一条记录交给 handle 处理
+func replaySealedRecord(sealer *sealer, sealed []byte, handle func(operation byte, key string, v *value)) error {
+	plaintext, err := sealer.open(sealed)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(bytes.NewReader(plaintext))
+	for {
+		operation, key, v, _, err := readAofRecord(reader)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return unknownAofOperationErr
+		}
+		handle(operation, key, v)
+	}
+}
+
+// readAofRecord 从 reader 中读取一条记录，n 是这条记录的长度，两种格式的设置记录返回的操作类型都是 aofSetOperation
+func readAofRecord(reader *bufio.Reader) (operation byte, key string, v *value, n int64, err error) {
+	operation, err = reader.ReadByte()
+	if err != nil {
+		return 0, "", nil, 0, err
+	}
+	keyBytes, err := readBytes(reader)
+	if err != nil {
+		return 0, "", nil, 0, unexpectedEOF(err)
+	}
+	n = 1 + 4 + int64(len(keyBytes))
+	if operation == aofDeleteOperation || operation == aofSelectOperation || operation == aofFlushOperation {
+		return operation, string(keyBytes), nil, n, nil
+	}
+	if operation != aofSetOperation && operation != aofSetWithExpirationOperation {
+		return 0, "", nil, 0, unknownAofOperationErr
+	}
+
+	fixed := make([]byte, 16)
+	if operation == aofSetWithExpirationOperation {
+		fixed = make([]byte, expirationSize)
+	}
+	if _, err = io.ReadFull(reader, fixed); err != nil {
+		return 0, "", nil, 0, unexpectedEOF(err)
+	}
+	data, err := readBytes(reader)
+	if err != nil {
+		return 0, "", nil, 0, unexpectedEOF(err)
+	}
+	if operation == aofSetWithExpirationOperation {
+		v = valueOf(data, fixed)
+	} else {
+		v = legacyValue(data, int64(binary.BigEndian.Uint64(fixed)), int64(binary.BigEndian.Uint64(fixed[8:])))
+	}
+	return aofSetOperation, string(keyBytes), v, n + int64(len(fixed)) + 4 + int64(len(data)), nil
+}
+
+// unexpectedEOF 将记录中间出现的 io.EOF 转换成 io.ErrUnexpectedEOF，表示记录不完整
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
@@ -0,0 +1,145 @@
+package caches
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func newAofTestOptions(t *testing.T) Options {
+	dir := t.TempDir()
+	options := DefaultOptions()
+	options.SegmentSize = 16
+	options.DumpFile = filepath.Join(dir, "kafo.dump")
+	options.AofFile = filepath.Join(dir, "kafo.aof")
+	options.AofFsync = FsyncAlways
+	return options
+}
+
+func TestAofReplay(t *testing.T) {
+	options := newAofTestOptions(t)
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("a", []byte("1"))
+	cache.Set("b", []byte("2"))
+	cache.Set("a", []byte("3"))
+	cache.Delete("b")
+
+	// 不关闭日志直接重新打开，模拟进程崩溃
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := recovered.Get("a"); !ok || string(value) != "3" {
+		t.Fatalf("a should be 3 but got %s, %v", value, ok)
+	}
+	if _, ok := recovered.Get("b"); ok {
+		t.Fatal("b should be deleted")
+	}
+}
+
+func TestAofRewrite(t *testing.T) {
+	options := newAofTestOptions(t)
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("a", []byte("1"))
+	if err = cache.dump(); err != nil {
+		t.Fatal(err)
+	}
+	if size := cache.aof.currentSize(); size != 0 {
+		t.Fatalf("aof should be empty after rewriting but got %d bytes", size)
+	}
+	if _, err = os.Stat(options.AofFile + rotatedAofSuffix); !os.IsNotExist(err) {
+		t.Fatal("rotated aof should be removed after rewriting")
+	}
+	cache.Set("b", []byte("2"))
+	cache.aof.close()
+
+	// 重写之后的数据来自持久化文件和新的日志
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"a": "1", "b": "2"} {
+		if value, ok := recovered.Get(key); !ok || string(value) != expected {
+			t.Fatalf("%s should be %s but got %s, %v", key, expected, value, ok)
+		}
+	}
+}
+
+func TestAofTruncatedTail(t *testing.T) {
+	options := newAofTestOptions(t)
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("a", []byte("1"))
+	cache.aof.close()
+
+	// 在日志末尾写入半条记录，模拟写入时发生崩溃
+	file, err := os.OpenFile(options.AofFile, os.O_APPEND|os.O_WRONLY, 0664)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte{aofSetOperation, 0, 0})
+	file.Close()
+
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := recovered.Get("a"); !ok || string(value) != "1" {
+		t.Fatalf("a should be 1 but got %s, %v", value, ok)
+	}
+	recovered.Set("b", []byte("2"))
+	recovered.aof.close()
+
+	again, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := again.Get("b"); !ok || string(value) != "2" {
+		t.Fatalf("b should be 2 but got %s, %v", value, ok)
+	}
+}
+
+func TestAofLogsGcExpiration(t *testing.T) {
+	options := newAofTestOptions(t)
+	options.SegmentSize = 1
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetWithExpiration("key", []byte("value"), FixedTTL(10*time.Millisecond))
+	time.Sleep(20 * time.Millisecond)
+
+	// 堆中记录的 key 已经不存在时，清理需要跳过它，而不是访问不存在的值
+	segment := cache.segmentOf("key")
+	segment.expiries.update("missing", 1)
+	cache.gc()
+	if status := cache.Status(); status.Expired != 1 || status.Count != 0 {
+		t.Fatalf("gc should expire key but got %+v", status)
+	}
+	if segment.expiries.Len() != 0 {
+		t.Fatalf("gc should remove missing key from expiry heap but got %d items", segment.expiries.Len())
+	}
+
+	// 清理掉的 key 也需要记录到日志中
+	var last byte
+	_, err = replayAof(options.AofFile, nil, func(operation byte, namespace string, key string, v *value) {
+		if key == "key" {
+			last = operation
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != aofDeleteOperation {
+		t.Fatalf("last operation of expired key should be delete but got %d", last)
+	}
+}
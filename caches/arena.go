@@ -0,0 +1,344 @@
+package caches
+
+import (
+	"sync/atomic"
+)
+
+const (
+	// 每个键值对在 arena 中的格式如下，每项都占用一个 uint64，key 和 value 按照小端的顺序每 8 个字节放入一个 uint64：
+	//
+	//	key 长度 << 32 | value 长度，压缩方式 << 8 | 有效期方式，滑动有效期，过期时间点，版本号，key，value
+	arenaSizesWord   = 0
+	arenaModeWord    = 1
+	arenaTtlWord     = 2
+	arenaExpireWord  = 3
+	arenaVersionWord = 4
+	arenaHeaderWords = 5
+
+	// fnvOffset 和 fnvPrime 是 64 位 FNV-1a 哈希的参数
+	fnvOffset = 14695981039346656037
+	fnvPrime  = 1099511628211
+)
+
+// arenaStorage 将键值对编码之后依次写入一个环形的 []uint64，索引是 key 的哈希到位置的映射，两者都不包含指针
+// 覆盖和删除只会让原来的位置变成垃圾，空间不够时从最早写入的位置开始回收，垃圾直接丢弃，还在使用的键值对挪到末尾，
+// 所有键值对都挪动过一遍仍然放不下时会整理一次，数据确实放不下时容量翻倍。过期时间点单独占用一个 uint64，
+// 所以只持有读锁时也可以原子地推迟滑动有效期
+type arenaStorage struct {
+	words []uint64
+	// head 是最早写入的键值对的位置，tail 是下一个键值对写入的位置
+	head int
+	tail int
+	// wrapped 表示 tail 已经绕回到了开头，这时数据分布在 [head, end) 和 [0, tail) 中，否则分布在 [head, tail) 中
+	wrapped bool
+	end     int
+	// live 是还在使用的键值对占用的 uint64 个数，不包括垃圾
+	live int
+	// index 记录了每个 key 的哈希对应的位置，位置的单位是 uint64
+	index map[uint64]uint32
+	// collisions 记录了哈希和其他 key 冲突的 key，几乎总是空的
+	collisions map[string]uint32
+	// scratch 是挪动键值对时使用的临时空间
+	scratch []uint64
+}
+
+// newArenaStorage 按照 options 中的 ArenaSizeOfSegment 预先分配空间，单位是字节
+func newArenaStorage(options *Options) storage {
+	return &arenaStorage{
+		words: make([]uint64, options.ArenaSizeOfSegment/8),
+		index: make(map[uint64]uint32, options.MapSizeOfSegment),
+	}
+}
+
+func (as *arenaStorage) get(key string) (*value, bool) {
+	offset, ok := as.lookup(key)
+	if !ok {
+		return nil, false
+	}
+	return as.valueAt(offset), true
+}
+
+func (as *arenaStorage) set(key string, v *value) {
+	if offset, ok := as.lookup(key); ok {
+		as.unpoint(key)
+		as.live -= as.entryWordsAt(offset)
+	}
+
+	size := arenaHeaderWords + wordsOf(len(key)) + wordsOf(len(v.Data))
+	offset := as.allocate(size)
+	as.words[offset+arenaSizesWord] = uint64(len(key))<<32 | uint64(len(v.Data))
+	as.words[offset+arenaModeWord] = uint64(v.Compression)<<8 | uint64(v.Mode)
+	as.words[offset+arenaTtlWord] = uint64(v.Ttl)
+	as.words[offset+arenaExpireWord] = uint64(atomic.LoadInt64(&v.Expire))
+	as.words[offset+arenaVersionWord] = v.Version
+	packBytes(as.words[offset+arenaHeaderWords:], []byte(key))
+	packBytes(as.words[offset+arenaHeaderWords+wordsOf(len(key)):], v.Data)
+	as.point(key, offset)
+	as.live += size
+}
+
+func (as *arenaStorage) touch(key string, v *value) {
+	if v.Mode != SlidingExpiry {
+		return
+	}
+	if offset, ok := as.lookup(key); ok {
+		atomic.StoreUint64(&as.words[offset+arenaExpireWord], uint64(atomic.LoadInt64(&v.Expire)))
+	}
+}
+
+func (as *arenaStorage) delete(key string) {
+	if offset, ok := as.lookup(key); ok {
+		as.unpoint(key)
+		as.live -= as.entryWordsAt(offset)
+	}
+}
+
+func (as *arenaStorage) sizeOf(key string, v *value) int64 {
+	return int64(arenaEntryOverhead + (wordsOf(len(key))+wordsOf(len(v.Data)))*8)
+}
+
+func (as *arenaStorage) len() int {
+	return len(as.index) + len(as.collisions)
+}
+
+func (as *arenaStorage) each(fn func(key string, v *value) bool) {
+	for _, offset := range as.index {
+		if !fn(as.keyAt(int(offset)), as.valueAt(int(offset))) {
+			return
+		}
+	}
+	for key, offset := range as.collisions {
+		if !fn(key, as.valueAt(int(offset))) {
+			return
+		}
+	}
+}
+
+// lookup 返回 key 所在的位置
+func (as *arenaStorage) lookup(key string) (int, bool) {
+	if offset, ok := as.index[hashOf(key)]; ok && as.keyEquals(int(offset), key) {
+		return int(offset), true
+	}
+	if len(as.collisions) > 0 {
+		offset, ok := as.collisions[key]
+		return int(offset), ok
+	}
+	return 0, false
+}
+
+// point 记录 key 的位置，哈希已经被其他 key 占用时记录到 collisions 中
+func (as *arenaStorage) point(key string, offset int) {
+	hash := hashOf(key)
+	if current, ok := as.index[hash]; ok && !as.keyEquals(int(current), key) {
+		if as.collisions == nil {
+			as.collisions = map[string]uint32{}
+		}
+		as.collisions[key] = uint32(offset)
+		return
+	}
+	as.index[hash] = uint32(offset)
+	delete(as.collisions, key)
+}
+
+// unpoint 移除 key 的位置，原来的位置就变成了垃圾
+func (as *arenaStorage) unpoint(key string) {
+	hash := hashOf(key)
+	if current, ok := as.index[hash]; ok && as.keyEquals(int(current), key) {
+		delete(as.index, hash)
+		return
+	}
+	delete(as.collisions, key)
+}
+
+// isLive 判断 offset 处的键值对是否还在使用
+func (as *arenaStorage) isLive(offset int) bool {
+	if current, ok := as.index[as.hashAt(offset)]; ok && int(current) == offset {
+		return true
+	}
+	if len(as.collisions) > 0 {
+		current, ok := as.collisions[as.keyAt(offset)]
+		return ok && int(current) == offset
+	}
+	return false
+}
+
+// allocate 分配 size 个 uint64 的连续空间，返回分配的位置
+func (as *arenaStorage) allocate(size int) int {
+	if as.live+size > len(as.words) {
+		capacity := 2 * len(as.words)
+		if capacity < as.live+size {
+			capacity = as.live + size
+		}
+		as.rebuild(capacity)
+	}
+
+	moved := 0
+	for {
+		if offset, ok := as.place(size); ok {
+			return offset
+		}
+		// 所有还在使用的键值对都挪动过一遍仍然没有连续的空间，说明空间被分成了两段，整理之后一定可以放下
+		if moved > as.live {
+			as.rebuild(len(as.words))
+			continue
+		}
+		moved += as.rotate()
+	}
+}
+
+// place 在 tail 处分配 size 个 uint64 的连续空间，末尾放不下时绕回到开头，不会回收任何空间
+func (as *arenaStorage) place(size int) (int, bool) {
+	if !as.wrapped {
+		if as.head == as.tail {
+			as.head, as.tail = 0, 0
+		}
+		if as.tail+size <= len(as.words) {
+			as.tail += size
+			return as.tail - size, true
+		}
+		if size > as.head {
+			return 0, false
+		}
+		as.wrapped = true
+		as.end = as.tail
+		as.tail = size
+		return 0, true
+	}
+	if as.tail+size > as.head {
+		return 0, false
+	}
+	as.tail += size
+	return as.tail - size, true
+}
+
+// rotate 回收 head 处的键值对，垃圾直接丢弃，还在使用的键值对挪到末尾，返回挪动的 uint64 个数
+func (as *arenaStorage) rotate() int {
+	if as.wrapped && as.head == as.end {
+		as.head = 0
+		as.wrapped = false
+		return 0
+	}
+	offset := as.head
+	size := as.entryWordsAt(offset)
+	as.head += size
+	if !as.isLive(offset) {
+		return 0
+	}
+
+	// 刚刚回收的空间和 tail 之后的空间是连续的，所以一定可以放下这个键值对
+	as.scratch = append(as.scratch[:0], as.words[offset:offset+size]...)
+	newOffset, _ := as.place(size)
+	copy(as.words[newOffset:], as.scratch)
+	if current, ok := as.index[as.hashAt(newOffset)]; ok && int(current) == offset {
+		as.index[as.hashAt(newOffset)] = uint32(newOffset)
+	} else {
+		as.collisions[as.keyAt(newOffset)] = uint32(newOffset)
+	}
+	return size
+}
+
+// rebuild 将所有还在使用的键值对依次复制到容量为 capacity 的新空间中，垃圾都会被丢弃
+func (as *arenaStorage) rebuild(capacity int) {
+	words := make([]uint64, capacity)
+	tail := 0
+	for hash, offset := range as.index {
+		size := as.entryWordsAt(int(offset))
+		copy(words[tail:], as.words[offset:int(offset)+size])
+		as.index[hash] = uint32(tail)
+		tail += size
+	}
+	for key, offset := range as.collisions {
+		size := as.entryWordsAt(int(offset))
+		copy(words[tail:], as.words[offset:int(offset)+size])
+		as.collisions[key] = uint32(tail)
+		tail += size
+	}
+	as.words = words
+	as.head, as.tail, as.end = 0, tail, 0
+	as.wrapped = false
+}
+
+// entryWordsAt 返回 offset 处的键值对占用的 uint64 个数
+func (as *arenaStorage) entryWordsAt(offset int) int {
+	sizes := as.words[offset+arenaSizesWord]
+	return arenaHeaderWords + wordsOf(int(sizes>>32)) + wordsOf(int(uint32(sizes)))
+}
+
+func (as *arenaStorage) keyAt(offset int) string {
+	keySize := int(as.words[offset+arenaSizesWord] >> 32)
+	return string(unpackBytes(as.words[offset+arenaHeaderWords:], keySize))
+}
+
+// keyEquals 判断 offset 处的 key 是不是 key，比较时不需要把 key 解码出来
+func (as *arenaStorage) keyEquals(offset int, key string) bool {
+	if int(as.words[offset+arenaSizesWord]>>32) != len(key) {
+		return false
+	}
+	words := as.words[offset+arenaHeaderWords:]
+	for i := 0; i < len(key); i++ {
+		if byte(words[i/8]>>(8*uint(i%8))) != key[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hashAt 返回 offset 处的 key 的哈希，和 hashOf 的结果相同
+func (as *arenaStorage) hashAt(offset int) uint64 {
+	keySize := int(as.words[offset+arenaSizesWord] >> 32)
+	words := as.words[offset+arenaHeaderWords:]
+	hash := uint64(fnvOffset)
+	for i := 0; i < keySize; i++ {
+		hash ^= uint64(byte(words[i/8] >> (8 * uint(i%8))))
+		hash *= fnvPrime
+	}
+	return hash
+}
+
+// valueAt 解码 offset 处的值，返回的值和 arena 不共享内存
+func (as *arenaStorage) valueAt(offset int) *value {
+	sizes := as.words[offset+arenaSizesWord]
+	return &value{
+		Data:        unpackBytes(as.words[offset+arenaHeaderWords+wordsOf(int(sizes>>32)):], int(uint32(sizes))),
+		Compression: byte(as.words[offset+arenaModeWord] >> 8),
+		Mode:        ExpiryMode(as.words[offset+arenaModeWord]),
+		Ttl:         int64(as.words[offset+arenaTtlWord]),
+		Expire:      int64(atomic.LoadUint64(&as.words[offset+arenaExpireWord])),
+		Version:     as.words[offset+arenaVersionWord],
+	}
+}
+
+// hashOf 返回 key 的 64 位 FNV-1a 哈希
+func hashOf(key string) uint64 {
+	hash := uint64(fnvOffset)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= fnvPrime
+	}
+	return hash
+}
+
+// wordsOf 返回 size 个字节需要的 uint64 个数
+func wordsOf(size int) int {
+	return (size + 7) / 8
+}
+
+// packBytes 将 data 按照小端的顺序每 8 个字节放入 words 中的一个 uint64
+func packBytes(words []uint64, data []byte) {
+	for i := 0; i < len(data); i += 8 {
+		word := uint64(0)
+		for j := 0; j < 8 && i+j < len(data); j++ {
+			word |= uint64(data[i+j]) << (8 * uint(j))
+		}
+		words[i/8] = word
+	}
+}
+
+// unpackBytes 从 words 中解码出 size 个字节
+func unpackBytes(words []uint64, size int) []byte {
+	data := make([]byte, size)
+	for i := 0; i < size; i++ {
+		data[i] = byte(words[i/8] >> (8 * uint(i%8)))
+	}
+	return data
+}
@@ -0,0 +1,96 @@
+package caches
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// TestArenaStorage 使用很小的空间反复覆盖和删除，让 arena 不断地回收、挪动和扩容，结果需要和 map 存储一致
+func TestArenaStorage(t *testing.T) {
+	options := DefaultOptions()
+	options.ArenaSizeOfSegment = 512
+	arena := newArenaStorage(&options)
+	expected := newMapStorage(&options)
+
+	random := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		key := "key-" + strconv.Itoa(random.Intn(64))
+		if random.Intn(4) == 0 {
+			arena.delete(key)
+			expected.delete(key)
+			continue
+		}
+		v := &value{Data: bytes.Repeat([]byte{byte(i)}, random.Intn(40)), Mode: SlidingExpiry, Ttl: int64(i), Expire: int64(i), Version: uint64(i)}
+		arena.set(key, v)
+		expected.set(key, v)
+	}
+
+	if arena.len() != expected.len() {
+		t.Fatalf("arena should have %d entries but got %d", expected.len(), arena.len())
+	}
+	expected.each(func(key string, v *value) bool {
+		got, ok := arena.get(key)
+		if !ok || !bytes.Equal(got.Data, v.Data) || got.Mode != v.Mode || got.Ttl != v.Ttl || got.Expire != v.Expire || got.Version != v.Version {
+			t.Fatalf("%s should be %+v but got %+v, %v", key, v, got, ok)
+		}
+		return true
+	})
+	if live := arena.(*arenaStorage).live; live > len(arena.(*arenaStorage).words) {
+		t.Fatalf("live words %d should not exceed capacity", live)
+	}
+}
+
+func TestArenaCollision(t *testing.T) {
+	options := DefaultOptions()
+	as := newArenaStorage(&options).(*arenaStorage)
+	as.set("a", &value{Data: []byte("1")})
+	// 让 b 的哈希被 a 占用，b 只能记录在 collisions 中
+	as.index[hashOf("b")] = as.index[hashOf("a")]
+	as.set("b", &value{Data: []byte("2")})
+	as.rebuild(len(as.words))
+
+	if v, ok := as.get("b"); !ok || string(v.Data) != "2" || len(as.collisions) != 1 {
+		t.Fatalf("b should be 2 in collisions but got %v, %v", v, ok)
+	}
+	as.delete("b")
+	if _, ok := as.get("b"); ok || as.len() != 2 {
+		t.Fatalf("b should be deleted but there are %d entries", as.len())
+	}
+}
+
+func TestArenaCache(t *testing.T) {
+	options := DefaultOptions()
+	options.StorageEngine = ArenaStorage
+	options.ArenaSizeOfSegment = 64
+	options.SegmentSize = 4
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		cache.Set(strconv.Itoa(i), []byte(strconv.Itoa(i*i)))
+	}
+	cache.SetWithExpiration("sliding", []byte("s"), SlidingTTL(200*time.Millisecond))
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, ok := cache.Get("sliding"); !ok {
+			t.Fatal("sliding should be extended by reading from arena")
+		}
+	}
+	for i := 0; i < 100; i += 2 {
+		cache.Delete(strconv.Itoa(i))
+	}
+	if value, ok := cache.Get("99"); !ok || string(value) != "9801" {
+		t.Fatalf("99 should be 9801 but got %s, %v", value, ok)
+	}
+	if count := cache.Status().Count; count != 51 {
+		t.Fatalf("count should be 51 but got %d", count)
+	}
+	keys, _, err := cache.Scan("", "9*", 100)
+	if err != nil || len(keys) != 6 {
+		t.Fatalf("there should be 6 keys matching 9* but got %v, %v", keys, err)
+	}
+}
@@ -1,155 +1,348 @@
 package caches
 
 import (
+	"errors"
 	"fmt"
+	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
 )
 
+var (
+	// dumpingErr 意味着当前已经有持久化任务在执行
+	dumpingErr = errors.New("cache is dumping")
+	// invalidWatermarkErr 意味着水位的配置不正确
+	invalidWatermarkErr = errors.New("watermarks should satisfy 0 <= LowWatermark <= HighWatermark <= 100")
+)
+
 type Cache struct {
-	// Value使用[]byte 是为了方便网络传输
-	segmentSize int
-	segments    []*segment
-	//data        map[string]*value
+	// Namespace 是默认的命名空间，直接在 Cache 上进行的读写操作都属于默认命名空间
+	*Namespace
+
 	options *Options
 
-	// dumping 表示当前缓存是不是处于持久化状态。 1表示处于持久化状态. 如果进入持久化状态，那么所有更新操作进入自旋状态，等待持久化完成
+	// namespaces 存储了所有的命名空间，包括默认的命名空间
+	namespaces map[string]*Namespace
+	// versions 是所有命名空间共用的版本号计数器
+	versions *uint64
+	// memory 是默认的命名空间和所有没有单独配置容量限制的命名空间共用的内存额度，上限是 MaxEntrySize
+	// 这样客户端使用再多的命名空间，这些命名空间加起来也不会超过 MaxEntrySize
+	memory *memoryBudget
+	// lock 保护 namespaces 和 aof
+	lock *sync.RWMutex
+
+	// dumping 表示当前缓存是不是处于持久化状态。 1表示处于持久化状态.
+	// 持久化是逐个 segment 生成快照进行的，不会阻塞读写操作，这个标记只用于避免多个持久化任务同时执行
 	dumping int32
-	//status  *Status
-	//lock    *sync.RWMutex
+
+	// aof 记录修改操作的日志，为 nil 时表示没有开启日志
+	aof *aof
+
+	// events 发布所有命名空间中 key 变化的事件
+	events *EventBus
+
+	// keyring 是加密持久化文件和日志使用的密钥，为 nil 时表示不加密
+	keyring *keyring
+
+	// closed 在调用 Close 时被关闭，用于停止后台任务，tasks 用于等待后台任务结束
+	closed    chan struct{}
+	tasks     *sync.WaitGroup
+	closeOnce *sync.Once
+	closeErr  error
 }
 
+// NewCache 使用默认选项创建缓存，创建失败时会 panic，需要处理错误的话使用 OpenCache
 func NewCache() *Cache {
 	return NewCacheWith(DefaultOptions())
 }
 
+// NewCacheWith 使用 options 创建缓存，创建失败时会 panic，需要处理错误的话使用 OpenCacheWith
 func NewCacheWith(options Options) *Cache {
-	if cache, ok := recoverFromDumpFile(options.DumpFile); ok {
-		return cache
-	}
-	return &Cache{
-		segmentSize: options.SegmentSize,
-		segments:    newSegments(&options),
-		options:     &options,
-		dumping:     0,
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		panic(err)
 	}
+	return cache
+}
+
+// OpenCache 使用默认选项创建缓存
+func OpenCache() (*Cache, error) {
+	return OpenCacheWith(DefaultOptions())
 }
 
-func recoverFromDumpFile(dumpFile string) (*Cache, bool) {
-	cache, err := newEmptyDump().from(dumpFile)
+// OpenCacheWith 使用 options 创建缓存，选项不合法、密钥、持久化文件或者日志加载失败时返回错误
+func OpenCacheWith(options Options) (*Cache, error) {
+	if options.LowWatermark < 0 || options.LowWatermark > options.HighWatermark || options.HighWatermark > 100 {
+		return nil, invalidWatermarkErr
+	}
+	cache := &Cache{
+		options:    &options,
+		namespaces: map[string]*Namespace{},
+		versions:   newVersions(),
+		memory:     newMemoryBudget(&options),
+		lock:       &sync.RWMutex{},
+		events:     newEventBus(),
+		dumping:    0,
+		closed:     make(chan struct{}),
+		tasks:      &sync.WaitGroup{},
+		closeOnce:  &sync.Once{},
+	}
+	keyring, err := loadKeyring(&options)
 	if err != nil {
-		return nil, false
+		return nil, fmt.Errorf("failed to load encryption keys: %w", err)
 	}
-	return cache, true
-}
+	cache.keyring = keyring
 
-func newSegments(options *Options) []*segment {
-	segments := make([]*segment, options.SegmentSize)
-	for i := 0; i < options.SegmentSize; i++ {
-		segments[i] = newSegment(options)
+	cache.Namespace = cache.createSharedNamespace(DefaultNamespace)
+	for name, maxEntrySize := range options.Namespaces {
+		cache.createNamespace(name, maxEntrySize)
 	}
-	return segments
-}
 
-func index(key string) int {
-	index := 0
-	keyBytes := []byte(key)
-	for _, b := range keyBytes {
-		index = 31*index + int(b&0xff)
+	if err := cache.recoverFromDumpFile(); err != nil {
+		return nil, err
+	}
+	if options.AofFile == "" {
+		return cache, nil
 	}
-	return index ^ (index >> 16)
+	if err := cache.loadAof(); err != nil {
+		return nil, err
+	}
+	return cache, nil
 }
 
-func (c *Cache) segmentOf(key string) *segment {
-	return c.segments[index(key)&(c.segmentSize-1)]
+// createNamespace 创建内存上限为 maxEntrySize 的命名空间，调用方需要持有写锁
+func (c *Cache) createNamespace(name string, maxEntrySize int64) *Namespace {
+	options := *c.options
+	options.MaxEntrySize = maxEntrySize
+	namespace := newNamespace(name, &options, c.versions, c.aof, c.events)
+	c.namespaces[name] = namespace
+	return namespace
 }
 
-func (c *Cache) Get(key string) ([]byte, bool) {
-	c.waitForDumping()
-	return c.segmentOf(key).get(key)
+// createSharedNamespace 创建使用共用内存额度的命名空间，调用方需要持有写锁
+func (c *Cache) createSharedNamespace(name string) *Namespace {
+	namespace := c.createNamespace(name, c.options.MaxEntrySize)
+	namespace.shareMemory(c.memory, c.namespacesSharing)
+	return namespace
 }
 
-func (c *Cache) Set(key string, value []byte) error {
-	return c.SetWithTTL(key, value, NeverDie)
+// namespacesSharing 返回使用共用内存额度的所有命名空间
+func (c *Cache) namespacesSharing() []*Namespace {
+	namespaces := c.Namespaces()
+	sharing := namespaces[:0]
+	for _, namespace := range namespaces {
+		if namespace.memory == c.memory {
+			sharing = append(sharing, namespace)
+		}
+	}
+	return sharing
 }
-func (c *Cache) SetWithTTL(key string, value []byte, ttl int64) error {
-	c.waitForDumping()
-	return c.segmentOf(key).set(key, value, ttl)
+
+// NamespaceOf 返回名为 name 的命名空间，不存在时创建一个，name 为空时返回默认的命名空间
+// 自动创建的命名空间和默认的命名空间共用 MaxEntrySize 的内存额度，需要单独设置容量限制的命名空间可以在 Options.Namespaces 中配置
+func (c *Cache) NamespaceOf(name string) *Namespace {
+	if name == "" {
+		return c.Namespace
+	}
+	c.lock.RLock()
+	namespace, ok := c.namespaces[name]
+	c.lock.RUnlock()
+	if ok {
+		return namespace
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if namespace, ok = c.namespaces[name]; ok {
+		return namespace
+	}
+	return c.createSharedNamespace(name)
 }
 
-func (c *Cache) Delete(key string) error {
-	c.waitForDumping()
-	c.segmentOf(key).delete(key)
-	return nil
+// Namespaces 返回所有的命名空间，按照名字排序
+func (c *Cache) Namespaces() []*Namespace {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	namespaces := make([]*Namespace, 0, len(c.namespaces))
+	for _, namespace := range c.namespaces {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Slice(namespaces, func(i, j int) bool {
+		return namespaces[i].name < namespaces[j].name
+	})
+	return namespaces
 }
 
+// FlushNamespace 清空名为 name 的命名空间中所有的数据，命名空间本身和它的容量限制会保留下来
+func (c *Cache) FlushNamespace(name string) error {
+	return c.NamespaceOf(name).flush()
+}
+
+// Subscribe 订阅命名空间 namespace 中匹配 pattern 的 key 的事件，namespace 为空时订阅所有命名空间，pattern 为空时匹配所有 key
+// pattern 的语法和 Scan 相同，订阅者处理得太慢时会丢失事件，可以通过 Subscription.Dropped 检查
+func (c *Cache) Subscribe(namespace string, pattern string) (*Subscription, error) {
+	return c.events.subscribe(namespace, pattern)
+}
+
+// Status 返回所有命名空间汇总之后的状态，单个命名空间的状态可以通过 NamespaceOf 获取
+// 共用的内存额度只计算一次，所以 MaxMemory 是所有命名空间加起来实际可以使用的内存上限
 func (c *Cache) Status() Status {
 	result := NewStatus()
-	for _, segment := range c.segments {
-		status := segment.status()
-		result.Count += status.Count
-		result.KeySize += status.KeySize
-		result.ValueSize += status.ValueSize
+	for _, namespace := range c.Namespaces() {
+		status := namespace.Status()
+		if namespace.memory == c.memory && namespace != c.Namespace {
+			status.MaxMemory, status.HighWatermark, status.LowWatermark = 0, 0, 0
+		}
+		result.merge(status)
 	}
 	return *result
 }
 
-//// 判断数据是否达到最大的容量
-//func (c *Cache) checkEntrySize(newKey string, newValue []byte) bool {
-//	return c.status.entrySize()+int64(len(newKey))+int64(len(newValue)) <= c.options.MaxEntrySize*1024*1024
-//}
+// loadAof 在持久化文件的基础上回放日志，然后打开日志继续记录修改操作
+// 上一次重写没有完成时旧日志会残留下来，它比当前日志更早，需要先回放
+func (c *Cache) loadAof() error {
+	apply := func(operation byte, namespace string, key string, v *value) {
+		ns := c.NamespaceOf(namespace)
+		switch operation {
+		case aofDeleteOperation:
+			ns.segmentOf(key).delete(key)
+		case aofFlushOperation:
+			ns.flush()
+		default:
+			ns.restore(key, v)
+		}
+	}
+	if _, err := replayAof(c.options.AofFile+rotatedAofSuffix, c.keyring, apply); err != nil {
+		return err
+	}
+	validSize, err := replayAof(c.options.AofFile, c.keyring, apply)
+	if err != nil {
+		return err
+	}
+
+	aof, err := openAof(c.options.AofFile, c.options.AofFsync, validSize, c.keyring)
+	if err != nil {
+		return err
+	}
+	aof.rewriteSize = c.options.AofRewriteSize * 1024 * 1024
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.aof = aof
+	for _, namespace := range c.namespaces {
+		for _, segment := range namespace.segments {
+			segment.aof = aof
+		}
+	}
+	return nil
+}
+
+// recoverFromDumpFile 从持久化文件中恢复数据，持久化文件不存在时当成空缓存
+// 持久化文件损坏时会返回错误，而不是当成空缓存继续运行，避免数据被悄悄丢弃
+func (c *Cache) recoverFromDumpFile() error {
+	err := newDump(c).from(c.options.DumpFile)
+	if err == nil || os.IsNotExist(err) {
+		return nil
+	}
+	return fmt.Errorf("failed to recover from dump file %s: %w", c.options.DumpFile, err)
+}
 
 // gc 会触发清理任务
 func (c *Cache) gc() {
-	c.waitForDumping()
-	// 记录清理的个数
-	wg := &sync.WaitGroup{}
-	for _, segment := range c.segments {
-		wg.Add(1)
-		go func() {
-			defer wg.Done()
-			segment.gc()
-		}()
+	for _, namespace := range c.Namespaces() {
+		namespace.gc()
 	}
-	wg.Wait()
 }
 
 func (c *Cache) AutoGc() {
+	c.tasks.Add(1)
 	go func() {
-		ticker := time.NewTicker(time.Duration(c.options.GcDuration) * time.Minute)
+		defer c.tasks.Done()
+		ticker := time.NewTicker(time.Duration(c.options.GcInterval) * time.Millisecond)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				c.gc()
+			case <-c.closed:
+				return
 			}
 		}
 	}()
 }
 
 func (c *Cache) dump() error {
+	// 上一次持久化还没有结束，就跳过这一次
+	if !atomic.CompareAndSwapInt32(&c.dumping, 0, 1) {
+		return dumpingErr
+	}
+	defer atomic.StoreInt32(&c.dumping, 0)
 	defer func() {
 		fmt.Println("导出结束")
 	}()
-	atomic.StoreInt32(&c.dumping, 1)
-	defer atomic.StoreInt32(&c.dumping, 0)
-	return newDump(c).to(c.options.DumpFile)
+	if c.aof == nil {
+		return newDump(c).to(c.options.DumpFile)
+	}
+
+	// 开启日志时，持久化的同时也会重写日志：先将当前日志转移成旧日志，
+	// 新的持久化文件包含了旧日志中的所有修改，所以写入成功之后旧日志就可以删除了
+	if err := c.aof.rotate(); err != nil {
+		return err
+	}
+	if err := newDump(c).to(c.options.DumpFile); err != nil {
+		return err
+	}
+	return c.aof.removeRotated()
 }
 
 func (c *Cache) AutoDump() {
+	c.tasks.Add(1)
 	go func() {
+		defer c.tasks.Done()
 		ticker := time.NewTicker(time.Duration(c.options.DumpDuration) * time.Second)
+		defer ticker.Stop()
+		// aofTicker 用于检查日志大小，日志过大时提前进行重写
+		aofTicker := time.NewTicker(time.Second)
+		defer aofTicker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				c.dump()
+			case <-aofTicker.C:
+				if c.aof != nil && c.aof.needsRewrite() {
+					c.dump()
+				}
+			case <-c.closed:
+				return
 			}
 		}
 	}()
 }
 
-func (c *Cache) waitForDumping() {
-	for atomic.LoadInt32(&c.dumping) != 0 {
-		time.Sleep(time.Duration(c.options.CasSleepTime) * time.Microsecond)
+// Close 停止后台的清理和持久化任务，写入最后一次持久化文件并关闭日志，之后不能再使用缓存
+// 正在执行的持久化任务会先执行完，多次调用只会关闭一次，返回的都是第一次关闭的结果
+func (c *Cache) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.tasks.Wait()
+		c.closeErr = c.close()
+	})
+	return c.closeErr
+}
+
+// close 写入最后一次持久化文件并关闭日志，持久化失败时也会关闭日志，这样日志中的修改不会丢失
+func (c *Cache) close() error {
+	var err error
+	if c.options.DumpFile != "" {
+		err = c.dump()
+	}
+	if c.aof == nil {
+		return err
+	}
+	if aofErr := c.aof.close(); err == nil {
+		err = aofErr
 	}
+	return err
 }
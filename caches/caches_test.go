@@ -26,7 +26,10 @@ func testTask(task func(no int)) string {
 }
 
 func TestCacheSetGet(t *testing.T) {
-	cache := NewCache()
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	writeTime := testTask(func(no int) {
 		data := strconv.Itoa(no)
@@ -41,3 +44,204 @@ func TestCacheSetGet(t *testing.T) {
 	})
 	t.Logf("读取消耗时间为: %s", readTime)
 }
+
+func TestCacheMany(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entries := map[string][]byte{}
+	keys := make([]string, 0, 100)
+	for i := 0; i < 100; i++ {
+		key := strconv.Itoa(i)
+		entries[key] = []byte(key)
+		keys = append(keys, key)
+	}
+	if err = cache.SetMany(entries); err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.SetManyWithTTL(map[string][]byte{"expired": []byte("x")}, 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(1100 * time.Millisecond)
+
+	values := cache.GetMany(append(keys, "missing", "expired"))
+	if len(values) != len(keys) {
+		t.Fatalf("should get %d values but got %d", len(keys), len(values))
+	}
+	for _, key := range keys {
+		if string(values[key]) != key {
+			t.Fatalf("%s should be %s but got %s", key, key, values[key])
+		}
+	}
+
+	if err = cache.DeleteMany(keys[:50]); err != nil {
+		t.Fatal(err)
+	}
+	if values = cache.GetMany(keys); len(values) != 50 {
+		t.Fatalf("should get 50 values after deleting but got %d", len(values))
+	}
+	if count := cache.Status().Count; count != 50 {
+		t.Fatalf("count should be 50 but got %d", count)
+	}
+}
+
+func TestCacheIncrement(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testTask(func(no int) {
+		cache.Increment("counter", 1, NeverDie)
+	})
+	if value, ok := cache.Get("counter"); !ok || string(value) != strconv.Itoa(concurrency) {
+		t.Fatalf("counter should be %d but got %s", concurrency, value)
+	}
+	if result, err := cache.Increment("counter", -concurrency-1, NeverDie); err != nil || result != -1 {
+		t.Fatalf("counter should be -1 but got %d, %v", result, err)
+	}
+
+	cache.Set("text", []byte("abc"))
+	if _, err = cache.Increment("text", 1, NeverDie); err != notIntegerErr {
+		t.Fatalf("incrementing text should fail with %v but got %v", notIntegerErr, err)
+	}
+	cache.Set("max", []byte("9223372036854775807"))
+	if _, err = cache.Increment("max", 1, NeverDie); err != integerOverflowErr {
+		t.Fatalf("incrementing max should fail with %v but got %v", integerOverflowErr, err)
+	}
+}
+
+func TestCacheCompareAndSet(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	version, err := cache.CompareAndSet("key", []byte("a"), 0, NeverDie)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = cache.CompareAndSet("key", []byte("b"), 0, NeverDie); !IsVersionMismatch(err) {
+		t.Fatalf("setting an existing key with version 0 should fail but got %v", err)
+	}
+
+	value, current, ok := cache.GetWithVersion("key")
+	if !ok || string(value) != "a" || current != version {
+		t.Fatalf("key should be a with version %d but got %s with version %d", version, value, current)
+	}
+	newVersion, err := cache.CompareAndSet("key", []byte("b"), current, NeverDie)
+	if err != nil || newVersion <= current {
+		t.Fatalf("version should increase after setting but got %d, %v", newVersion, err)
+	}
+	if _, err = cache.CompareAndSet("key", []byte("c"), current, NeverDie); !IsVersionMismatch(err) {
+		t.Fatalf("setting with a stale version should fail but got %v", err)
+	}
+
+	// 并发地使用比较并设置自增，每次成功都意味着没有丢失其他人的修改
+	cache.Set("counter", []byte("0"))
+	testTask(func(no int) {
+		for {
+			value, version, _ := cache.GetWithVersion("counter")
+			number, _ := strconv.Atoi(string(value))
+			if _, err := cache.CompareAndSet("counter", []byte(strconv.Itoa(number+1)), version, NeverDie); err == nil {
+				return
+			}
+		}
+	})
+	if value, _ = cache.Get("counter"); string(value) != strconv.Itoa(concurrency) {
+		t.Fatalf("counter should be %d but got %s", concurrency, value)
+	}
+}
+
+func TestCacheSetIfNewer(t *testing.T) {
+	options := newAofTestOptions(t)
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("restored", []byte("old"))
+	cache, err = OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他节点上更早写入的数据不会覆盖当前节点上的新数据
+	cache.Set("key", []byte("new"))
+	_, current, _ := cache.GetWithVersion("key")
+	old := current - 1
+	if ok, err := cache.SetIfNewer("key", []byte("old"), Expiration{}, old); ok || err != nil {
+		t.Fatalf("older value should be ignored but got %v, %v", ok, err)
+	}
+	if ok, err := cache.SetIfNewer("key", []byte("newer"), FixedTTL(time.Hour), current+1); !ok || err != nil {
+		t.Fatalf("newer value should be set but got %v, %v", ok, err)
+	}
+	value, version, _ := cache.GetWithVersion("key")
+	if string(value) != "newer" || version != current+1 {
+		t.Fatalf("value should be set with its own version %d but got %s, %d", current+1, value, version)
+	}
+
+	// 同样的版本号再写入一次只会更新有效期，之后在当前节点上的写入比同步过来的数据更新
+	if ok, _ := cache.SetIfNewer("key", []byte("newer"), Expiration{}, version); !ok {
+		t.Fatal("same version should be set again")
+	}
+	if ttl, _ := cache.TTL("key"); ttl != NeverDie {
+		t.Fatalf("expiration should be updated but got %d", ttl)
+	}
+	if newVersion, err := cache.CompareAndSet("key", []byte("local"), version, NeverDie); err != nil || newVersion <= version {
+		t.Fatalf("local write should get a newer version but got %d, %v", newVersion, err)
+	}
+
+	// 恢复出来的数据比其他节点上任何新写入的数据都旧
+	if _, version, _ = cache.GetWithVersion("restored"); version != restoredVersion {
+		t.Fatalf("restored key should have version %d but got %d", restoredVersion, version)
+	}
+	if ok, _ := cache.SetIfNewer("restored", []byte("fresh"), Expiration{}, old); !ok {
+		t.Fatal("restored key should be overwritten by data written after restarting")
+	}
+	if ok, _ := cache.SetIfNewer("absent", []byte("value"), Expiration{}, old); !ok {
+		t.Fatal("absent key should be set")
+	}
+}
+
+func TestCacheConditionalWrites(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := cache.SetXX("key", []byte("a"), NeverDie); ok || err != nil {
+		t.Fatalf("SetXX should not set an absent key but got %v, %v", ok, err)
+	}
+
+	// 并发地抢同一把锁，只能有一个成功
+	winners := int64(0)
+	lock := &sync.Mutex{}
+	testTask(func(no int) {
+		if ok, _ := cache.SetNX("lock", []byte(strconv.Itoa(no)), NeverDie); ok {
+			lock.Lock()
+			winners++
+			lock.Unlock()
+		}
+	})
+	if winners != 1 {
+		t.Fatalf("only one SetNX should succeed but got %d", winners)
+	}
+
+	if old, ok, err := cache.GetSet("key", []byte("a"), NeverDie); ok || old != nil || err != nil {
+		t.Fatalf("GetSet on an absent key should return nothing but got %s, %v, %v", old, ok, err)
+	}
+	if ok, err := cache.SetXX("key", []byte("b"), NeverDie); !ok || err != nil {
+		t.Fatalf("SetXX should set an existing key but got %v, %v", ok, err)
+	}
+	if old, ok, err := cache.GetSet("key", []byte("c"), NeverDie); !ok || string(old) != "b" || err != nil {
+		t.Fatalf("GetSet should return b but got %s, %v, %v", old, ok, err)
+	}
+	if old, ok, err := cache.GetAndDelete("key"); !ok || string(old) != "c" || err != nil {
+		t.Fatalf("GetAndDelete should return c but got %s, %v, %v", old, ok, err)
+	}
+	if _, ok, _ := cache.GetAndDelete("key"); ok {
+		t.Fatal("key should be deleted")
+	}
+}
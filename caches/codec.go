@@ -0,0 +1,78 @@
+package caches
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"sync/atomic"
+)
+
+// appendBytes 以 长度 + 内容 的形式将 data 追加到 buf
+func appendBytes(buf []byte, data []byte) []byte {
+	buf = appendUint32(buf, uint32(len(data)))
+	return append(buf, data...)
+}
+
+// appendUint32 使用大端形式将 i 追加到 buf
+func appendUint32(buf []byte, i uint32) []byte {
+	bytes := make([]byte, 4)
+	binary.BigEndian.PutUint32(bytes, i)
+	return append(buf, bytes...)
+}
+
+// appendInt64 使用大端形式将 i 追加到 buf
+func appendInt64(buf []byte, i int64) []byte {
+	bytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(bytes, uint64(i))
+	return append(buf, bytes...)
+}
+
+// expirationSize 是持久化时有效期的长度：方式 (1) | 滑动有效期的毫秒数 (8) | 过期时间点的毫秒数 (8)
+// 方式的低 4 位是有效期方式，高 4 位是数据的压缩方式，旧版本写入的高 4 位都是 0，也就是没有压缩
+const expirationSize = 1 + 8 + 8
+
+// appendExpiration 将 v 的有效期和压缩方式追加到 buf
+func appendExpiration(buf []byte, v *value) []byte {
+	buf = append(buf, byte(v.Mode)|v.Compression<<4)
+	buf = appendInt64(buf, v.Ttl)
+	return appendInt64(buf, atomic.LoadInt64(&v.Expire))
+}
+
+// valueOf 使用数据 data 和 appendExpiration 写入的有效期 expiration 创建 value
+func valueOf(data []byte, expiration []byte) *value {
+	return &value{
+		Data:        data,
+		Compression: expiration[0] >> 4,
+		Mode:        ExpiryMode(expiration[0] & 0x0f),
+		Ttl:         int64(binary.BigEndian.Uint64(expiration[1:])),
+		Expire:      int64(binary.BigEndian.Uint64(expiration[9:])),
+	}
+}
+
+// readBytesChunk 是 readBytes 一次性分配的最大长度，更长的数据边读边扩容
+const readBytesChunk = 64 << 10
+
+// readBytes 读取以 长度 + 内容 形式存储的数据
+// 长度来自文件，文件损坏时可能是一个很大的数，所以不会按照长度一次性分配内存，
+// 而是随着读取到的数据逐步扩容，占用的内存不会超过文件剩下的大小，数据不足时返回 io.ErrUnexpectedEOF
+func readBytes(reader io.Reader) ([]byte, error) {
+	length := make([]byte, 4)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	n := int64(binary.BigEndian.Uint32(length))
+	if n <= readBytesChunk {
+		data := make([]byte, n)
+		_, err := io.ReadFull(reader, data)
+		return data, err
+	}
+
+	buffer := bytes.NewBuffer(make([]byte, 0, readBytesChunk))
+	if _, err := io.CopyN(buffer, reader, n); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,126 @@
+package caches
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+const (
+	// NoCompression 不压缩数据
+	NoCompression = "none"
+	// GzipCompression 使用 gzip 压缩数据，压缩率比较高
+	GzipCompression = "gzip"
+	// FlateCompression 使用 deflate 压缩数据，和 gzip 的压缩率差不多，但是没有 gzip 的头部和校验，更快一些
+	FlateCompression = "flate"
+
+	// rawData、gzipData 和 flateData 是记录在 value 中的压缩方式，持久化时也会记录下来，所以不能修改
+	rawData   = byte(0)
+	gzipData  = byte(1)
+	flateData = byte(2)
+)
+
+var (
+	// malformedCompressedDataErr 意味着压缩过的数据已经损坏
+	malformedCompressedDataErr = errors.New("compressed data is malformed")
+
+	// compressions 记录了所有支持的压缩方式
+	compressions = map[string]byte{
+		NoCompression:    rawData,
+		GzipCompression:  gzipData,
+		FlateCompression: flateData,
+	}
+
+	// gzipWriters 和 flateWriters 复用压缩时使用的 writer，每个 writer 都会占用几百 KB 的内存
+	gzipWriters = &sync.Pool{
+		New: func() interface{} {
+			writer, _ := gzip.NewWriterLevel(ioutil.Discard, gzip.BestSpeed)
+			return writer
+		},
+	}
+	flateWriters = &sync.Pool{
+		New: func() interface{} {
+			writer, _ := flate.NewWriter(ioutil.Discard, flate.BestSpeed)
+			return writer
+		},
+	}
+)
+
+// IsValidCompression 判断 compression 是否是支持的压缩方式
+func IsValidCompression(compression string) bool {
+	_, ok := compressions[compression]
+	return ok
+}
+
+// compress 使用 compression 压缩 data，压缩之后的数据以原始数据的长度开头
+// 压缩之后没有变小的数据不值得压缩，返回 false
+func compress(data []byte, compression byte) ([]byte, bool) {
+	buffer := bytes.NewBuffer(make([]byte, 0, binary.MaxVarintLen64+len(data)/2))
+	length := make([]byte, binary.MaxVarintLen64)
+	buffer.Write(length[:binary.PutUvarint(length, uint64(len(data)))])
+
+	var err error
+	switch compression {
+	case gzipData:
+		writer := gzipWriters.Get().(*gzip.Writer)
+		defer gzipWriters.Put(writer)
+		writer.Reset(buffer)
+		_, err = writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+	case flateData:
+		writer := flateWriters.Get().(*flate.Writer)
+		defer flateWriters.Put(writer)
+		writer.Reset(buffer)
+		_, err = writer.Write(data)
+		if err == nil {
+			err = writer.Close()
+		}
+	default:
+		return nil, false
+	}
+	if err != nil || buffer.Len() >= len(data) {
+		return nil, false
+	}
+	return buffer.Bytes(), true
+}
+
+// decompress 解压 compress 压缩的数据
+func decompress(data []byte, compression byte) ([]byte, error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 {
+		return nil, malformedCompressedDataErr
+	}
+
+	var reader io.Reader
+	switch compression {
+	case gzipData:
+		gzipReader, err := gzip.NewReader(bytes.NewReader(data[n:]))
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+	case flateData:
+		reader = flate.NewReader(bytes.NewReader(data[n:]))
+	default:
+		return nil, malformedCompressedDataErr
+	}
+
+	result := make([]byte, length)
+	if _, err := io.ReadFull(reader, result); err != nil {
+		return nil, malformedCompressedDataErr
+	}
+	return result, nil
+}
+
+// decompressedSize 返回压缩之前的数据长度，不需要解压
+func decompressedSize(data []byte) int64 {
+	length, _ := binary.Uvarint(data)
+	return int64(length)
+}
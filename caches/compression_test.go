@@ -0,0 +1,59 @@
+package caches
+
+import (
+	"bytes"
+	"math/rand"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	payload := []byte(strings.Repeat(`{"name":"kafo","tags":["cache","compression"]},`, 1000))
+	random := make([]byte, 4096)
+	rand.New(rand.NewSource(1)).Read(random)
+
+	for _, compression := range []string{GzipCompression, FlateCompression} {
+		options := DefaultOptions()
+		options.Compression = compression
+		options.DumpFile = filepath.Join(t.TempDir(), "kafo.dump")
+		options.StorageEngine = ArenaStorage
+		cache, err := OpenCacheWith(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.Set("payload", payload)
+		cache.Set("small", []byte("small"))
+		cache.Set("random", random)
+
+		if value, ok := cache.Get("payload"); !ok || !bytes.Equal(value, payload) {
+			t.Fatalf("%s: payload should be decompressed when getting", compression)
+		}
+		if v, _ := cache.segmentOf("small").data.get("small"); v.Compression != rawData {
+			t.Fatalf("%s: small value should not be compressed", compression)
+		}
+		if v, _ := cache.segmentOf("random").data.get("random"); v.Compression != rawData {
+			t.Fatalf("%s: incompressible value should not be compressed", compression)
+		}
+		status := cache.Status()
+		if logical := int64(len(payload) + len("small") + len(random)); status.ValueSize != logical || status.StoredValueSize >= logical/2 {
+			t.Fatalf("%s: value size should be %d and stored value size should be much smaller but got %+v", compression, logical, status)
+		}
+
+		// 压缩过的数据按照原样持久化，关闭压缩之后恢复出来的数据也可以正常读取
+		if err = cache.dump(); err != nil {
+			t.Fatal(err)
+		}
+		options.Compression = NoCompression
+		recovered, err := OpenCacheWith(options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := recovered.Status(); status.StoredValueSize != cache.Status().StoredValueSize {
+			t.Fatalf("%s: compressed values should be recovered as is but got %+v", compression, status)
+		}
+		if old, ok, err := recovered.GetSet("payload", []byte("new"), NeverDie); !ok || err != nil || !bytes.Equal(old, payload) {
+			t.Fatalf("%s: old payload should be decompressed but got %v, %v", compression, ok, err)
+		}
+	}
+}
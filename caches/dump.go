@@ -1,27 +1,69 @@
 package caches
 
 import (
-	"encoding/gob"
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
 	"os"
-	"sync"
+	"path/filepath"
 	"time"
 )
 
-type dump struct {
-	SegmentSize int
-	Segments    []*segment
-	Options     *Options
-}
+// 持久化文件的格式如下，所有整数都使用大端形式：
+//
+//	头部：魔数 KAFO (4) | 版本号 (1) | segment 个数 (4) | CRC (4)
+//	命名空间记录：类型 (1) | 名字长度 (4) | 名字 | CRC (4)
+//	segment 记录：类型 (1) | segment 下标 (4) | 键值对个数 (4) | CRC (4)
+//	键值对记录：类型 (1) | key 长度 (4) | key | 有效期方式和压缩方式 (1) | 滑动有效期 (8) | 过期时间点 (8) | value 长度 (4) | value | CRC (4)
+//	结束记录：类型 (1) | 键值对总数 (8) | CRC (4)
+//
+// 每个命名空间记录后面紧跟着这个命名空间的所有 segment 记录，每个 segment 记录后面紧跟着这个 segment 的所有键值对记录，
+// CRC 是对记录中 CRC 之前所有字节的校验，有效期都以毫秒为单位，过期时间点是 Unix 时间，所以重启之后剩余的有效期不变
+// 压缩过的 value 会按照压缩之后的样子写入，恢复之后也不需要重新压缩
+// 版本 1 没有命名空间记录，所有键值对都属于默认的命名空间。版本 1 和 2 的键值对记录中是以秒为单位的 ttl (8) | ctime (8)
+//
+// 配置了密钥时，上面的内容会使用 sealedWriter 分块加密，文件以 KAFE 开头，头部记录了加密使用的密钥编号，
+// 所以轮换密钥之后，只要旧密钥还在 keyring 中，使用旧密钥加密的持久化文件仍然可以恢复，没有加密的持久化文件也可以恢复
+const (
+	dumpMagic   = "KAFO"
+	dumpVersion = byte(3)
+	// dumpVersion1 是没有命名空间的旧版本，dumpVersion2 是有效期以秒为单位的旧版本，读取时仍然支持
+	dumpVersion1 = byte(1)
+	dumpVersion2 = byte(2)
+
+	dumpSegmentRecord = byte(1)
+	dumpEntryRecord   = byte(2)
+	dumpEndRecord     = byte(3)
+	// dumpNamespaceRecord 表示之后的 segment 记录都属于这个命名空间
+	dumpNamespaceRecord = byte(4)
+)
+
+var (
+	// dumpMagicMismatchErr 意味着文件不是持久化文件，或者是旧版本使用 gob 编码的持久化文件
+	dumpMagicMismatchErr = errors.New("dump file has wrong magic number")
+	// dumpVersionMismatchErr 意味着持久化文件的版本号不支持
+	dumpVersionMismatchErr = errors.New("dump file version is not supported")
+	// dumpChecksumMismatchErr 意味着持久化文件的数据已经损坏
+	dumpChecksumMismatchErr = errors.New("dump file checksum mismatch")
+	// dumpTruncatedErr 意味着持久化文件不完整，很可能是写入时发生了崩溃
+	dumpTruncatedErr = errors.New("dump file is truncated")
+	// unknownDumpRecordErr 意味着持久化文件中出现了不认识的记录类型
+	unknownDumpRecordErr = errors.New("unknown record in dump file")
+)
 
-func newEmptyDump() *dump {
-	return &dump{}
+// dump 负责将缓存写入持久化文件，以及从持久化文件中恢复缓存
+// 写入和读取都是流式的，写入时逐个 segment 生成快照，读取时逐条记录恢复，都不会把整个缓存放到内存中
+type dump struct {
+	cache *Cache
 }
 
 func newDump(c *Cache) *dump {
 	return &dump{
-		SegmentSize: c.segmentSize,
-		Options:     c.options,
-		Segments:    c.segments,
+		cache: c,
 	}
 }
 
@@ -31,42 +73,310 @@ func nowSuffix() string {
 
 func (d *dump) to(dumpFile string) error {
 	newDumpFile := dumpFile + nowSuffix()
-	file, err := os.OpenFile(newDumpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0664)
+	file, err := os.OpenFile(newDumpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	// 对文件进行gob编码
-	err = gob.NewEncoder(file).Encode(d)
+
+	writer := bufio.NewWriter(file)
+	if d.cache.keyring == nil {
+		err = d.writeTo(writer)
+	} else {
+		err = d.writeSealedTo(writer)
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = file.Close()
+	}
 	if err != nil {
 		file.Close()
 		os.Remove(newDumpFile)
 		return err
 	}
-	// 删除旧的持久化文件
-	os.Remove(dumpFile)
-	file.Close()
-	return os.Rename(newDumpFile, dumpFile)
+	// Rename 会原子地替换旧的持久化文件，不能先删除旧文件，否则在两步之间崩溃就没有任何持久化文件了
+	if err = os.Rename(newDumpFile, dumpFile); err != nil {
+		os.Remove(newDumpFile)
+		return err
+	}
+	return syncDir(filepath.Dir(dumpFile))
 }
 
-func (d *dump) from(dumpFile string) (*Cache, error) {
+// syncDir 将目录的修改写入磁盘，保证重命名之后崩溃时新的文件名不会丢失
+func syncDir(dir string) error {
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+// writeSealedTo 将缓存加密之后写入 writer
+func (d *dump) writeSealedTo(writer io.Writer) error {
+	sealedWriter, err := newSealedWriter(writer, d.cache.keyring)
+	if err != nil {
+		return err
+	}
+	if err = d.writeTo(sealedWriter); err != nil {
+		return err
+	}
+	return sealedWriter.Close()
+}
+
+// writeTo 将缓存按照持久化文件的格式写入 writer
+// 每个 segment 的快照都是一个时间点的一致视图，生成快照时只会短暂持有这个 segment 的读锁
+func (d *dump) writeTo(writer io.Writer) error {
+	header := make([]byte, 0, 9)
+	header = append(header, dumpMagic...)
+	header = append(header, dumpVersion)
+	header = appendUint32(header, uint32(len(d.cache.segments)))
+	if err := writeRecord(writer, header); err != nil {
+		return err
+	}
+
+	total := int64(0)
+	for _, namespace := range d.cache.Namespaces() {
+		record := []byte{dumpNamespaceRecord}
+		record = appendBytes(record, []byte(namespace.name))
+		if err := writeRecord(writer, record); err != nil {
+			return err
+		}
+		count, err := d.writeNamespaceTo(writer, namespace)
+		if err != nil {
+			return err
+		}
+		total += count
+	}
+
+	record := []byte{dumpEndRecord}
+	record = appendInt64(record, total)
+	return writeRecord(writer, record)
+}
+
+// writeNamespaceTo 将命名空间的所有 segment 写入 writer，返回写入的键值对个数
+func (d *dump) writeNamespaceTo(writer io.Writer, namespace *Namespace) (int64, error) {
+	total := int64(0)
+	for i, segment := range namespace.segments {
+		snapshot := segment.snapshot()
+		alive := make(map[string]*value, snapshot.data.len())
+		snapshot.data.each(func(key string, value *value) bool {
+			if value.alive() {
+				alive[key] = value
+			}
+			return true
+		})
+
+		record := []byte{dumpSegmentRecord}
+		record = appendUint32(record, uint32(i))
+		record = appendUint32(record, uint32(len(alive)))
+		if err := writeRecord(writer, record); err != nil {
+			return 0, err
+		}
+		for key, value := range alive {
+			record = record[:0]
+			record = append(record, dumpEntryRecord)
+			record = appendBytes(record, []byte(key))
+			record = appendExpiration(record, value)
+			record = appendBytes(record, value.Data)
+			if err := writeRecord(writer, record); err != nil {
+				return 0, err
+			}
+		}
+		total += int64(len(alive))
+	}
+	return total, nil
+}
+
+// from 从持久化文件中恢复数据到缓存中
+func (d *dump) from(dumpFile string) error {
 	file, err := os.Open(dumpFile)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer file.Close()
-	if err = gob.NewDecoder(file).Decode(d); err != nil {
-		return nil, err
-	}
-	// 恢复出 segment 之后需要为每个segment 的未导出字段进行初始化
-	for _, segment := range d.Segments {
-		segment.options = d.Options
-		segment.lock = &sync.RWMutex{}
-	}
-	return &Cache{
-		segmentSize: d.SegmentSize,
-		options:     d.Options,
-		segments:    d.Segments,
-		dumping:     0,
-	}, nil
+
+	reader := bufio.NewReader(file)
+	if magic, _ := reader.Peek(len(encryptedDumpMagic)); string(magic) != encryptedDumpMagic {
+		return d.readFrom(reader)
+	}
+	header := make([]byte, len(encryptedDumpMagic)+1)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return truncated(err)
+	}
+	if header[len(encryptedDumpMagic)] != encryptedDumpVersion {
+		return dumpVersionMismatchErr
+	}
+	sealedReader, err := newSealedReader(reader, d.cache.keyring)
+	if err != nil {
+		return truncated(err)
+	}
+	return d.readFrom(sealedReader)
+}
+
+// readFrom 按照持久化文件的格式从 reader 中读取数据并恢复到缓存中
+// segment 的个数可以和持久化时不同，因为每个键值对都会重新计算所属的 segment
+// 持久化文件中的命名空间不存在时会使用默认的容量限制创建
+func (d *dump) readFrom(reader io.Reader) error {
+	records := newRecordReader(reader)
+	header := make([]byte, 9)
+	if err := records.read(header); err != nil {
+		return err
+	}
+	if string(header[:4]) != dumpMagic {
+		return dumpMagicMismatchErr
+	}
+	if header[4] != dumpVersion && header[4] != dumpVersion2 && header[4] != dumpVersion1 {
+		return dumpVersionMismatchErr
+	}
+	records.version = header[4]
+	if err := records.check(); err != nil {
+		return err
+	}
+
+	total := int64(0)
+	namespace := d.cache.Namespace
+	for {
+		recordType, err := records.readByte()
+		if err != nil {
+			return err
+		}
+		switch recordType {
+		case dumpNamespaceRecord:
+			name, err := readBytes(records.tee)
+			if err != nil {
+				return truncated(err)
+			}
+			if err = records.check(); err != nil {
+				return err
+			}
+			namespace = d.cache.NamespaceOf(string(name))
+		case dumpSegmentRecord:
+			// segment 记录只用于校验，键值对的个数在读取结束时通过总数校验
+			if err = records.read(make([]byte, 8)); err != nil {
+				return err
+			}
+			if err = records.check(); err != nil {
+				return err
+			}
+		case dumpEntryRecord:
+			key, v, err := records.readEntry()
+			if err != nil {
+				return err
+			}
+			if v.alive() {
+				if err = namespace.restore(key, v); err != nil {
+					return fmt.Errorf("failed to restore key %s: %w", key, err)
+				}
+			}
+			total++
+		case dumpEndRecord:
+			count := make([]byte, 8)
+			if err = records.read(count); err != nil {
+				return err
+			}
+			if err = records.check(); err != nil {
+				return err
+			}
+			if int64(binary.BigEndian.Uint64(count)) != total {
+				return dumpTruncatedErr
+			}
+			return nil
+		default:
+			return unknownDumpRecordErr
+		}
+	}
+}
+
+// writeRecord 将 record 和它的 CRC 写入 writer
+func writeRecord(writer io.Writer, record []byte) error {
+	if _, err := writer.Write(record); err != nil {
+		return err
+	}
+	_, err := writer.Write(appendUint32(nil, crc32.ChecksumIEEE(record)))
+	return err
+}
+
+// recordReader 读取记录的同时计算 CRC，读取完一条记录之后使用 check 进行校验
+type recordReader struct {
+	reader io.Reader
+	// buffer 记录当前这条记录已经读取的字节
+	buffer *bytes.Buffer
+	// tee 从 reader 中读取数据，并同时写入 buffer
+	tee io.Reader
+	// version 是持久化文件的版本号，决定了键值对记录的格式
+	version byte
+}
+
+func newRecordReader(reader io.Reader) *recordReader {
+	buffer := &bytes.Buffer{}
+	return &recordReader{
+		reader: reader,
+		buffer: buffer,
+		tee:    io.TeeReader(reader, buffer),
+	}
+}
+
+// read 读满 data，文件提前结束说明文件不完整
+func (rr *recordReader) read(data []byte) error {
+	_, err := io.ReadFull(rr.tee, data)
+	return truncated(err)
+}
+
+func (rr *recordReader) readByte() (byte, error) {
+	data := make([]byte, 1)
+	err := rr.read(data)
+	return data[0], err
+}
+
+// readEntry 读取键值对记录中类型之后的部分，并进行校验
+func (rr *recordReader) readEntry() (string, *value, error) {
+	key, err := readBytes(rr.tee)
+	if err != nil {
+		return "", nil, truncated(err)
+	}
+	fixed := make([]byte, 16)
+	if rr.version == dumpVersion {
+		fixed = make([]byte, expirationSize)
+	}
+	if err = rr.read(fixed); err != nil {
+		return "", nil, err
+	}
+	data, err := readBytes(rr.tee)
+	if err != nil {
+		return "", nil, truncated(err)
+	}
+	if err = rr.check(); err != nil {
+		return "", nil, err
+	}
+	if rr.version == dumpVersion {
+		return string(key), valueOf(data, fixed), nil
+	}
+	return string(key), legacyValue(data, int64(binary.BigEndian.Uint64(fixed)), int64(binary.BigEndian.Uint64(fixed[8:]))), nil
+}
+
+// check 读取记录末尾的 CRC，并和已读取内容的 CRC 进行比较，然后开始新的一条记录
+func (rr *recordReader) check() error {
+	checksum := make([]byte, 4)
+	if _, err := io.ReadFull(rr.reader, checksum); err != nil {
+		return truncated(err)
+	}
+	defer rr.buffer.Reset()
+	if binary.BigEndian.Uint32(checksum) != crc32.ChecksumIEEE(rr.buffer.Bytes()) {
+		return dumpChecksumMismatchErr
+	}
+	return nil
+}
+
+// truncated 将读取时提前结束的错误转换成 dumpTruncatedErr
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return dumpTruncatedErr
+	}
+	return err
 }
@@ -0,0 +1,184 @@
+package caches
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestDumpWhileWriting(t *testing.T) {
+	options := DefaultOptions()
+	options.SegmentSize = 16
+	options.DumpFile = filepath.Join(t.TempDir(), "kafo.dump")
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		data := strconv.Itoa(i)
+		cache.Set(data, []byte(data))
+	}
+
+	// 持久化的同时继续读写，持久化不应该阻塞读写操作
+	wg := &sync.WaitGroup{}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 1000; i < 2000; i++ {
+			data := strconv.Itoa(i)
+			cache.Set(data, []byte(data))
+			cache.Get(data)
+		}
+	}()
+	if err := cache.dump(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		data := strconv.Itoa(i)
+		value, ok := recovered.Get(data)
+		if !ok || string(value) != data {
+			t.Fatalf("key %s should be recovered but got %s, %v", data, value, ok)
+		}
+	}
+	if err := recovered.Set("new", []byte("new")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDumpReplacesOldDump(t *testing.T) {
+	options := DefaultOptions()
+	options.SegmentSize = 16
+	dir := t.TempDir()
+	options.DumpFile = filepath.Join(dir, "kafo.dump")
+	options.AofFile = filepath.Join(dir, "kafo.aof")
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cache.Close()
+
+	// 第二次持久化会替换第一次的持久化文件，替换之后目录中只剩下持久化文件和新的日志
+	for i := 0; i < 2; i++ {
+		cache.Set("key", []byte(strconv.Itoa(i)))
+		if err = cache.dump(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		if file.Name() != "kafo.dump" && file.Name() != "kafo.aof" {
+			t.Fatalf("file %s should be removed after dump", file.Name())
+		}
+	}
+
+	options.AofFile = ""
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := recovered.Get("key"); !ok || string(value) != "1" {
+		t.Fatalf("key should be recovered from the latest dump but got %s, %v", value, ok)
+	}
+}
+
+func TestDumpCorrupted(t *testing.T) {
+	options := DefaultOptions()
+	options.SegmentSize = 16
+	options.DumpFile = filepath.Join(t.TempDir(), "kafo.dump")
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("key", []byte("value"))
+	if err = cache.dump(); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(options.DumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[error][]byte{
+		dumpMagicMismatchErr:    append([]byte("GOB!"), content[4:]...),
+		dumpTruncatedErr:        content[:len(content)-6],
+		dumpChecksumMismatchErr: append(append([]byte{}, content[:len(content)-20]...), flip(content[len(content)-20:])...),
+	}
+	for expected, corrupted := range cases {
+		if err = ioutil.WriteFile(options.DumpFile, corrupted, 0664); err != nil {
+			t.Fatal(err)
+		}
+		if _, err = OpenCacheWith(options); !errors.Is(err, expected) {
+			t.Fatalf("expected %v but got %v", expected, err)
+		}
+	}
+
+	// 损坏的长度不能导致按照长度分配内存，而是在读到文件末尾时发现文件不完整
+	huge := append([]byte{}, content...)
+	at := bytes.Index(huge, []byte("value")) - 4
+	copy(huge[at:], []byte{0xff, 0xff, 0xff, 0xff})
+	if err = ioutil.WriteFile(options.DumpFile, huge, 0664); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenCacheWith(options); !errors.Is(err, dumpTruncatedErr) {
+		t.Fatalf("expected %v but got %v", dumpTruncatedErr, err)
+	}
+}
+
+func TestCloseDumpsFinally(t *testing.T) {
+	options := DefaultOptions()
+	options.SegmentSize = 16
+	options.DumpDuration = 3600
+	options.DumpFile = filepath.Join(t.TempDir(), "kafo.dump")
+	options.AofFile = filepath.Join(t.TempDir(), "kafo.aof")
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.AutoGc()
+	cache.AutoDump()
+	for i := 0; i < 100; i++ {
+		data := strconv.Itoa(i)
+		cache.Set(data, []byte(data))
+	}
+
+	// 后台任务还没有持久化过，关闭时需要写入最后一次持久化文件，重复关闭返回同样的结果
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cache.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	options.AofFile = ""
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 100; i++ {
+		data := strconv.Itoa(i)
+		value, ok := recovered.Get(data)
+		if !ok || string(value) != data {
+			t.Fatalf("key %s should be recovered from dump file but got %s, %v", data, value, ok)
+		}
+	}
+}
+
+// flip 翻转 data 第一个字节的所有位
+func flip(data []byte) []byte {
+	flipped := append([]byte{}, data...)
+	flipped[0] = ^flipped[0]
+	return flipped
+}
@@ -0,0 +1,293 @@
+package caches
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptedDumpMagic 是加密之后的持久化文件的魔数，和 dumpMagic 不同，所以读取时可以区分文件有没有加密
+	encryptedDumpMagic = "KAFE"
+	// encryptedDumpVersion 是加密格式的版本号
+	encryptedDumpVersion = byte(1)
+
+	// sealedChunkSize 是加密持久化文件时每一块明文的最大长度
+	sealedChunkSize = 64 * 1024
+
+	// noncePrefixSize 是随机的 nonce 前缀的长度，nonce 由前缀和 4 个字节的序号组成，同一个前缀下每个序号只使用一次
+	noncePrefixSize = 8
+)
+
+var (
+	// malformedKeyringErr 意味着密钥的格式不正确
+	malformedKeyringErr = errors.New("keyring should be lines like id=hex-encoded 16, 24 or 32 bytes key")
+	// encryptionKeyMissingErr 意味着文件是加密的，但是没有配置加密时使用的密钥
+	encryptionKeyMissingErr = errors.New("file is encrypted by a key which is not in the keyring")
+	// decryptionFailedErr 意味着文件无法解密，可能是密钥不对，也可能是文件已经损坏
+	decryptionFailedErr = errors.New("failed to decrypt the file")
+	// nonceExhaustedErr 意味着同一个 nonce 前缀下的序号已经用完了
+	nonceExhaustedErr = errors.New("nonces of the key are exhausted")
+)
+
+// keyring 保存了加密持久化文件和日志时使用的 AES-GCM 密钥，每个密钥都有一个编号，编号会写入文件中
+// 第一个密钥用于加密新的文件，其他的密钥只用于解密使用旧密钥加密的文件，所以轮换密钥时把新密钥放到最前面就可以了
+type keyring struct {
+	current string
+	keys    map[string]cipher.AEAD
+}
+
+// loadKeyring 从 options 中配置的密钥文件或者环境变量中读取密钥，两个都没有配置时返回 nil，表示不加密
+// 密钥文件和环境变量的格式相同：每行或者每个逗号分隔的一项是 编号=十六进制的密钥，# 开头的行是注释
+func loadKeyring(options *Options) (*keyring, error) {
+	content := ""
+	if options.EncryptionKeyFile != "" {
+		data, err := ioutil.ReadFile(options.EncryptionKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		content = string(data)
+	} else if options.EncryptionKeyEnv != "" {
+		content = os.Getenv(options.EncryptionKeyEnv)
+		if content == "" {
+			return nil, fmt.Errorf("environment variable %s is empty", options.EncryptionKeyEnv)
+		}
+	} else {
+		return nil, nil
+	}
+	return parseKeyring(content)
+}
+
+// parseKeyring 解析 loadKeyring 中描述的密钥格式
+func parseKeyring(content string) (*keyring, error) {
+	kr := &keyring{keys: map[string]cipher.AEAD{}}
+	for _, line := range strings.FieldsFunc(content, func(r rune) bool { return r == '\n' || r == ',' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || len(parts[0]) > 255 {
+			return nil, malformedKeyringErr
+		}
+		key, err := hex.DecodeString(strings.TrimSpace(parts[1]))
+		if err != nil {
+			return nil, malformedKeyringErr
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, malformedKeyringErr
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		id := strings.TrimSpace(parts[0])
+		if kr.current == "" {
+			kr.current = id
+		}
+		kr.keys[id] = aead
+	}
+	if kr.current == "" {
+		return nil, malformedKeyringErr
+	}
+	return kr, nil
+}
+
+// sealer 使用一个密钥和一个随机的 nonce 前缀依次加密多段数据，每段数据使用递增的序号作为 nonce 的后半部分
+// 解密时也需要按照同样的顺序，所以调换、删除或者重复某一段数据都会导致解密失败
+type sealer struct {
+	id      string
+	aead    cipher.AEAD
+	prefix  []byte
+	counter uint32
+}
+
+// newSealer 使用 keyring 的当前密钥创建 sealer，并生成一个随机的 nonce 前缀
+func (kr *keyring) newSealer() (*sealer, error) {
+	prefix := make([]byte, noncePrefixSize)
+	if _, err := io.ReadFull(rand.Reader, prefix); err != nil {
+		return nil, err
+	}
+	return &sealer{
+		id:     kr.current,
+		aead:   kr.keys[kr.current],
+		prefix: prefix,
+	}, nil
+}
+
+// opener 返回用于解密的 sealer，id 和 prefix 都是从文件中读取出来的
+func (kr *keyring) opener(id string, prefix []byte) (*sealer, error) {
+	if kr == nil {
+		return nil, encryptionKeyMissingErr
+	}
+	aead, ok := kr.keys[id]
+	if !ok {
+		return nil, encryptionKeyMissingErr
+	}
+	return &sealer{id: id, aead: aead, prefix: prefix}, nil
+}
+
+// header 返回写在加密数据之前的头部：密钥编号长度 (1) | 密钥编号 | nonce 前缀 (8)
+func (s *sealer) header() []byte {
+	header := make([]byte, 0, 1+len(s.id)+noncePrefixSize)
+	header = append(header, byte(len(s.id)))
+	header = append(header, s.id...)
+	return append(header, s.prefix...)
+}
+
+// readSealerHeader 读取 header 写入的头部，并返回对应的用于解密的 sealer
+func readSealerHeader(reader io.Reader, kr *keyring) (*sealer, error) {
+	length := make([]byte, 1)
+	if _, err := io.ReadFull(reader, length); err != nil {
+		return nil, err
+	}
+	rest := make([]byte, int(length[0])+noncePrefixSize)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return kr.opener(string(rest[:length[0]]), rest[length[0]:])
+}
+
+func (s *sealer) nonce() ([]byte, error) {
+	if s.counter == ^uint32(0) {
+		return nil, nonceExhaustedErr
+	}
+	nonce := make([]byte, 0, noncePrefixSize+4)
+	nonce = append(nonce, s.prefix...)
+	nonce = appendUint32(nonce, s.counter)
+	s.counter++
+	return nonce, nil
+}
+
+// seal 加密下一段数据
+func (s *sealer) seal(plaintext []byte) ([]byte, error) {
+	nonce, err := s.nonce()
+	if err != nil {
+		return nil, err
+	}
+	return s.aead.Seal(nil, nonce, plaintext, nil), nil
+}
+
+// open 解密下一段数据
+func (s *sealer) open(ciphertext []byte) ([]byte, error) {
+	nonce, err := s.nonce()
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := s.aead.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, decryptionFailedErr
+	}
+	return plaintext, nil
+}
+
+// sealedWriter 将写入的数据按照 sealedChunkSize 分块加密之后写入 writer，每块的格式是 密文长度 (4) | 密文
+// 写入结束之后需要调用 Close 写入最后一块
+type sealedWriter struct {
+	writer io.Writer
+	sealer *sealer
+	buffer []byte
+}
+
+// newSealedWriter 写入加密文件的头部：魔数 KAFE (4) | 版本号 (1) | sealer 的头部，并返回用于写入之后内容的 sealedWriter
+func newSealedWriter(writer io.Writer, kr *keyring) (*sealedWriter, error) {
+	sealer, err := kr.newSealer()
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(encryptedDumpMagic), encryptedDumpVersion)
+	if _, err = writer.Write(append(header, sealer.header()...)); err != nil {
+		return nil, err
+	}
+	return &sealedWriter{
+		writer: writer,
+		sealer: sealer,
+		buffer: make([]byte, 0, sealedChunkSize),
+	}, nil
+}
+
+func (sw *sealedWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := copy(sw.buffer[len(sw.buffer):cap(sw.buffer)], data)
+		sw.buffer = sw.buffer[:len(sw.buffer)+n]
+		data = data[n:]
+		written += n
+		if len(sw.buffer) == cap(sw.buffer) {
+			if err := sw.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// flush 加密并写入缓冲区中的数据
+func (sw *sealedWriter) flush() error {
+	if len(sw.buffer) == 0 {
+		return nil
+	}
+	sealed, err := sw.sealer.seal(sw.buffer)
+	if err != nil {
+		return err
+	}
+	sw.buffer = sw.buffer[:0]
+	if _, err = sw.writer.Write(appendUint32(nil, uint32(len(sealed)))); err != nil {
+		return err
+	}
+	_, err = sw.writer.Write(sealed)
+	return err
+}
+
+func (sw *sealedWriter) Close() error {
+	return sw.flush()
+}
+
+// sealedReader 读取 sealedWriter 写入的数据并解密，魔数和版本号需要调用方先读取并校验
+type sealedReader struct {
+	reader    io.Reader
+	sealer    *sealer
+	plaintext []byte
+}
+
+func newSealedReader(reader io.Reader, kr *keyring) (*sealedReader, error) {
+	sealer, err := readSealerHeader(reader, kr)
+	if err != nil {
+		return nil, err
+	}
+	return &sealedReader{reader: reader, sealer: sealer}, nil
+}
+
+func (sr *sealedReader) Read(data []byte) (int, error) {
+	for len(sr.plaintext) == 0 {
+		length := make([]byte, 4)
+		if _, err := io.ReadFull(sr.reader, length); err != nil {
+			return 0, err
+		}
+		size := binary.BigEndian.Uint32(length)
+		if size > sealedChunkSize+uint32(sr.sealer.aead.Overhead()) {
+			return 0, decryptionFailedErr
+		}
+		sealed := make([]byte, size)
+		if _, err := io.ReadFull(sr.reader, sealed); err != nil {
+			return 0, unexpectedEOF(err)
+		}
+		plaintext, err := sr.sealer.open(sealed)
+		if err != nil {
+			return 0, err
+		}
+		sr.plaintext = plaintext
+	}
+	n := copy(data, sr.plaintext)
+	sr.plaintext = sr.plaintext[n:]
+	return n, nil
+}
@@ -0,0 +1,120 @@
+package caches
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const (
+	testKey1 = "k1=000102030405060708090a0b0c0d0e0f000102030405060708090a0b0c0d0e0f"
+	testKey2 = "k2=ffeeddccbbaa99887766554433221100ffeeddccbbaa99887766554433221100"
+)
+
+func TestEncryptedDump(t *testing.T) {
+	options := newAofTestOptions(t)
+	options.AofFile = ""
+	options.EncryptionKeyEnv = "KAFO_TEST_ENCRYPTION_KEYS"
+	os.Setenv(options.EncryptionKeyEnv, testKey1)
+	defer os.Unsetenv(options.EncryptionKeyEnv)
+
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("session", []byte("secret-token"))
+	cache.NamespaceOf("team-a").Set("key", []byte("value"))
+	if err = cache.dump(); err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(options.DumpFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte(encryptedDumpMagic)) || bytes.Contains(data, []byte("secret-token")) || bytes.Contains(data, []byte("team-a")) {
+		t.Fatal("dump file should be encrypted")
+	}
+	if info, _ := os.Stat(options.DumpFile); info.Mode().Perm() != 0600 {
+		t.Fatalf("dump file should only be accessible by owner but got %v", info.Mode())
+	}
+
+	// 轮换密钥之后旧的持久化文件仍然可以恢复，新的持久化文件使用新密钥加密
+	os.Setenv(options.EncryptionKeyEnv, testKey2+","+testKey1)
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := recovered.Get("session"); !ok || string(value) != "secret-token" {
+		t.Fatalf("session should be recovered but got %s, %v", value, ok)
+	}
+	if err = recovered.dump(); err != nil {
+		t.Fatal(err)
+	}
+
+	os.Setenv(options.EncryptionKeyEnv, testKey2)
+	if recovered, err = OpenCacheWith(options); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := recovered.NamespaceOf("team-a").Get("key"); !ok || string(value) != "value" {
+		t.Fatalf("key in team-a should be recovered but got %s, %v", value, ok)
+	}
+
+	os.Setenv(options.EncryptionKeyEnv, testKey1)
+	if _, err = OpenCacheWith(options); err == nil {
+		t.Fatal("recovering with a wrong key should fail")
+	}
+}
+
+func TestEncryptedAof(t *testing.T) {
+	options := newAofTestOptions(t)
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.Set("plain", []byte("1"))
+	cache.aof.close()
+
+	// 开启加密之后，已有的明文记录仍然可以回放，新的记录会加密
+	options.EncryptionKeyFile = options.AofFile + ".keys"
+	if err = ioutil.WriteFile(options.EncryptionKeyFile, []byte("# keys\n"+testKey1+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cache, err = OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.NamespaceOf("team-a").Set("sealed", []byte("secret-token"))
+	cache.Delete("plain")
+	cache.aof.close()
+
+	data, err := ioutil.ReadFile(options.AofFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("plain")) || bytes.Contains(data, []byte("secret-token")) || bytes.Contains(data, []byte("team-a")) {
+		t.Fatal("only new records should be encrypted")
+	}
+
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := recovered.NamespaceOf("team-a").Get("sealed"); !ok || string(value) != "secret-token" {
+		t.Fatalf("sealed should be replayed but got %s, %v", value, ok)
+	}
+	if _, ok := recovered.Get("plain"); ok {
+		t.Fatal("plain should be deleted")
+	}
+	recovered.aof.close()
+
+	// 被篡改的加密记录无法解密
+	data[len(data)-1] ^= 1
+	if err = ioutil.WriteFile(options.AofFile, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = OpenCacheWith(options); err == nil || !strings.Contains(err.Error(), decryptionFailedErr.Error()) {
+		t.Fatalf("tampered aof should fail to decrypt but got %v", err)
+	}
+}
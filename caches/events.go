@@ -0,0 +1,129 @@
+package caches
+
+import (
+	"path"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// SetEvent 表示 key 被写入了，包括新增和覆盖
+	SetEvent = "set"
+	// DeleteEvent 表示 key 被删除了，清空命名空间时每个 key 都会有一个删除事件
+	DeleteEvent = "delete"
+	// ExpireEvent 表示 key 因为过期被清理了
+	ExpireEvent = "expire"
+	// EvictEvent 表示 key 因为容量不足被淘汰了
+	EvictEvent = "evict"
+
+	// eventBufferSize 是每个订阅者可以缓冲的事件个数
+	eventBufferSize = 1024
+)
+
+// Event 是 key 发生变化时产生的事件
+type Event struct {
+	// Reason 是事件的原因，是 SetEvent、DeleteEvent、ExpireEvent 和 EvictEvent 中的一个
+	Reason    string `json:"reason"`
+	Namespace string `json:"namespace"`
+	Key       string `json:"key"`
+}
+
+// EventBus 将事件分发给所有匹配的订阅者
+// 事件是在 segment 持有锁的时候发布的，所以发布永远不会阻塞：订阅者来不及处理时，缓冲满了之后的事件会被丢弃并计数
+type EventBus struct {
+	subscriptions map[*Subscription]struct{}
+	// count 是订阅者的个数，没有订阅者时发布事件只需要一次原子操作
+	count int32
+	lock  *sync.RWMutex
+}
+
+func newEventBus() *EventBus {
+	return &EventBus{
+		subscriptions: map[*Subscription]struct{}{},
+		lock:          &sync.RWMutex{},
+	}
+}
+
+// Subscription 是一个订阅者，通过 Events 接收事件，不再需要时必须调用 Close
+type Subscription struct {
+	bus *EventBus
+	// namespace 为空时表示订阅所有命名空间
+	namespace string
+	// pattern 是 key 的匹配模式，语法和 path.Match 相同，为空时表示匹配所有 key
+	pattern string
+	events  chan Event
+	// dropped 是因为缓冲满了而丢弃的事件个数
+	dropped uint64
+	once    *sync.Once
+}
+
+// subscribe 订阅命名空间 namespace 中匹配 pattern 的 key 的事件
+func (b *EventBus) subscribe(namespace string, pattern string) (*Subscription, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	subscription := &Subscription{
+		bus:       b,
+		namespace: namespace,
+		pattern:   pattern,
+		events:    make(chan Event, eventBufferSize),
+		once:      &sync.Once{},
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.subscriptions[subscription] = struct{}{}
+	atomic.AddInt32(&b.count, 1)
+	return subscription, nil
+}
+
+// publish 将 event 发送给所有匹配的订阅者，b 为 nil 时表示不需要发布事件
+func (b *EventBus) publish(event Event) {
+	if b == nil || atomic.LoadInt32(&b.count) == 0 {
+		return
+	}
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	for subscription := range b.subscriptions {
+		if !subscription.matches(event) {
+			continue
+		}
+		select {
+		case subscription.events <- event:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
+
+// matches 判断 event 是不是这个订阅者关心的
+func (s *Subscription) matches(event Event) bool {
+	if s.namespace != "" && s.namespace != event.Namespace {
+		return false
+	}
+	if s.pattern == "" {
+		return true
+	}
+	matched, _ := path.Match(s.pattern, event.Key)
+	return matched
+}
+
+// Events 返回接收事件的管道，订阅被关闭之后管道也会被关闭
+func (s *Subscription) Events() <-chan Event {
+	return s.events
+}
+
+// Dropped 返回因为来不及处理而被丢弃的事件个数，不为 0 时说明订阅者错过了一些变化
+func (s *Subscription) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Close 取消订阅，可以多次调用
+func (s *Subscription) Close() {
+	s.once.Do(func() {
+		s.bus.lock.Lock()
+		defer s.bus.lock.Unlock()
+		delete(s.bus.subscriptions, s)
+		atomic.AddInt32(&s.bus.count, -1)
+		close(s.events)
+	})
+}
@@ -0,0 +1,95 @@
+package caches
+
+import (
+	"testing"
+	"time"
+)
+
+// nextEvent 等待下一个事件，超时说明事件没有被发布
+func nextEvent(t *testing.T, subscription *Subscription) Event {
+	t.Helper()
+	select {
+	case event := <-subscription.Events():
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for an event")
+	}
+	return Event{}
+}
+
+func TestCacheEvents(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := cache.Subscribe("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer all.Close()
+	users, err := cache.Subscribe(DefaultNamespace, "user:*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer users.Close()
+	if _, err = cache.Subscribe("", "["); err == nil {
+		t.Fatal("subscribing with a malformed pattern should fail")
+	}
+
+	cache.Set("user:1", []byte("a"))
+	cache.NamespaceOf("team-a").Set("user:2", []byte("b"))
+	cache.Delete("user:1")
+	cache.SetWithTTL("session", []byte("c"), 1)
+	time.Sleep(1100 * time.Millisecond)
+	cache.Get("session")
+
+	expected := []Event{
+		{Reason: SetEvent, Namespace: DefaultNamespace, Key: "user:1"},
+		{Reason: SetEvent, Namespace: "team-a", Key: "user:2"},
+		{Reason: DeleteEvent, Namespace: DefaultNamespace, Key: "user:1"},
+		{Reason: SetEvent, Namespace: DefaultNamespace, Key: "session"},
+		{Reason: ExpireEvent, Namespace: DefaultNamespace, Key: "session"},
+	}
+	for _, e := range expected {
+		if event := nextEvent(t, all); event != e {
+			t.Fatalf("event should be %+v but got %+v", e, event)
+		}
+	}
+	for _, e := range []Event{expected[0], expected[2]} {
+		if event := nextEvent(t, users); event != e {
+			t.Fatalf("event should be %+v but got %+v", e, event)
+		}
+	}
+	select {
+	case event := <-users.Events():
+		t.Fatalf("users should not receive %+v", event)
+	default:
+	}
+
+	users.Close()
+	if _, ok := <-users.Events(); ok {
+		t.Fatal("events should be closed after closing the subscription")
+	}
+}
+
+func TestEvictEvent(t *testing.T) {
+	bus := newEventBus()
+	subscription, err := bus.subscribe("", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer subscription.Close()
+
+	value := make([]byte, 1000)
+	s := newTestSegment(LRU)
+	s.events = bus
+	s.set("a", value, Expiration{})
+	s.set("b", value, Expiration{})
+	s.set("c", value, Expiration{})
+
+	nextEvent(t, subscription)
+	nextEvent(t, subscription)
+	if event := nextEvent(t, subscription); event.Reason != EvictEvent || event.Key != "a" {
+		t.Fatalf("a should be evicted but got %+v", event)
+	}
+}
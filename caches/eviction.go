@@ -0,0 +1,259 @@
+package caches
+
+import (
+	"container/list"
+	"sync"
+)
+
+const (
+	// NoEviction 不淘汰任何数据，容量满了之后直接拒绝写入
+	NoEviction = "none"
+	// LRU 淘汰最久没有被访问的数据
+	LRU = "lru"
+	// LFU 淘汰访问次数最少的数据，次数相同时淘汰最久没有被访问的数据
+	LFU = "lfu"
+	// FIFO 淘汰最早写入的数据
+	FIFO = "fifo"
+)
+
+// evictor 是淘汰策略的实现，每个 segment 拥有一个独立的 evictor
+// 由于 segment 的读操作只持有读锁，所以 evictor 的实现需要自己保证并发安全
+type evictor interface {
+	// add 记录一个新写入的 key，key 已经存在时说明是覆盖写入，按照一次访问处理，之前的访问记录会保留下来
+	add(key string)
+	// access 记录一次对 key 的访问
+	access(key string)
+	// remove 移除 key 的记录
+	remove(key string)
+	// victim 选出下一个需要淘汰的 key，没有可以淘汰的 key 时返回 false
+	victim() (string, bool)
+}
+
+// evictors 记录了所有支持的淘汰策略
+var evictors = map[string]func() evictor{
+	NoEviction: newNoEvictor,
+	LRU:        newLruEvictor,
+	LFU:        newLfuEvictor,
+	FIFO:       newFifoEvictor,
+}
+
+// newEvictor 根据淘汰策略的名字创建 evictor，不认识的策略会当成 NoEviction 处理
+func newEvictor(policy string) evictor {
+	if newFunc, ok := evictors[policy]; ok {
+		return newFunc()
+	}
+	return newNoEvictor()
+}
+
+// IsValidEvictionPolicy 判断 policy 是否是支持的淘汰策略
+func IsValidEvictionPolicy(policy string) bool {
+	_, ok := evictors[policy]
+	return ok
+}
+
+type noEvictor struct{}
+
+func newNoEvictor() evictor {
+	return noEvictor{}
+}
+
+func (noEvictor) add(key string)         {}
+func (noEvictor) access(key string)      {}
+func (noEvictor) remove(key string)      {}
+func (noEvictor) victim() (string, bool) { return "", false }
+
+// lruEvictor 使用链表记录访问顺序，链表头部是最近访问的 key
+type lruEvictor struct {
+	keys     *list.List
+	elements map[string]*list.Element
+	lock     *sync.Mutex
+}
+
+func newLruEvictor() evictor {
+	return &lruEvictor{
+		keys:     list.New(),
+		elements: map[string]*list.Element{},
+		lock:     &sync.Mutex{},
+	}
+}
+
+func (le *lruEvictor) add(key string) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if element, ok := le.elements[key]; ok {
+		le.keys.MoveToFront(element)
+		return
+	}
+	le.elements[key] = le.keys.PushFront(key)
+}
+
+func (le *lruEvictor) access(key string) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if element, ok := le.elements[key]; ok {
+		le.keys.MoveToFront(element)
+	}
+}
+
+func (le *lruEvictor) remove(key string) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if element, ok := le.elements[key]; ok {
+		le.keys.Remove(element)
+		delete(le.elements, key)
+	}
+}
+
+func (le *lruEvictor) victim() (string, bool) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	element := le.keys.Back()
+	if element == nil {
+		return "", false
+	}
+	return element.Value.(string), true
+}
+
+// fifoEvictor 使用链表记录写入顺序，访问不会改变顺序
+type fifoEvictor struct {
+	keys     *list.List
+	elements map[string]*list.Element
+	lock     *sync.Mutex
+}
+
+func newFifoEvictor() evictor {
+	return &fifoEvictor{
+		keys:     list.New(),
+		elements: map[string]*list.Element{},
+		lock:     &sync.Mutex{},
+	}
+}
+
+func (fe *fifoEvictor) add(key string) {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	if _, ok := fe.elements[key]; ok {
+		return
+	}
+	fe.elements[key] = fe.keys.PushBack(key)
+}
+
+func (fe *fifoEvictor) access(key string) {}
+
+func (fe *fifoEvictor) remove(key string) {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	if element, ok := fe.elements[key]; ok {
+		fe.keys.Remove(element)
+		delete(fe.elements, key)
+	}
+}
+
+func (fe *fifoEvictor) victim() (string, bool) {
+	fe.lock.Lock()
+	defer fe.lock.Unlock()
+	element := fe.keys.Front()
+	if element == nil {
+		return "", false
+	}
+	return element.Value.(string), true
+}
+
+// lfuEntry 是 lfuEvictor 中记录的一个 key 和它的访问次数
+type lfuEntry struct {
+	key       string
+	frequency int
+}
+
+// lfuEvictor 按访问次数把 key 分组，每组是一个链表，链表头部是最近访问的 key
+// 这样增加访问次数和选出淘汰的 key 都是 O(1) 的
+type lfuEvictor struct {
+	frequencies  map[int]*list.List
+	elements     map[string]*list.Element
+	minFrequency int
+	lock         *sync.Mutex
+}
+
+func newLfuEvictor() evictor {
+	return &lfuEvictor{
+		frequencies: map[int]*list.List{},
+		elements:    map[string]*list.Element{},
+		lock:        &sync.Mutex{},
+	}
+}
+
+func (le *lfuEvictor) add(key string) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if element, ok := le.elements[key]; ok {
+		le.increase(element)
+		return
+	}
+	le.elements[key] = le.listOf(1).PushFront(&lfuEntry{key: key, frequency: 1})
+	le.minFrequency = 1
+}
+
+func (le *lfuEvictor) access(key string) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if element, ok := le.elements[key]; ok {
+		le.increase(element)
+	}
+}
+
+func (le *lfuEvictor) remove(key string) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	element, ok := le.elements[key]
+	if !ok {
+		return
+	}
+	le.unlink(element)
+	delete(le.elements, key)
+}
+
+func (le *lfuEvictor) victim() (string, bool) {
+	le.lock.Lock()
+	defer le.lock.Unlock()
+	if len(le.elements) == 0 {
+		return "", false
+	}
+	// minFrequency 在移除 key 之后可能不准确，所以需要往上找到第一个非空的分组
+	for {
+		if keys, ok := le.frequencies[le.minFrequency]; ok {
+			return keys.Back().Value.(*lfuEntry).key, true
+		}
+		le.minFrequency++
+	}
+}
+
+// listOf 返回访问次数为 frequency 的分组，没有则创建
+func (le *lfuEvictor) listOf(frequency int) *list.List {
+	keys, ok := le.frequencies[frequency]
+	if !ok {
+		keys = list.New()
+		le.frequencies[frequency] = keys
+	}
+	return keys
+}
+
+// unlink 将 element 从所在的分组中移除，分组为空时删除这个分组
+func (le *lfuEvictor) unlink(element *list.Element) {
+	frequency := element.Value.(*lfuEntry).frequency
+	keys := le.frequencies[frequency]
+	keys.Remove(element)
+	if keys.Len() == 0 {
+		delete(le.frequencies, frequency)
+	}
+}
+
+// increase 将 element 的访问次数加一，并移动到对应的分组
+func (le *lfuEvictor) increase(element *list.Element) {
+	entry := element.Value.(*lfuEntry)
+	le.unlink(element)
+	if entry.frequency == le.minFrequency && le.frequencies[entry.frequency] == nil {
+		le.minFrequency++
+	}
+	entry.frequency++
+	le.elements[entry.key] = le.listOf(entry.frequency).PushFront(entry)
+}
@@ -0,0 +1,137 @@
+package caches
+
+import (
+	"testing"
+)
+
+// newTestSegment 创建一个只能放下两个 1000 字节的值的 segment
+func newTestSegment(policy string) *segment {
+	options := DefaultOptions()
+	options.MaxEntrySize = 2*(entryOverhead+1+1000) + 100
+	options.EvictionPolicy = policy
+	return newSegment(&options)
+}
+
+func TestSegmentEviction(t *testing.T) {
+	value := make([]byte, 1000)
+	cases := []struct {
+		policy  string
+		evicted string
+	}{
+		{policy: LRU, evicted: "b"},
+		{policy: LFU, evicted: "b"},
+		{policy: FIFO, evicted: "a"},
+	}
+
+	for _, c := range cases {
+		s := newTestSegment(c.policy)
+		s.set("a", value, Expiration{})
+		s.set("b", value, Expiration{})
+		s.get("a")
+		if err := s.set("c", value, Expiration{}); err != nil {
+			t.Fatalf("%s: set should evict instead of failing: %v", c.policy, err)
+		}
+		if _, ok := s.get(c.evicted); ok {
+			t.Fatalf("%s: key %s should be evicted", c.policy, c.evicted)
+		}
+		if _, ok := s.get("c"); !ok {
+			t.Fatalf("%s: key c should exist", c.policy)
+		}
+		if status := s.status(); status.Evictions != 1 || status.Count != 2 {
+			t.Fatalf("%s: wrong status %+v", c.policy, status)
+		}
+	}
+}
+
+func TestSegmentNoEviction(t *testing.T) {
+	value := make([]byte, 1000)
+	s := newTestSegment(NoEviction)
+	s.set("a", value, Expiration{})
+	s.set("b", value, Expiration{})
+	if err := s.set("c", value, Expiration{}); err == nil {
+		t.Fatal("set should fail when eviction is disabled")
+	}
+
+	// 覆盖已有的 key 不需要淘汰数据
+	if err := s.set("a", value, Expiration{}); err != nil {
+		t.Fatalf("overwriting should not fail: %v", err)
+	}
+}
+
+func TestLfuEvictor(t *testing.T) {
+	e := newLfuEvictor()
+	e.add("a")
+	e.add("b")
+	e.add("c")
+	e.access("a")
+	e.access("a")
+	e.access("c")
+	if victim, _ := e.victim(); victim != "b" {
+		t.Fatalf("victim should be b but got %s", victim)
+	}
+	e.remove("b")
+	if victim, _ := e.victim(); victim != "c" {
+		t.Fatalf("victim should be c but got %s", victim)
+	}
+	e.remove("c")
+	e.remove("a")
+	if _, ok := e.victim(); ok {
+		t.Fatal("empty evictor should have no victim")
+	}
+}
+
+func TestOverwriteKeepsAccessHistory(t *testing.T) {
+	value := make([]byte, 1000)
+	s := newTestSegment(LFU)
+	s.set("a", value, Expiration{})
+	s.set("b", value, Expiration{})
+	for i := 0; i < 3; i++ {
+		s.get("a")
+	}
+	s.get("b")
+
+	// 覆盖写入不会让 a 的访问次数从头开始，所以淘汰的仍然是访问次数更少的 b
+	if err := s.set("a", value, Expiration{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.set("c", value, Expiration{}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.get("b"); ok {
+		t.Fatal("key b should be evicted")
+	}
+	if _, ok := s.get("a"); !ok {
+		t.Fatal("key a should be kept after overwriting")
+	}
+
+	// 写入失败时 a 的旧值和访问记录都还在
+	if err := s.set("a", make([]byte, 3000), Expiration{}); err == nil {
+		t.Fatal("too large value should be rejected")
+	}
+	if data, ok := s.get("a"); !ok || len(data) != len(value) {
+		t.Fatalf("old value of a should be kept but got %d bytes, %v", len(data), ok)
+	}
+	if victim, _ := s.evictor.victim(); victim != "c" {
+		t.Fatalf("victim should be c but got %s", victim)
+	}
+}
+
+func TestOverwriteLeastRecentlyUsed(t *testing.T) {
+	// 覆盖的 key 正好是最久没有访问的，segment 没办法自己淘汰其他数据，交给命名空间淘汰
+	options := DefaultOptions()
+	options.SegmentSize = 1
+	options.MaxEntrySize = 2*(entryOverhead+1+1000) + 100
+	options.EvictionPolicy = LRU
+	ns := newNamespace(DefaultNamespace, &options, newVersions(), nil, nil)
+	ns.Set("a", make([]byte, 1000))
+	ns.Set("b", make([]byte, 1000))
+	if err := ns.Set("a", make([]byte, 1500)); err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := ns.Get("a"); !ok || len(data) != 1500 {
+		t.Fatalf("a should be overwritten but got %d bytes, %v", len(data), ok)
+	}
+	if _, ok := ns.Get("b"); ok {
+		t.Fatal("b should be evicted")
+	}
+}
@@ -0,0 +1,83 @@
+package caches
+
+import (
+	"time"
+)
+
+const (
+	// millisecondsPerSecond 用于在秒和毫秒之间转换
+	millisecondsPerSecond = 1000
+)
+
+// ExpiryMode 是有效期的计算方式
+type ExpiryMode byte
+
+const (
+	// FixedExpiry 从写入时开始计算有效期，读取不会延长有效期
+	FixedExpiry ExpiryMode = 0
+	// SlidingExpiry 从最后一次访问时开始计算有效期，一直被访问的 key 不会过期
+	// 只有读取会延长有效期，而且延长不会被记录到日志中，所以从日志中恢复的数据是从最后一次写入开始计算有效期的
+	SlidingExpiry ExpiryMode = 1
+	// AbsoluteExpiry 在指定的时间点过期
+	AbsoluteExpiry ExpiryMode = 2
+)
+
+// Expiration 描述一个键值对什么时候过期，零值表示永不过期
+type Expiration struct {
+	Mode ExpiryMode
+	// TTL 是 FixedExpiry 和 SlidingExpiry 的有效期，精确到毫秒，不大于 0 时表示永不过期
+	TTL time.Duration
+	// Deadline 是 AbsoluteExpiry 的过期时间点，精确到毫秒，零值表示永不过期
+	Deadline time.Time
+}
+
+// FixedTTL 返回从写入时开始计算的有效期
+func FixedTTL(ttl time.Duration) Expiration {
+	return Expiration{Mode: FixedExpiry, TTL: ttl}
+}
+
+// SlidingTTL 返回从最后一次访问时开始计算的有效期
+func SlidingTTL(ttl time.Duration) Expiration {
+	return Expiration{Mode: SlidingExpiry, TTL: ttl}
+}
+
+// ExpireAt 返回在 deadline 过期的有效期
+func ExpireAt(deadline time.Time) Expiration {
+	return Expiration{Mode: AbsoluteExpiry, Deadline: deadline}
+}
+
+// secondsTTL 将以秒为单位的 ttl 转换成固定有效期，兼容以秒作为有效期的接口
+func secondsTTL(ttl int64) Expiration {
+	return FixedTTL(time.Duration(ttl) * time.Second)
+}
+
+// expireAt 返回当前时间是 now 时的过期时间点，now 和返回值都是 Unix 时间的毫秒数，NeverDie 表示永不过期
+func (e Expiration) expireAt(now int64) int64 {
+	if e.Mode == AbsoluteExpiry {
+		if e.Deadline.IsZero() {
+			return NeverDie
+		}
+		// 1970 年之前的时间点也表示已经过期，不能和 NeverDie 混淆
+		if expire := e.Deadline.UnixNano() / int64(time.Millisecond); expire > 0 {
+			return expire
+		}
+		return 1
+	}
+	if e.TTL <= 0 {
+		return NeverDie
+	}
+	return now + millisecondsOf(e.TTL)
+}
+
+// nowMilliseconds 返回当前 Unix 时间的毫秒数
+func nowMilliseconds() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+// millisecondsOf 将 d 转换成毫秒数，不足一毫秒的有效期按一毫秒计算，避免被当成永不过期
+func millisecondsOf(d time.Duration) int64 {
+	if ms := int64(d / time.Millisecond); ms > 0 {
+		return ms
+	}
+	return 1
+}
@@ -0,0 +1,175 @@
+package caches
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestExpiryModes(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetWithExpiration("fixed", []byte("a"), FixedTTL(300*time.Millisecond))
+	cache.SetWithExpiration("sliding", []byte("b"), SlidingTTL(300*time.Millisecond))
+	cache.SetWithExpiration("absolute", []byte("c"), ExpireAt(time.Now().Add(300*time.Millisecond)))
+
+	// 读取不会延长固定有效期和绝对过期时间，只会延长滑动有效期
+	for i := 0; i < 4; i++ {
+		time.Sleep(150 * time.Millisecond)
+		if _, ok := cache.Get("sliding"); !ok {
+			t.Fatalf("sliding should be alive after %d reads", i)
+		}
+		if i == 0 {
+			if _, ok := cache.Get("fixed"); !ok {
+				t.Fatal("fixed should be alive before its ttl")
+			}
+		}
+	}
+	for _, key := range []string{"fixed", "absolute"} {
+		if _, ok := cache.Get(key); ok {
+			t.Fatalf("%s should be expired", key)
+		}
+	}
+	time.Sleep(400 * time.Millisecond)
+	if _, ok := cache.Get("sliding"); ok {
+		t.Fatal("sliding should be expired after it is not read")
+	}
+}
+
+func TestExpireAndPersist(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := cache.Expire("missing", FixedTTL(time.Second)); ok || err != nil {
+		t.Fatalf("expiring a missing key should return false but got %v, %v", ok, err)
+	}
+
+	cache.Set("key", []byte("value"))
+	if ttl, ok := cache.TTL("key"); !ok || ttl != NeverDie {
+		t.Fatalf("ttl should be NeverDie but got %d, %v", ttl, ok)
+	}
+	_, version, _ := cache.GetWithVersion("key")
+	if ok, err := cache.Expire("key", FixedTTL(1500*time.Millisecond)); !ok || err != nil {
+		t.Fatalf("expire should succeed but got %v, %v", ok, err)
+	}
+	if ttl, ok := cache.PTTL("key"); !ok || ttl <= 1000 || ttl > 1500 {
+		t.Fatalf("pttl should be about 1500 but got %d, %v", ttl, ok)
+	}
+	if ttl, ok := cache.TTL("key"); !ok || ttl != 2 {
+		t.Fatalf("ttl should be rounded up to 2 but got %d, %v", ttl, ok)
+	}
+	if _, newVersion, _ := cache.GetWithVersion("key"); newVersion != version {
+		t.Fatalf("expire should not change the version %d but got %d", version, newVersion)
+	}
+
+	if ok, err := cache.Persist("key"); !ok || err != nil {
+		t.Fatalf("persist should succeed but got %v, %v", ok, err)
+	}
+	if ttl, ok := cache.PTTL("key"); !ok || ttl != NeverDie {
+		t.Fatalf("pttl should be NeverDie after persist but got %d, %v", ttl, ok)
+	}
+
+	if ok, _ := cache.Expire("key", ExpireAt(time.Now().Add(-time.Second))); !ok {
+		t.Fatal("expire should succeed")
+	}
+	if _, ok := cache.Get("key"); ok {
+		t.Fatal("key should be expired after expiring at a past deadline")
+	}
+}
+
+func TestDumpKeepsExpiration(t *testing.T) {
+	options := DefaultOptions()
+	options.DumpFile = filepath.Join(t.TempDir(), "kafo.dump")
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetWithExpiration("absolute", []byte("a"), ExpireAt(time.Now().Add(time.Hour)))
+	cache.SetWithExpiration("sliding", []byte("b"), SlidingTTL(time.Minute))
+	cache.Set("forever", []byte("c"))
+	if err = cache.dump(); err != nil {
+		t.Fatal(err)
+	}
+
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl, ok := recovered.PTTL("absolute"); !ok || ttl <= 59*60*1000 || ttl > 60*60*1000 {
+		t.Fatalf("remaining ttl should be kept but got %d, %v", ttl, ok)
+	}
+	if ttl, ok := recovered.PTTL("forever"); !ok || ttl != NeverDie {
+		t.Fatalf("forever should never die but got %d, %v", ttl, ok)
+	}
+	v, _ := recovered.segmentOf("sliding").data.get("sliding")
+	if v.Mode != SlidingExpiry || v.Ttl != 60*1000 {
+		t.Fatalf("sliding expiration should be kept but got %d, %d", v.Mode, v.Ttl)
+	}
+}
+
+func TestActiveExpiration(t *testing.T) {
+	options := DefaultOptions()
+	options.SegmentSize = 1
+	options.MaxGcCount = 5
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		cache.SetWithExpiration(strconv.Itoa(i), []byte("a"), FixedTTL(50*time.Millisecond))
+	}
+	cache.SetWithExpiration("sliding", []byte("b"), SlidingTTL(100*time.Millisecond))
+	cache.SetWithExpiration("overwritten", []byte("c"), FixedTTL(50*time.Millisecond))
+	cache.Set("overwritten", []byte("c"))
+
+	time.Sleep(70 * time.Millisecond)
+	cache.Get("sliding")
+	time.Sleep(60 * time.Millisecond)
+
+	// 每次清理最多检查 MaxGcCount 个 key，被读取过的滑动有效期只会重新排序
+	cache.gc()
+	if status := cache.Status(); status.Expired != 5 || status.Count != 17 {
+		t.Fatalf("one gc should expire 5 keys but got %+v", status)
+	}
+	for i := 0; i < 4; i++ {
+		cache.gc()
+	}
+	if status := cache.Status(); status.Expired != 20 || status.Count != 2 {
+		t.Fatalf("all fixed keys should be expired but got %+v", status)
+	}
+	for _, key := range []string{"sliding", "overwritten"} {
+		if _, ok := cache.Get(key); !ok {
+			t.Fatalf("%s should not be expired", key)
+		}
+	}
+}
+
+func TestPeekDoesNotExtendSlidingTTL(t *testing.T) {
+	cache, err := OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cache.SetWithExpiration("sliding", []byte("b"), SlidingTTL(300*time.Millisecond))
+	_, version, _ := cache.GetWithVersion("sliding")
+
+	value, expiration, peekedVersion, ok := cache.Peek("sliding")
+	if !ok || string(value) != "b" || peekedVersion != version {
+		t.Fatalf("peek should return the value and its version but got %s, %d, %v", value, peekedVersion, ok)
+	}
+	if expiration.Mode != SlidingExpiry || expiration.TTL != 300*time.Millisecond {
+		t.Fatalf("peek should return the full sliding ttl but got %+v", expiration)
+	}
+
+	// Peek 不算作访问，所以不会推迟过期时间
+	for i := 0; i < 4; i++ {
+		time.Sleep(100 * time.Millisecond)
+		cache.Peek("sliding")
+	}
+	if _, _, _, ok = cache.Peek("sliding"); ok {
+		t.Fatal("sliding should be expired when it is only peeked")
+	}
+}
@@ -0,0 +1,87 @@
+package caches
+
+import (
+	"container/heap"
+)
+
+// expiryItem 是过期堆中的一个 key，expire 是入堆时的过期时间，index 是在堆中的下标
+type expiryItem struct {
+	key    string
+	expire int64
+	index  int
+}
+
+// expiryHeap 是按照过期时间排序的最小堆，每个 segment 拥有一个，用于主动清理已经过期的 key
+// 永不过期的 key 不会进入堆中。滑动有效期在读取时只持有读锁，没办法调整堆，所以堆中的过期时间可能比实际的早，
+// 取出时需要和 value 中的过期时间再比较一次。堆不是并发安全的，调用方需要持有 segment 的写锁
+type expiryHeap struct {
+	items []*expiryItem
+	// keys 记录了每个 key 在堆中的位置，一个 key 在堆中最多只有一项
+	keys map[string]*expiryItem
+}
+
+func newExpiryHeap() *expiryHeap {
+	return &expiryHeap{
+		keys: map[string]*expiryItem{},
+	}
+}
+
+// update 记录 key 的过期时间，NeverDie 表示 key 不会过期，会从堆中移除
+func (h *expiryHeap) update(key string, expire int64) {
+	if expire == NeverDie {
+		h.remove(key)
+		return
+	}
+	if item, ok := h.keys[key]; ok {
+		item.expire = expire
+		heap.Fix(h, item.index)
+		return
+	}
+	item := &expiryItem{key: key, expire: expire}
+	h.keys[key] = item
+	heap.Push(h, item)
+}
+
+// remove 将 key 从堆中移除，key 不在堆中时什么都不做
+func (h *expiryHeap) remove(key string) {
+	if item, ok := h.keys[key]; ok {
+		heap.Remove(h, item.index)
+		delete(h.keys, key)
+	}
+}
+
+// earliest 返回过期时间最早的一项，堆为空时返回 false
+func (h *expiryHeap) earliest() (*expiryItem, bool) {
+	if len(h.items) == 0 {
+		return nil, false
+	}
+	return h.items[0], true
+}
+
+func (h *expiryHeap) Len() int {
+	return len(h.items)
+}
+
+func (h *expiryHeap) Less(i, j int) bool {
+	return h.items[i].expire < h.items[j].expire
+}
+
+func (h *expiryHeap) Swap(i, j int) {
+	h.items[i], h.items[j] = h.items[j], h.items[i]
+	h.items[i].index = i
+	h.items[j].index = j
+}
+
+func (h *expiryHeap) Push(x interface{}) {
+	item := x.(*expiryItem)
+	item.index = len(h.items)
+	h.items = append(h.items, item)
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	last := len(h.items) - 1
+	item := h.items[last]
+	h.items[last] = nil
+	h.items = h.items[:last]
+	return item
+}
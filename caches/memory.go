@@ -0,0 +1,112 @@
+package caches
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+const (
+	// entryOverhead 是 MapStorage 中每个键值对除了 key 和 value 本身之外占用的内存，是按照 64 位平台估算出来的：
+	// Data 中的 map 项大约 40 字节，value 结构体 56 字节，淘汰策略记录 key 的链表节点和 map 项大约 64 字节
+	entryOverhead = 160
+	// arenaEntryOverhead 是 ArenaStorage 中每个键值对除了 key 和 value 本身之外占用的内存：
+	// 头部的 5 个 uint64 共 40 字节，索引的 map 项大约 16 字节，淘汰策略记录 key 的链表节点和 map 项大约 64 字节
+	// key 和 value 会被补齐到 8 字节的整数倍，补齐的部分由 arenaStorage.sizeOf 另外计算
+	arenaEntryOverhead = 120
+	// expiryOverhead 是会过期的键值对在过期堆中额外占用的内存，包括 expiryItem、堆中的指针和 map 项
+	expiryOverhead = 72
+)
+
+var (
+	// invalidSizeErr 意味着容量的格式不正确
+	invalidSizeErr = errors.New("size should be a number with an optional unit such as 512MB")
+
+	// sizeUnits 是容量支持的单位，都是以 1024 为进制的
+	sizeUnits = map[string]int64{
+		"":   1,
+		"B":  1,
+		"K":  1 << 10,
+		"KB": 1 << 10,
+		"M":  1 << 20,
+		"MB": 1 << 20,
+		"G":  1 << 30,
+		"GB": 1 << 30,
+		"T":  1 << 40,
+		"TB": 1 << 40,
+	}
+)
+
+// ParseSize 解析带单位的容量，比如 512MB、1.5GB，单位不区分大小写，没有单位时就是字节数
+func ParseSize(size string) (int64, error) {
+	size = strings.ToUpper(strings.TrimSpace(size))
+	i := len(size)
+	for i > 0 && (size[i-1] < '0' || size[i-1] > '9') && size[i-1] != '.' {
+		i--
+	}
+	unit, ok := sizeUnits[strings.TrimSpace(size[i:])]
+	if !ok {
+		return 0, invalidSizeErr
+	}
+	number, err := strconv.ParseFloat(size[:i], 64)
+	if err != nil || number < 0 {
+		return 0, invalidSizeErr
+	}
+	return int64(number * float64(unit)), nil
+}
+
+// entrySizeOf 返回键值对在 data 中占用的内存，包括 key、value 和存储方式自身的开销
+func entrySizeOf(data storage, key string, v *value) int64 {
+	size := data.sizeOf(key, v)
+	if v.Expire != NeverDie {
+		size += expiryOverhead
+	}
+	return size
+}
+
+// memoryBudget 是一个命名空间中所有 segment 共用的内存额度，也可以被多个命名空间共用，used 超过 limit 的写入会失败
+// 内存使用量超过高水位时，后台清理任务会淘汰数据直到低于低水位，这样写入时一般不需要自己淘汰数据
+type memoryBudget struct {
+	limit int64
+	high  int64
+	low   int64
+	used  int64
+}
+
+// newMemoryBudget 使用 options 中的 MaxEntrySize 和水位创建内存额度，水位是相对 MaxEntrySize 的百分比
+func newMemoryBudget(options *Options) *memoryBudget {
+	return &memoryBudget{
+		limit: options.MaxEntrySize,
+		high:  options.MaxEntrySize * int64(options.HighWatermark) / 100,
+		low:   options.MaxEntrySize * int64(options.LowWatermark) / 100,
+	}
+}
+
+// reserve 占用 size 字节的内存，超出 limit 时不会占用并返回 false
+func (mb *memoryBudget) reserve(size int64) bool {
+	for {
+		used := atomic.LoadInt64(&mb.used)
+		if used+size > mb.limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&mb.used, used, used+size) {
+			return true
+		}
+	}
+}
+
+// take 不管是否超出 limit 都占用 size 字节的内存，用于撤销已经释放的内存
+func (mb *memoryBudget) take(size int64) {
+	atomic.AddInt64(&mb.used, size)
+}
+
+// release 释放 size 字节的内存
+func (mb *memoryBudget) release(size int64) {
+	atomic.AddInt64(&mb.used, -size)
+}
+
+// usage 返回已经使用的内存
+func (mb *memoryBudget) usage() int64 {
+	return atomic.LoadInt64(&mb.used)
+}
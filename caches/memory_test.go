@@ -0,0 +1,147 @@
+package caches
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseSize(t *testing.T) {
+	cases := map[string]int64{
+		"100":    100,
+		"100B":   100,
+		"512MB":  512 << 20,
+		"512mb":  512 << 20,
+		"1.5 GB": 3 << 29,
+		"2k":     2 << 10,
+		"1TB":    1 << 40,
+	}
+	for size, expected := range cases {
+		if result, err := ParseSize(size); err != nil || result != expected {
+			t.Fatalf("%s should be %d but got %d, %v", size, expected, result, err)
+		}
+	}
+	for _, size := range []string{"", "MB", "-1MB", "12PB", "1..2GB"} {
+		if _, err := ParseSize(size); err == nil {
+			t.Fatalf("%q should be invalid", size)
+		}
+	}
+}
+
+func TestMemoryBudget(t *testing.T) {
+	entrySize := int64(entryOverhead + len("key-00") + 100)
+	options := DefaultOptions()
+	options.SegmentSize = 16
+	options.MaxEntrySize = 32 * entrySize
+	options.HighWatermark = 50
+	options.LowWatermark = 25
+	options.EvictionPolicy = NoEviction
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 所有 segment 共用一个内存额度，不管 key 怎么分布都可以写满
+	value := make([]byte, 100)
+	for i := 0; i < 32; i++ {
+		if err = cache.Set(fmt.Sprintf("key-%02d", i), value); err != nil {
+			t.Fatalf("key-%02d should be set: %v", i, err)
+		}
+	}
+	if err = cache.Set("key-32", value); err == nil {
+		t.Fatal("set should fail when memory is full")
+	}
+	status := cache.Status()
+	if status.MemorySize != 32*entrySize || status.MaxMemory != 32*entrySize || status.HighWatermark != 16*entrySize || status.LowWatermark != 8*entrySize {
+		t.Fatalf("wrong memory status %+v", status)
+	}
+
+	// 超过高水位之后，后台清理会淘汰数据直到低于低水位
+	options.EvictionPolicy = LRU
+	cache, err = OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		cache.Set(fmt.Sprintf("key-%02d", i), value)
+	}
+	cache.gc()
+	if status = cache.Status(); status.MemorySize > 8*entrySize || status.Evictions != int64(20-status.Count) {
+		t.Fatalf("memory should be reclaimed below low watermark but got %+v", status)
+	}
+	cache.Set("expiring", value)
+	cache.Expire("expiring", FixedTTL(time.Minute))
+	cache.FlushNamespace(DefaultNamespace)
+	if usage := cache.memory.usage(); usage != 0 {
+		t.Fatalf("memory should be released after flushing but got %d", usage)
+	}
+}
+
+func TestEvictionAcrossSegments(t *testing.T) {
+	entrySize := int64(entryOverhead + len("key-00") + 100)
+	options := DefaultOptions()
+	options.SegmentSize = 4
+	options.MaxEntrySize = 4 * entrySize
+	options.EvictionPolicy = LRU
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 把内存都写给同一个 segment，其他 segment 中没有可以淘汰的数据
+	value := make([]byte, 100)
+	full := cache.segmentOf("key-00")
+	var keys []string
+	for i := 0; len(keys) < 5; i++ {
+		key := fmt.Sprintf("key-%02d", i)
+		if cache.segmentOf(key) == full {
+			keys = append(keys, key)
+		}
+	}
+	for _, key := range keys[:4] {
+		if err = cache.Set(key, value); err != nil {
+			t.Fatalf("%s should be set: %v", key, err)
+		}
+	}
+	var other string
+	for i := 0; other == ""; i++ {
+		if key := fmt.Sprintf("new-%02d", i); cache.segmentOf(key) != full {
+			other = key
+		}
+	}
+
+	// 写入其他 segment 时需要从写满的 segment 中淘汰
+	if err = cache.Set(other, make([]byte, 100-len(other)+len("key-00"))); err != nil {
+		t.Fatalf("%s should be set after evicting from other segments: %v", other, err)
+	}
+	if _, ok := cache.Get(keys[0]); ok {
+		t.Fatalf("%s should be evicted", keys[0])
+	}
+	if status := cache.Status(); status.Evictions != 1 || status.MemorySize != 4*entrySize {
+		t.Fatalf("wrong status after eviction %+v", status)
+	}
+
+	// 单个键值对超过内存上限时不应该淘汰任何数据
+	if err = cache.Set(other, make([]byte, 5*entrySize)); err == nil {
+		t.Fatal("set should fail when the entry is larger than the memory limit")
+	}
+	if status := cache.Status(); status.Evictions != 1 {
+		t.Fatalf("nothing should be evicted for an oversized entry but got %+v", status)
+	}
+}
+
+func TestArenaEntrySize(t *testing.T) {
+	options := DefaultOptions()
+	options.StorageEngine = ArenaStorage
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = cache.Set("key", make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	// key 和 value 都会补齐到 8 字节
+	if size := cache.Status().MemorySize; size != arenaEntryOverhead+8+104 {
+		t.Fatalf("arena entry should take %d bytes but got %d", arenaEntryOverhead+8+104, size)
+	}
+}
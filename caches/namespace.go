@@ -0,0 +1,401 @@
+package caches
+
+const (
+	// DefaultNamespace 是默认的命名空间，不指定命名空间的操作都在这个命名空间中进行
+	DefaultNamespace = "default"
+)
+
+// Namespace 是缓存中的一个命名空间，不同命名空间中的 key 互不影响
+// 每个命名空间都有自己的 segment 和状态，可以单独清空
+// 单独配置了容量限制的命名空间有自己的内存额度，写满了只会淘汰自己的数据，其他命名空间共用一个额度，写满时轮流从它们中淘汰
+type Namespace struct {
+	name        string
+	segmentSize int
+	segments    []*segment
+	options     *Options
+	// memory 是所有 segment 共用的内存额度，数据分布不均匀时某个 segment 也可以使用更多的内存
+	memory *memoryBudget
+	// sharing 返回和这个命名空间共用内存额度的所有命名空间，包括它自己，为 nil 时表示额度是自己独占的
+	sharing func() []*Namespace
+}
+
+// newNamespace 创建名为 name 的命名空间，options 中的 MaxEntrySize 就是这个命名空间的内存上限
+// 所有命名空间共用一个版本号计数器、日志和事件总线
+func newNamespace(name string, options *Options, versions *uint64, aof *aof, events *EventBus) *Namespace {
+	memory := newMemoryBudget(options)
+	segments := make([]*segment, options.SegmentSize)
+	for i := 0; i < options.SegmentSize; i++ {
+		segments[i] = newSegment(options)
+		segments[i].namespace = name
+		segments[i].versions = versions
+		segments[i].aof = aof
+		segments[i].events = events
+		segments[i].memory = memory
+	}
+	return &Namespace{
+		name:        name,
+		segmentSize: options.SegmentSize,
+		segments:    segments,
+		options:     options,
+		memory:      memory,
+	}
+}
+
+// shareMemory 让命名空间使用 memory 作为内存额度，sharing 返回所有使用这个额度的命名空间，需要在命名空间写入数据之前调用
+func (ns *Namespace) shareMemory(memory *memoryBudget, sharing func() []*Namespace) {
+	ns.memory = memory
+	ns.sharing = sharing
+	for _, segment := range ns.segments {
+		segment.memory = memory
+	}
+}
+
+// group 返回和这个命名空间共用内存额度的所有命名空间，淘汰数据时需要在它们之间轮流进行
+func (ns *Namespace) group() []*Namespace {
+	if ns.sharing == nil {
+		return []*Namespace{ns}
+	}
+	return ns.sharing()
+}
+
+// Name 返回命名空间的名字
+func (ns *Namespace) Name() string {
+	return ns.name
+}
+
+func index(key string) int {
+	index := 0
+	keyBytes := []byte(key)
+	for _, b := range keyBytes {
+		index = 31*index + int(b&0xff)
+	}
+	return index ^ (index >> 16)
+}
+
+func (ns *Namespace) segmentOf(key string) *segment {
+	return ns.segments[index(key)&(ns.segmentSize-1)]
+}
+
+func (ns *Namespace) Get(key string) ([]byte, bool) {
+	return ns.segmentOf(key).get(key)
+}
+
+func (ns *Namespace) Set(key string, value []byte) error {
+	return ns.SetWithTTL(key, value, NeverDie)
+}
+
+// SetWithTTL 写入键值对，ttl 是从写入时开始计算的有效期，单位是秒
+func (ns *Namespace) SetWithTTL(key string, value []byte, ttl int64) error {
+	return ns.SetWithExpiration(key, value, secondsTTL(ttl))
+}
+
+// SetWithExpiration 写入键值对，并按照 expiration 计算有效期
+func (ns *Namespace) SetWithExpiration(key string, value []byte, expiration Expiration) error {
+	return ns.withRoom(func() error {
+		return ns.segmentOf(key).set(key, value, expiration)
+	})
+}
+
+// TTL 返回 key 剩余的有效期，单位是秒，不足一秒的部分按一秒计算，NeverDie 表示永不过期，key 不存在时返回 false
+func (ns *Namespace) TTL(key string) (int64, bool) {
+	ttl, ok := ns.PTTL(key)
+	if !ok || ttl == NeverDie {
+		return ttl, ok
+	}
+	return (ttl + millisecondsPerSecond - 1) / millisecondsPerSecond, true
+}
+
+// PTTL 返回 key 剩余的有效期，单位是毫秒，NeverDie 表示永不过期，key 不存在时返回 false
+func (ns *Namespace) PTTL(key string) (int64, bool) {
+	return ns.segmentOf(key).ttl(key)
+}
+
+// Expire 将 key 的有效期修改为 expiration，值和版本号都不会改变，key 不存在时返回 false
+func (ns *Namespace) Expire(key string, expiration Expiration) (bool, error) {
+	return ns.segmentOf(key).setExpiration(key, expiration)
+}
+
+// Persist 移除 key 的有效期，让 key 永不过期，key 不存在时返回 false
+func (ns *Namespace) Persist(key string) (bool, error) {
+	return ns.Expire(key, Expiration{})
+}
+
+func (ns *Namespace) Delete(key string) error {
+	return ns.segmentOf(key).delete(key)
+}
+
+// SetNX 只有在 key 不存在或者已经过期时才写入，返回是否写入，可以用来实现分布式锁
+func (ns *Namespace) SetNX(key string, value []byte, ttl int64) (bool, error) {
+	var ok bool
+	err := ns.withRoom(func() (err error) {
+		ok, err = ns.segmentOf(key).setNX(key, value, secondsTTL(ttl))
+		return err
+	})
+	return ok, err
+}
+
+// SetXX 只有在 key 存在并且没有过期时才写入，返回是否写入
+func (ns *Namespace) SetXX(key string, value []byte, ttl int64) (bool, error) {
+	var ok bool
+	err := ns.withRoom(func() (err error) {
+		ok, err = ns.segmentOf(key).setXX(key, value, secondsTTL(ttl))
+		return err
+	})
+	return ok, err
+}
+
+// GetSet 写入新的值并返回旧的值，旧的值不存在时返回 false
+func (ns *Namespace) GetSet(key string, value []byte, ttl int64) ([]byte, bool, error) {
+	var oldValue []byte
+	var ok bool
+	err := ns.withRoom(func() (err error) {
+		oldValue, ok, err = ns.segmentOf(key).getSet(key, value, secondsTTL(ttl))
+		return err
+	})
+	return oldValue, ok, err
+}
+
+// GetAndDelete 删除 key 并返回删除之前的值，key 不存在时返回 false
+func (ns *Namespace) GetAndDelete(key string) ([]byte, bool, error) {
+	return ns.segmentOf(key).getAndDelete(key)
+}
+
+// GetWithVersion 返回 key 对应的值和版本号，版本号可以用于 CompareAndSet
+func (ns *Namespace) GetWithVersion(key string) ([]byte, uint64, bool) {
+	return ns.segmentOf(key).getWithVersion(key)
+}
+
+// Peek 返回 key 对应的值、有效期和版本号，有效期的格式和 Range 相同
+// 和 Get 不同，Peek 不算作一次访问，不会推迟滑动有效期，也不会影响淘汰的顺序，用于把数据同步给其他节点
+func (ns *Namespace) Peek(key string) ([]byte, Expiration, uint64, bool) {
+	return ns.segmentOf(key).peek(key)
+}
+
+// CompareAndSet 只有在 key 当前的版本号等于 expectedVersion 时才写入 value，成功时返回新的版本号
+// 版本号不一致时返回当前的版本号和错误。key 不存在时版本号是 0，所以 expectedVersion 为 0 表示只有 key 不存在时才写入
+func (ns *Namespace) CompareAndSet(key string, value []byte, expectedVersion uint64, ttl int64) (uint64, error) {
+	var version uint64
+	err := ns.withRoom(func() (err error) {
+		version, err = ns.segmentOf(key).compareAndSet(key, value, expectedVersion, secondsTTL(ttl))
+		return err
+	})
+	return version, err
+}
+
+// CompareAndDelete 只有在 key 当前的版本号等于 expectedVersion 时才删除，返回是否删除
+// 可以和 RangeWithVersion 一起使用，避免删除掉遍历之后才写入的新值
+func (ns *Namespace) CompareAndDelete(key string, expectedVersion uint64) (bool, error) {
+	return ns.segmentOf(key).compareAndDelete(key, expectedVersion)
+}
+
+// SetIfNewer 写入其他节点同步过来的键值对，version 是它在原来节点上的版本号，返回是否写入
+// 只有在 key 不存在、已经过期或者当前的版本号不比 version 新时才写入，所以迁移和同步过来的旧数据不会覆盖新的数据
+// 写入的值保留 version 作为版本号，之后在当前节点上的写入会分配比它更大的版本号
+func (ns *Namespace) SetIfNewer(key string, value []byte, expiration Expiration, version uint64) (bool, error) {
+	var ok bool
+	err := ns.withRoom(func() (err error) {
+		ok, err = ns.segmentOf(key).setIfNewer(key, value, expiration, version)
+		return err
+	})
+	return ok, err
+}
+
+// IsVersionMismatch 判断 err 是不是 CompareAndSet 因为版本号不一致返回的错误
+func IsVersionMismatch(err error) bool {
+	return err == versionMismatchErr
+}
+
+// Increment 将 key 对应的整数原子地加上 delta，并返回相加之后的结果，delta 为负数时就是自减
+// 整数使用十进制字符串存储，所以 Get 到的也是十进制字符串。key 不存在或者已经过期时从 0 开始
+// 和 SetWithTTL 一样，结果会使用 ttl 作为新的有效期
+func (ns *Namespace) Increment(key string, delta int64, ttl int64) (int64, error) {
+	var result int64
+	err := ns.withRoom(func() (err error) {
+		result, err = ns.segmentOf(key).increment(key, delta, secondsTTL(ttl))
+		return err
+	})
+	return result, err
+}
+
+// GetMany 返回 keys 中存在并且没有过期的键值对，每个 segment 只会加一次锁
+func (ns *Namespace) GetMany(keys []string) map[string][]byte {
+	values := make(map[string][]byte, len(keys))
+	for segment, segmentKeys := range ns.groupKeys(keys) {
+		segment.getMany(segmentKeys, values)
+	}
+	return values
+}
+
+func (ns *Namespace) SetMany(entries map[string][]byte) error {
+	return ns.SetManyWithTTL(entries, NeverDie)
+}
+
+// SetManyWithTTL 使用同样的有效期写入 entries 中所有的键值对，每个 segment 只会加一次锁
+// 某个键值对写入失败不会影响其他键值对，返回的是第一个错误
+func (ns *Namespace) SetManyWithTTL(entries map[string][]byte, ttl int64) error {
+	groups := map[*segment]map[string][]byte{}
+	for key, value := range entries {
+		segment := ns.segmentOf(key)
+		if groups[segment] == nil {
+			groups[segment] = map[string][]byte{}
+		}
+		groups[segment][key] = value
+	}
+
+	var firstErr error
+	for segment, segmentEntries := range groups {
+		err := ns.withRoom(func() error {
+			return segment.setMany(segmentEntries, secondsTTL(ttl))
+		})
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// DeleteMany 删除 keys 中所有的 key，每个 segment 只会加一次锁
+func (ns *Namespace) DeleteMany(keys []string) error {
+	for segment, segmentKeys := range ns.groupKeys(keys) {
+		if err := segment.deleteMany(segmentKeys); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// groupKeys 将 keys 按照所属的 segment 分组
+func (ns *Namespace) groupKeys(keys []string) map[*segment][]string {
+	groups := map[*segment][]string{}
+	for _, key := range keys {
+		segment := ns.segmentOf(key)
+		groups[segment] = append(groups[segment], key)
+	}
+	return groups
+}
+
+// Range 依次将缓存中没有过期的键值对交给 fn 处理，expiration 是剩余的有效期，fn 返回 false 时停止遍历
+// 固定有效期会被转换成过期的时间点，滑动有效期仍然是完整的有效期
+// 遍历是在每个 segment 的快照上进行的，所以不会长时间阻塞读写，但也不保证能看到遍历期间的修改
+func (ns *Namespace) Range(fn func(key string, value []byte, expiration Expiration) bool) {
+	ns.RangeWithVersion(func(key string, value []byte, expiration Expiration, version uint64) bool {
+		return fn(key, value, expiration)
+	})
+}
+
+// RangeWithVersion 和 Range 一样，但是同时会将键值对在快照中的版本号交给 fn
+func (ns *Namespace) RangeWithVersion(fn func(key string, value []byte, expiration Expiration, version uint64) bool) {
+	for _, segment := range ns.segments {
+		stopped := false
+		segment.snapshot().data.each(func(key string, value *value) bool {
+			if !value.alive() {
+				return true
+			}
+			// 数据损坏的键值对没办法交给 fn，跳过就可以了
+			if data, err := value.bytes(); err == nil && !fn(key, data, value.expiration(), value.Version) {
+				stopped = true
+			}
+			return !stopped
+		})
+		if stopped {
+			return
+		}
+	}
+}
+
+// restore 将 v 原样存入 key 所在的 segment，用于从持久化文件和日志中恢复数据
+func (ns *Namespace) restore(key string, v *value) error {
+	return ns.withRoom(func() error {
+		return ns.segmentOf(key).restore(key, v)
+	})
+}
+
+// withRoom 执行写入操作 write，key 所在的 segment 没有可以淘汰的数据时，轮流从其他 segment 中淘汰数据之后重试
+// 写入的 segment 持有写锁时不能去锁其他 segment，否则两个 segment 同时这么做会死锁，所以淘汰是在释放锁之后进行的
+// 共用内存额度的所有命名空间都没有可以淘汰的数据时才拒绝写入
+func (ns *Namespace) withRoom(write func() error) error {
+	for {
+		err := write()
+		if err != segmentFullErr {
+			return err
+		}
+		if !ns.evictRound() {
+			return entrySizeExceededErr
+		}
+	}
+}
+
+// evictRound 从共用内存额度的每个命名空间的每个 segment 中各淘汰一个键值对，所有 segment 都没有淘汰掉数据时返回 false
+func (ns *Namespace) evictRound() bool {
+	evicted := false
+	for _, namespace := range ns.group() {
+		for _, segment := range namespace.segments {
+			if segment.evictOne() {
+				evicted = true
+			}
+		}
+	}
+	return evicted
+}
+
+// Status 返回命名空间的状态
+func (ns *Namespace) Status() Status {
+	result := NewStatus()
+	for _, segment := range ns.segments {
+		result.merge(segment.status())
+	}
+	result.MaxMemory = ns.memory.limit
+	result.HighWatermark = ns.memory.high
+	result.LowWatermark = ns.memory.low
+	return *result
+}
+
+// flush 清空命名空间中所有的数据
+// 清空期间会按顺序持有所有 segment 的写锁，这样日志中的清空记录和其他修改记录的先后顺序才是正确的
+func (ns *Namespace) flush() error {
+	for _, segment := range ns.segments {
+		segment.lock.Lock()
+		defer segment.lock.Unlock()
+	}
+	if err := ns.segments[0].aof.appendFlush(ns.name); err != nil {
+		return err
+	}
+	for _, segment := range ns.segments {
+		segment.clear()
+	}
+	return nil
+}
+
+// gc 清理命名空间中过期的数据，每个 segment 的清理工作量都是有上限的，所以依次清理就可以了
+// 清理之后内存仍然超过高水位的话，会淘汰数据直到低于低水位
+func (ns *Namespace) gc() {
+	for _, segment := range ns.segments {
+		segment.gc()
+	}
+	ns.reclaim()
+}
+
+// reclaim 在内存超过高水位时轮流从每个 segment 中淘汰一个键值对，直到低于低水位，每次只持有一个 segment 的写锁
+// 共用内存额度时会轮流从所有共用的命名空间中淘汰，淘汰的顺序只在 segment 内部遵循淘汰策略，所有 segment 都没有可以淘汰的数据时停止
+func (ns *Namespace) reclaim() {
+	if ns.memory.usage() <= ns.memory.high {
+		return
+	}
+	group := ns.group()
+	for {
+		evicted := false
+		for _, namespace := range group {
+			for _, segment := range namespace.segments {
+				if ns.memory.usage() <= ns.memory.low {
+					return
+				}
+				if segment.evictOne() {
+					evicted = true
+				}
+			}
+		}
+		if !evicted {
+			return
+		}
+	}
+}
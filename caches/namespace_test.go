@@ -0,0 +1,132 @@
+package caches
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestNamespaceIsolation(t *testing.T) {
+	options := newAofTestOptions(t)
+	options.EvictionPolicy = NoEviction
+	options.Namespaces = map[string]int64{"small": 0}
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	teamA := cache.NamespaceOf("team-a")
+	cache.Set("key", []byte("default"))
+	teamA.Set("key", []byte("team-a"))
+	teamA.Set("other", []byte("team-a"))
+	if value, ok := cache.Get("key"); !ok || string(value) != "default" {
+		t.Fatalf("key in default namespace should be default but got %s, %v", value, ok)
+	}
+	if value, ok := teamA.Get("key"); !ok || string(value) != "team-a" {
+		t.Fatalf("key in team-a should be team-a but got %s, %v", value, ok)
+	}
+	if count := cache.Status().Count; count != 3 {
+		t.Fatalf("count of all namespaces should be 3 but got %d", count)
+	}
+
+	// small 的容量限制是 0，写入会失败，但是不会影响其他命名空间
+	if err = cache.NamespaceOf("small").Set("key", []byte("small")); err == nil {
+		t.Fatal("setting a namespace without capacity should fail")
+	}
+
+	if err = cache.FlushNamespace("team-a"); err != nil {
+		t.Fatal(err)
+	}
+	if count := teamA.Status().Count; count != 0 {
+		t.Fatalf("team-a should be empty after flushing but got %d", count)
+	}
+	teamA.Set("after", []byte("flush"))
+	if _, ok := cache.Get("key"); !ok {
+		t.Fatal("flushing team-a should not affect default namespace")
+	}
+
+	// 日志中的清空记录和持久化文件中的命名空间都要能恢复
+	recovered, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := recovered.NamespaceOf("team-a").Get("key"); ok {
+		t.Fatal("key in team-a should be flushed after replaying aof")
+	}
+	if err = recovered.dump(); err != nil {
+		t.Fatal(err)
+	}
+	recovered.aof.close()
+
+	recovered, err = OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := recovered.NamespaceOf("team-a").Get("after"); !ok || string(value) != "flush" {
+		t.Fatalf("after in team-a should be flush but got %s, %v", value, ok)
+	}
+	if value, ok := recovered.Get("key"); !ok || string(value) != "default" {
+		t.Fatalf("key in default namespace should be default but got %s, %v", value, ok)
+	}
+	if names := len(recovered.Namespaces()); names != 3 {
+		t.Fatalf("there should be 3 namespaces but got %d", names)
+	}
+}
+
+func TestNamespacesShareMemory(t *testing.T) {
+	entrySize := int64(entryOverhead + len("key-00") + 100)
+	options := DefaultOptions()
+	options.SegmentSize = 4
+	options.MaxEntrySize = 8 * entrySize
+	options.EvictionPolicy = NoEviction
+	options.Namespaces = map[string]int64{"own": 4 * entrySize}
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 自动创建的命名空间和默认的命名空间加起来只能使用 MaxEntrySize
+	value := make([]byte, 100)
+	for i := 0; i < 8; i++ {
+		namespace := cache.NamespaceOf(fmt.Sprintf("team-%d", i))
+		if err = namespace.Set(fmt.Sprintf("key-%02d", i), value); err != nil {
+			t.Fatalf("key-%02d should be set: %v", i, err)
+		}
+	}
+	if err = cache.Set("key-08", value); err == nil {
+		t.Fatal("set should fail when shared memory is full")
+	}
+	if err = cache.NamespaceOf("team-8").Set("key-08", value); err == nil {
+		t.Fatal("a new namespace should not get its own memory")
+	}
+
+	// 单独配置的命名空间有自己的额度，不受影响
+	if err = cache.NamespaceOf("own").Set("key-00", value); err != nil {
+		t.Fatal(err)
+	}
+	status := cache.Status()
+	if status.MemorySize != 9*entrySize || status.MaxMemory != 12*entrySize {
+		t.Fatalf("wrong memory status %+v", status)
+	}
+
+	// 共用额度写满之后会从其他命名空间中淘汰数据
+	options.EvictionPolicy = LRU
+	options.Namespaces = nil
+	cache, err = OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 8; i++ {
+		if err = cache.NamespaceOf("team-a").Set(fmt.Sprintf("key-%02d", i), value); err != nil {
+			t.Fatalf("key-%02d should be set: %v", i, err)
+		}
+	}
+	if err = cache.NamespaceOf("team-b").Set("key-08", value); err != nil {
+		t.Fatalf("team-b should evict entries of team-a: %v", err)
+	}
+	if count := cache.NamespaceOf("team-a").Status().Count; count >= 8 {
+		t.Fatalf("some entries of team-a should be evicted but got %d", count)
+	}
+	if status := cache.Status(); status.MemorySize > 8*entrySize {
+		t.Fatalf("memory of all namespaces should not exceed %d but got %d", 8*entrySize, status.MemorySize)
+	}
+}
@@ -1,12 +1,15 @@
 package caches
 
 type Options struct {
-	// MaxEntrySize 键值对最大容量
-	MaxEntrySize int
-	// MaxGcCount 至每个segment 要清理的过期数据个数
+	// MaxEntrySize 键值对可以使用的内存上限，单位是字节，包括每个键值对的额外开销，可以使用 ParseSize 解析带单位的容量
+	MaxEntrySize int64
+	// HighWatermark 和 LowWatermark 是相对 MaxEntrySize 的百分比，内存超过高水位时后台会淘汰数据直到低于低水位
+	HighWatermark int
+	LowWatermark  int
+	// MaxGcCount 每次清理时每个 segment 最多检查的过期数据个数
 	MaxGcCount int
-	// GcDuration 多久执行一次 Gc 工作
-	GcDuration int64
+	// GcInterval 多久执行一次清理工作，单位是毫秒，每次只清理已经过期的数据，所以间隔越短过期的数据被清理得越及时
+	GcInterval int64
 
 	// DumpFile 持久化文件路径
 	DumpFile string
@@ -16,22 +19,62 @@ type Options struct {
 	// MapSizeOfSegment segment 中map的初始化大小
 	MapSizeOfSegment int
 
+	// StorageEngine 键值对的存储方式，支持 map, arena，键值对很多时使用 arena 可以减轻垃圾回收的压力
+	StorageEngine string
+	// ArenaSizeOfSegment 使用 arena 存储时每个 segment 预先分配的空间，单位是字节，放不下时会自动扩容
+	ArenaSizeOfSegment int64
+
 	// SegmentSize 缓存中有多少个segment
 	SegmentSize int
 
+	// AofFile 日志文件路径，为空时表示不开启日志
+	AofFile string
+	// AofFsync 日志同步到磁盘的策略，支持 always, everysec, never
+	AofFsync string
+	// AofRewriteSize 日志超过这个大小就提前重写，单位是 MB，为 0 时只在持久化时重写
+	AofRewriteSize int64
+
+	// Compression 数据的压缩方式，支持 none, gzip, flate，只会压缩不小于 CompressionThreshold 字节的数据
+	// 读取时会自动解压，修改压缩方式之后，已经压缩过的数据仍然可以正常读取
+	Compression          string
+	CompressionThreshold int
+
+	// EncryptionKeyFile 加密持久化文件和日志使用的密钥文件，每行是 编号=十六进制的密钥，第一个密钥用于加密，其他的只用于解密旧文件
+	// EncryptionKeyEnv 是保存密钥的环境变量名，格式和密钥文件相同，多个密钥之间也可以使用逗号分隔，两个都为空时表示不加密
+	EncryptionKeyFile string
+	EncryptionKeyEnv  string
+
+	// EvictionPolicy 容量不足时的淘汰策略，支持 none, lru, lfu, fifo，默认为 none，和以前一样容量满了之后拒绝写入
+	EvictionPolicy string
+
+	// Namespaces 需要单独设置容量限制的命名空间，值是这个命名空间键值对的内存上限，单位和 MaxEntrySize 相同
+	// 没有配置的命名空间在第一次使用时创建，它们和默认的命名空间共用 MaxEntrySize 的内存额度
+	Namespaces map[string]int64
+
 	// CasSleepTime 每次CAS 自选需要等待时间 单位微妙
+	// Deprecated: 持久化不再阻塞读写操作，这个选项已经没有作用了，只是为了兼容以前的代码而保留
 	CasSleepTime int
 }
 
 func DefaultOptions() Options {
 	return Options{
-		MaxEntrySize:     4,
-		MaxGcCount:       10,
-		GcDuration:       60,
-		DumpFile:         "kafo.dump",
-		DumpDuration:     30,
-		MapSizeOfSegment: 256,
-		SegmentSize:      1024,
-		CasSleepTime:     1000,
+		MaxEntrySize:         4 << 30,
+		HighWatermark:        90,
+		LowWatermark:         80,
+		MaxGcCount:           20,
+		GcInterval:           100,
+		DumpFile:             "kafo.dump",
+		DumpDuration:         30,
+		MapSizeOfSegment:     256,
+		StorageEngine:        MapStorage,
+		ArenaSizeOfSegment:   64 << 10,
+		SegmentSize:          1024,
+		AofFile:              "",
+		AofFsync:             FsyncEverySecond,
+		AofRewriteSize:       64,
+		Compression:          NoCompression,
+		CompressionThreshold: 1024,
+		EvictionPolicy:       NoEviction,
+		Namespaces:           map[string]int64{},
 	}
 }
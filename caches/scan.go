@@ -0,0 +1,111 @@
+package caches
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"path"
+	"sort"
+)
+
+var (
+	// invalidCursorErr 意味着游标不是 Scan 返回的
+	invalidCursorErr = errors.New("invalid scan cursor")
+)
+
+// scanCursor 记录了扫描的位置，segment 是正在扫描的 segment 下标，lastKey 是这个 segment 中最后返回的 key
+// 每个 segment 中的 key 都按照字典序返回，所以从 lastKey 之后继续扫描，就能保证扫描期间一直存在的 key 都恰好返回一次
+// 空字符串也是合法的 key，所以使用 started 区分是从 segment 的开头扫描，还是从空字符串这个 key 之后扫描
+type scanCursor struct {
+	segment int
+	lastKey string
+	started bool
+}
+
+// encode 将游标编码成字符串，扫描结束时返回空字符串
+func (sc *scanCursor) encode() string {
+	data := make([]byte, 4, 5+len(sc.lastKey))
+	binary.BigEndian.PutUint32(data, uint32(sc.segment))
+	if sc.started {
+		data = append(data, 1)
+	} else {
+		data = append(data, 0)
+	}
+	data = append(data, sc.lastKey...)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// decodeScanCursor 解析游标，空字符串表示从头开始扫描
+func decodeScanCursor(cursor string, segmentSize int) (*scanCursor, error) {
+	if cursor == "" {
+		return &scanCursor{}, nil
+	}
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil || len(data) < 5 || data[4] > 1 || (data[4] == 0 && len(data) > 5) {
+		return nil, invalidCursorErr
+	}
+	segment := int(binary.BigEndian.Uint32(data))
+	if segment >= segmentSize {
+		return nil, invalidCursorErr
+	}
+	return &scanCursor{segment: segment, lastKey: string(data[5:]), started: data[4] == 1}, nil
+}
+
+// Scan 从 cursor 的位置开始扫描匹配 pattern 的 key，最多返回 count 个，同时返回下一次扫描使用的游标
+// cursor 为空字符串表示从头开始，返回的游标为空字符串表示扫描结束。pattern 的语法和 path.Match 一样，为空时匹配所有的 key
+// 扫描是逐个 segment 进行的，同一时间只会持有一个 segment 的读锁。扫描期间一直存在的 key 都会返回，并且只返回一次，
+// 扫描期间新增或者删除的 key 可能返回也可能不返回
+func (ns *Namespace) Scan(cursor string, pattern string, count int) ([]string, string, error) {
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, "", err
+		}
+	}
+	position, err := decodeScanCursor(cursor, len(ns.segments))
+	if err != nil {
+		return nil, "", err
+	}
+	if count <= 0 {
+		count = 1
+	}
+
+	keys := make([]string, 0, count)
+	for ; position.segment < len(ns.segments); position.segment++ {
+		// 已经扫描到足够的 key 了，下一次从这个 segment 的开头继续
+		if len(keys) >= count {
+			return keys, position.encode(), nil
+		}
+		segmentKeys := ns.segments[position.segment].keysAfter(position.lastKey, position.started, pattern)
+		if remaining := count - len(keys); len(segmentKeys) > remaining {
+			keys = append(keys, segmentKeys[:remaining]...)
+			position.lastKey = keys[len(keys)-1]
+			position.started = true
+			return keys, position.encode(), nil
+		}
+		keys = append(keys, segmentKeys...)
+		position.lastKey = ""
+		position.started = false
+	}
+	return keys, "", nil
+}
+
+// keysAfter 按照字典序返回所有没有过期并且匹配 pattern 的 key，started 为 true 时只返回大于 lastKey 的 key
+func (s *segment) keysAfter(lastKey string, started bool, pattern string) []string {
+	s.lock.RLock()
+	keys := make([]string, 0, s.data.len())
+	s.data.each(func(key string, value *value) bool {
+		if (started && key <= lastKey) || !value.alive() {
+			return true
+		}
+		if pattern != "" {
+			if matched, _ := path.Match(pattern, key); !matched {
+				return true
+			}
+		}
+		keys = append(keys, key)
+		return true
+	})
+	s.lock.RUnlock()
+	sort.Strings(keys)
+	return keys
+}
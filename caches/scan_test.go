@@ -0,0 +1,80 @@
+package caches
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestCacheScan(t *testing.T) {
+	options := DefaultOptions()
+	options.SegmentSize = 16
+	cache, err := OpenCacheWith(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 1000; i++ {
+		cache.Set("user:"+strconv.Itoa(i), []byte("v"))
+		cache.Set("order:"+strconv.Itoa(i), []byte("v"))
+	}
+
+	// 扫描期间删除一部分 key，没有被删除的 key 都应该恰好返回一次
+	seen := map[string]int{}
+	cursor := ""
+	for round := 0; ; round++ {
+		keys, next, err := cache.Scan(cursor, "user:*", 37)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) > 37 {
+			t.Fatalf("scan should return at most 37 keys but got %d", len(keys))
+		}
+		for _, key := range keys {
+			seen[key]++
+		}
+		if round == 3 {
+			for i := 0; i < 100; i++ {
+				cache.Delete("user:" + strconv.Itoa(i))
+			}
+		}
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+
+	for i := 100; i < 1000; i++ {
+		if key := "user:" + strconv.Itoa(i); seen[key] != 1 {
+			t.Fatalf("%s should be returned exactly once but got %d", key, seen[key])
+		}
+	}
+	for key, times := range seen {
+		if times != 1 {
+			t.Fatalf("%s should be returned at most once but got %d", key, times)
+		}
+		if key[:5] != "user:" {
+			t.Fatalf("%s should not match the pattern", key)
+		}
+	}
+
+	// 每次扫描的个数恰好用完时，下一次扫描需要从下一个 segment 的开头继续
+	total := 0
+	cursor = ""
+	for {
+		keys, next, err := cache.Scan(cursor, "", 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		total += len(keys)
+		if next == "" {
+			break
+		}
+		cursor = next
+	}
+	if total != 1900 {
+		t.Fatalf("scan should return 1900 keys but got %d", total)
+	}
+
+	if _, _, err = cache.Scan("not a cursor!", "", 10); err != invalidCursorErr {
+		t.Fatalf("scan with a bad cursor should fail with %v but got %v", invalidCursorErr, err)
+	}
+}
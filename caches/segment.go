@@ -2,90 +2,590 @@ package caches
 
 import (
 	"errors"
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
+)
+
+var (
+	// entrySizeExceededErr 意味着写入这个键值对之后会超出内存上限
+	entrySizeExceededErr = errors.New("the entry size will exceed if you set this entry")
+	// notIntegerErr 意味着 key 对应的值不是十进制整数，不能进行自增
+	notIntegerErr = errors.New("value is not an integer")
+	// integerOverflowErr 意味着自增之后的结果超出了 int64 的范围
+	integerOverflowErr = errors.New("increment or decrement would overflow")
+	// versionMismatchErr 意味着 key 当前的版本号和期望的不一致，说明在这期间已经被修改过了
+	versionMismatchErr = errors.New("version mismatch")
+	// segmentFullErr 意味着 segment 中已经没有可以淘汰的数据了，命名空间会尝试从其他 segment 中淘汰数据之后重试
+	segmentFullErr = errors.New("no entry left to evict in this segment")
 )
 
 type segment struct {
-	Data    map[string]*value
+	// data 存储了 segment 中所有的键值对，存储方式由 Options.StorageEngine 决定
+	data    storage
 	Status  *Status
 	options *Options
 	lock    *sync.RWMutex
+	// evictor 记录 key 的访问情况，容量不足时用来选出需要淘汰的 key
+	evictor evictor
+	// aof 记录修改操作的日志，为 nil 时表示没有开启日志
+	aof *aof
+	// versions 是分配版本号的计数器，同一个缓存的所有 segment 共用一个计数器
+	versions *uint64
+	// namespace 是 segment 所属的命名空间，记录日志时需要
+	namespace string
+	// events 用于发布 key 变化的事件，为 nil 时表示不发布事件
+	events *EventBus
+	// expiries 按照过期时间记录了所有会过期的 key，用于主动清理过期的数据
+	expiries *expiryHeap
+	// memory 是 segment 可以使用的内存额度，同一个命名空间的所有 segment 共用一个额度
+	memory *memoryBudget
 }
 
 func newSegment(options *Options) *segment {
 	return &segment{
-		Data:    make(map[string]*value, options.MapSizeOfSegment),
-		Status:  NewStatus(),
-		options: options,
-		lock:    &sync.RWMutex{},
+		data:      newStorage(options),
+		Status:    NewStatus(),
+		options:   options,
+		lock:      &sync.RWMutex{},
+		evictor:   newEvictor(options.EvictionPolicy),
+		versions:  newVersions(),
+		namespace: DefaultNamespace,
+		expiries:  newExpiryHeap(),
+		memory:    newMemoryBudget(options),
 	}
 }
 
 func (s *segment) get(key string) ([]byte, bool) {
+	data, _, ok := s.getWithVersion(key)
+	return data, ok
+}
+
+// getWithVersion 返回 key 对应的值和版本号
+func (s *segment) getWithVersion(key string) ([]byte, uint64, bool) {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	value, ok := s.Data[key]
+	value, ok := s.data.get(key)
 	if !ok {
-		return nil, false
+		return nil, 0, false
 	}
 	if !value.alive() {
 		s.lock.RUnlock()
-		s.delete(key)
+		s.expire([]string{key})
 		s.lock.RLock()
+		return nil, 0, false
+	}
+	s.evictor.access(key)
+	data, err := value.visit()
+	s.data.touch(key, value)
+	if err != nil {
+		return nil, 0, false
+	}
+	return data, value.Version, true
+}
+
+// peek 返回 key 对应的值、有效期和版本号，和 getWithVersion 不同，不算作一次访问，不会推迟滑动有效期
+func (s *segment) peek(key string) ([]byte, Expiration, uint64, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	value, ok := s.aliveValueOf(key)
+	if !ok {
+		return nil, Expiration{}, 0, false
+	}
+	data, err := value.bytes()
+	if err != nil {
+		return nil, Expiration{}, 0, false
+	}
+	return data, value.expiration(), value.Version, true
+}
+
+// newValue 使用 data 创建 value，超过 CompressionThreshold 的数据会按照 Options.Compression 压缩
+// 压缩比较耗时，所以应该在加锁之前调用
+func (s *segment) newValue(data []byte, expiration Expiration) *value {
+	compression := compressions[s.options.Compression]
+	if compression == rawData || len(data) < s.options.CompressionThreshold {
+		return newValue(data, expiration)
+	}
+	compressed, ok := compress(data, compression)
+	if !ok {
+		return newValue(data, expiration)
+	}
+	v := &value{
+		Data:        compressed,
+		Compression: compression,
+	}
+	v.setExpiration(expiration)
+	return v
+}
+
+func (s *segment) set(key string, value []byte, expiration Expiration) error {
+	v := s.newValue(value, expiration)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.store(key, v)
+}
+
+// increment 将 key 对应的整数加上 delta，key 不存在或者已经过期时从 0 开始
+// 读取和写入都在写锁中完成，所以并发的自增不会丢失
+func (s *segment) increment(key string, delta int64, expiration Expiration) (int64, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	current := int64(0)
+	if oldValue, ok := s.aliveValueOf(key); ok {
+		data, err := oldValue.bytes()
+		if err != nil {
+			return 0, err
+		}
+		number, err := strconv.ParseInt(string(data), 10, 64)
+		if err != nil {
+			return 0, notIntegerErr
+		}
+		current = number
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return 0, integerOverflowErr
+	}
+
+	// 整数最多只有 20 个字节，不需要压缩
+	result := current + delta
+	if err := s.store(key, newValue([]byte(strconv.FormatInt(result, 10)), expiration)); err != nil {
+		return 0, err
+	}
+	return result, nil
+}
+
+// compareAndSet 只有在 key 当前的版本号等于 expectedVersion 时才写入，返回新的版本号
+// key 不存在或者已经过期时版本号是 0，所以 expectedVersion 为 0 表示只有 key 不存在时才写入
+func (s *segment) compareAndSet(key string, value []byte, expectedVersion uint64, expiration Expiration) (uint64, error) {
+	v := s.newValue(value, expiration)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	currentVersion := uint64(0)
+	if oldValue, ok := s.aliveValueOf(key); ok {
+		currentVersion = oldValue.Version
+	}
+	if currentVersion != expectedVersion {
+		return currentVersion, versionMismatchErr
+	}
+	if err := s.store(key, v); err != nil {
+		return 0, err
+	}
+	return v.Version, nil
+}
+
+// setNX 只有在 key 不存在或者已经过期时才写入，返回是否写入
+func (s *segment) setNX(key string, value []byte, expiration Expiration) (bool, error) {
+	v := s.newValue(value, expiration)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.aliveValueOf(key); ok {
+		return false, nil
+	}
+	return true, s.store(key, v)
+}
+
+// setXX 只有在 key 存在并且没有过期时才写入，返回是否写入
+func (s *segment) setXX(key string, value []byte, expiration Expiration) (bool, error) {
+	v := s.newValue(value, expiration)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if _, ok := s.aliveValueOf(key); !ok {
+		return false, nil
+	}
+	return true, s.store(key, v)
+}
+
+// getSet 写入新的值并返回旧的值，旧的值不存在时返回 false
+func (s *segment) getSet(key string, value []byte, expiration Expiration) ([]byte, bool, error) {
+	v := s.newValue(value, expiration)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldValue, ok := s.aliveValueOf(key)
+	if err := s.store(key, v); err != nil {
+		return nil, false, err
+	}
+	if !ok {
+		return nil, false, nil
+	}
+	data, err := oldValue.bytes()
+	return data, err == nil, err
+}
+
+// getAndDelete 删除 key 并返回删除之前的值，key 不存在时返回 false
+func (s *segment) getAndDelete(key string) ([]byte, bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldValue, ok := s.aliveValueOf(key)
+	if !ok {
+		return nil, false, nil
+	}
+	if err := s.remove(key); err != nil {
+		return nil, false, err
+	}
+	data, err := oldValue.bytes()
+	return data, err == nil, err
+}
+
+// compareAndDelete 只有在 key 当前的版本号等于 expectedVersion 时才删除，返回是否删除
+func (s *segment) compareAndDelete(key string, expectedVersion uint64) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldValue, ok := s.aliveValueOf(key)
+	if !ok || oldValue.Version != expectedVersion {
+		return false, nil
+	}
+	if err := s.remove(key); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// ttl 返回 key 剩余的有效期，单位是毫秒，NeverDie 表示永不过期，key 不存在时返回 false
+// 查询有效期不算是访问，所以不会延长滑动有效期
+func (s *segment) ttl(key string) (int64, bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	v, ok := s.aliveValueOf(key)
+	if !ok {
+		return 0, false
+	}
+	return v.remainingTtl()
+}
+
+// setExpiration 将 key 的有效期修改为 expiration，值和版本号都不会改变，key 不存在时返回 false
+func (s *segment) setExpiration(key string, expiration Expiration) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	oldValue, ok := s.aliveValueOf(key)
+	if !ok {
+		return false, nil
+	}
+	v := oldValue.copy()
+	v.setExpiration(expiration)
+	if err := s.aof.appendSet(s.namespace, key, v); err != nil {
+		return false, err
+	}
+	// 修改有效期最多只会让占用的内存变化 expiryOverhead，所以不会为此淘汰数据
+	s.Status.subEntry(key, oldValue, s.release(key, oldValue))
+	s.Status.addEntry(key, v, s.take(key, v))
+	s.data.set(key, v)
+	s.expiries.update(key, v.Expire)
+	return true, nil
+}
+
+// aliveValueOf 返回 key 对应的没有过期的值，调用方需要持有锁
+func (s *segment) aliveValueOf(key string) (*value, bool) {
+	v, ok := s.data.get(key)
+	if !ok || !v.alive() {
 		return nil, false
 	}
-	return value.visit(), true
+	return v, true
 }
 
-func (s *segment) set(key string, value []byte, ttl int64) error {
+// restore 将恢复出来的 v 存入 segment，用于回放日志
+func (s *segment) restore(key string, v *value) error {
+	v.Version = restoredVersion
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if oldValue, ok := s.Data[key]; ok {
-		s.Status.subEntry(key, oldValue.Data)
+	return s.store(key, v)
+}
+
+// setIfNewer 只有在 key 不存在、已经过期或者当前的版本号不比 version 新时才写入，写入的值保留 version 作为版本号，返回是否写入
+// 版本号相同说明是同一次写入，重新写入一次只会更新有效期
+func (s *segment) setIfNewer(key string, value []byte, expiration Expiration, version uint64) (bool, error) {
+	v := s.newValue(value, expiration)
+	v.Version = version
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if oldValue, ok := s.aliveValueOf(key); ok && oldValue.Version > version {
+		return false, nil
+	}
+	return true, s.store(key, v)
+}
+
+// store 将 key 和 v 存入 segment，调用方需要持有写锁
+func (s *segment) store(key string, v *value) error {
+	// 单个键值对就超过了内存上限，淘汰再多数据也放不下
+	size := entrySizeOf(s.data, key, v)
+	if size > s.memory.limit {
+		return entrySizeExceededErr
+	}
+
+	// 覆盖已有的 key 时 key 会留在 evictor 中，这样它的访问记录不会丢失，写入失败时也不需要恢复
+	oldValue, exists := s.data.get(key)
+	if exists {
+		s.Status.subEntry(key, oldValue, s.release(key, oldValue))
+	}
+	rollback := func() {
+		if exists {
+			s.Status.addEntry(key, oldValue, s.take(key, oldValue))
+		}
 	}
 
-	if !s.checkEntrySize(key, value) {
-		if oldValue, ok := s.Data[key]; ok {
-			s.Status.addEntry(key, oldValue.Data)
+	// 内存不足时按照淘汰策略淘汰这个 segment 中的数据，直到可以放下新的键值对
+	// 这里持有写锁，不能再去锁其他 segment，所以这个 segment 淘汰完之后交给命名空间从其他 segment 中淘汰
+	// 正在覆盖的 key 被选中说明这个 segment 中没有比它更应该淘汰的数据了，同样交给命名空间处理
+	for !s.memory.reserve(size) {
+		victim, ok := s.evictor.victim()
+		if !ok || victim == key {
+			rollback()
+			return segmentFullErr
 		}
-		return errors.New("the entry size will exceed if you set this entry")
+		if err := s.evict(victim); err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	// 先写日志再修改数据，日志写入失败的话这次修改就是失败的
+	if err := s.aof.appendSet(s.namespace, key, v); err != nil {
+		s.memory.release(size)
+		rollback()
+		return err
 	}
-	s.Status.addEntry(key, value)
-	s.Data[key] = newValue(value, ttl)
+	s.Status.addEntry(key, v, size)
+	if v.Version == 0 {
+		v.Version = nextVersion(s.versions)
+	} else {
+		observeVersion(s.versions, v.Version)
+	}
+	s.data.set(key, v)
+	s.evictor.add(key)
+	s.expiries.update(key, v.Expire)
+	s.publish(SetEvent, key)
 	return nil
 }
 
-func (s *segment) delete(key string) {
+// take 不管是否超出上限都占用键值对需要的内存，返回占用的字节数
+func (s *segment) take(key string, v *value) int64 {
+	size := entrySizeOf(s.data, key, v)
+	s.memory.take(size)
+	return size
+}
+
+// release 释放键值对占用的内存，返回释放的字节数
+func (s *segment) release(key string, v *value) int64 {
+	size := entrySizeOf(s.data, key, v)
+	s.memory.release(size)
+	return size
+}
+
+// publish 发布 key 的事件
+func (s *segment) publish(reason string, key string) {
+	s.events.publish(Event{Reason: reason, Namespace: s.namespace, Key: key})
+}
+
+// getMany 将 keys 中存在的键值对放入 values，整个过程只持有一次读锁
+func (s *segment) getMany(keys []string, values map[string][]byte) {
+	var expired []string
+	s.lock.RLock()
+	for _, key := range keys {
+		value, ok := s.data.get(key)
+		if !ok {
+			continue
+		}
+		if !value.alive() {
+			expired = append(expired, key)
+			continue
+		}
+		s.evictor.access(key)
+		data, err := value.visit()
+		s.data.touch(key, value)
+		if err == nil {
+			values[key] = data
+		}
+	}
+	s.lock.RUnlock()
+
+	// 过期的数据需要写锁才能删除，所以放到最后统一处理
+	if len(expired) > 0 {
+		s.expire(expired)
+	}
+}
+
+// setMany 将 entries 全部存入 segment，整个过程只持有一次写锁
+// 某个键值对写入失败不会影响其他键值对，返回的是第一个错误
+// setMany 写入 entries 中所有的键值对，写入成功的键值对会从 entries 中删除，剩下的就是写入失败的
+func (s *segment) setMany(entries map[string][]byte, expiration Expiration) error {
+	values := make(map[string]*value, len(entries))
+	for key, data := range entries {
+		values[key] = s.newValue(data, expiration)
+	}
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	if oldValue, ok := s.Data[key]; ok {
-		s.Status.subEntry(key, oldValue.Data)
-		delete(s.Data, key)
+	var firstErr error
+	for key, v := range values {
+		if err := s.store(key, v); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		delete(entries, key)
 	}
+	return firstErr
 }
 
-func (s *segment) status() Status {
+func (s *segment) delete(key string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.remove(key)
+}
+
+// deleteMany 删除 keys 中所有的 key，整个过程只持有一次写锁
+func (s *segment) deleteMany(keys []string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range keys {
+		if err := s.remove(key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove 删除 key，调用方需要持有写锁
+func (s *segment) remove(key string) error {
+	oldValue, ok := s.data.get(key)
+	if !ok {
+		return nil
+	}
+	if err := s.aof.appendDelete(s.namespace, key); err != nil {
+		return err
+	}
+	s.drop(key, oldValue, DeleteEvent)
+	return nil
+}
+
+// expire 删除 keys 中已经过期的 key，释放读锁到获取写锁之间 key 可能被重新写入了，所以需要再检查一次
+func (s *segment) expire(keys []string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, key := range keys {
+		oldValue, ok := s.data.get(key)
+		if !ok || oldValue.alive() {
+			continue
+		}
+		if err := s.aof.appendDelete(s.namespace, key); err != nil {
+			return
+		}
+		s.drop(key, oldValue, ExpireEvent)
+	}
+}
+
+// drop 将 key 从 segment 中移除并发布 reason 事件，调用方需要持有写锁
+func (s *segment) drop(key string, oldValue *value, reason string) {
+	s.Status.subEntry(key, oldValue, s.release(key, oldValue))
+	if reason == ExpireEvent {
+		s.Status.Expired++
+	}
+	s.data.delete(key)
+	s.evictor.remove(key)
+	s.expiries.remove(key)
+	s.publish(reason, key)
+}
+
+// clear 清空 segment 中所有的数据，淘汰次数和过期次数会保留下来，调用方需要持有写锁
+func (s *segment) clear() {
+	s.data.each(func(key string, v *value) bool {
+		s.publish(DeleteEvent, key)
+		return true
+	})
+	s.memory.release(s.Status.MemorySize)
+	s.data = newStorage(s.options)
+	s.evictor = newEvictor(s.options.EvictionPolicy)
+	s.expiries = newExpiryHeap()
+	evictions, expired := s.Status.Evictions, s.Status.Expired
+	s.Status = NewStatus()
+	s.Status.Evictions = evictions
+	s.Status.Expired = expired
+}
+
+// evict 淘汰 key，调用方需要持有写锁
+// 和 expire 一样，日志写入失败时不会淘汰，key 仍然留在 evictor 中
+func (s *segment) evict(key string) error {
+	oldValue, ok := s.data.get(key)
+	if !ok {
+		s.evictor.remove(key)
+		return nil
+	}
+	// 淘汰也需要记录到日志中，否则回放日志时被淘汰的数据会重新出现
+	if err := s.aof.appendDelete(s.namespace, key); err != nil {
+		return err
+	}
+	s.Status.Evictions++
+	s.drop(key, oldValue, EvictEvent)
+	return nil
+}
+
+// evictOne 按照淘汰策略淘汰一个键值对，没有可以淘汰的数据或者淘汰失败时返回 false
+func (s *segment) evictOne() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	victim, ok := s.evictor.victim()
+	if !ok {
+		return false
+	}
+	return s.evict(victim) == nil
+}
+
+// snapshot 返回 segment 当前时刻的副本，只在复制期间持有读锁，所以不会长时间阻塞读写
+func (s *segment) snapshot() *segment {
 	s.lock.RLock()
 	defer s.lock.RUnlock()
-	return *s.Status
+	// 快照总是使用 map 存储，arena 中读出来的值本来就是副本，复制一次也只是共享 Data
+	data := make(mapStorage, s.data.len())
+	s.data.each(func(key string, v *value) bool {
+		data[key] = v.copy()
+		return true
+	})
+	status := *s.Status
+	return &segment{
+		data:      data,
+		Status:    &status,
+		options:   s.options,
+		lock:      &sync.RWMutex{},
+		evictor:   newNoEvictor(),
+		namespace: s.namespace,
+		expiries:  newExpiryHeap(),
+	}
 }
 
-func (s *segment) checkEntrySize(newKey string, newValue []byte) bool {
-	return s.Status.entrySize()+int64(len(newKey))+int64(len(newValue)) <= int64(s.options.MaxEntrySize*1024*2014/s.options.SegmentSize)
+func (s *segment) status() Status {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return *s.Status
 }
 
+// gc 清理过期时间最早的一批 key，每次最多检查 MaxGcCount 个，剩下的留给下一次，这样每次持有写锁的时间都是有上限的
+// 过期的 key 被读取时也会被清理，所以这里只需要清理那些一直没有被读取的 key
 func (s *segment) gc() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	count := 0
-	for key, value := range s.Data {
-		if !value.alive() {
-			s.Status.subEntry(key, value.Data)
-			delete(s.Data, key)
-			count++
-			if count >= s.options.MaxGcCount {
-				break
-			}
+	now := nowMilliseconds()
+	for count := 0; count < s.options.MaxGcCount; count++ {
+		item, ok := s.expiries.earliest()
+		if !ok || item.expire > now {
+			return
+		}
+		value, ok := s.data.get(item.key)
+		if !ok {
+			// 堆和数据不一致时以数据为准，key 已经不存在了，移除它在堆中的记录
+			s.expiries.remove(item.key)
+			continue
+		}
+		if expire := atomic.LoadInt64(&value.Expire); expire == NeverDie || expire > now {
+			// 滑动有效期在读取之后推迟了过期时间，按照新的过期时间重新排序
+			s.expiries.update(item.key, expire)
+			continue
+		}
+		// 和 expire 一样需要记录到日志中，否则回放日志时过期的数据会重新出现，写入日志失败时留给下一次清理
+		if err := s.aof.appendDelete(s.namespace, item.key); err != nil {
+			return
 		}
+		s.drop(item.key, value, ExpireEvent)
 	}
 }
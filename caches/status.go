@@ -1,31 +1,64 @@
 package caches
 
 type Status struct {
-	Count     int   `json:"count"`
-	KeySize   int64 `json:"keySize"`
-	ValueSize int64 `json:"valueSize"`
+	Count   int   `json:"count"`
+	KeySize int64 `json:"keySize"`
+	// ValueSize 是原始数据的大小，StoredValueSize 是压缩之后实际存储的大小
+	ValueSize       int64 `json:"valueSize"`
+	StoredValueSize int64 `json:"storedValueSize"`
+	// Evictions 因为容量不足被淘汰的键值对个数
+	Evictions int64 `json:"evictions"`
+	// Expired 因为过期被清理的键值对个数，包括读取时发现过期的和后台主动清理的
+	Expired int64 `json:"expired"`
+	// MemorySize 键值对占用的内存，除了 key 和 value 还包括了每个键值对的额外开销
+	MemorySize int64 `json:"memorySize"`
+	// MaxMemory 可以使用的内存上限，HighWatermark 和 LowWatermark 是后台开始淘汰和停止淘汰的内存使用量
+	MaxMemory     int64 `json:"maxMemory"`
+	HighWatermark int64 `json:"highWatermark"`
+	LowWatermark  int64 `json:"lowWatermark"`
 }
 
 func NewStatus() *Status {
 	return &Status{
-		Count:     0,
-		KeySize:   0,
-		ValueSize: 0,
+		Count:           0,
+		KeySize:         0,
+		ValueSize:       0,
+		StoredValueSize: 0,
+		Evictions:       0,
+		Expired:         0,
+		MemorySize:      0,
+		MaxMemory:       0,
+		HighWatermark:   0,
+		LowWatermark:    0,
 	}
 }
 
-func (s *Status) addEntry(key string, value []byte) {
+func (s *Status) addEntry(key string, v *value, size int64) {
 	s.Count++
 	s.KeySize += int64(len(key))
-	s.ValueSize += int64(len(value))
+	s.ValueSize += v.size()
+	s.StoredValueSize += int64(len(v.Data))
+	s.MemorySize += size
 }
 
-func (s *Status) subEntry(key string, value []byte) {
+func (s *Status) subEntry(key string, v *value, size int64) {
 	s.Count--
 	s.KeySize -= int64(len(key))
-	s.ValueSize -= int64(len(value))
+	s.ValueSize -= v.size()
+	s.StoredValueSize -= int64(len(v.Data))
+	s.MemorySize -= size
 }
 
-func (s *Status) entrySize() int64 {
-	return s.KeySize + s.ValueSize
+// merge 将 other 的统计累加到 s 上
+func (s *Status) merge(other Status) {
+	s.Count += other.Count
+	s.KeySize += other.KeySize
+	s.ValueSize += other.ValueSize
+	s.StoredValueSize += other.StoredValueSize
+	s.Evictions += other.Evictions
+	s.Expired += other.Expired
+	s.MemorySize += other.MemorySize
+	s.MaxMemory += other.MaxMemory
+	s.HighWatermark += other.HighWatermark
+	s.LowWatermark += other.LowWatermark
 }
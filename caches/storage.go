@@ -0,0 +1,86 @@
+package caches
+
+const (
+	// MapStorage 使用 map 存储键值对，每个键值对都是一个单独的对象，读写最快，但是键值对很多时会给垃圾回收带来很大的压力
+	MapStorage = "map"
+	// ArenaStorage 将键值对编码之后存储在预先分配的大块内存中，索引中也不包含指针，垃圾回收几乎不需要扫描这些数据
+	ArenaStorage = "arena"
+)
+
+// storage 是 segment 存储键值对的方式，每个 segment 拥有一个独立的 storage
+// storage 不是并发安全的，除了 get 和 touch 可以在持有读锁时调用之外，其他方法都需要调用方持有 segment 的写锁
+type storage interface {
+	// get 返回 key 对应的值，修改返回的值不一定会影响存储的值，需要使用 set 或者 touch 写回
+	get(key string) (*value, bool)
+	// set 存入 key 对应的值，key 已经存在时会覆盖
+	set(key string, v *value)
+	// touch 写回滑动有效期在读取之后推迟的过期时间
+	touch(key string, v *value)
+	// delete 删除 key，key 不存在时什么都不做
+	delete(key string)
+	// len 返回键值对的个数
+	len() int
+	// each 依次将每个键值对交给 fn 处理，fn 返回 false 时停止，遍历期间不能修改 storage
+	each(fn func(key string, v *value) bool)
+	// sizeOf 返回键值对存入之后占用的内存，不包括过期堆的开销
+	sizeOf(key string, v *value) int64
+}
+
+// storages 记录了所有支持的存储方式
+var storages = map[string]func(options *Options) storage{
+	MapStorage:   newMapStorage,
+	ArenaStorage: newArenaStorage,
+}
+
+// newStorage 根据 options 中的存储方式创建 storage，不认识的存储方式会当成 MapStorage 处理
+func newStorage(options *Options) storage {
+	if newFunc, ok := storages[options.StorageEngine]; ok {
+		return newFunc(options)
+	}
+	return newMapStorage(options)
+}
+
+// IsValidStorageEngine 判断 engine 是否是支持的存储方式
+func IsValidStorageEngine(engine string) bool {
+	_, ok := storages[engine]
+	return ok
+}
+
+// mapStorage 直接使用 map 存储键值对，get 返回的就是存储的值本身
+type mapStorage map[string]*value
+
+func newMapStorage(options *Options) storage {
+	return make(mapStorage, options.MapSizeOfSegment)
+}
+
+func (ms mapStorage) get(key string) (*value, bool) {
+	v, ok := ms[key]
+	return v, ok
+}
+
+func (ms mapStorage) set(key string, v *value) {
+	ms[key] = v
+}
+
+// touch 什么都不需要做，因为 value.visit 已经修改了存储的值
+func (ms mapStorage) touch(key string, v *value) {}
+
+func (ms mapStorage) delete(key string) {
+	delete(ms, key)
+}
+
+func (ms mapStorage) len() int {
+	return len(ms)
+}
+
+func (ms mapStorage) each(fn func(key string, v *value) bool) {
+	for key, v := range ms {
+		if !fn(key, v) {
+			return
+		}
+	}
+}
+
+func (ms mapStorage) sizeOf(key string, v *value) int64 {
+	return int64(entryOverhead + len(key) + len(v.Data))
+}
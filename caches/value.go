@@ -11,24 +11,145 @@ const (
 )
 
 type value struct {
-	Data  []byte
-	Ttl   int64
-	Ctime int64
+	// Data 是存储的数据，Compression 不是 rawData 时 Data 是压缩过的，需要使用 bytes 获取原始数据
+	Data []byte
+	// Compression 是 Data 的压缩方式
+	Compression byte
+	// Mode 是有效期的计算方式
+	Mode ExpiryMode
+	// Ttl 是滑动有效期的时长，单位是毫秒，每次访问之后过期时间都会推迟到当前时间加上 Ttl，其他方式不使用
+	Ttl int64
+	// Expire 是过期的时间点，是 Unix 时间的毫秒数，NeverDie 表示永不过期
+	Expire int64
+	// Version 是写入时分配的版本号，每次写入都会变大，用于实现比较并设置，也用于判断其他节点同步过来的数据是不是更新
+	// 版本号不会被持久化，从持久化文件和日志中恢复的数据使用 restoredVersion
+	Version uint64
 }
 
-func newValue(data []byte, ttl int64) *value {
-	return &value{
-		Data:  helpers.Copy(data),
-		Ttl:   ttl,
-		Ctime: time.Now().Unix(),
+// restoredVersion 是从持久化文件和日志中恢复的数据的版本号
+// 这些数据一定是重启之前写入的，所以使用比所有新写入的版本号都小的值，其他节点同步过来的数据总是比它们新
+const restoredVersion = uint64(1)
+
+// newVersions 创建一个版本号计数器，以当前时间的纳秒数作为起点，这样重启之后的版本号也不会和重启之前的重复
+func newVersions() *uint64 {
+	versions := uint64(time.Now().UnixNano())
+	return &versions
+}
+
+// nextVersion 分配一个新的版本号，版本号不小于当前时间的纳秒数，并且比计数器中所有的版本号都大
+// 这样不同节点分配的版本号大致按照写入的时间排序，可以用来比较同一个 key 在不同节点上的哪个值更新
+func nextVersion(versions *uint64) uint64 {
+	for {
+		current := atomic.LoadUint64(versions)
+		next := current + 1
+		if now := uint64(time.Now().UnixNano()); now > next {
+			next = now
+		}
+		if atomic.CompareAndSwapUint64(versions, current, next) {
+			return next
+		}
+	}
+}
+
+// observeVersion 让计数器不小于 version，其他节点同步过来的数据保留了原来的版本号，之后在当前节点上的写入需要比它更新
+func observeVersion(versions *uint64, version uint64) {
+	for {
+		current := atomic.LoadUint64(versions)
+		if current >= version || atomic.CompareAndSwapUint64(versions, current, version) {
+			return
+		}
+	}
+}
+
+func newValue(data []byte, expiration Expiration) *value {
+	v := &value{
+		Data: helpers.Copy(data),
+	}
+	v.setExpiration(expiration)
+	return v
+}
+
+// legacyValue 使用旧格式中以秒为单位的 ttl 和写入时间 ctime 创建 value，旧格式中的有效期都按照固定有效期处理
+func legacyValue(data []byte, ttl int64, ctime int64) *value {
+	v := &value{
+		Data: data,
+		Mode: FixedExpiry,
+	}
+	if ttl != NeverDie {
+		v.Expire = (ctime + ttl) * millisecondsPerSecond
+	}
+	return v
+}
+
+// setExpiration 按照 expiration 重新计算过期时间，调用方需要保证没有其他 goroutine 在访问 v
+func (v *value) setExpiration(expiration Expiration) {
+	v.Mode = expiration.Mode
+	v.Ttl = 0
+	v.Expire = expiration.expireAt(nowMilliseconds())
+	if expiration.Mode == SlidingExpiry && v.Expire != NeverDie {
+		v.Ttl = millisecondsOf(expiration.TTL)
 	}
 }
 
 func (v *value) alive() bool {
-	return v.Ttl == NeverDie || v.Ttl > time.Now().Unix()-v.Ctime
+	expire := atomic.LoadInt64(&v.Expire)
+	return expire == NeverDie || expire > nowMilliseconds()
 }
 
-func (v *value) visit() []byte {
-	atomic.SwapInt64(&v.Ctime, time.Now().Unix())
-	return v.Data
+// remainingTtl 返回剩余的有效期，单位是毫秒，已经过期时返回 false
+func (v *value) remainingTtl() (int64, bool) {
+	expire := atomic.LoadInt64(&v.Expire)
+	if expire == NeverDie {
+		return NeverDie, true
+	}
+	ttl := expire - nowMilliseconds()
+	return ttl, ttl > 0
+}
+
+// expiration 返回 v 剩余的有效期，固定有效期和绝对过期时间都使用过期的时间点表示
+func (v *value) expiration() Expiration {
+	expire := atomic.LoadInt64(&v.Expire)
+	if expire == NeverDie {
+		return Expiration{}
+	}
+	if v.Mode == SlidingExpiry {
+		return SlidingTTL(time.Duration(v.Ttl) * time.Millisecond)
+	}
+	return ExpireAt(time.Unix(0, expire*int64(time.Millisecond)))
+}
+
+// visit 返回 v 的原始数据，滑动有效期会在每次访问之后重新计算过期时间
+func (v *value) visit() ([]byte, error) {
+	if v.Mode == SlidingExpiry && v.Ttl > 0 {
+		atomic.StoreInt64(&v.Expire, nowMilliseconds()+v.Ttl)
+	}
+	return v.bytes()
+}
+
+// bytes 返回 v 的原始数据，压缩过的数据会被解压
+func (v *value) bytes() ([]byte, error) {
+	if v.Compression == rawData {
+		return v.Data, nil
+	}
+	return decompress(v.Data, v.Compression)
+}
+
+// size 返回原始数据的长度，压缩过的数据不需要解压就可以知道
+func (v *value) size() int64 {
+	if v.Compression == rawData {
+		return int64(len(v.Data))
+	}
+	return decompressedSize(v.Data)
+}
+
+// copy 返回 value 的一个副本，Data 在写入之后不会被修改，所以副本和原值共享 Data
+func (v *value) copy() *value {
+	return &value{
+		Data:        v.Data,
+		Compression: v.Compression,
+		Mode:        v.Mode,
+		Ttl:         v.Ttl,
+		Expire:      atomic.LoadInt64(&v.Expire),
+		Version:     v.Version,
+	}
 }
@@ -3,7 +3,6 @@ module cache
 go 1.15
 
 require (
-	github.com/FishGoddess/cachego v0.1.1 // indirect
 	github.com/hashicorp/memberlist v0.2.2
 	github.com/julienschmidt/httprouter v1.3.0
 	stathat.com/c/consistent v1.0.0
@@ -3,8 +3,15 @@ package main
 import (
 	"cache/caches"
 	"cache/services"
+	"context"
 	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
+	"time"
 )
 
 func main() {
@@ -15,30 +22,74 @@ func main() {
 	flag.StringVar(&serverOptions.ServerType, "serverType", serverOptions.ServerType, "The type of server (http ,tcp)")
 	flag.IntVar(&serverOptions.VirtualNodeCount, "virtualNodeCount", serverOptions.VirtualNodeCount, "the number of virtual nodes in consistent hash")
 	flag.IntVar(&serverOptions.UpdateCircleDuration, "updateCircleDuration", serverOptions.UpdateCircleDuration, "The duration between two circle updating operations. The unit is second.")
+	flag.StringVar(&serverOptions.RoutingMode, "routingMode", serverOptions.RoutingMode, "The way to handle requests whose key belongs to other nodes (redirect, proxy)")
+	flag.IntVar(&serverOptions.ReplicaCount, "replicaCount", serverOptions.ReplicaCount, "The number of nodes every key is stored on, including the primary node. Replicas are updated asynchronously and may serve stale reads")
+	flag.StringVar(&serverOptions.TLSCertFile, "tlsCertFile", serverOptions.TLSCertFile, "The PEM encoded certificate used to serve TLS and connect to other nodes. It is reloaded when the file changes")
+	flag.StringVar(&serverOptions.TLSKeyFile, "tlsKeyFile", serverOptions.TLSKeyFile, "The PEM encoded private key of tlsCertFile")
+	flag.StringVar(&serverOptions.TLSClientCAFile, "tlsClientCAFile", serverOptions.TLSClientCAFile, "The PEM encoded CA used to verify client certificates. Clients must present a certificate when it is set")
+	flag.StringVar(&serverOptions.TLSCAFile, "tlsCAFile", serverOptions.TLSCAFile, "The PEM encoded CA used to verify certificates of other nodes. Empty means system roots")
+	flag.StringVar(&serverOptions.ACLFile, "aclFile", serverOptions.ACLFile, "The JSON file of users and their rights on commands, namespaces and key prefixes. Empty means no authentication")
 
 	cluster := flag.String("cluster", "", "The cluster of servers. One node in cluster will be ok")
+	shutdownTimeout := flag.Int64("shutdownTimeout", 30, "The max duration to wait for in-flight requests when shutting down. The unit is second")
 
 	// 准备缓存配置选项
 	options := caches.DefaultOptions()
-	flag.IntVar(&options.MaxEntrySize, "maxEntrySize", options.MaxEntrySize, "The max memory size that entries can use . the unit is GB.")
-	flag.IntVar(&options.MaxGcCount, "maxGcCount", options.MaxGcCount, "The")
-	flag.Int64Var(&options.GcDuration, "gcDuration", options.GcDuration, "The duration between two gc tasks. The unit is Minute")
+	maxEntrySize := flag.String("maxEntrySize", "4GB", "The max memory size that entries can use, such as 512MB. A number without unit means GB")
+	flag.IntVar(&options.HighWatermark, "highWatermark", options.HighWatermark, "The percent of maxEntrySize above which entries are evicted in background")
+	flag.IntVar(&options.LowWatermark, "lowWatermark", options.LowWatermark, "The percent of maxEntrySize below which background eviction stops")
+	flag.IntVar(&options.MaxGcCount, "maxGcCount", options.MaxGcCount, "The max number of expired entries checked in one segment by one gc task")
+	flag.Int64Var(&options.GcInterval, "gcInterval", options.GcInterval, "The interval between two gc tasks. The unit is Millisecond")
 
 	// 获取持久化路径，和间隔时间
 	flag.StringVar(&options.DumpFile, "dumpFile", options.DumpFile, "The file used to dump the cache")
 	flag.Int64Var(&options.DumpDuration, "dumpDuration", options.DumpDuration, "The duration between two dump task")
 
+	flag.StringVar(&options.AofFile, "aofFile", options.AofFile, "The append only file used to log every write. Empty means disabled")
+	flag.StringVar(&options.AofFsync, "aofFsync", options.AofFsync, "The policy of syncing append only file to disk (always, everysec, never)")
+	flag.Int64Var(&options.AofRewriteSize, "aofRewriteSize", options.AofRewriteSize, "The size of append only file which triggers a rewrite. The unit is MB")
+
 	flag.IntVar(&options.MapSizeOfSegment, "mapSizeOfSegment", options.MapSizeOfSegment, "The map size of segment")
+	flag.StringVar(&options.StorageEngine, "storageEngine", options.StorageEngine, "The way to store entries (map, arena). Arena is friendly to garbage collector when there are millions of entries")
+	arenaSizeOfSegment := flag.String("arenaSizeOfSegment", "64KB", "The size of memory allocated in advance for every segment when storage engine is arena, such as 1MB")
 	flag.IntVar(&options.SegmentSize, "segmentSize", options.SegmentSize, "The number of segment in a cache. this value should be the pow of 2 for precision.")
-	flag.IntVar(&options.CasSleepTime, "casSleepTime", options.CasSleepTime, "The time of sleep in one cas step. the unit is Microsecond")
+	flag.StringVar(&options.Compression, "compression", options.Compression, "The way to compress large values (none, gzip, flate)")
+	flag.IntVar(&options.CompressionThreshold, "compressionThreshold", options.CompressionThreshold, "The min size of values to be compressed. The unit is byte")
+	flag.StringVar(&options.EncryptionKeyFile, "encryptionKeyFile", options.EncryptionKeyFile, "The file of keys used to encrypt dump file and append only file, every line is like id=hex-encoded key and the first key is used to encrypt")
+	flag.StringVar(&options.EncryptionKeyEnv, "encryptionKeyEnv", options.EncryptionKeyEnv, "The environment variable of keys used when encryptionKeyFile is empty, such as KAFO_ENCRYPTION_KEYS")
+	flag.StringVar(&options.EvictionPolicy, "evictionPolicy", options.EvictionPolicy, "The policy used to evict entries when cache is full (none, lru, lfu, fifo)")
+	namespaces := flag.String("namespaces", "", "The namespaces with their own max entry size, such as team-a=2GB,team-b=512MB. The unit is the same as maxEntrySize. Other namespaces share maxEntrySize with the default namespace")
 
 	flag.Parse()
 
+	// 不认识的取值会被当成默认值处理，很容易让配置错误被忽略，所以在启动之前检查
+	err := validate(options)
+	if err != nil {
+		panic(err)
+	}
+
 	// 从 flag 中解析出集群信息
 	serverOptions.Cluster = nodesInCluster(*cluster)
 
+	// 从 flag 中解析出内存上限、arena 的大小和命名空间的容量限制
+	options.MaxEntrySize, err = sizeOf(*maxEntrySize)
+	if err != nil {
+		panic(err)
+	}
+	options.ArenaSizeOfSegment, err = caches.ParseSize(*arenaSizeOfSegment)
+	if err != nil {
+		panic(err)
+	}
+	options.Namespaces, err = namespacesOf(*namespaces)
+	if err != nil {
+		panic(err)
+	}
+
 	// 使用选项配置初始化缓存
-	cache := caches.NewCacheWith(options)
+	cache, err := caches.OpenCacheWith(options)
+	if err != nil {
+		panic(err)
+	}
 	cache.AutoGc()
 	cache.AutoDump()
 
@@ -48,15 +99,79 @@ func main() {
 		panic(err)
 	}
 
-	err = server.Run()
-	if err != nil {
+	// 收到退出信号之后优雅地关闭服务器，再关闭缓存，关闭缓存时会写入最后一次持久化文件
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.Run()
+	}()
+	select {
+	case err = <-errs:
+		if err != nil {
+			panic(err)
+		}
+	case <-signals:
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(*shutdownTimeout)*time.Second)
+	defer cancel()
+	if err = server.Shutdown(ctx); err != nil {
+		fmt.Println("failed to shutdown server:", err)
+	}
+	if err = cache.Close(); err != nil {
 		panic(err)
 	}
 }
 
+// validate 检查选项中只能从固定几个值中选择的配置
+func validate(options caches.Options) error {
+	if !caches.IsValidEvictionPolicy(options.EvictionPolicy) {
+		return fmt.Errorf("unknown eviction policy %s", options.EvictionPolicy)
+	}
+	if !caches.IsValidAofFsync(options.AofFsync) {
+		return fmt.Errorf("unknown aof fsync policy %s", options.AofFsync)
+	}
+	if !caches.IsValidStorageEngine(options.StorageEngine) {
+		return fmt.Errorf("unknown storage engine %s", options.StorageEngine)
+	}
+	if !caches.IsValidCompression(options.Compression) {
+		return fmt.Errorf("unknown compression %s", options.Compression)
+	}
+	return nil
+}
+
 func nodesInCluster(cluster string) []string {
 	if cluster == "" {
 		return nil
 	}
 	return strings.Split(cluster, ",")
 }
+
+// sizeOf 解析带单位的容量，没有单位时按照 GB 计算，和以前只支持 GB 的配置保持兼容
+func sizeOf(size string) (int64, error) {
+	if gigabytes, err := strconv.ParseInt(size, 10, 64); err == nil {
+		return gigabytes << 30, nil
+	}
+	return caches.ParseSize(size)
+}
+
+// namespacesOf 解析命名空间的容量限制，格式为 name=size，多个命名空间之间使用逗号分隔
+func namespacesOf(namespaces string) (map[string]int64, error) {
+	result := map[string]int64{}
+	if namespaces == "" {
+		return result, nil
+	}
+	for _, namespace := range strings.Split(namespaces, ",") {
+		parts := strings.SplitN(namespace, "=", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return nil, fmt.Errorf("namespace %q should be like name=size", namespace)
+		}
+		maxEntrySize, err := sizeOf(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("size of namespace %s is invalid: %w", parts[0], err)
+		}
+		result[parts[0]] = maxEntrySize
+	}
+	return result, nil
+}
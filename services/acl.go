@@ -0,0 +1,410 @@
+package services
+
+import (
+	"cache/caches"
+	"cache/vex"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+const (
+	// ReadRight 可以读取数据，包括扫描 key 和订阅事件
+	ReadRight = "read"
+	// WriteRight 可以写入、修改和删除数据，包括发布消息
+	WriteRight = "write"
+	// AdminRight 可以执行所有命令，包括查看状态、清空命名空间和节点之间同步数据
+	AdminRight = "admin"
+)
+
+// right 是权限的位掩码
+type right uint8
+
+const (
+	readRight right = 1 << iota
+	writeRight
+	adminRight
+
+	// allRights 是 AdminRight 授予的权限
+	allRights = readRight | writeRight | adminRight
+)
+
+var (
+	// authenticationFailedErr 意味着用户名和密码不匹配，或者令牌不存在
+	authenticationFailedErr = errors.New("invalid username, password or token")
+
+	// permissionDeniedErr 意味着用户没有执行这个命令的权限
+	permissionDeniedErr = errors.New("permission denied")
+
+	// rights 记录了配置文件中可以使用的权限
+	rights = map[string]right{
+		ReadRight:  readRight,
+		WriteRight: writeRight,
+		AdminRight: allRights,
+	}
+
+	// commandRights 记录了每个命令需要的权限，不在其中的命令只有拥有 AdminRight 的用户才能执行
+	// 权限为 0 的命令只要通过了认证就可以执行，比如客户端更新一致性哈希时需要的 nodesCommand
+	commandRights = map[byte]right{
+		nodesCommand: 0,
+
+		getCommand:            readRight,
+		getManyCommand:        readRight,
+		getWithVersionCommand: readRight,
+		ttlCommand:            readRight,
+		scanCommand:           readRight,
+		eventsCommand:         readRight,
+		subscribeCommand:      readRight,
+
+		setCommand:           writeRight,
+		deleteCommand:        writeRight,
+		setManyCommand:       writeRight,
+		deleteManyCommand:    writeRight,
+		incrementCommand:     writeRight,
+		compareAndSetCommand: writeRight,
+		setNXCommand:         writeRight,
+		setXXCommand:         writeRight,
+		expireCommand:        writeRight,
+		publishCommand:       writeRight,
+
+		// 这两个命令会返回旧的值，所以同时需要读和写的权限
+		getSetCommand:       readRight | writeRight,
+		getAndDeleteCommand: readRight | writeRight,
+	}
+
+	// commandKeys 从命令的参数中取出 key，用于检查 key 的前缀，不在其中的命令没有 key
+	commandKeys = map[byte]func(args [][]byte) []string{
+		getCommand:            keyAt(0),
+		deleteCommand:         keyAt(0),
+		getWithVersionCommand: keyAt(0),
+		getAndDeleteCommand:   keyAt(0),
+		ttlCommand:            keyAt(0),
+		expireCommand:         keyAt(0),
+		replicaDeleteCommand:  keyAt(0),
+		replicaExpireCommand:  keyAt(0),
+
+		setCommand:           keyAt(1),
+		setNXCommand:         keyAt(1),
+		setXXCommand:         keyAt(1),
+		getSetCommand:        keyAt(1),
+		incrementCommand:     keyAt(1),
+		compareAndSetCommand: keyAt(1),
+		replicaSetCommand:    keyAt(1),
+
+		getManyCommand:           keysOf,
+		deleteManyCommand:        keysOf,
+		replicaDeleteManyCommand: keysOf,
+
+		setManyCommand:        entryKeysOf,
+		replicaSetManyCommand: entryKeysOf,
+
+		// 频道的名字和 key 一样检查前缀，匹配模式按照第一个通配符之前的部分检查前缀
+		publishCommand:   keyAt(0),
+		scanCommand:      patternAt(1),
+		eventsCommand:    patternAt(1),
+		subscribeCommand: patternAt(0),
+	}
+)
+
+// acl 记录了所有的用户和他们的权限，从 Options.ACLFile 中读取，文件格式如下：
+//
+//	{
+//	  "clusterUser": "node",
+//	  "users": {
+//	    "node": {"password": "...", "rules": [{"rights": ["admin"]}]},
+//	    "team-a": {
+//	      "password": "...",
+//	      "tokens": ["..."],
+//	      "rules": [
+//	        {"rights": ["read", "write"], "namespaces": ["team-a"], "prefixes": ["user:", "order:"]},
+//	        {"rights": ["read"], "commands": [21]}
+//	      ]
+//	    }
+//	  }
+//	}
+//
+// 每条规则授予用户一些权限，commands、namespaces 和 prefixes 限制了规则适用的命令编号、命名空间和 key 的前缀，为空时不限制
+// 命令中的每个 key 都需要被规则授予足够的权限，限制了前缀的规则不适用于没有 key 的命令，比如查看节点和清空命名空间
+// 发布和订阅消息时频道的名字也按照前缀检查；扫描、订阅事件和订阅消息使用的匹配模式只有在第一个通配符之前的部分
+// 以规则的前缀开头时才适用，这样匹配到的 key 和频道一定都带有这个前缀，没有指定匹配模式时表示匹配所有，限制了前缀的规则不适用
+type acl struct {
+	// ClusterUser 是节点之间通信时使用的用户，需要拥有 AdminRight，只有一个节点时可以不配置
+	ClusterUser string `json:"clusterUser"`
+
+	Users map[string]*aclUser `json:"users"`
+
+	// tokens 记录了令牌的哈希对应的用户
+	tokens map[[sha256.Size]byte]string
+}
+
+// aclUser 是一个用户，可以使用用户名和密码认证，也可以使用令牌认证
+type aclUser struct {
+	Password string     `json:"password"`
+	Tokens   []string   `json:"tokens"`
+	Rules    []*aclRule `json:"rules"`
+}
+
+// aclRule 是一条授权规则
+type aclRule struct {
+	Rights     []string `json:"rights"`
+	Commands   []int    `json:"commands"`
+	Namespaces []string `json:"namespaces"`
+	Prefixes   []string `json:"prefixes"`
+
+	// granted 是 Rights 对应的权限
+	granted right
+}
+
+// loadACL 从 file 中读取用户和权限，file 为空时返回 nil，表示不需要认证
+func loadACL(file string) (*acl, error) {
+	if file == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	a := &acl{}
+	if err = json.Unmarshal(data, a); err != nil {
+		return nil, fmt.Errorf("failed to parse acl file %s: %w", file, err)
+	}
+
+	a.tokens = map[[sha256.Size]byte]string{}
+	for name, user := range a.Users {
+		if user == nil {
+			return nil, fmt.Errorf("user %s in acl file has no config", name)
+		}
+		for _, token := range user.Tokens {
+			a.tokens[sha256.Sum256([]byte(token))] = name
+		}
+		for _, rule := range user.Rules {
+			for _, r := range rule.Rights {
+				granted, ok := rights[r]
+				if !ok {
+					return nil, fmt.Errorf("right %s of user %s is unknown", r, name)
+				}
+				rule.granted |= granted
+			}
+			for _, command := range rule.Commands {
+				if command < 0 || command > 255 {
+					return nil, fmt.Errorf("command %d of user %s is out of range", command, name)
+				}
+			}
+		}
+	}
+	if _, ok := a.Users[a.ClusterUser]; a.ClusterUser != "" && !ok {
+		return nil, fmt.Errorf("cluster user %s is not in acl file", a.ClusterUser)
+	}
+	return a, nil
+}
+
+// authenticate 认证用户，用户名为空时把 password 当成令牌
+func (a *acl) authenticate(username string, password string) (string, error) {
+	if username == "" {
+		if user, ok := a.tokens[sha256.Sum256([]byte(password))]; ok {
+			return user, nil
+		}
+		return "", authenticationFailedErr
+	}
+	user, ok := a.Users[username]
+	if !ok || user.Password == "" || subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) != 1 {
+		return "", authenticationFailedErr
+	}
+	return username, nil
+}
+
+// authenticateRequest 使用 HTTP 请求中的 Bearer 令牌或者 Basic 认证信息认证用户
+func (a *acl) authenticateRequest(request *http.Request) (string, error) {
+	authorization := request.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return a.authenticate("", strings.TrimPrefix(authorization, "Bearer "))
+	}
+	if username, password, ok := request.BasicAuth(); ok {
+		return a.authenticate(username, password)
+	}
+	return "", authenticationFailedErr
+}
+
+// authorize 判断 user 能不能在命名空间 namespace 中执行命令 command，keys 是命令涉及的 key
+// namespace 为空表示命令涉及所有命名空间，比如订阅所有命名空间的事件，这时只有不限制命名空间的规则才适用
+func (a *acl) authorize(user string, namespace string, command byte, keys []string) error {
+	u, ok := a.Users[user]
+	if !ok {
+		return permissionDeniedErr
+	}
+	required, ok := commandRights[command]
+	if !ok {
+		required = adminRight
+	}
+	if required == 0 {
+		return nil
+	}
+
+	if len(keys) == 0 {
+		if u.granted(namespace, command, "", false)&required != required {
+			return permissionDeniedErr
+		}
+		return nil
+	}
+	for _, key := range keys {
+		if u.granted(namespace, command, key, true)&required != required {
+			return permissionDeniedErr
+		}
+	}
+	return nil
+}
+
+// granted 返回所有适用的规则授予的权限
+func (au *aclUser) granted(namespace string, command byte, key string, hasKey bool) right {
+	granted := right(0)
+	for _, rule := range au.Rules {
+		if rule.matches(namespace, command, key, hasKey) {
+			granted |= rule.granted
+		}
+	}
+	return granted
+}
+
+// matches 判断规则是否适用
+func (ar *aclRule) matches(namespace string, command byte, key string, hasKey bool) bool {
+	if len(ar.Commands) > 0 && !containsCommand(ar.Commands, command) {
+		return false
+	}
+	if len(ar.Namespaces) > 0 && !containsString(ar.Namespaces, namespace) {
+		return false
+	}
+	if len(ar.Prefixes) == 0 {
+		return true
+	}
+	if !hasKey {
+		return false
+	}
+	for _, prefix := range ar.Prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsCommand(commands []int, command byte) bool {
+	for _, c := range commands {
+		if c == int(command) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// clusterCredentials 返回节点之间通信时使用的用户名和密码，没有开启 ACL 或者没有配置集群用户时返回 false
+func (a *acl) clusterCredentials() (string, string, bool) {
+	if a == nil || a.ClusterUser == "" {
+		return "", "", false
+	}
+	return a.ClusterUser, a.Users[a.ClusterUser].Password, true
+}
+
+// login 使用集群用户认证到其他节点的连接
+func (a *acl) login(client *vex.Client) error {
+	if username, password, ok := a.clusterCredentials(); ok {
+		return client.Auth(username, password)
+	}
+	return nil
+}
+
+// namespaceNameOf 返回命名空间的名字，空的名字表示默认的命名空间
+func namespaceNameOf(name string) string {
+	if name == "" {
+		return caches.DefaultNamespace
+	}
+	return name
+}
+
+// keyAt 返回从第 index 个参数中取出 key 的函数
+func keyAt(index int) func(args [][]byte) []string {
+	return func(args [][]byte) []string {
+		if len(args) <= index {
+			return nil
+		}
+		return []string{string(args[index])}
+	}
+}
+
+// patternAt 返回从第 index 个参数中取出匹配模式的函数，匹配模式会被转换成它的字面前缀
+func patternAt(index int) func(args [][]byte) []string {
+	return func(args [][]byte) []string {
+		if len(args) <= index {
+			return nil
+		}
+		return []string{literalPrefixOf(string(args[index]))}
+	}
+}
+
+// literalPrefixOf 返回匹配模式中第一个通配符之前的部分，模式的语法和 path.Match 相同，所以匹配到的内容一定以它开头
+func literalPrefixOf(pattern string) string {
+	if i := strings.IndexAny(pattern, `*?[\`); i >= 0 {
+		return pattern[:i]
+	}
+	return pattern
+}
+
+// entryKeysOf 从批量写入命令的参数中取出所有的 key，参数是 ttl | key | value | key | value ...
+func entryKeysOf(args [][]byte) []string {
+	var keys []string
+	for i := 1; i < len(args); i += 2 {
+		keys = append(keys, string(args[i]))
+	}
+	return keys
+}
+
+// tcpAuthenticator 使用 acl 认证 vex 连接上的用户，并根据命令的参数检查权限
+type tcpAuthenticator struct {
+	acl *acl
+}
+
+func (ta *tcpAuthenticator) Authenticate(username string, password string) (string, error) {
+	return ta.acl.authenticate(username, password)
+}
+
+// Authorize 检查命令需要的权限，在命名空间中执行的命令按照被包装的命令检查
+func (ta *tcpAuthenticator) Authorize(user string, command byte, args [][]byte) error {
+	namespace := caches.DefaultNamespace
+	switch command {
+	case namespaceCommand:
+		if len(args) < 2 || len(args[1]) < 1 {
+			return commandNeedsMoreArgumentsErr
+		}
+		namespace = namespaceNameOf(string(args[0]))
+		command, args = args[1][0], args[2:]
+	case flushNamespaceCommand, replicaFlushNamespaceCommand:
+		if len(args) > 0 {
+			namespace = namespaceNameOf(string(args[0]))
+		}
+	case eventsCommand:
+		// 命名空间为空时订阅所有命名空间的事件
+		namespace = ""
+		if len(args) > 0 {
+			namespace = string(args[0])
+		}
+	}
+
+	var keys []string
+	if keysOf, ok := commandKeys[command]; ok {
+		keys = keysOf(args)
+	}
+	return ta.acl.authorize(user, namespace, command, keys)
+}
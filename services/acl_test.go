@@ -0,0 +1,177 @@
+package services
+
+import (
+	"cache/caches"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+const testACL = `{
+  "clusterUser": "node",
+  "users": {
+    "node": {"password": "node-password", "rules": [{"rights": ["admin"]}]},
+    "team-a": {
+      "password": "team-a-password",
+      "tokens": ["team-a-token"],
+      "rules": [
+        {"rights": ["read", "write"], "namespaces": ["team-a"], "prefixes": ["user:"]},
+        {"rights": ["read"], "commands": [21]}
+      ]
+    }
+  }
+}`
+
+// writeACL 将 content 写入临时的 ACL 文件，返回文件路径
+func writeACL(t *testing.T, content string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "acl.json")
+	if err := ioutil.WriteFile(file, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadACL(t *testing.T) {
+	if a, err := loadACL(""); a != nil || err != nil {
+		t.Fatalf("acl should be disabled without file but got %v, %v", a, err)
+	}
+	invalid := []string{
+		`{"users": {"a": {"rules": [{"rights": ["root"]}]}}}`,
+		`{"users": {"a": {"rules": [{"rights": ["read"], "commands": [256]}]}}}`,
+		`{"clusterUser": "node", "users": {}}`,
+		`{"users": {"a": null}}`,
+		`not json`,
+	}
+	for _, content := range invalid {
+		if _, err := loadACL(writeACL(t, content)); err == nil {
+			t.Fatalf("acl %s should be invalid", content)
+		}
+	}
+
+	a, err := loadACL(writeACL(t, testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user, err := a.authenticate("team-a", "team-a-password"); err != nil || user != "team-a" {
+		t.Fatalf("password should be accepted but got %s, %v", user, err)
+	}
+	if user, err := a.authenticate("", "team-a-token"); err != nil || user != "team-a" {
+		t.Fatalf("token should be accepted but got %s, %v", user, err)
+	}
+	for _, credentials := range [][2]string{{"team-a", "wrong"}, {"nobody", ""}, {"", "wrong-token"}} {
+		if _, err := a.authenticate(credentials[0], credentials[1]); err != authenticationFailedErr {
+			t.Fatalf("%v should be rejected but got %v", credentials, err)
+		}
+	}
+	if username, password, ok := a.clusterCredentials(); !ok || username != "node" || password != "node-password" {
+		t.Fatalf("wrong cluster credentials %s, %s, %v", username, password, ok)
+	}
+}
+
+func TestTCPAuthorize(t *testing.T) {
+	a, err := loadACL(writeACL(t, testACL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	authenticator := &tcpAuthenticator{acl: a}
+	inTeamA := func(command byte, args ...[]byte) [][]byte {
+		return append([][]byte{[]byte("team-a"), {command}}, args...)
+	}
+	cases := []struct {
+		user    string
+		command byte
+		args    [][]byte
+		allowed bool
+	}{
+		{"node", statusCommand, nil, true},
+		{"node", replicaSetCommand, [][]byte{nil, []byte("order:1")}, true},
+		{"team-a", nodesCommand, nil, true},
+		{"nobody", nodesCommand, nil, false},
+
+		// 权限只在 team-a 命名空间中 user: 开头的 key 上生效
+		{"team-a", namespaceCommand, inTeamA(getCommand, []byte("user:1")), true},
+		{"team-a", namespaceCommand, inTeamA(setCommand, nil, []byte("user:1"), nil), true},
+		{"team-a", namespaceCommand, inTeamA(getCommand, []byte("order:1")), false},
+		{"team-a", getCommand, [][]byte{[]byte("user:1")}, false},
+		{"team-a", namespaceCommand, inTeamA(setManyCommand, nil, []byte("user:1"), nil, []byte("order:1"), nil), false},
+		{"team-a", namespaceCommand, inTeamA(getSetCommand, nil, []byte("user:1"), nil), true},
+		{"team-a", namespaceCommand, inTeamA(statusCommand), false},
+		{"team-a", flushNamespaceCommand, [][]byte{[]byte("team-a")}, false},
+
+		// 频道按照 key 检查前缀，匹配模式按照第一个通配符之前的部分检查前缀
+		{"team-a", publishCommand, [][]byte{[]byte("user:channel"), nil}, false},
+		{"team-a", eventsCommand, [][]byte{[]byte("team-a"), []byte("user:*")}, true},
+		{"team-a", eventsCommand, [][]byte{[]byte("team-a"), []byte("us*")}, false},
+		{"team-a", eventsCommand, [][]byte{[]byte(""), []byte("user:*")}, false},
+		{"team-a", namespaceCommand, inTeamA(subscribeCommand, []byte("user:[ab]")), true},
+		{"team-a", namespaceCommand, inTeamA(subscribeCommand, []byte("[u]ser:*")), false},
+
+		// 扫描命令被单独授予了读权限，任何命名空间和匹配模式都可以
+		{"team-a", scanCommand, [][]byte{nil, []byte("*")}, true},
+		{"team-a", namespaceCommand, inTeamA(scanCommand, nil, []byte("order:*")), true},
+	}
+	for i, c := range cases {
+		err := authenticator.Authorize(c.user, c.command, c.args)
+		if c.allowed && err != nil {
+			t.Fatalf("case %d: %s should be allowed to execute %d but got %v", i, c.user, c.command, err)
+		}
+		if !c.allowed && err == nil {
+			t.Fatalf("case %d: %s should not be allowed to execute %d", i, c.user, c.command)
+		}
+	}
+	if err = authenticator.Authorize("team-a", namespaceCommand, [][]byte{[]byte("team-a")}); err != commandNeedsMoreArgumentsErr {
+		t.Fatalf("namespace command without command should fail with %v but got %v", commandNeedsMoreArgumentsErr, err)
+	}
+}
+
+func TestHTTPAuthorize(t *testing.T) {
+	file := writeACL(t, testACL)
+	servers := startHTTPServers(t, 1, func(options *Options) {
+		options.ACLFile = file
+	})
+	server := servers[0]
+	basic := func(username string, password string) http.Header {
+		request, _ := http.NewRequest(http.MethodGet, "/", nil)
+		request.SetBasicAuth(username, password)
+		return request.Header
+	}
+	token := http.Header{"Authorization": {"Bearer team-a-token"}}
+
+	cases := []struct {
+		method string
+		uri    string
+		header http.Header
+		status int
+	}{
+		{http.MethodPut, "/ns/team-a/cache/user:1", nil, http.StatusUnauthorized},
+		{http.MethodPut, "/ns/team-a/cache/user:1", basic("team-a", "wrong"), http.StatusUnauthorized},
+		{http.MethodPut, "/ns/team-a/cache/user:1", basic("team-a", "team-a-password"), http.StatusCreated},
+		{http.MethodGet, "/ns/team-a/cache/user:1", token, http.StatusOK},
+		{http.MethodGet, "/ns/team-a/cache/order:1", token, http.StatusForbidden},
+		{http.MethodGet, "/cache/user:1", token, http.StatusForbidden},
+		{http.MethodGet, "/status", token, http.StatusForbidden},
+		{http.MethodGet, "/status", basic("node", "node-password"), http.StatusOK},
+		{http.MethodPost, "/publish/user:channel", token, http.StatusForbidden},
+		{http.MethodGet, "/ns/team-a/keys?match=order:*", token, http.StatusOK},
+
+		// 其他节点同步过来的请求需要 AdminRight
+		{http.MethodPut, "/ns/team-a/cache/user:2", http.Header{"Authorization": token["Authorization"], replicaHeader: {"true"}}, http.StatusForbidden},
+	}
+	for i, c := range cases {
+		response, body := doRequest(t, c.method, server.url(c.uri), []byte("value"), c.header)
+		if response.StatusCode != c.status {
+			t.Fatalf("case %d: %s %s should respond %d but got %s, %s", i, c.method, c.uri, c.status, response.Status, body)
+		}
+	}
+	if _, ok := server.cache.NamespaceOf("team-a").Get("user:2"); ok {
+		t.Fatal("forbidden replica request should not be stored")
+	}
+	if value, ok := server.cache.NamespaceOf("team-a").Get("user:1"); !ok || string(value) != "value" {
+		t.Fatalf("allowed request should be stored but got %s, %v", value, ok)
+	}
+	if _, ok := server.cache.NamespaceOf(caches.DefaultNamespace).Get("user:1"); ok {
+		t.Fatal("value should only be stored in team-a")
+	}
+}
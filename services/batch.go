@@ -0,0 +1,150 @@
+package services
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+var (
+	// malformedBatchErr 意味着批量命令的参数或者响应格式不正确
+	malformedBatchErr = errors.New("malformed batch")
+)
+
+// groupByOwner 将 keys 按照处理它们的节点分组
+// 读请求只要当前节点是 key 的所有者之一就可以处理，写请求只能交给主节点，所以 primary 为 true 时按照主节点分组
+// 返回值中的 owners 记录了每个 key 的所有节点，用于之后同步给副本节点
+func (n *node) groupByOwner(keys []string, primary bool) (groups map[string][]string, owners map[string][]string, err error) {
+	groups = map[string][]string{}
+	owners = make(map[string][]string, len(keys))
+	for _, key := range keys {
+		keyOwners, err := n.ownersOf(key)
+		if err != nil {
+			return nil, nil, err
+		}
+		owners[key] = keyOwners
+
+		owner := keyOwners[0]
+		if !primary && n.isOwnerOf(keyOwners) {
+			owner = n.address
+		}
+		groups[owner] = append(groups[owner], key)
+	}
+	return groups, owners, nil
+}
+
+// fanOut 并发地对每个节点执行 task，返回第一个错误
+func fanOut(groups map[string][]string, task func(node string, keys []string) error) error {
+	wg := &sync.WaitGroup{}
+	errs := make(chan error, len(groups))
+	for node, keys := range groups {
+		wg.Add(1)
+		go func(node string, keys []string) {
+			defer wg.Done()
+			if err := task(node, keys); err != nil {
+				errs <- err
+			}
+		}(node, keys)
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+// keysOf 将参数转换成 key
+func keysOf(args [][]byte) []string {
+	keys := make([]string, len(args))
+	for i, arg := range args {
+		keys[i] = string(arg)
+	}
+	return keys
+}
+
+// keyArgsOf 将 keys 转换成参数
+func keyArgsOf(keys []string) [][]byte {
+	args := make([][]byte, len(keys))
+	for i, key := range keys {
+		args[i] = []byte(key)
+	}
+	return args
+}
+
+// keysOfEntries 返回 entries 中所有的 key
+func keysOfEntries(entries map[string][]byte) []string {
+	keys := make([]string, 0, len(entries))
+	for key := range entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// entryArgsOf 将 ttl 和 keys 对应的键值对转换成批量设置命令的参数：ttl | key1 | value1 | key2 | value2 ...
+func entryArgsOf(ttl int64, keys []string, entries map[string][]byte) [][]byte {
+	ttlBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttlBytes, uint64(ttl))
+	args := make([][]byte, 0, 1+2*len(keys))
+	args = append(args, ttlBytes)
+	for _, key := range keys {
+		args = append(args, []byte(key), entries[key])
+	}
+	return args
+}
+
+// entriesOf 从批量设置命令的参数中解析出 ttl 和键值对
+func entriesOf(args [][]byte) (ttl int64, keys []string, entries map[string][]byte, err error) {
+	if len(args) < 1 || len(args[0]) != 8 || len(args)%2 != 1 {
+		return 0, nil, nil, commandNeedsMoreArgumentsErr
+	}
+	ttl = int64(binary.BigEndian.Uint64(args[0]))
+	keys = make([]string, 0, len(args)/2)
+	entries = make(map[string][]byte, len(args)/2)
+	for i := 1; i < len(args); i += 2 {
+		key := string(args[i])
+		keys = append(keys, key)
+		entries[key] = args[i+1]
+	}
+	return ttl, keys, entries, nil
+}
+
+// encodeValues 按照 keys 的顺序编码批量读取的结果，每个 key 对应：是否存在 (1) | value 长度 (4) | value
+func encodeValues(keys []string, values map[string][]byte) []byte {
+	body := make([]byte, 0, 5*len(keys))
+	length := make([]byte, 4)
+	for _, key := range keys {
+		value, ok := values[key]
+		if !ok {
+			body = append(body, 0)
+			continue
+		}
+		binary.BigEndian.PutUint32(length, uint32(len(value)))
+		body = append(body, 1)
+		body = append(body, length...)
+		body = append(body, value...)
+	}
+	return body
+}
+
+// decodeValues 解析 encodeValues 编码的结果，并将存在的键值对放入 values
+func decodeValues(body []byte, keys []string, values map[string][]byte) error {
+	for _, key := range keys {
+		if len(body) < 1 {
+			return malformedBatchErr
+		}
+		found := body[0]
+		body = body[1:]
+		if found == 0 {
+			continue
+		}
+		if len(body) < 4 {
+			return malformedBatchErr
+		}
+		length := binary.BigEndian.Uint32(body)
+		body = body[4:]
+		if uint32(len(body)) < length {
+			return malformedBatchErr
+		}
+		values[key] = body[:length]
+		body = body[length:]
+	}
+	return nil
+}
@@ -1,90 +1,280 @@
 package services
 
 import (
+	"bytes"
 	"cache/caches"
 	"cache/helpers"
+	"context"
 	"encoding/json"
+	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"io/ioutil"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"path"
 	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// replicaHeader 标记这个请求是其他节点同步过来的数据，不需要检查 key 所属的节点
+	replicaHeader = "Kafo-Replica"
+
+	// forwardedHeader 标记这个请求是其他节点代理转发过来的，不会再次转发
+	forwardedHeader = "Kafo-Forwarded"
+
+	// versionHeader 是其他节点同步过来的数据在原来节点上的版本号，只有当前节点上没有更新的值时才会写入
+	versionHeader = "Kafo-Version"
 )
 
 type HTTPServer struct {
 	*node
 	cache   *caches.Cache
 	options *Options
+	// certs 提供 TLS 使用的证书，为 nil 时不使用 TLS
+	certs *certReloader
+	// acl 记录了用户和他们的权限，为 nil 时不需要认证
+	acl *acl
+	// peer 用于和集群中的其他节点通信
+	peer *httpPeer
+	// replicator 负责将数据同步到副本节点
+	replicator *replicator
+	// migrator 负责在集群成员变化时迁移数据
+	migrator *migrator
+	// proxies 缓存了转发请求到其他节点的反向代理
+	proxies map[string]*httputil.ReverseProxy
+	// server 是监听请求的 HTTP 服务器
+	server *http.Server
+	// closing 在服务器关闭时被关闭，用于结束推送事件和消息的长连接
+	closing chan struct{}
+	// closeOnce 保证多次调用 Shutdown 时 closing 只会被关闭一次
+	closeOnce *sync.Once
+	lock      *sync.Mutex
 }
 
 func NewHTTPServer(cache *caches.Cache, options *Options) (*HTTPServer, error) {
+	certs, err := newCertReloader(options)
+	if err != nil {
+		return nil, err
+	}
+	accessControl, err := loadACL(options.ACLFile)
+	if err != nil {
+		return nil, err
+	}
 	n, err := newNode(options)
 	if err != nil {
 		return nil, err
 	}
-	return &HTTPServer{
-		node:    n,
-		cache:   cache,
-		options: options,
-	}, nil
+	hs := newHTTPServer(n, cache, options, certs, accessControl)
+	hs.migrator.autoMigrate()
+	return hs, nil
+}
+
+// newHTTPServer 在已经加入集群的节点 n 上创建 HTTP 服务器
+func newHTTPServer(n *node, cache *caches.Cache, options *Options, certs *certReloader, accessControl *acl) *HTTPServer {
+	peer := &httpPeer{client: &http.Client{Transport: certs.transport()}, scheme: certs.scheme(), acl: accessControl}
+	hs := &HTTPServer{
+		node:       n,
+		cache:      cache,
+		options:    options,
+		certs:      certs,
+		acl:        accessControl,
+		peer:       peer,
+		replicator: newReplicator(n, cache, peer),
+		migrator:   newMigrator(n, cache, peer),
+		proxies:    map[string]*httputil.ReverseProxy{},
+		closing:    make(chan struct{}),
+		closeOnce:  &sync.Once{},
+		lock:       &sync.Mutex{},
+	}
+	hs.server = &http.Server{
+		Addr:    helpers.JoinAddressAndPort(options.Address, options.Port),
+		Handler: hs.routerHandler(),
+	}
+	if certs != nil {
+		hs.server.TLSConfig = certs.serverConfig()
+	}
+	return hs
 }
 
 func (hs *HTTPServer) Run() error {
-	return http.ListenAndServe(helpers.JoinAddressAndPort(hs.options.Address, hs.options.Port), hs.routerHandler())
+	var err error
+	if hs.certs == nil {
+		err = hs.server.ListenAndServe()
+	} else {
+		// 证书由 TLSConfig 动态提供，所以不需要传入证书文件
+		err = hs.server.ListenAndServeTLS("", "")
+	}
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (hs *HTTPServer) Shutdown(ctx context.Context) error {
+	leaveErr := hs.leave(ctx)
+	// 推送事件和消息的请求不会自己结束，需要先通知它们
+	hs.closeOnce.Do(func() {
+		close(hs.closing)
+	})
+	if err := hs.server.Shutdown(ctx); err != nil {
+		return err
+	}
+	return leaveErr
 }
 
 func wrapUriWithVersion(uri string) string {
 	return path.Join("/", APIVersion, uri)
 }
 
+// namespacePathOf 返回命名空间 namespace 的路径前缀，默认的命名空间不需要前缀
+func namespacePathOf(namespace string) string {
+	if namespace == "" || namespace == caches.DefaultNamespace {
+		return ""
+	}
+	return "/ns/" + url.PathEscape(namespace)
+}
+
 func (hs *HTTPServer) routerHandler() http.Handler {
 	router := httprouter.New()
-	router.GET(wrapUriWithVersion("/cache/:key"), hs.getHandler)
-	router.PUT(wrapUriWithVersion("/cache/:key"), hs.setHandler)
-	router.DELETE(wrapUriWithVersion("/cache/:key"), hs.deleteHandler)
-	router.GET(wrapUriWithVersion("/status"), hs.statusHandler)
 
-	router.GET(wrapUriWithVersion("/nodes"), hs.nodesHandler)
+	// 不带命名空间的路径使用默认的命名空间，/ns/:ns 开头的路径使用 :ns 指定的命名空间
+	// 每个接口都按照功能相同的 TCP 命令检查权限，批量接口中的每一部分会分别检查
+	for _, prefix := range []string{"", "/ns/:ns"} {
+		router.GET(wrapUriWithVersion(prefix+"/cache/:key"), hs.guard(getCommand, hs.getHandler))
+		router.PUT(wrapUriWithVersion(prefix+"/cache/:key"), hs.guard(setCommand, hs.setHandler))
+		router.DELETE(wrapUriWithVersion(prefix+"/cache/:key"), hs.guard(deleteCommand, hs.deleteHandler))
+		router.POST(wrapUriWithVersion(prefix+"/cache/:key/incr"), hs.guard(incrementCommand, hs.incrementHandler))
+		router.GET(wrapUriWithVersion(prefix+"/cache/:key/ttl"), hs.guard(ttlCommand, hs.ttlHandler))
+		router.PUT(wrapUriWithVersion(prefix+"/cache/:key/ttl"), hs.guard(expireCommand, hs.expireHandler))
+		router.DELETE(wrapUriWithVersion(prefix+"/cache/:key/ttl"), hs.guard(expireCommand, hs.persistHandler))
+		router.POST(wrapUriWithVersion(prefix+"/batch"), hs.authenticated(hs.batchHandler))
+		router.GET(wrapUriWithVersion(prefix+"/keys"), hs.guard(scanCommand, hs.keysHandler))
+		router.GET(wrapUriWithVersion(prefix+"/events"), hs.guard(eventsCommand, hs.eventsHandler))
+	}
+	router.DELETE(wrapUriWithVersion("/ns/:ns"), hs.guard(flushNamespaceCommand, hs.flushNamespaceHandler))
+	router.POST(wrapUriWithVersion("/publish/:channel"), hs.guard(publishCommand, hs.publishHandler))
+	router.GET(wrapUriWithVersion("/subscribe"), hs.guard(subscribeCommand, hs.subscribeHandler))
+	router.GET(wrapUriWithVersion("/status"), hs.guard(statusCommand, hs.statusHandler))
+
+	router.GET(wrapUriWithVersion("/nodes"), hs.guard(nodesCommand, hs.nodesHandler))
 	return router
 }
 
+// authenticated 包装 handle，开启了 ACL 时请求必须通过认证，认证通过的用户会放到请求的 context 中
+func (hs *HTTPServer) authenticated(handle httprouter.Handle) httprouter.Handle {
+	if hs.acl == nil {
+		return handle
+	}
+	return func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		user, err := hs.acl.authenticateRequest(request)
+		if err != nil {
+			writer.Header().Set("WWW-Authenticate", `Basic realm="kafo"`)
+			writer.WriteHeader(http.StatusUnauthorized)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		handle(writer, request.WithContext(context.WithValue(request.Context(), userContextKey{}, user)), params)
+	}
+}
+
+// guard 包装 handle，开启了 ACL 时请求必须通过认证，并且用户拥有执行 command 的权限，请求中有 key、频道或者匹配模式时还会检查前缀
+func (hs *HTTPServer) guard(command byte, handle httprouter.Handle) httprouter.Handle {
+	return hs.authenticated(func(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+		if !hs.authorize(writer, request, params, command, keysOfRequest(request, params)) {
+			return
+		}
+		handle(writer, request, params)
+	})
+}
+
+// keysOfRequest 返回请求涉及的 key，和 TCP 命令一样，频道当成 key，查询参数 match 中的匹配模式转换成字面前缀
+func keysOfRequest(request *http.Request, params httprouter.Params) []string {
+	if key := params.ByName("key"); key != "" {
+		return []string{key}
+	}
+	if channel := params.ByName("channel"); channel != "" {
+		return []string{channel}
+	}
+	patterns, ok := request.URL.Query()["match"]
+	if !ok {
+		return nil
+	}
+	keys := make([]string, len(patterns))
+	for i, pattern := range patterns {
+		keys[i] = literalPrefixOf(pattern)
+	}
+	return keys
+}
+
+// userContextKey 是认证通过的用户在请求的 context 中的 key
+type userContextKey struct{}
+
+// authorize 判断请求的用户能不能在路径指定的命名空间中执行 command，不能的话会响应 403
+// 其他节点同步过来的请求会跳过 key 所属节点的检查，所以需要 AdminRight
+func (hs *HTTPServer) authorize(writer http.ResponseWriter, request *http.Request, params httprouter.Params, command byte, keys []string) bool {
+	if hs.acl == nil {
+		return true
+	}
+	if request.Header.Get(replicaHeader) != "" {
+		command = replicaSetCommand
+	}
+	// 事件接口没有指定命名空间时订阅的是所有命名空间的事件
+	namespace := namespaceNameOf(params.ByName("ns"))
+	if command == eventsCommand {
+		namespace = params.ByName("ns")
+	}
+	user, _ := request.Context().Value(userContextKey{}).(string)
+	if err := hs.acl.authorize(user, namespace, command, keys); err != nil {
+		writer.WriteHeader(http.StatusForbidden)
+		writer.Write([]byte("Error:" + err.Error()))
+		return false
+	}
+	return true
+}
+
+// namespaceOf 返回请求路径中指定的命名空间，没有指定时返回默认的命名空间
+func (hs *HTTPServer) namespaceOf(params httprouter.Params) *caches.Namespace {
+	return hs.cache.NamespaceOf(params.ByName("ns"))
+}
+
 func (hs *HTTPServer) getHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ns := hs.namespaceOf(params)
 	key := params.ByName("key")
-	node, err := hs.selectNode(key)
+	owners, err := hs.ownersOf(key)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
 
-	// 判断这个 key 所属的物理节点是否是当前节点， 如果不是， 需要响应重定向信息给客户端，并告知正确的节点地址
-	if !hs.isCurrentNode(node) {
-		writer.Header().Set("Location", node+request.RequestURI)
-		writer.WriteHeader(http.StatusTemporaryRedirect)
+	// 判断当前节点是否保存了这个 key， 如果不是， 需要响应重定向信息给客户端，并告知正确的节点地址
+	// 主节点和副本节点都可以处理读请求，这样主节点故障时副本节点可以继续提供服务
+	if !hs.isOwnerOf(owners) {
+		hs.routeTo(writer, request, owners[0])
+		return
 	}
 
-	// 当前节点处理
-	value, ok := hs.cache.Get(key)
+	// 当前节点处理，副本节点上的数据可能落后于主节点，只有主节点返回的版本号才一定能用于比较并设置，所以只有主节点会响应 ETag
+	value, version, ok := ns.GetWithVersion(key)
 	if !ok {
 		writer.WriteHeader(http.StatusNotFound)
 		return
 	}
+	if hs.isCurrentNode(owners[0]) {
+		writer.Header().Set("ETag", etagOf(version))
+	}
 	writer.Write(value)
 }
 
 func (hs *HTTPServer) setHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
 
 	// 使用一致性哈希选择出key所在的物理节点
+	ns := hs.namespaceOf(params)
 	key := params.ByName("key")
-	node, err := hs.selectNode(key)
-	if err != nil {
-		writer.WriteHeader(http.StatusInternalServerError)
-		return
-	}
-
-	// 判断这个key所属的是否是当前节点，如果不是，需要重新定向给客户端，并告知正确的节点地址
-	if !hs.isCurrentNode(node) {
-		writer.Header().Set("Location", node+request.RequestURI)
-		writer.WriteHeader(http.StatusTemporaryRedirect)
+	owners, ok := hs.checkPrimary(writer, request, key)
+	if !ok {
 		return
 	}
 
@@ -101,15 +291,206 @@ func (hs *HTTPServer) setHandler(writer http.ResponseWriter, request *http.Reque
 		return
 	}
 
-	err = hs.cache.SetWithTTL(key, value, ttl)
+	// 带有 If-Match 或者 If-None-Match: * 的请求需要比较版本号，其他节点同步过来的请求不需要
+	expectedVersion, conditional, err := expectedVersionOf(request)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	nx, xx, get := hasFlag(request, "nx"), hasFlag(request, "xx"), hasFlag(request, "get")
+	if countTrue(conditional, nx, xx, get) > 1 {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error:only one of If-Match, If-None-Match, nx, xx and get can be used"))
+		return
+	}
+	withExpiration := hasFlag(request, "ttl") || hasFlag(request, "at")
+	if withExpiration && countTrue(conditional, nx, xx, get) > 0 {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error:ttl and at cannot be used with If-Match, If-None-Match, nx, xx and get"))
+		return
+	}
+
+	// 查询参数 nx 表示只有 key 不存在时才写入，xx 表示只有 key 存在时才写入，没有写入时响应 412
+	if (nx || xx) && owners != nil {
+		set := ns.SetNX
+		if xx {
+			set = ns.SetXX
+		}
+		ok, err := set(key, value, ttl)
+		if err != nil {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		if !ok {
+			writer.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		hs.replicator.replicate(ns.Name(), owners, key)
+		writer.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	// 查询参数 get 表示写入并返回旧的值，旧的值存在时响应 200 和旧的值，否则响应 201
+	if get && owners != nil {
+		old, ok, err := ns.GetSet(key, value, ttl)
+		if err != nil {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		hs.replicator.replicate(ns.Name(), owners, key)
+		if !ok {
+			writer.WriteHeader(http.StatusCreated)
+			return
+		}
+		writer.Write(old)
+		return
+	}
+
+	if conditional && owners != nil {
+		version, err := ns.CompareAndSet(key, value, expectedVersion, ttl)
+		if caches.IsVersionMismatch(err) {
+			writer.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		hs.replicator.replicate(ns.Name(), owners, key)
+		writer.Header().Set("ETag", etagOf(version))
+		writer.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	// 查询参数 ttl 和 at 是完整的有效期，格式和 expireHandler 相同，会代替请求头 Ttl 中以秒为单位的有效期，有效期和数据一起原子地写入
+	// 其他节点迁移和同步过来的数据还带有版本号，只有当前节点上没有更新的值才会写入
+	if withExpiration {
+		expiration, err := expirationOfQuery(request)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		if versionParam := request.Header.Get(versionHeader); owners == nil && versionParam != "" {
+			version, err := strconv.ParseUint(versionParam, 10, 64)
+			if err != nil {
+				writer.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			_, err = ns.SetIfNewer(key, value, expiration, version)
+		} else {
+			err = ns.SetWithExpiration(key, value, expiration)
+		}
+		if err != nil {
+			writer.WriteHeader(http.StatusRequestEntityTooLarge)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		if owners != nil {
+			hs.replicator.replicate(ns.Name(), owners, key)
+		}
+		writer.WriteHeader(http.StatusCreated)
+		return
+	}
+
+	err = ns.SetWithTTL(key, value, ttl)
 	if err != nil {
 		writer.WriteHeader(http.StatusRequestEntityTooLarge)
 		writer.Write([]byte("Error:" + err.Error()))
 		return
 	}
+	hs.replicator.replicate(ns.Name(), owners, key)
 	writer.WriteHeader(http.StatusCreated)
 }
 
+// hasFlag 判断请求是否带有查询参数 name，参数的值会被忽略
+func hasFlag(request *http.Request, name string) bool {
+	_, ok := request.URL.Query()[name]
+	return ok
+}
+
+// countTrue 返回 flags 中为 true 的个数
+func countTrue(flags ...bool) int {
+	count := 0
+	for _, flag := range flags {
+		if flag {
+			count++
+		}
+	}
+	return count
+}
+
+// etagOf 将版本号转换成 ETag
+func etagOf(version uint64) string {
+	return `"` + strconv.FormatUint(version, 10) + `"`
+}
+
+// expectedVersionOf 从 If-Match 中解析出期望的版本号，If-None-Match: * 表示只有 key 不存在时才写入，也就是期望的版本号为 0
+// 没有这两个请求头时 conditional 为 false，表示直接写入
+func expectedVersionOf(request *http.Request) (version uint64, conditional bool, err error) {
+	if request.Header.Get("If-None-Match") == "*" {
+		return 0, true, nil
+	}
+	etag := request.Header.Get("If-Match")
+	if etag == "" {
+		return 0, false, nil
+	}
+	version, err = strconv.ParseUint(strings.Trim(strings.TrimPrefix(etag, "W/"), `"`), 10, 64)
+	return version, true, err
+}
+
+// checkPrimary 判断当前节点是否是 key 的主节点，写请求只能由主节点处理，再由主节点同步给副本节点
+// 如果不是，需要将请求交给主节点处理。其他节点同步过来的请求不需要检查，返回的 owners 为空
+func (hs *HTTPServer) checkPrimary(writer http.ResponseWriter, request *http.Request, key string) ([]string, bool) {
+	if request.Header.Get(replicaHeader) != "" {
+		return nil, true
+	}
+
+	owners, err := hs.ownersOf(key)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return nil, false
+	}
+	if !hs.isCurrentNode(owners[0]) {
+		hs.routeTo(writer, request, owners[0])
+		return nil, false
+	}
+	return owners, true
+}
+
+// routeTo 将请求交给 owner 节点处理
+// 重定向模式下会响应重定向信息给客户端，并告知正确的节点地址；代理模式下由当前节点转发请求，并将结果返回给客户端
+// 已经被转发过的请求不会再次转发，避免节点之间的一致性哈希不一致时请求被来回转发
+func (hs *HTTPServer) routeTo(writer http.ResponseWriter, request *http.Request, owner string) {
+	if hs.options.RoutingMode != ProxyRouting || request.Header.Get(forwardedHeader) != "" {
+		writer.Header().Set("Location", owner+request.RequestURI)
+		writer.WriteHeader(http.StatusTemporaryRedirect)
+		return
+	}
+	hs.proxyOf(owner).ServeHTTP(writer, request)
+}
+
+// proxyOf 返回转发请求到 owner 节点的反向代理，没有则创建
+func (hs *HTTPServer) proxyOf(owner string) *httputil.ReverseProxy {
+	hs.lock.Lock()
+	defer hs.lock.Unlock()
+	if proxy, ok := hs.proxies[owner]; ok {
+		return proxy
+	}
+	proxy := httputil.NewSingleHostReverseProxy(&url.URL{Scheme: hs.peer.scheme, Host: owner})
+	proxy.Transport = hs.peer.client.Transport
+	director := proxy.Director
+	proxy.Director = func(request *http.Request) {
+		director(request)
+		request.Header.Set(forwardedHeader, hs.address)
+	}
+	hs.proxies[owner] = proxy
+	return proxy
+}
+
 func ttlOf(request *http.Request) (int64, error) {
 	ttls, ok := request.Header["Ttl"]
 	if !ok || len(ttls) < 1 {
@@ -119,29 +500,345 @@ func ttlOf(request *http.Request) (int64, error) {
 }
 
 func (hs *HTTPServer) deleteHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ns := hs.namespaceOf(params)
 	key := params.ByName("key")
-	node, err := hs.selectNode(key)
+	owners, ok := hs.checkPrimary(writer, request, key)
+	if !ok {
+		return
+	}
+
+	// 查询参数 get 表示删除并返回删除之前的值，key 不存在时响应 404
+	if hasFlag(request, "get") && owners != nil {
+		value, ok, err := ns.GetAndDelete(key)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			writer.WriteHeader(http.StatusNotFound)
+			return
+		}
+		hs.replicator.replicate(ns.Name(), owners, key)
+		writer.Write(value)
+		return
+	}
+
+	// 当前节点处理
+	err := ns.Delete(key)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	hs.replicator.replicate(ns.Name(), owners, key)
+}
 
-	if !hs.isCurrentNode(node) {
-		writer.Header().Set("Location", node+request.RequestURI)
-		writer.WriteHeader(http.StatusTemporaryRedirect)
+// incrementHandler 将 key 对应的整数加上查询参数 delta，没有 delta 时加 1，响应体是十进制的结果
+func (hs *HTTPServer) incrementHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ns := hs.namespaceOf(params)
+	key := params.ByName("key")
+	owners, ok := hs.checkPrimary(writer, request, key)
+	if !ok {
 		return
 	}
 
-	// 当前节点处理
-	err = hs.cache.Delete(key)
+	delta := int64(1)
+	if deltaParam := request.URL.Query().Get("delta"); deltaParam != "" {
+		var err error
+		delta, err = strconv.ParseInt(deltaParam, 10, 64)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	ttl, err := ttlOf(request)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	result, err := ns.Increment(key, delta, ttl)
+	if err != nil {
+		writer.WriteHeader(http.StatusConflict)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	value := []byte(strconv.FormatInt(result, 10))
+	hs.replicator.replicate(ns.Name(), owners, key)
+	writer.Write(value)
+}
+
+// ttlHandler 响应 key 剩余的有效期，单位是毫秒，0 表示永不过期
+func (hs *HTTPServer) ttlHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ns := hs.namespaceOf(params)
+	key := params.ByName("key")
+	owners, err := hs.ownersOf(key)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !hs.isOwnerOf(owners) {
+		hs.routeTo(writer, request, owners[0])
+		return
+	}
+	ttl, ok := ns.PTTL(key)
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writer.Write([]byte(strconv.FormatInt(ttl, 10)))
+}
+
+// expireHandler 修改 key 的有效期，key 不存在时响应 404
+// 查询参数 ttl 是从现在开始的有效期，单位是毫秒，同时带有 sliding 时是滑动有效期；查询参数 at 是过期时间点的 Unix 毫秒数
+func (hs *HTTPServer) expireHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	expiration, err := expirationOfQuery(request)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	hs.expire(writer, request, params, expiration)
+}
+
+// persistHandler 移除 key 的有效期，key 不存在时响应 404
+func (hs *HTTPServer) persistHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	hs.expire(writer, request, params, caches.Expiration{})
+}
+
+// expire 将 key 的有效期修改为 expiration，再同步给副本节点
+func (hs *HTTPServer) expire(writer http.ResponseWriter, request *http.Request, params httprouter.Params, expiration caches.Expiration) {
+	ns := hs.namespaceOf(params)
+	key := params.ByName("key")
+	owners, ok := hs.checkPrimary(writer, request, key)
+	if !ok {
+		return
+	}
+	ok, err := ns.Expire(key, expiration)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	if !ok {
+		writer.WriteHeader(http.StatusNotFound)
+		return
+	}
+	hs.replicator.replicate(ns.Name(), owners, key)
+}
+
+// expirationOfQuery 从查询参数中解析出有效期，参数的含义见 expireHandler
+func expirationOfQuery(request *http.Request) (caches.Expiration, error) {
+	query := request.URL.Query()
+	if at := query.Get("at"); at != "" {
+		milliseconds, err := strconv.ParseInt(at, 10, 64)
+		if err != nil {
+			return caches.Expiration{}, err
+		}
+		return expirationOf(caches.AbsoluteExpiry, milliseconds)
+	}
+	milliseconds, err := strconv.ParseInt(query.Get("ttl"), 10, 64)
+	if err != nil {
+		return caches.Expiration{}, err
+	}
+	if hasFlag(request, "sliding") {
+		return expirationOf(caches.SlidingExpiry, milliseconds)
+	}
+	return expirationOf(caches.FixedExpiry, milliseconds)
+}
+
+// expirationQueryOf 将 expiration 编码成 expirationOfQuery 可以解析的查询参数
+func expirationQueryOf(expiration caches.Expiration) string {
+	milliseconds := strconv.FormatInt(millisecondsOfExpiration(expiration), 10)
+	switch expiration.Mode {
+	case caches.AbsoluteExpiry:
+		return "at=" + milliseconds
+	case caches.SlidingExpiry:
+		return "ttl=" + milliseconds + "&sliding"
+	default:
+		return "ttl=" + milliseconds
+	}
+}
+
+// batchRequest 是批量接口的请求体，value 在 JSON 中使用 base64 编码
+// 每个节点上依次执行设置、删除和读取，所以同一个批量请求中读取到的是设置和删除之后的结果
+type batchRequest struct {
+	Set    map[string][]byte `json:"set,omitempty"`
+	Ttl    int64             `json:"ttl,omitempty"`
+	Delete []string          `json:"delete,omitempty"`
+	Get    []string          `json:"get,omitempty"`
+}
+
+// batchResponse 是批量接口的响应体，只包含存在的 key
+type batchResponse struct {
+	Values map[string][]byte `json:"values"`
+}
+
+// batchHandler 处理批量请求
+// 批量请求中的 key 可能属于不同的节点，没办法整体重定向，所以不管是哪种路由模式，都由当前节点拆分之后并发转发给各个主节点
+func (hs *HTTPServer) batchHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	ns := hs.namespaceOf(params)
+	batch := &batchRequest{}
+	if err := json.NewDecoder(request.Body).Decode(batch); err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	parts := map[byte][]string{getManyCommand: batch.Get, setManyCommand: keysOfEntries(batch.Set), deleteManyCommand: batch.Delete}
+	for command, keys := range parts {
+		if len(keys) > 0 && !hs.authorize(writer, request, params, command, keys) {
+			return
+		}
+	}
+
+	// 其他节点同步过来的请求直接在当前节点处理
+	if request.Header.Get(replicaHeader) != "" {
+		response, err := doBatch(ns, batch)
+		hs.writeBatchResponse(writer, response, err)
+		return
+	}
+
+	batches, owners, err := hs.splitBatch(batch)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	localBatch := batches[hs.address]
+	delete(batches, hs.address)
+
+	// 已经被转发过的请求不会再次转发，避免节点之间的一致性哈希不一致时请求被来回转发
+	if len(batches) > 0 && request.Header.Get(forwardedHeader) != "" {
+		writer.WriteHeader(http.StatusMisdirectedRequest)
+		return
+	}
+
+	response, err := hs.forwardBatches(ns.Name(), batches)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	if localBatch != nil {
+		localResponse, err := doBatch(ns, localBatch)
+		if err != nil {
+			writer.WriteHeader(http.StatusInternalServerError)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		hs.replicator.replicateMany(ns.Name(), keysOfEntries(localBatch.Set), owners)
+		hs.replicator.replicateMany(ns.Name(), localBatch.Delete, owners)
+		for key, value := range localResponse.Values {
+			response.Values[key] = value
+		}
+	}
+	hs.writeBatchResponse(writer, response, nil)
+}
+
+// splitBatch 将批量请求按照 key 的主节点拆分，返回值中的 owners 记录了每个 key 的所有节点
+// 读取也交给主节点处理，保证能读到同一个批量请求中设置的值
+func (hs *HTTPServer) splitBatch(batch *batchRequest) (batches map[string]*batchRequest, owners map[string][]string, err error) {
+	batches = map[string]*batchRequest{}
+	batchOf := func(owner string) *batchRequest {
+		if _, ok := batches[owner]; !ok {
+			batches[owner] = &batchRequest{Set: map[string][]byte{}, Ttl: batch.Ttl}
+		}
+		return batches[owner]
+	}
+
+	owners = map[string][]string{}
+	group := func(keys []string, add func(b *batchRequest, keys []string)) error {
+		groups, keyOwners, err := hs.groupByOwner(keys, true)
+		if err != nil {
+			return err
+		}
+		for key, keyOwner := range keyOwners {
+			owners[key] = keyOwner
+		}
+		for owner, ownerKeys := range groups {
+			add(batchOf(owner), ownerKeys)
+		}
+		return nil
+	}
+
+	err = group(keysOfEntries(batch.Set), func(b *batchRequest, keys []string) {
+		for _, key := range keys {
+			b.Set[key] = batch.Set[key]
+		}
+	})
+	if err == nil {
+		err = group(batch.Delete, func(b *batchRequest, keys []string) {
+			b.Delete = append(b.Delete, keys...)
+		})
+	}
+	if err == nil {
+		err = group(batch.Get, func(b *batchRequest, keys []string) {
+			b.Get = append(b.Get, keys...)
+		})
+	}
+	return batches, owners, err
+}
+
+// forwardBatches 将命名空间 namespace 中拆分之后的批量请求并发转发给各个节点，并合并它们的结果
+func (hs *HTTPServer) forwardBatches(namespace string, batches map[string]*batchRequest) (*batchResponse, error) {
+	result := &batchResponse{Values: map[string][]byte{}}
+	wg := &sync.WaitGroup{}
+	lock := &sync.Mutex{}
+	var firstErr error
+	for owner, batch := range batches {
+		wg.Add(1)
+		go func(owner string, batch *batchRequest) {
+			defer wg.Done()
+			response, err := hs.peer.batch(owner, namespace, batch, http.Header{forwardedHeader: {hs.address}})
+			lock.Lock()
+			defer lock.Unlock()
+			if err != nil {
+				if firstErr == nil {
+					firstErr = err
+				}
+				return
+			}
+			for key, value := range response.Values {
+				result.Values[key] = value
+			}
+		}(owner, batch)
+	}
+	wg.Wait()
+	return result, firstErr
+}
+
+// doBatch 在当前节点的命名空间 ns 中依次执行批量请求中的设置、删除和读取
+func doBatch(ns *caches.Namespace, batch *batchRequest) (*batchResponse, error) {
+	if err := ns.SetManyWithTTL(batch.Set, batch.Ttl); err != nil {
+		return nil, err
+	}
+	if err := ns.DeleteMany(batch.Delete); err != nil {
+		return nil, err
+	}
+	return &batchResponse{Values: ns.GetMany(batch.Get)}, nil
+}
+
+func (hs *HTTPServer) writeBatchResponse(writer http.ResponseWriter, response *batchResponse, err error) {
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	body, err := json.Marshal(response)
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
 }
 
 func (hs *HTTPServer) statusHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
-	status, err := json.Marshal(hs.cache.Status())
+	status, err := json.Marshal(serverStatus{
+		Status:      hs.cache.Status(),
+		Namespaces:  namespaceStatusOf(hs.cache),
+		Migration:   hs.migrator.currentStatus(),
+		Replication: hs.replicator.currentStatus(),
+	})
 	if err != nil {
 		writer.WriteHeader(http.StatusInternalServerError)
 		return
@@ -149,6 +846,170 @@ func (hs *HTTPServer) statusHandler(writer http.ResponseWriter, request *http.Re
 	writer.Write(status)
 }
 
+// keysHandler 扫描当前节点作为主节点的 key，查询参数 match 是匹配模式，cursor 是上一次返回的游标，count 是最多返回的个数
+func (hs *HTTPServer) keysHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	query := request.URL.Query()
+	count := defaultScanCount
+	if countParam := query.Get("count"); countParam != "" {
+		var err error
+		count, err = strconv.Atoi(countParam)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			return
+		}
+	}
+
+	result, err := hs.scanPrimaryKeys(hs.namespaceOf(params), query.Get("cursor"), query.Get("match"), count)
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	body, err := json.Marshal(result)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(body)
+}
+
+// flushNamespaceHandler 清空集群中的命名空间 :ns
+// 命名空间的数据分布在集群的所有节点上，所以当前节点清空之后还需要通知其他所有节点，其他节点同步过来的请求只清空当前节点
+func (hs *HTTPServer) flushNamespaceHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	namespace := params.ByName("ns")
+	if err := hs.cache.FlushNamespace(namespace); err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	if request.Header.Get(replicaHeader) != "" {
+		return
+	}
+	if err := hs.replicator.replicateFlushNamespace(namespace); err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		writer.Write([]byte("Error:" + err.Error()))
+	}
+}
+
+// eventsHandler 使用 Server-Sent Events 推送当前节点上 key 变化的事件，查询参数 match 是 key 的匹配模式
+// 不带命名空间的路径会推送所有命名空间的事件，事件的类型是变化的原因，数据是 JSON 编码的事件
+func (hs *HTTPServer) eventsHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	subscription, err := hs.cache.Subscribe(params.ByName("ns"), request.URL.Query().Get("match"))
+	if err != nil {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error:" + err.Error()))
+		return
+	}
+	defer subscription.Close()
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case event := <-subscription.Events():
+			data, err := json.Marshal(event)
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(writer, "event: %s\ndata: %s\n\n", event.Reason, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		case <-hs.closing:
+			return
+		}
+	}
+}
+
+// publishHandler 将请求体作为消息发布到频道 :channel
+func (hs *HTTPServer) publishHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	message, err := ioutil.ReadAll(request.Body)
+	if err != nil {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if err = hs.pubsub.publish(params.ByName("channel"), message); err != nil {
+		writer.WriteHeader(http.StatusBadGateway)
+		writer.Write([]byte("Error:" + err.Error()))
+	}
+}
+
+// subscribeHandler 使用 Server-Sent Events 推送频道上的消息，查询参数 match 是频道的匹配模式，可以指定多个
+// 事件的类型是 message，数据是 JSON 编码的 ChannelMessage，关闭连接就是取消订阅
+func (hs *HTTPServer) subscribeHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
+	flusher, ok := writer.(http.Flusher)
+	if !ok {
+		writer.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	patterns := request.URL.Query()["match"]
+	if len(patterns) == 0 {
+		writer.WriteHeader(http.StatusBadRequest)
+		writer.Write([]byte("Error:at least one match is required"))
+		return
+	}
+
+	// 所有匹配模式的消息汇总到同一个管道中，由当前 goroutine 写给客户端
+	messages := make(chan ChannelMessage)
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer close(done)
+	for _, pattern := range patterns {
+		subscription, err := hs.pubsub.subscribe(pattern)
+		if err != nil {
+			writer.WriteHeader(http.StatusBadRequest)
+			writer.Write([]byte("Error:" + err.Error()))
+			return
+		}
+		defer hs.pubsub.unsubscribe(subscription)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for message := range subscription.messages {
+				select {
+				case messages <- message:
+				case <-done:
+					return
+				}
+			}
+		}()
+	}
+
+	writer.Header().Set("Content-Type", "text/event-stream")
+	writer.Header().Set("Cache-Control", "no-cache")
+	writer.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case message := <-messages:
+			data, err := json.Marshal(message)
+			if err != nil {
+				return
+			}
+			if _, err = fmt.Fprintf(writer, "event: message\ndata: %s\n\n", data); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-request.Context().Done():
+			return
+		case <-hs.closing:
+			return
+		}
+	}
+}
+
 func (hs *HTTPServer) nodesHandler(writer http.ResponseWriter, request *http.Request, params httprouter.Params) {
 	nodes, err := json.Marshal(hs.nodes())
 	if err != nil {
@@ -157,3 +1018,85 @@ func (hs *HTTPServer) nodesHandler(writer http.ResponseWriter, request *http.Req
 	}
 	writer.Write(nodes)
 }
+
+// httpPeer 使用 HTTP 协议将数据同步到其他节点
+type httpPeer struct {
+	client *http.Client
+	// scheme 是访问其他节点时使用的协议，使用 TLS 时是 https
+	scheme string
+	// acl 提供节点之间通信时使用的集群用户
+	acl *acl
+}
+
+// send 使用集群用户的身份发送请求
+func (hp *httpPeer) send(request *http.Request) (*http.Response, error) {
+	if username, password, ok := hp.acl.clusterCredentials(); ok {
+		request.SetBasicAuth(username, password)
+	}
+	return hp.client.Do(request)
+}
+
+// do 向 address 节点发送同步数据的请求，uri 是不带版本号的路径
+func (hp *httpPeer) do(method string, address string, uri string, body []byte, header http.Header) error {
+	request, err := http.NewRequest(method, hp.scheme+"://"+address+wrapUriWithVersion(uri), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	request.Header.Set(replicaHeader, "true")
+	response, err := hp.send(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("failed to replicate to node %s: %s", address, response.Status)
+	}
+	return nil
+}
+
+// keyUriOf 返回命名空间 namespace 中 key 的路径
+func keyUriOf(namespace string, key string) string {
+	return namespacePathOf(namespace) + "/cache/" + url.PathEscape(key)
+}
+
+// setWithExpiration 使用和 expireHandler 一样的查询参数发送完整的有效期，版本号放在 versionHeader 中
+func (hp *httpPeer) setWithExpiration(address string, namespace string, key string, value []byte, expiration caches.Expiration, version uint64) error {
+	header := http.Header{versionHeader: {strconv.FormatUint(version, 10)}}
+	return hp.do(http.MethodPut, address, keyUriOf(namespace, key)+"?"+expirationQueryOf(expiration), value, header)
+}
+
+func (hp *httpPeer) delete(address string, namespace string, key string) error {
+	return hp.do(http.MethodDelete, address, keyUriOf(namespace, key), nil, nil)
+}
+
+func (hp *httpPeer) flushNamespace(address string, namespace string) error {
+	return hp.do(http.MethodDelete, address, "/ns/"+url.PathEscape(namespace), nil, nil)
+}
+
+// batch 向 address 节点发送命名空间 namespace 中的批量请求
+func (hp *httpPeer) batch(address string, namespace string, batch *batchRequest, header http.Header) (*batchResponse, error) {
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequest(http.MethodPost, hp.scheme+"://"+address+wrapUriWithVersion(namespacePathOf(namespace)+"/batch"), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	response, err := hp.send(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode >= http.StatusBadRequest {
+		return nil, fmt.Errorf("failed to send batch to node %s: %s", address, response.Status)
+	}
+	result := &batchResponse{}
+	return result, json.NewDecoder(response.Body).Decode(result)
+}
@@ -0,0 +1,610 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"cache/caches"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testHTTPServer 是 startHTTPServers 启动的一个节点
+type testHTTPServer struct {
+	*HTTPServer
+	server *httptest.Server
+}
+
+// url 返回节点上 uri 的完整地址，uri 是不带版本号的路径
+func (ts *testHTTPServer) url(uri string) string {
+	return ts.server.URL + wrapUriWithVersion(uri)
+}
+
+// startHTTPServers 在本地启动 count 个 HTTP 服务器，它们的一致性哈希中包含了所有的服务器，configure 用于修改选项
+// 节点不会真的加入集群，集群成员由测试通过 setMembers 控制
+func startHTTPServers(t *testing.T, count int, configure func(options *Options)) []*testHTTPServer {
+	t.Helper()
+	servers := make([]*httptest.Server, count)
+	members := make([]string, count)
+	for i := range servers {
+		servers[i] = httptest.NewUnstartedServer(nil)
+		members[i] = servers[i].Listener.Addr().String()
+	}
+
+	result := make([]*testHTTPServer, count)
+	for i, server := range servers {
+		host, port, err := net.SplitHostPort(members[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		options := DefaultOptions()
+		options.ServerType = "http"
+		options.Address = host
+		options.Port, _ = strconv.Atoi(port)
+		options.VirtualNodeCount = 64
+		if configure != nil {
+			configure(&options)
+		}
+		accessControl, err := loadACL(options.ACLFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache, err := caches.OpenCache()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := newTestNode(&options, members)
+		hs := newHTTPServer(n, cache, &options, nil, accessControl)
+		server.Config.Handler = hs.server.Handler
+		server.Start()
+		t.Cleanup(func() {
+			stopTestNode(n)
+			server.Close()
+		})
+		result[i] = &testHTTPServer{HTTPServer: hs, server: server}
+	}
+	return result
+}
+
+// ownedBy 返回一个主节点是 owner 的 key
+func ownedBy(t *testing.T, owner *node, prefix string) string {
+	t.Helper()
+	for i := 0; i < 10000; i++ {
+		key := prefix + strconv.Itoa(i)
+		if primary, err := owner.selectNode(key); err == nil && owner.isCurrentNode(primary) {
+			return key
+		}
+	}
+	t.Fatalf("no key is owned by %s", owner.address)
+	return ""
+}
+
+// doRequest 发送请求并读取完整的响应体，不会跟随重定向，这样才能检查重定向的响应
+func doRequest(t *testing.T, method string, url string, body []byte, header http.Header) (*http.Response, []byte) {
+	t.Helper()
+	request, err := http.NewRequest(method, url, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, values := range header {
+		request.Header[name] = values
+	}
+	response, err := http.DefaultTransport.RoundTrip(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	data, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response, data
+}
+
+func TestHTTPProxyRouting(t *testing.T) {
+	servers := startHTTPServers(t, 2, func(options *Options) {
+		options.RoutingMode = ProxyRouting
+	})
+	entry, owner := servers[0], servers[1]
+	key := ownedBy(t, owner.node, "user:")
+
+	// 当前节点不负责的 key 由当前节点转发给负责的节点，客户端不需要知道 key 在哪里
+	response, _ := doRequest(t, http.MethodPut, entry.url("/ns/team-a/cache/"+key), []byte("value"), nil)
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("set should be proxied but got %s", response.Status)
+	}
+	if value, ok := owner.cache.NamespaceOf("team-a").Get(key); !ok || string(value) != "value" {
+		t.Fatalf("value should be stored on the owner but got %s, %v", value, ok)
+	}
+	if _, ok := entry.cache.NamespaceOf("team-a").Get(key); ok {
+		t.Fatal("value should not be stored on the entry node")
+	}
+	response, body := doRequest(t, http.MethodGet, entry.url("/ns/team-a/cache/"+key), nil, nil)
+	if response.StatusCode != http.StatusOK || string(body) != "value" || response.Header.Get("ETag") == "" {
+		t.Fatalf("get should be proxied to the primary but got %s, %s, %q", response.Status, body, response.Header.Get("ETag"))
+	}
+
+	// 已经被转发过的请求不会再次转发，避免节点之间的一致性哈希不一致时来回转发
+	response, _ = doRequest(t, http.MethodGet, entry.url("/ns/team-a/cache/"+key), nil, http.Header{forwardedHeader: {owner.address}})
+	if response.StatusCode != http.StatusTemporaryRedirect || response.Header.Get("Location") != owner.address+wrapUriWithVersion("/ns/team-a/cache/"+key) {
+		t.Fatalf("forwarded request should be redirected but got %s, %q", response.Status, response.Header.Get("Location"))
+	}
+
+	// 负责的节点不可用时返回错误，而不是重定向
+	owner.server.Close()
+	if response, _ = doRequest(t, http.MethodGet, entry.url("/ns/team-a/cache/"+key), nil, nil); response.StatusCode != http.StatusBadGateway {
+		t.Fatalf("proxy should fail with bad gateway when the owner is down but got %s", response.Status)
+	}
+}
+
+func TestHTTPRedirectRouting(t *testing.T) {
+	servers := startHTTPServers(t, 2, nil)
+	entry, owner := servers[0], servers[1]
+	key := ownedBy(t, owner.node, "user:")
+
+	response, _ := doRequest(t, http.MethodPut, entry.url("/cache/"+key), []byte("value"), nil)
+	if response.StatusCode != http.StatusTemporaryRedirect || response.Header.Get("Location") != owner.address+wrapUriWithVersion("/cache/"+key) {
+		t.Fatalf("set should be redirected to the owner but got %s, %q", response.Status, response.Header.Get("Location"))
+	}
+	if _, ok := owner.cache.Get(key); ok {
+		t.Fatal("redirected request should not be stored")
+	}
+}
+
+func TestHTTPShutdown(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	_, port, err := net.SplitHostPort(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	options := DefaultOptions()
+	options.ServerType = "http"
+	options.Address = "127.0.0.1"
+	options.Port, _ = strconv.Atoi(port)
+	cache, err := caches.OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs, err := NewHTTPServer(cache, &options)
+	if err != nil {
+		// 节点管理器使用固定的端口，被占用时没办法创建节点
+		t.Skipf("failed to create node: %v", err)
+	}
+	stopped := make(chan error, 1)
+	go func() {
+		stopped <- hs.Run()
+	}()
+
+	// 推送事件的请求不会自己结束，关闭时需要通知它们
+	var response *http.Response
+	for i := 0; i < 100; i++ {
+		if response, err = http.Get("http://" + address + wrapUriWithVersion("/events")); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	events := make(chan struct{})
+	go func() {
+		defer close(events)
+		ioutil.ReadAll(response.Body)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = hs.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-events:
+	case <-time.After(time.Second):
+		t.Fatal("events request should end after shutdown")
+	}
+	if err = <-stopped; err != nil {
+		t.Fatalf("run should return nil after shutdown but got %v", err)
+	}
+
+	// 重复关闭不会 panic
+	if err = hs.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHTTPBatch(t *testing.T) {
+	servers := startHTTPServers(t, 2, nil)
+	entries, keys := testEntries(20)
+	doBatch := func(batch *batchRequest) map[string][]byte {
+		t.Helper()
+		body, err := json.Marshal(batch)
+		if err != nil {
+			t.Fatal(err)
+		}
+		response, body := doRequest(t, http.MethodPost, servers[0].url("/batch"), body, nil)
+		if response.StatusCode != http.StatusOK {
+			t.Fatalf("batch should succeed but got %s, %s", response.Status, body)
+		}
+		result := batchResponse{}
+		if err = json.Unmarshal(body, &result); err != nil {
+			t.Fatal(err)
+		}
+		return result.Values
+	}
+
+	// 批量请求由收到请求的节点拆分之后转发给各个主节点，读取可以看到同一个请求中设置的值
+	values := doBatch(&batchRequest{Set: entries, Ttl: 60, Get: append(keys, "missing")})
+	if len(values) != len(keys) {
+		t.Fatalf("all keys except missing should be found but got %d", len(values))
+	}
+	for key, value := range entries {
+		if string(values[key]) != string(value) {
+			t.Fatalf("%s should be %s but got %s", key, value, values[key])
+		}
+	}
+	nodeCaches := map[string]*caches.Cache{servers[0].address: servers[0].cache, servers[1].address: servers[1].cache}
+	checkStoredOnPrimary(t, servers[0].node, nodeCaches, keys)
+	for _, key := range keys {
+		if ttl, ok := servers[1].cache.TTL(key); ok && (ttl <= 0 || ttl > 60) {
+			t.Fatalf("ttl of %s should be set on every node but got %d", key, ttl)
+		}
+	}
+
+	if values = doBatch(&batchRequest{Delete: keys[:10], Get: keys}); len(values) != 10 {
+		t.Fatalf("10 keys should be left but got %d", len(values))
+	}
+
+	// 格式错误的请求体
+	response, _ := doRequest(t, http.MethodPost, servers[0].url("/batch"), []byte("{"), nil)
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("malformed batch should be rejected but got %s", response.Status)
+	}
+}
+
+func TestHTTPIncrement(t *testing.T) {
+	servers := startHTTPServers(t, 2, nil)
+	owner := servers[0]
+	key := ownedBy(t, owner.node, "counter-")
+	increment := func(query string, header http.Header) (int, string) {
+		t.Helper()
+		response, body := doRequest(t, http.MethodPost, owner.url("/cache/"+key+"/incr"+query), nil, header)
+		return response.StatusCode, string(body)
+	}
+
+	// 默认加 1，delta 可以是负数，结果使用 Ttl 作为新的有效期
+	if status, body := increment("", nil); status != http.StatusOK || body != "1" {
+		t.Fatalf("incr should return 1 but got %d, %s", status, body)
+	}
+	if status, body := increment("?delta=-11", http.Header{"Ttl": {"60"}}); status != http.StatusOK || body != "-10" {
+		t.Fatalf("incr should return -10 but got %d, %s", status, body)
+	}
+	if ttl, ok := owner.cache.TTL(key); !ok || ttl <= 0 || ttl > 60 {
+		t.Fatalf("ttl should be set by incr but got %d, %v", ttl, ok)
+	}
+
+	if status, _ := increment("?delta=abc", nil); status != http.StatusBadRequest {
+		t.Fatalf("malformed delta should be rejected but got %d", status)
+	}
+	owner.cache.Set(key, []byte("abc"))
+	if status, _ := increment("", nil); status != http.StatusConflict {
+		t.Fatalf("incrementing a non-integer should conflict but got %d", status)
+	}
+
+	// 自增是写请求，其他节点会重定向到主节点
+	response, _ := doRequest(t, http.MethodPost, servers[1].url("/cache/"+key+"/incr"), nil, nil)
+	if response.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("incr on other node should be redirected but got %s", response.Status)
+	}
+}
+
+func TestHTTPCompareAndSet(t *testing.T) {
+	servers := startHTTPServers(t, 1, nil)
+	uri := servers[0].url("/cache/user:1")
+	set := func(value string, header http.Header) (int, string) {
+		t.Helper()
+		response, _ := doRequest(t, http.MethodPut, uri, []byte(value), header)
+		return response.StatusCode, response.Header.Get("ETag")
+	}
+
+	// If-None-Match: * 表示只有 key 不存在时才写入，成功时响应新的 ETag
+	status, etag := set("a", http.Header{"If-None-Match": {"*"}})
+	if status != http.StatusCreated || etag == "" {
+		t.Fatalf("set if absent should succeed with etag but got %d, %q", status, etag)
+	}
+	if status, _ = set("b", http.Header{"If-None-Match": {"*"}}); status != http.StatusPreconditionFailed {
+		t.Fatalf("set if absent should fail when key exists but got %d", status)
+	}
+	response, body := doRequest(t, http.MethodGet, uri, nil, nil)
+	if string(body) != "a" || response.Header.Get("ETag") != etag {
+		t.Fatalf("get should return a with etag %s but got %s, %q", etag, body, response.Header.Get("ETag"))
+	}
+
+	// If-Match 中的 ETag 和当前的一致时才写入，弱 ETag 也可以使用
+	status, newETag := set("b", http.Header{"If-Match": {"W/" + etag}})
+	if status != http.StatusCreated || newETag == "" || newETag == etag {
+		t.Fatalf("compare and set should succeed with a new etag but got %d, %q", status, newETag)
+	}
+	if status, _ = set("c", http.Header{"If-Match": {etag}}); status != http.StatusPreconditionFailed {
+		t.Fatalf("compare and set with old etag should fail but got %d", status)
+	}
+	if _, body = doRequest(t, http.MethodGet, uri, nil, nil); string(body) != "b" {
+		t.Fatalf("value should be b but got %s", body)
+	}
+
+	if status, _ = set("c", http.Header{"If-Match": {`"abc"`}}); status != http.StatusBadRequest {
+		t.Fatalf("malformed etag should be rejected but got %d", status)
+	}
+	response, _ = doRequest(t, http.MethodPut, uri+"?nx", []byte("c"), http.Header{"If-Match": {newETag}})
+	if response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("If-Match and nx should not be used together but got %s", response.Status)
+	}
+}
+
+func TestHTTPConditionalWrites(t *testing.T) {
+	servers := startHTTPServers(t, 1, nil)
+	uri := servers[0].url("/cache/user:1")
+	do := func(method string, query string, value string) (int, string) {
+		t.Helper()
+		response, body := doRequest(t, method, uri+query, []byte(value), nil)
+		return response.StatusCode, string(body)
+	}
+
+	// 没有写入时响应 412
+	if status, _ := do(http.MethodPut, "?xx", "a"); status != http.StatusPreconditionFailed {
+		t.Fatalf("xx should not write a missing key but got %d", status)
+	}
+	if status, _ := do(http.MethodPut, "?nx", "a"); status != http.StatusCreated {
+		t.Fatalf("nx should write a missing key but got %d", status)
+	}
+	if status, _ := do(http.MethodPut, "?nx", "b"); status != http.StatusPreconditionFailed {
+		t.Fatalf("nx should not overwrite but got %d", status)
+	}
+	if status, _ := do(http.MethodPut, "?xx", "b"); status != http.StatusCreated {
+		t.Fatalf("xx should overwrite but got %d", status)
+	}
+
+	// get 表示返回旧的值，旧的值存在时响应 200，否则响应 201
+	if status, body := do(http.MethodPut, "?get", "c"); status != http.StatusOK || body != "b" {
+		t.Fatalf("get set should return b but got %d, %s", status, body)
+	}
+	if status, body := do(http.MethodDelete, "?get", ""); status != http.StatusOK || body != "c" {
+		t.Fatalf("get and delete should return c but got %d, %s", status, body)
+	}
+	if status, _ := do(http.MethodDelete, "?get", ""); status != http.StatusNotFound {
+		t.Fatalf("get and delete on a missing key should respond 404 but got %d", status)
+	}
+	if status, body := do(http.MethodPut, "?get", "d"); status != http.StatusCreated || body != "" {
+		t.Fatalf("get set on a missing key should respond 201 but got %d, %s", status, body)
+	}
+
+	if status, _ := do(http.MethodPut, "?nx&xx", "e"); status != http.StatusBadRequest {
+		t.Fatalf("nx and xx should not be used together but got %d", status)
+	}
+	if _, body := do(http.MethodGet, "", ""); body != "d" {
+		t.Fatalf("value should be d but got %s", body)
+	}
+}
+
+func TestHTTPScan(t *testing.T) {
+	servers := startHTTPServers(t, 2, func(options *Options) {
+		options.ReplicaCount = 2
+	})
+	entries, keys := testEntries(30)
+	for _, server := range servers {
+		server.cache.SetMany(entries)
+		server.cache.Set("other", nil)
+	}
+
+	// 遍历所有节点并分页扫描，每个 key 只会出现一次
+	scanned := map[string]int{}
+	for _, server := range servers {
+		cursor := ""
+		for {
+			response, body := doRequest(t, http.MethodGet, server.url("/keys?match=key-*&count=7&cursor="+url.QueryEscape(cursor)), nil, nil)
+			if response.StatusCode != http.StatusOK {
+				t.Fatalf("scan should succeed but got %s, %s", response.Status, body)
+			}
+			result := scanResult{}
+			if err := json.Unmarshal(body, &result); err != nil {
+				t.Fatal(err)
+			}
+			for _, key := range result.Keys {
+				scanned[key]++
+			}
+			if cursor = result.Cursor; cursor == "" {
+				break
+			}
+		}
+	}
+	if len(scanned) != len(keys) {
+		t.Fatalf("%d keys should be scanned but got %d", len(keys), len(scanned))
+	}
+	for key, count := range scanned {
+		if _, ok := entries[key]; !ok || count != 1 {
+			t.Fatalf("%s should be scanned once but got %d", key, count)
+		}
+	}
+
+	for _, query := range []string{"?count=abc", "?match=["} {
+		if response, _ := doRequest(t, http.MethodGet, servers[0].url("/keys"+query), nil, nil); response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("scan with %s should be rejected but got %s", query, response.Status)
+		}
+	}
+}
+
+// streamEvents 订阅 url 上的 Server-Sent Events，把收到的事件放入返回的管道，测试结束时取消订阅
+func streamEvents(t *testing.T, url string) <-chan caches.Event {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	request, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response, err := http.DefaultClient.Do(request.WithContext(ctx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.StatusCode != http.StatusOK || response.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("events should be streamed but got %s, %s", response.Status, response.Header.Get("Content-Type"))
+	}
+
+	// 事件的类型是变化的原因，需要和数据中的原因一致
+	events := make(chan caches.Event, 64)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer response.Body.Close()
+		reason := ""
+		scanner := bufio.NewScanner(response.Body)
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event: "):
+				reason = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				event := caches.Event{}
+				if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil || event.Reason != reason {
+					t.Errorf("event %s should be %s: %v", line, reason, err)
+					return
+				}
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+	return events
+}
+
+func TestHTTPEvents(t *testing.T) {
+	servers := startHTTPServers(t, 1, nil)
+	server := servers[0]
+	put := func(namespace string, key string) {
+		response, body := doRequest(t, http.MethodPut, server.url(namespacePathOf(namespace)+"/cache/"+key), []byte("value"), nil)
+		if response.StatusCode != http.StatusOK && response.StatusCode != http.StatusCreated {
+			t.Fatalf("set %s should succeed but got %s, %s", key, response.Status, body)
+		}
+	}
+	syncKeys := []string{"user:sync"}
+	setSyncKey := func(key string) error {
+		put("team-a", key)
+		return nil
+	}
+
+	// 带命名空间的路径只推送这个命名空间的事件，不带命名空间的路径推送所有命名空间的事件
+	teamA := streamEvents(t, server.url("/ns/team-a/events?match=user:*"))
+	all := streamEvents(t, server.url("/events?match=user:*"))
+	syncEvents(t, teamA, syncKeys, setSyncKey)
+	syncEvents(t, all, syncKeys, setSyncKey)
+
+	put(caches.DefaultNamespace, "user:1")
+	put("team-a", "order:1")
+	put("team-a", "user:2")
+	if response, body := doRequest(t, http.MethodDelete, server.url("/ns/team-a/cache/user:2"), nil, nil); response.StatusCode != http.StatusOK {
+		t.Fatalf("delete should succeed but got %s, %s", response.Status, body)
+	}
+
+	expected := map[<-chan caches.Event]string{
+		teamA: "team-a/user:2/set,team-a/user:2/delete",
+		all:   "default/user:1/set,team-a/user:2/set,team-a/user:2/delete",
+	}
+	for events, want := range expected {
+		var received []string
+		for _, event := range syncEvents(t, events, syncKeys, setSyncKey) {
+			received = append(received, event.Namespace+"/"+event.Key+"/"+event.Reason)
+		}
+		if got := strings.Join(received, ","); got != want {
+			t.Fatalf("events should be %s but got %s", want, got)
+		}
+	}
+
+	if response, _ := doRequest(t, http.MethodGet, server.url("/events?match=["), nil, nil); response.StatusCode != http.StatusBadRequest {
+		t.Fatalf("invalid pattern should be rejected but got %s", response.Status)
+	}
+}
+
+// testExpirations 返回用于测试的有效期，key 是有效期的名字
+func testExpirations() map[string]caches.Expiration {
+	return map[string]caches.Expiration{
+		"fixed":    caches.FixedTTL(time.Hour),
+		"sliding":  caches.SlidingTTL(time.Hour),
+		"absolute": caches.ExpireAt(time.Now().Add(time.Hour)),
+		"forever":  {},
+	}
+}
+
+// checkExpiration 检查 ns 中的 key 按照名为 name 的有效期写入了，滑动有效期需要保留下来
+func checkExpiration(t *testing.T, ns *caches.Namespace, key string, name string) {
+	t.Helper()
+	value, expiration, _, ok := ns.Peek(key)
+	if !ok || string(value) != name {
+		t.Fatalf("%s should be set but got %s, %v", key, value, ok)
+	}
+	ttl, _ := ns.TTL(key)
+	switch {
+	case name == "forever" && ttl != caches.NeverDie:
+		t.Fatalf("%s should never expire but got %d", key, ttl)
+	case name != "forever" && (ttl <= 0 || ttl > 3600):
+		t.Fatalf("%s should expire in an hour but got %d", key, ttl)
+	case (name == "sliding") != (expiration.Mode == caches.SlidingExpiry):
+		t.Fatalf("%s should be %s but got mode %d", key, name, expiration.Mode)
+	}
+}
+
+func TestHTTPSetWithExpiration(t *testing.T) {
+	servers := startHTTPServers(t, 2, func(options *Options) {
+		options.ReplicaCount = 2
+	})
+	target := servers[0]
+
+	// 其他节点迁移过来的数据
+	for name, expiration := range testExpirations() {
+		if err := target.peer.setWithExpiration(target.address, "team-a", name, []byte(name), expiration, 0); err != nil {
+			t.Fatal(err)
+		}
+		checkExpiration(t, target.cache.NamespaceOf("team-a"), name, name)
+	}
+
+	// 客户端也可以使用 ttl 和 at 在写入时指定有效期，主节点写入之后同步给副本节点
+	for name, expiration := range testExpirations() {
+		key := ownedBy(t, target.node, name+"-")
+		response, body := doRequest(t, http.MethodPut, target.url("/ns/team-a/cache/"+key+"?"+expirationQueryOf(expiration)), []byte(name), nil)
+		if response.StatusCode != http.StatusCreated {
+			t.Fatalf("set %s should succeed but got %s, %s", key, response.Status, body)
+		}
+		eventually(t, key+" should be replicated", func() bool {
+			_, _, _, ok := servers[1].cache.NamespaceOf("team-a").Peek(key)
+			return ok
+		})
+		for _, server := range servers {
+			checkExpiration(t, server.cache.NamespaceOf("team-a"), key, name)
+		}
+	}
+
+	for _, query := range []string{"?ttl=abc", "?ttl=1000&nx", "?at=1&get"} {
+		key := ownedBy(t, target.node, "invalid-")
+		if response, _ := doRequest(t, http.MethodPut, target.url("/cache/"+key+query), []byte("value"), nil); response.StatusCode != http.StatusBadRequest {
+			t.Fatalf("set with %s should be rejected but got %s", query, response.Status)
+		}
+	}
+}
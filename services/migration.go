@@ -0,0 +1,186 @@
+package services
+
+import (
+	"cache/caches"
+	"stathat.com/c/consistent"
+	"sync"
+	"time"
+)
+
+const (
+	// migrationRetryDuration 迁移失败之后重试的时间间隔
+	migrationRetryDuration = 10 * time.Second
+)
+
+// migrationStatus 是数据迁移的进度
+type migrationStatus struct {
+	// Running 表示当前是否正在迁移数据
+	Running bool `json:"running"`
+	// Rounds 表示一共进行了多少轮迁移，每次一致性哈希发生变化都会进行一轮迁移
+	Rounds int64 `json:"rounds"`
+	// Scanned 表示当前这一轮已经检查过的键值对个数
+	Scanned int64 `json:"scanned"`
+	// Migrated 表示当前这一轮已经发送给新节点的键值对个数
+	Migrated int64 `json:"migrated"`
+	// Failed 表示当前这一轮发送失败的键值对个数，这些数据会在下一轮迁移时重试
+	Failed int64 `json:"failed"`
+	// StartedAt 和 FinishedAt 是当前这一轮开始和结束的时间，单位是秒
+	StartedAt  int64 `json:"startedAt"`
+	FinishedAt int64 `json:"finishedAt"`
+}
+
+// migrator 负责在一致性哈希发生变化时迁移数据
+// 对于每个 key，会比较变化前后保存它的节点，把数据发送给新增的节点，并删除当前节点不再负责的数据
+type migrator struct {
+	node  *node
+	cache *caches.Cache
+	peer  replicaPeer
+
+	// base 是上一轮迁移完成时一致性哈希中的物理节点，当前节点上的数据是按照它来分布的
+	base   []string
+	status migrationStatus
+	lock   *sync.Mutex
+}
+
+func newMigrator(n *node, cache *caches.Cache, peer replicaPeer) *migrator {
+	return &migrator{
+		node:  n,
+		cache: cache,
+		peer:  peer,
+		base:  n.currentMembers(),
+		lock:  &sync.Mutex{},
+	}
+}
+
+// autoMigrate 开启后台任务，一致性哈希发生变化时迁移数据
+// 迁移期间如果一致性哈希再次发生变化，会在这一轮结束之后再进行一轮
+func (m *migrator) autoMigrate() {
+	go func() {
+		for {
+			select {
+			case <-m.node.circleChanged:
+				m.migrate()
+			case <-m.node.stopped:
+				return
+			}
+		}
+	}()
+}
+
+// currentStatus 返回数据迁移的进度
+func (m *migrator) currentStatus() migrationStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.status
+}
+
+// updateStatus 在锁的保护下修改迁移进度
+func (m *migrator) updateStatus(update func(status *migrationStatus)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	update(&m.status)
+}
+
+// newCircleOf 使用 members 创建一个和当前节点配置相同的一致性哈希
+func (m *migrator) newCircleOf(members []string) *consistent.Consistent {
+	circle := consistent.New()
+	circle.NumberOfReplicas = m.node.options.VirtualNodeCount
+	circle.Set(members)
+	return circle
+}
+
+// migrate 按照当前的一致性哈希迁移当前节点上的数据
+func (m *migrator) migrate() {
+	members := m.node.currentMembers()
+	oldCircle := m.newCircleOf(m.base)
+	m.updateStatus(func(status *migrationStatus) {
+		*status = migrationStatus{
+			Running:   true,
+			Rounds:    status.Rounds + 1,
+			StartedAt: time.Now().Unix(),
+		}
+	})
+
+	failed := false
+	for _, ns := range m.cache.Namespaces() {
+		ns.RangeWithVersion(func(key string, value []byte, expiration caches.Expiration, version uint64) bool {
+			if !m.migrateKey(oldCircle, members, ns, key, value, expiration, version) {
+				failed = true
+			}
+			return true
+		})
+	}
+
+	// 有数据发送失败时不更新 base，过一段时间之后按照原来的分布重试
+	if failed {
+		time.AfterFunc(migrationRetryDuration, m.node.notifyCircleChanged)
+	} else {
+		m.base = members
+	}
+	m.updateStatus(func(status *migrationStatus) {
+		status.Running = false
+		status.FinishedAt = time.Now().Unix()
+	})
+}
+
+// migrateKey 迁移命名空间 ns 中的一个 key，发送失败时返回 false，version 是遍历时 key 的版本号
+// 有效期和数据在同一个请求中发送，这样新的节点上不会出现永不过期的数据，滑动有效期在新的节点上也仍然是滑动的
+// 版本号也一起发送，新的节点上已经有更新的值时不会被覆盖，比如客户端已经在新的节点上写入过，或者当前节点的数据是从旧的持久化文件中恢复的
+func (m *migrator) migrateKey(oldCircle *consistent.Consistent, members []string, ns *caches.Namespace, key string, value []byte, expiration caches.Expiration, version uint64) bool {
+	replicaCount := m.node.options.ReplicaCount
+	if replicaCount < 1 {
+		replicaCount = 1
+	}
+	newOwners, err := m.node.ownersOf(key)
+	if err != nil {
+		return false
+	}
+	oldOwners, err := oldCircle.GetN(key, replicaCount)
+	if err != nil {
+		oldOwners = nil
+	}
+
+	// 当前节点仍然保存这个 key 时，数据由变化前的节点中第一个还存活的节点负责发送，避免同一份数据被多个节点重复发送
+	// 当前节点不再保存这个 key 时总是由自己发送，因为只有确认新的节点都收到了数据才能删除，不能依赖其他节点发送成功
+	// 如果当前节点本来就不应该保存这个 key，说明数据滞留在了当前节点上，也由当前节点负责发送
+	// 重复发送的数据带有相同的版本号，新的节点只会写入一次，也不会覆盖更新的值
+	stillOwner := m.node.isOwnerOf(newOwners)
+	sender := m.node.address
+	if m.node.isOwnerOf(oldOwners) {
+		for _, owner := range oldOwners {
+			if containsNode(members, owner) {
+				sender = owner
+				break
+			}
+		}
+	}
+	if !m.node.isCurrentNode(sender) && stillOwner {
+		m.updateStatus(func(status *migrationStatus) { status.Scanned++ })
+		return true
+	}
+
+	ok := true
+	for _, owner := range newOwners {
+		if m.node.isCurrentNode(owner) || (containsNode(oldOwners, owner) && m.node.isOwnerOf(oldOwners)) {
+			continue
+		}
+		if err = m.peer.setWithExpiration(owner, ns.Name(), key, value, expiration, version); err != nil {
+			ok = false
+			continue
+		}
+		m.updateStatus(func(status *migrationStatus) { status.Migrated++ })
+	}
+
+	// 当前节点不再负责这个 key 了，所有新的节点都收到数据之后就可以删除了
+	// 遍历之后 key 可能又被写入了新的值，这时不能删除，新的值会在下一次迁移时发送
+	if ok && !stillOwner {
+		ns.CompareAndDelete(key, version)
+	}
+	m.updateStatus(func(status *migrationStatus) {
+		status.Scanned++
+		if !ok {
+			status.Failed++
+		}
+	})
+	return ok
+}
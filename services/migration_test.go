@@ -0,0 +1,162 @@
+package services
+
+import (
+	"cache/caches"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestMigrator 创建当前节点为 members[0] 的 migrator，缓存中有 count 个键值对，其中一半会过期
+func newTestMigrator(t *testing.T, members []string, count int) (*migrator, *fakePeer) {
+	t.Helper()
+	options := DefaultOptions()
+	options.VirtualNodeCount = 64
+	options.Address, options.Port = "127.0.0.1", 1
+	cache, err := caches.OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < count; i++ {
+		key := "key-" + strconv.Itoa(i)
+		expiration := caches.Expiration{}
+		if i%2 == 0 {
+			expiration = caches.SlidingTTL(time.Hour)
+		}
+		if err = cache.SetWithExpiration(key, []byte(key), expiration); err != nil {
+			t.Fatal(err)
+		}
+	}
+	peer := newFakePeer()
+	return newMigrator(newTestNode(&options, members), cache, peer), peer
+}
+
+func TestMigrate(t *testing.T) {
+	self, newcomer := "127.0.0.1:1", "127.0.0.1:2"
+	m, peer := newTestMigrator(t, []string{self}, 100)
+
+	setMembers(m.node, []string{self, newcomer})
+	m.migrate()
+
+	moved := peer.sent[newcomer]
+	if len(moved) == 0 || len(moved) == 100 {
+		t.Fatalf("some keys should be moved to the new node but got %d", len(moved))
+	}
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		owner, err := m.node.selectNode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entry, sent := moved[key]
+		_, kept := m.cache.Get(key)
+		if sent != (owner == newcomer) || kept == sent {
+			t.Fatalf("%s owned by %s should be sent %v and kept %v", key, owner, owner == newcomer, owner != newcomer)
+		}
+		// 有效期和数据一起发送，滑动有效期在新的节点上仍然是滑动的
+		if sent && i%2 == 0 && entry.expiration != caches.SlidingTTL(time.Hour) {
+			t.Fatalf("%s should be sent with its sliding ttl but got %+v", key, entry.expiration)
+		}
+		if sent && i%2 == 1 && entry.expiration != (caches.Expiration{}) {
+			t.Fatalf("%s should be sent without ttl but got %+v", key, entry.expiration)
+		}
+	}
+
+	status := m.currentStatus()
+	if status.Running || status.Rounds != 1 || status.Scanned != 100 || status.Migrated != int64(len(moved)) || status.Failed != 0 {
+		t.Fatalf("wrong migration status %+v", status)
+	}
+	if !equalNodes(m.base, []string{self, newcomer}) {
+		t.Fatalf("base should be updated after migrating but got %v", m.base)
+	}
+}
+
+func TestMigrateFailure(t *testing.T) {
+	self, newcomer := "127.0.0.1:1", "127.0.0.1:2"
+	m, peer := newTestMigrator(t, []string{self}, 20)
+	peer.setFail(errors.New("node is down"))
+
+	setMembers(m.node, []string{self, newcomer})
+	m.migrate()
+
+	// 发送失败的数据不能删除，一致性哈希按照原来的分布，下一轮迁移时重试
+	if count := m.cache.Status().Count; count != 20 {
+		t.Fatalf("no key should be deleted when sending fails but got %d keys", count)
+	}
+	if status := m.currentStatus(); status.Failed == 0 || status.Migrated != 0 {
+		t.Fatalf("wrong migration status %+v", status)
+	}
+	if !equalNodes(m.base, []string{self}) {
+		t.Fatalf("base should not be updated after failing but got %v", m.base)
+	}
+}
+
+func TestMigrateKeyWrittenDuringMigration(t *testing.T) {
+	self, newcomer := "127.0.0.1:1", "127.0.0.1:2"
+	m, peer := newTestMigrator(t, []string{self}, 0)
+	setMembers(m.node, []string{self, newcomer})
+	key := ""
+	for i := 0; key == ""; i++ {
+		if owner, _ := m.node.selectNode("key-" + strconv.Itoa(i)); owner == newcomer {
+			key = "key-" + strconv.Itoa(i)
+		}
+	}
+
+	// 遍历之后 key 又被写入了新的值，发送的是旧的值，所以不能删除新的值
+	ns := m.cache.Namespace
+	ns.Set(key, []byte("old"))
+	_, version, _ := ns.GetWithVersion(key)
+	ns.Set(key, []byte("new"))
+	if !m.migrateKey(m.newCircleOf([]string{self}), []string{self, newcomer}, ns, key, []byte("old"), caches.Expiration{}, version) {
+		t.Fatal("key should be migrated")
+	}
+	if _, ok := peer.sent[newcomer][key]; !ok {
+		t.Fatalf("%s should be sent to the new node", key)
+	}
+	if value, ok := ns.Get(key); !ok || string(value) != "new" {
+		t.Fatalf("value written during migration should be kept but got %s, %v", value, ok)
+	}
+}
+
+func TestMigratedKeyKeepsNewerValue(t *testing.T) {
+	httpServer := startHTTPServers(t, 1, nil)[0]
+	tcpServer := startTCPServers(t, 1, nil)[0]
+	targets := map[string]struct {
+		peer    replicaPeer
+		address string
+		cache   *caches.Cache
+	}{
+		"http": {httpServer.peer, httpServer.address, httpServer.cache},
+		"tcp":  {tcpServer.migrator.peer, tcpServer.address, tcpServer.cache},
+	}
+	for name, target := range targets {
+		ns := target.cache.NamespaceOf("team-a")
+		ns.Set("key", []byte("new"))
+		_, version, _ := ns.GetWithVersion("key")
+
+		// 旧的节点发送的是更早的版本，不能覆盖新的节点上已经写入的值
+		if err := target.peer.setWithExpiration(target.address, "team-a", "key", []byte("old"), caches.Expiration{}, version-1); err != nil {
+			t.Fatal(err)
+		}
+		if value, ok := ns.Get("key"); !ok || string(value) != "new" {
+			t.Fatalf("%s: older version should be ignored but got %s, %v", name, value, ok)
+		}
+
+		if err := target.peer.setWithExpiration(target.address, "team-a", "key", []byte("newer"), caches.Expiration{}, version+1); err != nil {
+			t.Fatal(err)
+		}
+		value, newVersion, ok := ns.GetWithVersion("key")
+		if !ok || string(value) != "newer" || newVersion != version+1 {
+			t.Fatalf("%s: newer version should be written but got %s, %d, %v", name, value, newVersion, ok)
+		}
+
+		// 不存在的 key 总是会被写入
+		if err := target.peer.setWithExpiration(target.address, "team-a", "absent", []byte("old"), caches.Expiration{}, 1); err != nil {
+			t.Fatal(err)
+		}
+		if value, ok := ns.Get("absent"); !ok || string(value) != "old" {
+			t.Fatalf("%s: absent key should be written but got %s, %v", name, value, ok)
+		}
+	}
+}
@@ -2,12 +2,20 @@ package services
 
 import (
 	"cache/helpers"
+	"context"
 	"github.com/hashicorp/memberlist"
 	"io/ioutil"
+	"sort"
 	"stathat.com/c/consistent"
+	"sync"
 	"time"
 )
 
+const (
+	// defaultLeaveTimeout 是离开集群时等待通知广播出去的默认时间
+	defaultLeaveTimeout = 5 * time.Second
+)
+
 // node 集群中的一个节点， 会保存一些和集群相关的数据
 type node struct {
 	// options 存储服务器相关的信息
@@ -18,6 +26,20 @@ type node struct {
 	circle *consistent.Consistent
 	// nodeManager 节点管理器 ，用于管理节点
 	nodeManager *memberlist.Memberlist
+	// events 接收集群成员变化的事件，比如有节点加入或者离开集群
+	events chan memberlist.NodeEvent
+	// members 是一致性哈希中当前的物理节点，已经排好序
+	members []string
+	// circleChanged 在一致性哈希中的物理节点发生变化时收到通知，多次变化可能只会收到一次通知
+	circleChanged chan struct{}
+	// pubsub 负责发布订阅，消息通过 nodeManager 广播给集群中的其他节点
+	pubsub *pubsub
+	// stopped 在节点离开集群之后被关闭，用于停止后台任务
+	stopped chan struct{}
+	// leaveOnce 保证多次调用 leave 时只会离开一次，leaveErr 是第一次离开的结果
+	leaveOnce *sync.Once
+	leaveErr  error
+	lock      *sync.Mutex
 }
 
 // newNode 创建一个节点实例 并使用options 去初始化
@@ -27,34 +49,44 @@ func newNode(options *Options) (*node, error) {
 		options.Cluster = []string{options.Address}
 	}
 
+	// 创建节点
+	node := &node{
+		options:       options,
+		address:       helpers.JoinAddressAndPort(options.Address, options.Port),
+		circle:        consistent.New(),
+		events:        make(chan memberlist.NodeEvent, 64),
+		circleChanged: make(chan struct{}, 1),
+		stopped:       make(chan struct{}),
+		leaveOnce:     &sync.Once{},
+		lock:          &sync.Mutex{},
+	}
+	node.pubsub = newPubsub(node)
+
 	// 创建节点管理器，后续所有和集群相关的操作都需要通过这个节点管理器
-	nodeManager, err := createNodeManager(options)
+	// 加入集群的过程中就会产生事件，所以需要先开始接收事件
+	events := node.watchEvents()
+	nodeManager, err := createNodeManager(options, node.events, &nodeDelegate{pubsub: node.pubsub})
 	if err != nil {
 		return nil, err
 	}
-
-	// 创建节点
-	node := &node{
-		options:     options,
-		address:     helpers.JoinAddressAndPort(options.Address, options.Port),
-		circle:      consistent.New(),
-		nodeManager: nodeManager,
-	}
+	node.nodeManager = nodeManager
 
 	// 注意这里设置了一致性哈希的虚拟节点数, 并开启了自动更新一致性哈希内的物理节点信息
 	node.circle.NumberOfReplicas = options.VirtualNodeCount
-	node.autoUpdateCircle()
+	node.autoUpdateCircle(events)
 	return node, nil
 }
 
-// createNodeManager 使用 options 创建并初始化节点管理器
-func createNodeManager(options *Options) (*memberlist.Memberlist, error) {
+// createNodeManager 使用 options 创建并初始化节点管理器，delegate 负责处理节点之间广播的消息
+func createNodeManager(options *Options, events chan memberlist.NodeEvent, delegate memberlist.Delegate) (*memberlist.Memberlist, error) {
 
 	// 在默认的 LAN 配置上进行设置
 	config := memberlist.DefaultLANConfig()
 	config.Name = helpers.JoinAddressAndPort(options.Address, options.Port)
 	config.BindAddr = options.Address
 	config.LogOutput = ioutil.Discard // 禁用日志输出
+	config.Events = &memberlist.ChannelEventDelegate{Ch: events}
+	config.Delegate = delegate
 
 	// 创建 memberlist 实例
 	nodeManager, err := memberlist.Create(config)
@@ -69,6 +101,10 @@ func createNodeManager(options *Options) (*memberlist.Memberlist, error) {
 
 // nodes 返回当前集群所有节点的名字
 func (n *node) nodes() []string {
+	// 没有节点管理器说明节点没有加入集群，比如在测试中，这时一致性哈希中的节点就是所有的节点
+	if n.nodeManager == nil {
+		return n.currentMembers()
+	}
 	members := n.nodeManager.Members()
 	nodes := make([]string, len(members))
 	for i, member := range members {
@@ -82,26 +118,121 @@ func (n *node) selectNode(name string) (string, error) {
 	return n.circle.Get(name)
 }
 
+// ownersOf 根据 name 选择出保存数据的所有节点，第一个是主节点，后面的是副本节点
+func (n *node) ownersOf(name string) ([]string, error) {
+	replicaCount := n.options.ReplicaCount
+	if replicaCount < 1 {
+		replicaCount = 1
+	}
+	return n.circle.GetN(name, replicaCount)
+}
+
+// isOwnerOf 判断当前节点是不是 owners 中的一个
+func (n *node) isOwnerOf(owners []string) bool {
+	return containsNode(owners, n.address)
+}
+
 // isCurrentNode 判断 address 是否指当前节点
 func (n *node) isCurrentNode(address string) bool {
 	return n.address == address
 }
 
-// updateCircle 更新一致性哈希信息
+// updateCircle 更新一致性哈希信息，物理节点发生变化时发出通知
 func (n *node) updateCircle() {
-	n.circle.Set(n.nodes())
+	members := n.nodes()
+	sort.Strings(members)
+
+	n.lock.Lock()
+	changed := !equalNodes(n.members, members)
+	n.members = members
+	n.circle.Set(members)
+	n.lock.Unlock()
+
+	if changed {
+		n.notifyCircleChanged()
+	}
+}
+
+// notifyCircleChanged 通知一致性哈希发生了变化，已经有通知没有被处理时不会重复通知
+func (n *node) notifyCircleChanged() {
+	select {
+	case n.circleChanged <- struct{}{}:
+	default:
+	}
+}
+
+// currentMembers 返回一致性哈希中当前的物理节点
+func (n *node) currentMembers() []string {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+	return n.members
+}
+
+// watchEvents 开始接收集群成员变化的事件，返回的通道会在有事件时收到通知，多个事件可能只会收到一次通知
+func (n *node) watchEvents() <-chan struct{} {
+	notifications := make(chan struct{}, 1)
+	go func() {
+		for {
+			select {
+			case <-n.events:
+				select {
+				case notifications <- struct{}{}:
+				default:
+				}
+			case <-n.stopped:
+				return
+			}
+		}
+	}()
+	return notifications
 }
 
-// autoUpdateCircle 开启定时任务去更新一致性hash信息
-func (n *node) autoUpdateCircle() {
+// autoUpdateCircle 开启定时任务去更新一致性hash信息，集群成员发生变化时也会立即更新
+func (n *node) autoUpdateCircle(events <-chan struct{}) {
 	n.updateCircle()
 	go func() {
 		ticker := time.NewTicker(time.Duration(n.options.UpdateCircleDuration) * time.Second)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				n.updateCircle()
+			case <-events:
+				n.updateCircle()
+			case <-n.stopped:
+				return
 			}
 		}
 	}()
 }
+
+// leave 通知集群中的其他节点当前节点正在离开，然后关闭节点管理器并停止后台任务
+// 通知的广播最多等到 ctx 结束，没有设置截止时间时最多等待 defaultLeaveTimeout
+// 可以多次调用，之后的调用直接返回第一次离开的结果
+func (n *node) leave(ctx context.Context) error {
+	n.leaveOnce.Do(func() {
+		timeout := defaultLeaveTimeout
+		if deadline, ok := ctx.Deadline(); ok {
+			timeout = time.Until(deadline)
+		}
+		n.leaveErr = n.nodeManager.Leave(timeout)
+		if shutdownErr := n.nodeManager.Shutdown(); n.leaveErr == nil {
+			n.leaveErr = shutdownErr
+		}
+		close(n.stopped)
+	})
+	return n.leaveErr
+}
+
+// equalNodes 判断两组排好序的节点是否相同
+func equalNodes(nodes []string, otherNodes []string) bool {
+	if len(nodes) != len(otherNodes) {
+		return false
+	}
+	for i := range nodes {
+		if nodes[i] != otherNodes[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package services
+
+import (
+	"cache/helpers"
+	"sort"
+	"stathat.com/c/consistent"
+	"sync"
+	"testing"
+)
+
+// newTestNode 创建一个不加入集群的节点，一致性哈希中的物理节点由 members 指定，用于在一个进程中模拟多个节点
+func newTestNode(options *Options, members []string) *node {
+	n := &node{
+		options:       options,
+		address:       helpers.JoinAddressAndPort(options.Address, options.Port),
+		circle:        consistent.New(),
+		circleChanged: make(chan struct{}, 1),
+		stopped:       make(chan struct{}),
+		leaveOnce:     &sync.Once{},
+		lock:          &sync.Mutex{},
+	}
+	n.circle.NumberOfReplicas = options.VirtualNodeCount
+	setMembers(n, members)
+	return n
+}
+
+// stopTestNode 停止 newTestNode 创建的节点上的后台任务，节点没有加入集群，所以不需要通知其他节点
+func stopTestNode(n *node) {
+	n.leaveOnce.Do(func() {
+		close(n.stopped)
+	})
+}
+
+// setMembers 模拟集群成员发生变化，和 updateCircle 一样更新一致性哈希并发出通知
+func setMembers(n *node, members []string) {
+	sorted := append([]string{}, members...)
+	sort.Strings(sorted)
+	n.lock.Lock()
+	n.members = sorted
+	n.circle.Set(sorted)
+	n.lock.Unlock()
+	n.notifyCircleChanged()
+}
+
+func TestOwnersOf(t *testing.T) {
+	options := DefaultOptions()
+	options.VirtualNodeCount = 64
+	options.ReplicaCount = 2
+	members := []string{"127.0.0.1:1", "127.0.0.1:2", "127.0.0.1:3"}
+	n := newTestNode(&options, members)
+
+	owners, err := n.ownersOf("key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(owners) != 2 || owners[0] == owners[1] {
+		t.Fatalf("key should be owned by 2 different nodes but got %v", owners)
+	}
+	primary, err := n.selectNode("key")
+	if err != nil || primary != owners[0] {
+		t.Fatalf("primary should be %s but got %s, %v", owners[0], primary, err)
+	}
+
+	// 副本数超过节点数时每个节点都保存一份
+	options.ReplicaCount = 5
+	if owners, err = n.ownersOf("key"); err != nil || len(owners) != len(members) {
+		t.Fatalf("key should be owned by all nodes but got %v, %v", owners, err)
+	}
+}
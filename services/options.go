@@ -1,5 +1,12 @@
 package services
 
+const (
+	// RedirectRouting 请求的 key 不属于当前节点时，告知客户端正确的节点地址，由客户端重新发送请求
+	RedirectRouting = "redirect"
+	// ProxyRouting 请求的 key 不属于当前节点时，由当前节点将请求转发给正确的节点，并将结果返回给客户端
+	ProxyRouting = "proxy"
+)
+
 type Options struct {
 	Address string
 	Port    int
@@ -14,6 +21,27 @@ type Options struct {
 
 	// Cluster 需要加入的集群
 	Cluster []string
+
+	// RoutingMode 请求的 key 不属于当前节点时的处理方式，支持 redirect 和 proxy
+	RoutingMode string
+
+	// ReplicaCount 每个 key 保存在多少个节点上，包括主节点在内，为 1 时表示不复制
+	// 副本是异步同步的，只保证最终一致，副本节点上可能读到旧的数据，详见 replicator
+	ReplicaCount int
+
+	// TLSCertFile 和 TLSKeyFile 是 PEM 格式的证书和私钥，都配置了才会使用 TLS，节点之间通信时也会使用这个证书
+	// 证书文件被替换之后会自动重新读取，不需要重启服务器
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// TLSClientCAFile 是校验客户端证书的 CA，配置之后客户端必须提供由这些 CA 签发的证书
+	TLSClientCAFile string
+
+	// TLSCAFile 是连接其他节点时校验对方证书的 CA，为空时使用系统的根证书
+	TLSCAFile string
+
+	// ACLFile 记录了用户和他们的权限，配置之后所有的请求都需要认证，格式见 acl
+	ACLFile string
 }
 
 func DefaultOptions() Options {
@@ -24,5 +52,12 @@ func DefaultOptions() Options {
 		VirtualNodeCount:     1024,
 		UpdateCircleDuration: 3,
 		Cluster:              nil,
+		RoutingMode:          RedirectRouting,
+		ReplicaCount:         1,
+		TLSCertFile:          "",
+		TLSKeyFile:           "",
+		TLSClientCAFile:      "",
+		TLSCAFile:            "",
+		ACLFile:              "",
 	}
 }
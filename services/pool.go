@@ -0,0 +1,97 @@
+package services
+
+import (
+	"cache/vex"
+	"sync"
+)
+
+const (
+	// maxIdleClientsPerNode 每个节点最多保留的空闲连接数
+	maxIdleClientsPerNode = 16
+)
+
+// clientPool 缓存了到集群中其他节点的连接，用于节点之间的通信
+// 只支持第一版协议的节点同一时间只能在一个连接上执行一个命令，所以每个节点会维护多个连接
+type clientPool struct {
+	// clients 存储每个节点的空闲连接
+	clients map[string]chan *vex.Client
+	// dial 创建到某个节点的新连接
+	dial func(address string) (*vex.Client, error)
+	lock *sync.Mutex
+}
+
+func newClientPool(dial func(address string) (*vex.Client, error)) *clientPool {
+	return &clientPool{
+		clients: map[string]chan *vex.Client{},
+		dial:    dial,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// idleClientsOf 返回 address 节点的空闲连接，没有则创建
+func (cp *clientPool) idleClientsOf(address string) chan *vex.Client {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	clients, ok := cp.clients[address]
+	if !ok {
+		clients = make(chan *vex.Client, maxIdleClientsPerNode)
+		cp.clients[address] = clients
+	}
+	return clients
+}
+
+// get 从池中取出一个到 address 的连接，没有空闲连接时创建新的连接
+func (cp *clientPool) get(address string) (*vex.Client, error) {
+	select {
+	case client := <-cp.idleClientsOf(address):
+		return client, nil
+	default:
+		return cp.dial(address)
+	}
+}
+
+// put 将连接放回池中，空闲连接过多时直接关闭
+func (cp *clientPool) put(address string, client *vex.Client) {
+	select {
+	case cp.idleClientsOf(address) <- client:
+	default:
+		client.Close()
+	}
+}
+
+// do 使用到 address 的连接执行命令，连接出错时会被关闭而不是放回池中
+func (cp *clientPool) do(address string, command byte, args [][]byte) ([]byte, error) {
+	client, err := cp.get(address)
+	if err != nil {
+		return nil, err
+	}
+	body, err := client.Do(command, args)
+	if err != nil && !vex.IsReplyError(err) {
+		client.Close()
+		return body, err
+	}
+	cp.put(address, client)
+	return body, err
+}
+
+// closeAll 关闭池中所有的空闲连接
+func (cp *clientPool) closeAll() {
+	cp.lock.Lock()
+	defer cp.lock.Unlock()
+	for address, clients := range cp.clients {
+		delete(cp.clients, address)
+		closeIdleClients(clients)
+	}
+}
+
+// closeIdleClients 关闭 clients 中所有的连接
+func closeIdleClients(clients chan *vex.Client) {
+	for {
+		select {
+		case client := <-clients:
+			client.Close()
+		default:
+			return
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package services
+
+import (
+	"github.com/hashicorp/memberlist"
+	"path"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	// publishMessageType 是节点之间转发发布的消息时使用的消息类型，写在消息的第一个字节
+	publishMessageType = byte(1)
+
+	// maxGossipMessageSize 是通过 gossip 广播的消息的最大字节数，gossip 使用 UDP 数据包，更大的消息会直接通过 TCP 发送给每个节点
+	maxGossipMessageSize = 1024
+
+	// gossipRetransmitMult 是 gossip 消息重传次数的系数，重传次数是 gossipRetransmitMult * log(节点数 + 1)
+	gossipRetransmitMult = 4
+
+	// seenMessagesSize 是记住的最近收到的消息个数，gossip 会将同一条消息发送多次，重复的消息会被丢弃
+	seenMessagesSize = 4096
+
+	// channelBufferSize 是每个订阅者可以缓冲的消息个数
+	channelBufferSize = 256
+)
+
+// ChannelMessage 是发布到频道上的一条消息
+type ChannelMessage struct {
+	// Channel 是消息被发布到的频道
+	Channel string `json:"channel"`
+	// Pattern 是订阅者订阅时使用的匹配模式
+	Pattern string `json:"pattern"`
+	Message []byte `json:"message"`
+}
+
+// channelSubscription 是一个订阅者，通过 messages 接收匹配 pattern 的频道上的消息，不再需要时必须调用 unsubscribe
+type channelSubscription struct {
+	// pattern 是频道的匹配模式，语法和 path.Match 相同，不包含通配符时只匹配同名的频道
+	pattern  string
+	messages chan ChannelMessage
+	// dropped 是因为缓冲满了而丢弃的消息个数
+	dropped uint64
+}
+
+// pubsub 实现了集群范围内的发布订阅
+// 消息先发送给当前节点上的订阅者，再通过 memberlist 广播给其他节点，每个节点只会把同一条消息发送给订阅者一次
+// 消息不会被持久化，也不保证顺序，订阅者来不及处理或者节点之间的网络出错时消息可能会丢失
+type pubsub struct {
+	node *node
+	// broadcasts 是等待通过 gossip 广播的消息
+	broadcasts *memberlist.TransmitLimitedQueue
+	// sequence 是当前节点发布的最后一条消息的序号，和节点地址一起组成消息的编号
+	sequence uint64
+
+	subscriptions map[*channelSubscription]struct{}
+	// seen 记录了最近收到的消息编号，seenOrder 按收到的顺序保存这些编号，记满之后最早的编号会被忘记
+	seen      map[string]struct{}
+	seenOrder []string
+	seenNext  int
+	lock      *sync.RWMutex
+}
+
+func newPubsub(node *node) *pubsub {
+	ps := &pubsub{
+		node:          node,
+		subscriptions: map[*channelSubscription]struct{}{},
+		seen:          map[string]struct{}{},
+		seenOrder:     make([]string, seenMessagesSize),
+		lock:          &sync.RWMutex{},
+	}
+	ps.broadcasts = &memberlist.TransmitLimitedQueue{
+		NumNodes: func() int {
+			if node.nodeManager == nil {
+				return 1
+			}
+			return node.nodeManager.NumMembers()
+		},
+		RetransmitMult: gossipRetransmitMult,
+	}
+	return ps
+}
+
+// subscribe 订阅所有匹配 pattern 的频道
+func (ps *pubsub) subscribe(pattern string) (*channelSubscription, error) {
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	subscription := &channelSubscription{
+		pattern:  pattern,
+		messages: make(chan ChannelMessage, channelBufferSize),
+	}
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	ps.subscriptions[subscription] = struct{}{}
+	return subscription, nil
+}
+
+// unsubscribe 取消订阅，订阅者的管道会被关闭，可以多次调用
+func (ps *pubsub) unsubscribe(subscription *channelSubscription) {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if _, ok := ps.subscriptions[subscription]; ok {
+		delete(ps.subscriptions, subscription)
+		close(subscription.messages)
+	}
+}
+
+// publish 将 message 发布到频道 channel，集群中所有节点上订阅了这个频道的订阅者都会收到
+func (ps *pubsub) publish(channel string, message []byte) error {
+	ps.deliver(channel, message)
+
+	sequence := atomic.AddUint64(&ps.sequence, 1)
+	id := ps.node.address + "/" + strconv.FormatUint(sequence, 10)
+	ps.markSeen(id)
+	data := []byte{publishMessageType}
+	data = appendLengthAndBytes(data, []byte(id))
+	data = appendLengthAndBytes(data, []byte(channel))
+	data = append(data, message...)
+	if len(data) <= maxGossipMessageSize {
+		ps.broadcasts.QueueBroadcast(gossipBroadcast(data))
+		return nil
+	}
+
+	// 消息放不进 gossip 的数据包，直接发送给其他每个节点
+	var firstErr error
+	for _, member := range ps.node.nodeManager.Members() {
+		if ps.node.isCurrentNode(member.Name) {
+			continue
+		}
+		if err := ps.node.nodeManager.SendReliable(member, data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// receive 处理其他节点广播过来的消息
+func (ps *pubsub) receive(data []byte) {
+	if len(data) < 1 || data[0] != publishMessageType {
+		return
+	}
+	id, rest, err := nextLengthAndBytes(data[1:])
+	if err != nil {
+		return
+	}
+	channel, message, err := nextLengthAndBytes(rest)
+	if err != nil {
+		return
+	}
+	if !ps.markSeen(string(id)) {
+		return
+	}
+	ps.deliver(string(channel), message)
+}
+
+// markSeen 记住消息编号 id，这个编号已经见过时返回 false
+func (ps *pubsub) markSeen(id string) bool {
+	ps.lock.Lock()
+	defer ps.lock.Unlock()
+	if _, ok := ps.seen[id]; ok {
+		return false
+	}
+	delete(ps.seen, ps.seenOrder[ps.seenNext])
+	ps.seenOrder[ps.seenNext] = id
+	ps.seenNext = (ps.seenNext + 1) % len(ps.seenOrder)
+	ps.seen[id] = struct{}{}
+	return true
+}
+
+// deliver 将消息发送给当前节点上所有匹配的订阅者，订阅者的缓冲满了时消息会被丢弃
+func (ps *pubsub) deliver(channel string, message []byte) {
+	ps.lock.RLock()
+	defer ps.lock.RUnlock()
+	for subscription := range ps.subscriptions {
+		if matched, _ := path.Match(subscription.pattern, channel); !matched {
+			continue
+		}
+		select {
+		case subscription.messages <- ChannelMessage{Channel: channel, Pattern: subscription.pattern, Message: message}:
+		default:
+			atomic.AddUint64(&subscription.dropped, 1)
+		}
+	}
+}
+
+// gossipBroadcast 是一条通过 gossip 广播的消息
+type gossipBroadcast []byte
+
+func (gb gossipBroadcast) Invalidates(other memberlist.Broadcast) bool {
+	return false
+}
+
+func (gb gossipBroadcast) Message() []byte {
+	return gb
+}
+
+func (gb gossipBroadcast) Finished() {}
+
+// nodeDelegate 接收其他节点通过 memberlist 发送过来的消息，并提供需要广播的消息
+type nodeDelegate struct {
+	pubsub *pubsub
+}
+
+func (nd *nodeDelegate) NodeMeta(limit int) []byte {
+	return nil
+}
+
+// NotifyMsg 处理其他节点发送过来的消息，msg 在返回之后会被 memberlist 复用，所以需要先复制一份
+func (nd *nodeDelegate) NotifyMsg(msg []byte) {
+	data := make([]byte, len(msg))
+	copy(data, msg)
+	nd.pubsub.receive(data)
+}
+
+func (nd *nodeDelegate) GetBroadcasts(overhead int, limit int) [][]byte {
+	return nd.pubsub.broadcasts.GetBroadcasts(overhead, limit)
+}
+
+func (nd *nodeDelegate) LocalState(join bool) []byte {
+	return nil
+}
+
+func (nd *nodeDelegate) MergeRemoteState(buf []byte, join bool) {}
+
+// encodeChannelMessage 将消息编码成 频道 | 匹配模式 | 消息，用于 TCP 协议推送给订阅者
+func encodeChannelMessage(message ChannelMessage) []byte {
+	body := appendLengthAndBytes(nil, []byte(message.Channel))
+	body = appendLengthAndBytes(body, []byte(message.Pattern))
+	return append(body, message.Message...)
+}
+
+// decodeChannelMessage 解码 encodeChannelMessage 编码的消息
+func decodeChannelMessage(body []byte) (ChannelMessage, error) {
+	channel, rest, err := nextLengthAndBytes(body)
+	if err != nil {
+		return ChannelMessage{}, err
+	}
+	pattern, message, err := nextLengthAndBytes(rest)
+	if err != nil {
+		return ChannelMessage{}, err
+	}
+	return ChannelMessage{Channel: string(channel), Pattern: string(pattern), Message: message}, nil
+}
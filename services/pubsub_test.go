@@ -0,0 +1,206 @@
+package services
+
+import (
+	"bytes"
+	"cache/helpers"
+	"context"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// newTestPubsub 创建一个不加入集群的节点上的发布订阅，消息只能通过 gossip 队列交给其他节点
+func newTestPubsub(t *testing.T, address string) *pubsub {
+	t.Helper()
+	options := DefaultOptions()
+	options.Address = address
+	n := newTestNode(&options, []string{helpers.JoinAddressAndPort(address, options.Port)})
+	t.Cleanup(func() { stopTestNode(n) })
+	n.pubsub = newPubsub(n)
+	return n.pubsub
+}
+
+// receiveMessage 从 subscription 中读取一条消息，等待超时时返回 false
+func receiveMessage(subscription *channelSubscription) (ChannelMessage, bool) {
+	select {
+	case message, ok := <-subscription.messages:
+		return message, ok
+	case <-time.After(3 * time.Second):
+		return ChannelMessage{}, false
+	}
+}
+
+// checkNoMessage 检查 subscription 中没有消息
+func checkNoMessage(t *testing.T, subscription *channelSubscription) {
+	t.Helper()
+	select {
+	case message := <-subscription.messages:
+		t.Fatalf("%s should not receive message from %s", subscription.pattern, message.Channel)
+	default:
+	}
+}
+
+func TestPubsubPatterns(t *testing.T) {
+	ps := newTestPubsub(t, "127.0.0.1")
+	if _, err := ps.subscribe("["); err == nil {
+		t.Fatal("invalid pattern should be rejected")
+	}
+	exact, err := ps.subscribe("news/sports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wildcard, err := ps.subscribe("news/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 匹配的语法和 path.Match 相同，* 不会匹配 /
+	if err = ps.publish("news/sports", []byte("goal")); err != nil {
+		t.Fatal(err)
+	}
+	for _, subscription := range []*channelSubscription{exact, wildcard} {
+		message, ok := receiveMessage(subscription)
+		if !ok || message.Channel != "news/sports" || message.Pattern != subscription.pattern || string(message.Message) != "goal" {
+			t.Fatalf("%s should receive goal but got %+v, %v", subscription.pattern, message, ok)
+		}
+	}
+	for _, channel := range []string{"news/sports/today", "news", "weather"} {
+		if err = ps.publish(channel, []byte("other")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkNoMessage(t, exact)
+	checkNoMessage(t, wildcard)
+
+	// 订阅者来不及处理时消息会被丢弃并计数
+	for i := 0; i < channelBufferSize+1; i++ {
+		ps.publish("news/sports", []byte("goal"))
+	}
+	if dropped := exact.dropped; dropped != 1 {
+		t.Fatalf("1 message should be dropped but got %d", dropped)
+	}
+}
+
+func TestPubsubUnsubscribe(t *testing.T) {
+	ps := newTestPubsub(t, "127.0.0.1")
+	subscription, err := ps.subscribe("news/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps.unsubscribe(subscription)
+	if _, ok := <-subscription.messages; ok {
+		t.Fatal("messages should be closed after unsubscribing")
+	}
+
+	// 取消订阅可以多次调用，之后发布的消息不会发送给这个订阅者
+	ps.unsubscribe(subscription)
+	if err = ps.publish("news/sports", []byte("goal")); err != nil {
+		t.Fatal(err)
+	}
+	if len(ps.subscriptions) != 0 {
+		t.Fatalf("there should be no subscription but got %d", len(ps.subscriptions))
+	}
+}
+
+func TestPubsubIgnoresRepeatedMessages(t *testing.T) {
+	sender := newTestPubsub(t, "127.0.0.1")
+	receiver := newTestPubsub(t, "127.0.0.2")
+	subscription, err := receiver.subscribe("news/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	own, err := sender.subscribe("news/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// gossip 会把同一条消息发送多次，这里把队列中的消息交给接收方两次
+	if err = sender.publish("news/sports", []byte("goal")); err != nil {
+		t.Fatal(err)
+	}
+	broadcasts := (&nodeDelegate{pubsub: sender}).GetBroadcasts(0, maxGossipMessageSize*4)
+	if len(broadcasts) != 1 {
+		t.Fatalf("1 message should be broadcast but got %d", len(broadcasts))
+	}
+	delegate := &nodeDelegate{pubsub: receiver}
+	delegate.NotifyMsg(broadcasts[0])
+	delegate.NotifyMsg(broadcasts[0])
+	if message, ok := receiveMessage(subscription); !ok || message.Channel != "news/sports" || string(message.Message) != "goal" {
+		t.Fatalf("goal should be received but got %+v, %v", message, ok)
+	}
+	checkNoMessage(t, subscription)
+
+	// 自己发布的消息被其他节点转发回来时也不会再发送给订阅者
+	if message, ok := receiveMessage(own); !ok || string(message.Message) != "goal" {
+		t.Fatalf("goal should be delivered to local subscribers but got %+v, %v", message, ok)
+	}
+	(&nodeDelegate{pubsub: sender}).NotifyMsg(broadcasts[0])
+	checkNoMessage(t, own)
+
+	// 只记住最近的 seenMessagesSize 个编号，更早的编号会被忘记
+	if !receiver.markSeen("first") || receiver.markSeen("first") {
+		t.Fatal("first should be seen only once")
+	}
+	for i := 0; i < seenMessagesSize; i++ {
+		receiver.markSeen("message-" + strconv.Itoa(i))
+	}
+	if !receiver.markSeen("first") {
+		t.Fatal("first should be forgotten")
+	}
+	if len(receiver.seen) != seenMessagesSize {
+		t.Fatalf("%d ids should be remembered but got %d", seenMessagesSize, len(receiver.seen))
+	}
+}
+
+// startClusterNodes 使用 memberlist 启动两个真正组成集群的节点，第二个节点加入第一个节点
+// memberlist 使用固定的端口，所以两个节点需要绑定不同的回环地址，无法绑定时跳过测试
+func startClusterNodes(t *testing.T) []*node {
+	t.Helper()
+	var nodes []*node
+	for i, address := range []string{"127.0.0.1", "127.0.0.2"} {
+		options := DefaultOptions()
+		options.Address = address
+		options.UpdateCircleDuration = 1
+		if i > 0 {
+			options.Cluster = []string{nodes[0].options.Address}
+		}
+		n, err := newNode(&options)
+		if err != nil {
+			t.Skipf("cluster nodes cannot be started: %v", err)
+		}
+		t.Cleanup(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+			defer cancel()
+			n.leave(ctx)
+		})
+		nodes = append(nodes, n)
+	}
+	eventually(t, "nodes should join the cluster", func() bool {
+		return nodes[0].nodeManager.NumMembers() == 2 && nodes[1].nodeManager.NumMembers() == 2
+	})
+	return nodes
+}
+
+func TestPubsubAcrossNodes(t *testing.T) {
+	nodes := startClusterNodes(t)
+	subscription, err := nodes[1].pubsub.subscribe("news/*")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 小消息通过 gossip 广播，放不进 gossip 数据包的大消息直接通过 TCP 发送
+	large := bytes.Repeat([]byte("x"), maxGossipMessageSize*2)
+	for _, message := range [][]byte{[]byte("goal"), large} {
+		if err = nodes[0].pubsub.publish("news/sports", message); err != nil {
+			t.Fatal(err)
+		}
+		received, ok := receiveMessage(subscription)
+		if !ok || received.Channel != "news/sports" || !bytes.Equal(received.Message, message) {
+			t.Fatalf("message of %d bytes should be received but got %d bytes, %v", len(message), len(received.Message), ok)
+		}
+	}
+
+	// gossip 重传的消息不会重复发送给订阅者
+	time.Sleep(500 * time.Millisecond)
+	checkNoMessage(t, subscription)
+}
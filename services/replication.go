@@ -0,0 +1,341 @@
+package services
+
+import (
+	"cache/caches"
+	"hash/fnv"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// replicationWorkers 是同步到每个副本节点时使用的 goroutine 个数，key 按照哈希值分给固定的 goroutine，所以同一个 key 总是按顺序同步
+	replicationWorkers = 4
+
+	// maxPendingKeys 是每个 goroutine 最多记录的等待同步的 key 个数，超过之后会丢弃记录的 key，改为完整地同步一次
+	maxPendingKeys = 16384
+
+	// replicationRetryDuration 是同步失败之后重试的时间间隔
+	replicationRetryDuration = time.Second
+)
+
+// replicaPeer 用于将数据同步到集群中的其他节点，TCP 和 HTTP 服务器使用各自的协议实现
+type replicaPeer interface {
+	// setWithExpiration 将命名空间 namespace 中的键值对连同完整的有效期和版本号一起同步到 address 节点，滑动有效期在对方节点上仍然是滑动的
+	// 对方节点只有在 key 不存在或者自己的版本号不比 version 新时才会写入，见 caches.Namespace.SetIfNewer
+	setWithExpiration(address string, namespace string, key string, value []byte, expiration caches.Expiration, version uint64) error
+	// delete 删除 address 节点上命名空间 namespace 中的 key
+	delete(address string, namespace string, key string) error
+	// flushNamespace 清空 address 节点上的命名空间 namespace
+	flushNamespace(address string, namespace string) error
+}
+
+// replicationStatus 是同步数据到副本节点的统计信息
+type replicationStatus struct {
+	// Failed 表示一共有多少次同步失败了，失败的 key 会在一段时间之后重试
+	Failed uint64 `json:"failed"`
+	// Pending 表示当前有多少个 key 在等待同步
+	Pending int `json:"pending"`
+	// Resyncs 表示一共对副本节点进行了多少次完整的同步
+	Resyncs uint64 `json:"resyncs"`
+}
+
+// pendingKey 是等待同步的 key 和它所在的命名空间
+type pendingKey struct {
+	namespace string
+	key       string
+}
+
+// replicaQueue 记录了一个副本节点上的一部分 key 的修改，由一个 goroutine 负责同步
+type replicaQueue struct {
+	replica string
+	// shard 是 queue 负责的 key 的编号，见 shardOf
+	shard int
+	// pending 是等待同步的 key，resync 表示需要把负责的 key 完整地同步一次
+	pending map[pendingKey]struct{}
+	resync  bool
+	// notify 在有 key 需要同步时收到通知
+	notify chan struct{}
+	lock   *sync.Mutex
+}
+
+func newReplicaQueue(replica string, shard int) *replicaQueue {
+	return &replicaQueue{
+		replica: replica,
+		shard:   shard,
+		pending: map[pendingKey]struct{}{},
+		notify:  make(chan struct{}, 1),
+		lock:    &sync.Mutex{},
+	}
+}
+
+// add 在锁的保护下记录需要同步的 key，记录的 key 太多时改为完整地同步一次
+func (q *replicaQueue) add(key pendingKey) {
+	if len(q.pending) >= maxPendingKeys {
+		q.pending = map[pendingKey]struct{}{}
+		q.resync = true
+	}
+	q.pending[key] = struct{}{}
+}
+
+// mark 将 key 标记为需要同步，并通知负责同步的 goroutine
+func (q *replicaQueue) mark(key pendingKey) {
+	q.lock.Lock()
+	q.add(key)
+	q.lock.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// take 取出所有等待同步的 key 和是否需要完整地同步
+func (q *replicaQueue) take() (map[pendingKey]struct{}, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	pending, resync := q.pending, q.resync
+	q.pending, q.resync = map[pendingKey]struct{}{}, false
+	return pending, resync
+}
+
+// retry 把没有同步成功的 keys 放回 queue
+func (q *replicaQueue) retry(keys map[pendingKey]struct{}) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for key := range keys {
+		q.add(key)
+	}
+}
+
+// requestResync 让 queue 在下次同步时先完整地同步一次
+func (q *replicaQueue) requestResync() {
+	q.lock.Lock()
+	q.resync = true
+	q.lock.Unlock()
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+// size 返回等待同步的 key 的个数
+func (q *replicaQueue) size() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.pending)
+}
+
+// replicator 负责将主节点上的修改同步到副本节点
+// 同步是异步的，主节点写入成功之后就会响应客户端，副本节点上的数据是最终一致的：
+//   - 写请求只会把 key 标记为需要同步，后台的 goroutine 再读取 key 当前的值、有效期和版本号发送给副本节点，key 不存在时发送删除，
+//     同一个副本节点上的同一个 key 总是由同一个 goroutine 同步，所以旧的状态不会在新的状态之后到达副本节点
+//   - 副本节点使用 caches.Namespace.SetIfNewer 写入，即使和数据迁移同时发生，版本号更旧的数据也不会覆盖更新的数据
+//   - 同步失败时会在一段时间之后重试，重试时会先把这个副本节点上由当前节点负责的 key 完整地同步一次，
+//     这样副本节点重启之后丢失的数据也能追上来
+//   - 等待同步的 key 太多时也会改为完整地同步一次，但是完整同步只会发送存在的 key，这期间被删除的 key 会留在副本节点上，直到过期或者再次被修改
+//   - 副本节点也会处理读请求，所以读到的可能是旧的数据，需要读到最新数据的客户端应该读取主节点，比如使用 getWithVersion
+type replicator struct {
+	node  *node
+	cache *caches.Cache
+	peer  replicaPeer
+	// queues 记录了每个副本节点的同步队列，第一次同步到某个副本节点时创建，并启动 replicationWorkers 个 goroutine
+	queues map[string][]*replicaQueue
+	// failed 是同步失败的次数，resyncs 是完整同步的次数，使用原子操作修改
+	failed  uint64
+	resyncs uint64
+	lock    *sync.Mutex
+}
+
+func newReplicator(n *node, cache *caches.Cache, peer replicaPeer) *replicator {
+	return &replicator{
+		node:   n,
+		cache:  cache,
+		peer:   peer,
+		queues: map[string][]*replicaQueue{},
+		lock:   &sync.Mutex{},
+	}
+}
+
+// shardOf 返回负责同步 key 的 goroutine 的编号
+func shardOf(key string) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % replicationWorkers)
+}
+
+// replicasOf 返回 owners 中除了当前节点之外的节点
+func (r *replicator) replicasOf(owners []string) []string {
+	replicas := make([]string, 0, len(owners))
+	for _, owner := range owners {
+		if !r.node.isCurrentNode(owner) {
+			replicas = append(replicas, owner)
+		}
+	}
+	return replicas
+}
+
+// isReplicaOf 判断当前节点是不是 key 的主节点，并且 replica 是 key 的副本节点
+func (r *replicator) isReplicaOf(replica string, key string) bool {
+	owners, err := r.node.ownersOf(key)
+	return err == nil && r.node.isCurrentNode(owners[0]) && containsNode(owners[1:], replica)
+}
+
+// queueOf 返回 replica 节点上负责同步 key 的队列
+func (r *replicator) queueOf(replica string, key string) *replicaQueue {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	queues, ok := r.queues[replica]
+	if !ok {
+		queues = make([]*replicaQueue, replicationWorkers)
+		for shard := range queues {
+			queues[shard] = newReplicaQueue(replica, shard)
+			go r.work(queues[shard])
+		}
+		r.queues[replica] = queues
+	}
+	return queues[shardOf(key)]
+}
+
+// replicate 将命名空间 namespace 中的 key 标记为需要同步到 owners 中的副本节点，写入、修改有效期和删除都使用它
+func (r *replicator) replicate(namespace string, owners []string, key string) {
+	for _, replica := range r.replicasOf(owners) {
+		r.queueOf(replica, key).mark(pendingKey{namespace: namespace, key: key})
+	}
+}
+
+// replicateMany 和 replicate 一样，用于批量的修改，owners 记录了每个 key 的所有节点
+func (r *replicator) replicateMany(namespace string, keys []string, owners map[string][]string) {
+	for _, key := range keys {
+		r.replicate(namespace, owners[key], key)
+	}
+}
+
+// work 在后台同步 q 中的 key，失败时等待一段时间之后重试，节点离开集群之后退出
+func (r *replicator) work(q *replicaQueue) {
+	for {
+		select {
+		case <-q.notify:
+		case <-r.node.stopped:
+			return
+		}
+		for !r.flush(q) {
+			select {
+			case <-time.After(replicationRetryDuration):
+			case <-r.node.stopped:
+				return
+			}
+		}
+	}
+}
+
+// flush 同步 q 中所有等待的 key，失败时立即停止并返回 false，没有同步成功的 key 会被放回 q 中
+// 同步失败说明副本节点可能重启过，丢失了之前同步过去的数据，所以这个副本节点上所有的队列都会完整地同步一次
+func (r *replicator) flush(q *replicaQueue) bool {
+	pending, resync := q.take()
+	ok := !resync || r.resync(q)
+	for key := range pending {
+		if !ok {
+			break
+		}
+		if err := r.sync(q.replica, key); err != nil {
+			ok = false
+			break
+		}
+		delete(pending, key)
+	}
+	if !ok {
+		q.retry(pending)
+		r.resyncReplica(q.replica)
+	}
+	return ok
+}
+
+// resyncReplica 让 replica 节点上所有的队列在下次同步时先完整地同步一次
+func (r *replicator) resyncReplica(replica string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, q := range r.queues[replica] {
+		q.requestResync()
+	}
+}
+
+// sync 把 key 当前的状态发送给 replica 节点，key 不存在时删除副本节点上的 key
+// 集群成员变化之后当前节点可能不再是主节点，或者 replica 不再是副本节点，这时由数据迁移负责，不需要再同步
+func (r *replicator) sync(replica string, key pendingKey) error {
+	if !r.isReplicaOf(replica, key.key) {
+		return nil
+	}
+	value, expiration, version, ok := r.cache.NamespaceOf(key.namespace).Peek(key.key)
+	if !ok {
+		return r.record(replica, r.peer.delete(replica, key.namespace, key.key))
+	}
+	return r.record(replica, r.peer.setWithExpiration(replica, key.namespace, key.key, value, expiration, version))
+}
+
+// resync 把 q 负责的所有 key 中，当前节点是主节点并且 q.replica 是副本节点的 key 发送给副本节点，失败时立即停止并返回 false
+// 遍历的是快照，遍历期间的修改会被标记到 q 中，在完整同步之后再同步
+func (r *replicator) resync(q *replicaQueue) bool {
+	atomic.AddUint64(&r.resyncs, 1)
+	for _, ns := range r.cache.Namespaces() {
+		var err error
+		ns.RangeWithVersion(func(key string, value []byte, expiration caches.Expiration, version uint64) bool {
+			if shardOf(key) != q.shard || !r.isReplicaOf(q.replica, key) {
+				return true
+			}
+			err = r.record(q.replica, r.peer.setWithExpiration(q.replica, ns.Name(), key, value, expiration, version))
+			return err == nil
+		})
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// record 记录同步到 replica 节点的结果，失败时输出日志并增加失败次数，然后原样返回 err
+func (r *replicator) record(replica string, err error) error {
+	if err != nil {
+		atomic.AddUint64(&r.failed, 1)
+		log.Printf("failed to replicate to node %s: %v", replica, err)
+	}
+	return err
+}
+
+// currentStatus 返回同步的统计信息
+func (r *replicator) currentStatus() replicationStatus {
+	status := replicationStatus{
+		Failed:  atomic.LoadUint64(&r.failed),
+		Resyncs: atomic.LoadUint64(&r.resyncs),
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, queues := range r.queues {
+		for _, q := range queues {
+			status.Pending += q.size()
+		}
+	}
+	return status
+}
+
+// replicateFlushNamespace 通知集群中的其他所有节点清空命名空间 namespace
+// 和其他同步操作不同，清空操作是同步执行的，失败时会返回错误，因为调用方需要知道数据有没有真的被清空
+func (r *replicator) replicateFlushNamespace(namespace string) error {
+	groups := map[string][]string{}
+	for _, replica := range r.replicasOf(r.node.currentMembers()) {
+		groups[replica] = nil
+	}
+	return fanOut(groups, func(replica string, keys []string) error {
+		return r.record(replica, r.peer.flushNamespace(replica, namespace))
+	})
+}
+
+// containsNode 判断 nodes 中是否包含 address
+func containsNode(nodes []string, address string) bool {
+	for _, node := range nodes {
+		if node == address {
+			return true
+		}
+	}
+	return false
+}
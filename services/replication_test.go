@@ -0,0 +1,313 @@
+package services
+
+import (
+	"cache/caches"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeEntry 是 fakePeer 最后一次发送给某个节点的 key 的状态
+type fakeEntry struct {
+	value      []byte
+	expiration caches.Expiration
+	version    uint64
+	deleted    bool
+}
+
+// fakePeer 记录发送给其他节点的数据，fail 不为 nil 时所有的发送都返回这个错误
+type fakePeer struct {
+	fail error
+	// sent 记录了最后一次发送给每个节点的每个 key 的状态
+	sent map[string]map[string]fakeEntry
+	lock *sync.Mutex
+}
+
+func newFakePeer() *fakePeer {
+	return &fakePeer{
+		sent: map[string]map[string]fakeEntry{},
+		lock: &sync.Mutex{},
+	}
+}
+
+// setFail 修改 fail，同步是在后台进行的，所以需要加锁
+func (fp *fakePeer) setFail(err error) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	fp.fail = err
+}
+
+// lastSent 返回最后一次发送给 address 节点的 key 的状态
+func (fp *fakePeer) lastSent(address string, key string) (fakeEntry, bool) {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	entry, ok := fp.sent[address][key]
+	return entry, ok
+}
+
+func (fp *fakePeer) record(address string, key string, entry fakeEntry) error {
+	fp.lock.Lock()
+	defer fp.lock.Unlock()
+	if fp.fail != nil {
+		return fp.fail
+	}
+	if fp.sent[address] == nil {
+		fp.sent[address] = map[string]fakeEntry{}
+	}
+	fp.sent[address][key] = entry
+	return nil
+}
+
+func (fp *fakePeer) setWithExpiration(address string, namespace string, key string, value []byte, expiration caches.Expiration, version uint64) error {
+	return fp.record(address, key, fakeEntry{value: value, expiration: expiration, version: version})
+}
+
+func (fp *fakePeer) delete(address string, namespace string, key string) error {
+	return fp.record(address, key, fakeEntry{deleted: true})
+}
+
+func (fp *fakePeer) flushNamespace(address string, namespace string) error {
+	return fp.record(address, "", fakeEntry{deleted: true})
+}
+
+// eventually 每隔一小段时间检查一次 condition，三秒之内都不成立时报告 what
+func eventually(t *testing.T, what string, condition func() bool) {
+	t.Helper()
+	for i := 0; i < 300; i++ {
+		if condition() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatal(what)
+}
+
+// newTestReplicator 创建当前节点为 members[0] 的 replicator，每个 key 保存在所有的节点上
+func newTestReplicator(t *testing.T, members []string) (*replicator, *fakePeer) {
+	t.Helper()
+	options := DefaultOptions()
+	options.VirtualNodeCount = 64
+	options.ReplicaCount = len(members)
+	options.Address, options.Port = "127.0.0.1", 5837
+	cache, err := caches.OpenCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := newTestNode(&options, members)
+	t.Cleanup(func() { stopTestNode(n) })
+	peer := newFakePeer()
+	return newReplicator(n, cache, peer), peer
+}
+
+func TestReplicator(t *testing.T) {
+	members := []string{"127.0.0.1:5837", "127.0.0.1:5838", "127.0.0.1:5839"}
+	r, peer := newTestReplicator(t, members)
+	ns := r.cache.NamespaceOf(caches.DefaultNamespace)
+	key := ownedBy(t, r.node, "key-")
+	owners, _ := r.node.ownersOf(key)
+
+	// 同步的是 key 当前的状态，包括完整的有效期和版本号，不会发送给当前节点
+	ns.SetWithExpiration(key, []byte("value"), caches.SlidingTTL(time.Hour))
+	r.replicate(ns.Name(), owners, key)
+	_, version, _ := ns.GetWithVersion(key)
+	for _, replica := range members[1:] {
+		eventually(t, key+" should be replicated to "+replica, func() bool {
+			entry, ok := peer.lastSent(replica, key)
+			return ok && string(entry.value) == "value" && entry.version == version && entry.expiration == caches.SlidingTTL(time.Hour)
+		})
+	}
+	if _, ok := peer.lastSent(members[0], key); ok {
+		t.Fatal("data should not be replicated to the current node")
+	}
+
+	// 删除之后 key 不存在了，副本节点上的 key 也会被删除
+	ns.Delete(key)
+	r.replicate(ns.Name(), owners, key)
+	for _, replica := range members[1:] {
+		eventually(t, key+" should be deleted from "+replica, func() bool {
+			entry, ok := peer.lastSent(replica, key)
+			return ok && entry.deleted
+		})
+	}
+
+	// 当前节点不是主节点的 key 由其他节点负责同步
+	other := "other-"
+	for i := 0; ; i++ {
+		if primary, _ := r.node.selectNode(other + strconv.Itoa(i)); !r.node.isCurrentNode(primary) {
+			other += strconv.Itoa(i)
+			break
+		}
+	}
+	ns.Set(other, []byte("value"))
+	r.replicate(ns.Name(), members, other)
+	r.replicate(ns.Name(), owners, key)
+	eventually(t, "replication should finish", func() bool {
+		return r.currentStatus().Pending == 0
+	})
+	for _, replica := range members[1:] {
+		if _, ok := peer.lastSent(replica, other); ok {
+			t.Fatalf("%s is not owned by the current node and should not be replicated", other)
+		}
+	}
+}
+
+func TestReplicatorSendsLatestState(t *testing.T) {
+	members := []string{"127.0.0.1:5837", "127.0.0.1:5838"}
+	r, peer := newTestReplicator(t, members)
+	ns := r.cache.NamespaceOf(caches.DefaultNamespace)
+	key := ownedBy(t, r.node, "key-")
+	owners, _ := r.node.ownersOf(key)
+
+	// 连续的修改可能被合并成一次同步，但是副本节点最后收到的一定是最新的状态
+	for i := 0; i < 100; i++ {
+		ns.Set(key, []byte(strconv.Itoa(i)))
+		r.replicate(ns.Name(), owners, key)
+	}
+	_, version, _ := ns.GetWithVersion(key)
+	eventually(t, "the latest value should be replicated", func() bool {
+		entry, ok := peer.lastSent(members[1], key)
+		return ok && string(entry.value) == "99" && entry.version == version
+	})
+}
+
+func TestReplicatorRetry(t *testing.T) {
+	members := []string{"127.0.0.1:5837", "127.0.0.1:5838"}
+	r, peer := newTestReplicator(t, members)
+	ns := r.cache.NamespaceOf(caches.DefaultNamespace)
+	key := ownedBy(t, r.node, "key-")
+	owners, _ := r.node.ownersOf(key)
+
+	// 副本节点不可用时主节点不会报错，失败的 key 会留在队列中
+	peer.setFail(errors.New("replica is down"))
+	missed := ownedBy(t, r.node, "missed-")
+	ns.Set(missed, []byte("value"))
+	ns.Set(key, []byte("value"))
+	r.replicate(ns.Name(), owners, key)
+	eventually(t, "replication should fail", func() bool {
+		status := r.currentStatus()
+		return status.Failed > 0 && status.Pending == 1
+	})
+	if err := r.replicateFlushNamespace("team-a"); err == nil {
+		t.Fatal("flushing namespace should fail when replicas are down")
+	}
+
+	// 副本节点恢复之后会重试，并且完整地同步一次，没有被标记过的 key 也会被同步
+	peer.setFail(nil)
+	eventually(t, key+" should be replicated after retrying", func() bool {
+		_, ok := peer.lastSent(members[1], key)
+		return ok
+	})
+	eventually(t, missed+" should be replicated by resyncing", func() bool {
+		_, ok := peer.lastSent(members[1], missed)
+		return ok
+	})
+}
+
+func TestReplicatorResyncsWhenTooManyPending(t *testing.T) {
+	q := newReplicaQueue("127.0.0.1:5838", 0)
+	for i := 0; i < maxPendingKeys; i++ {
+		q.mark(pendingKey{namespace: caches.DefaultNamespace, key: strconv.Itoa(i)})
+	}
+	if pending, resync := q.take(); len(pending) != maxPendingKeys || resync {
+		t.Fatalf("%d keys should be pending without resyncing but got %d, %v", maxPendingKeys, len(pending), resync)
+	}
+
+	// 记录的 key 太多时丢弃这些 key，改为完整地同步一次，之后的修改仍然会被记录
+	for i := 0; i <= maxPendingKeys; i++ {
+		q.mark(pendingKey{namespace: caches.DefaultNamespace, key: strconv.Itoa(i)})
+	}
+	if pending, resync := q.take(); len(pending) != 1 || !resync {
+		t.Fatalf("queue should resync with 1 pending key but got %d, %v", len(pending), resync)
+	}
+}
+
+func TestHTTPReplication(t *testing.T) {
+	servers := startHTTPServers(t, 2, func(options *Options) {
+		options.ReplicaCount = 2
+	})
+	primary, replica := servers[0], servers[1]
+	key := ownedBy(t, primary.node, "user:")
+
+	// 主节点写入成功之后就会响应，副本节点在后台收到数据，有效期和版本号都和主节点相同
+	response, _ := doRequest(t, http.MethodPut, primary.url("/cache/"+key), []byte("value"), http.Header{"Ttl": {"60"}})
+	if response.StatusCode != http.StatusCreated {
+		t.Fatalf("set should succeed but got %s", response.Status)
+	}
+	_, version, _ := primary.cache.GetWithVersion(key)
+	eventually(t, "value should be replicated", func() bool {
+		value, _, replicaVersion, ok := replica.cache.Peek(key)
+		return ok && string(value) == "value" && replicaVersion == version
+	})
+	if ttl, ok := replica.cache.TTL(key); !ok || ttl <= 0 || ttl > 60 {
+		t.Fatalf("ttl should be replicated but got %d, %v", ttl, ok)
+	}
+
+	// 副本节点可以处理读请求，但是版本号只有主节点的才有意义，所以不会返回 ETag
+	response, body := doRequest(t, http.MethodGet, replica.url("/cache/"+key), nil, nil)
+	if response.StatusCode != http.StatusOK || string(body) != "value" || response.Header.Get("ETag") != "" {
+		t.Fatalf("replica should serve reads without etag but got %s, %s, %q", response.Status, body, response.Header.Get("ETag"))
+	}
+
+	// 写请求只能由主节点处理
+	if response, _ = doRequest(t, http.MethodPut, replica.url("/cache/"+key), []byte("other"), nil); response.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("replica should redirect writes to primary but got %s", response.Status)
+	}
+
+	if response, _ = doRequest(t, http.MethodDelete, primary.url("/cache/"+key), nil, nil); response.StatusCode >= http.StatusBadRequest {
+		t.Fatalf("delete should succeed but got %s", response.Status)
+	}
+	eventually(t, "delete should be replicated", func() bool {
+		_, _, _, ok := replica.cache.Peek(key)
+		return !ok
+	})
+
+	// 副本节点不可用时主节点依然写入成功，失败的次数和等待重试的 key 可以在状态中看到
+	replica.server.Close()
+	if response, _ = doRequest(t, http.MethodPut, primary.url("/cache/"+key), []byte("value"), nil); response.StatusCode != http.StatusCreated {
+		t.Fatalf("set should succeed when replica is down but got %s", response.Status)
+	}
+	eventually(t, "replication should fail and be retried", func() bool {
+		_, body := doRequest(t, http.MethodGet, primary.url("/status"), nil, nil)
+		status := serverStatus{}
+		if err := json.Unmarshal(body, &status); err != nil {
+			t.Fatalf("failed to parse status %s: %v", body, err)
+		}
+		return status.Replication.Failed > 0 && status.Replication.Pending == 1
+	})
+}
+
+func TestTCPReplication(t *testing.T) {
+	servers := startTCPServers(t, 2, func(options *Options) {
+		options.ReplicaCount = 2
+	})
+	primary, replica := servers[0], servers[1]
+	key := ownedBy(t, primary.node, "user:")
+
+	// 副本节点通过 vex 协议收到带有版本号的数据，之后的修改也会按顺序同步过去
+	client := primary.dial(t)
+	for i := 0; i < 10; i++ {
+		if _, err := client.Do(setCommand, setArgsOf(key, []byte(strconv.Itoa(i)), 60)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, version, _ := primary.cache.GetWithVersion(key)
+	eventually(t, "the latest value should be replicated", func() bool {
+		value, _, replicaVersion, ok := replica.cache.Peek(key)
+		return ok && string(value) == "9" && replicaVersion == version
+	})
+	if ttl, ok := replica.cache.TTL(key); !ok || ttl <= 0 || ttl > 60 {
+		t.Fatalf("ttl should be replicated but got %d, %v", ttl, ok)
+	}
+
+	if _, err := client.Do(deleteCommand, [][]byte{[]byte(key)}); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "delete should be replicated", func() bool {
+		_, _, _, ok := replica.cache.Peek(key)
+		return !ok
+	})
+}
@@ -0,0 +1,84 @@
+package services
+
+import (
+	"cache/caches"
+	"encoding/binary"
+)
+
+const (
+	// defaultScanCount 是每次扫描默认返回的 key 的最大个数
+	defaultScanCount = 100
+)
+
+// scanResult 是一次扫描的结果，Cursor 为空字符串表示扫描结束
+type scanResult struct {
+	Keys   []string `json:"keys"`
+	Cursor string   `json:"cursor"`
+}
+
+// scanPrimaryKeys 扫描命名空间 ns 中当前节点作为主节点的 key，副本数据不会返回，这样遍历集群中所有节点的时候每个 key 只会出现一次
+// 过滤是在扫描之后进行的，所以返回的 key 可能少于 count 个，甚至一个都没有，但是只要游标不为空，扫描就还没有结束
+func (n *node) scanPrimaryKeys(ns *caches.Namespace, cursor string, pattern string, count int) (*scanResult, error) {
+	keys, next, err := ns.Scan(cursor, pattern, count)
+	if err != nil {
+		return nil, err
+	}
+	primaryKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		owners, err := n.ownersOf(key)
+		if err != nil {
+			return nil, err
+		}
+		if n.isCurrentNode(owners[0]) {
+			primaryKeys = append(primaryKeys, key)
+		}
+	}
+	return &scanResult{Keys: primaryKeys, Cursor: next}, nil
+}
+
+// encodeScanResult 编码扫描的结果：游标长度 (4) | 游标 | key 长度 (4) | key ...
+func encodeScanResult(result *scanResult) []byte {
+	body := appendLengthAndBytes(nil, []byte(result.Cursor))
+	for _, key := range result.Keys {
+		body = appendLengthAndBytes(body, []byte(key))
+	}
+	return body
+}
+
+// decodeScanResult 解析 encodeScanResult 编码的结果
+func decodeScanResult(body []byte) (*scanResult, error) {
+	cursor, body, err := nextLengthAndBytes(body)
+	if err != nil {
+		return nil, err
+	}
+	result := &scanResult{Cursor: string(cursor)}
+	for len(body) > 0 {
+		var key []byte
+		key, body, err = nextLengthAndBytes(body)
+		if err != nil {
+			return nil, err
+		}
+		result.Keys = append(result.Keys, string(key))
+	}
+	return result, nil
+}
+
+func appendLengthAndBytes(body []byte, data []byte) []byte {
+	length := make([]byte, 4)
+	binary.BigEndian.PutUint32(length, uint32(len(data)))
+	body = append(body, length...)
+	return append(body, data...)
+}
+
+// nextLengthAndBytes 从 body 中读取一段带长度的数据，并返回剩下的部分
+func nextLengthAndBytes(body []byte) ([]byte, []byte, error) {
+	if len(body) < 4 {
+		return nil, nil, malformedBatchErr
+	}
+	length := binary.BigEndian.Uint32(body)
+	body = body[4:]
+	if uint32(len(body)) < length {
+		return nil, nil, malformedBatchErr
+	}
+	return body[:length], body[length:], nil
+}
@@ -1,13 +1,41 @@
 package services
 
-import "cache/caches"
+import (
+	"cache/caches"
+	"context"
+)
 
 const (
 	APIVersion = "v1"
 )
 
+// serverStatus 是服务器的状态，包括缓存的状态和数据迁移的进度
+type serverStatus struct {
+	caches.Status
+	// Namespaces 是每个命名空间各自的状态，外层的状态是所有命名空间汇总之后的
+	Namespaces  map[string]caches.Status `json:"namespaces"`
+	Migration   migrationStatus          `json:"migration"`
+	Replication replicationStatus        `json:"replication"`
+}
+
+// namespaceStatusOf 返回 cache 中每个命名空间的状态
+func namespaceStatusOf(cache *caches.Cache) map[string]caches.Status {
+	namespaces := cache.Namespaces()
+	status := make(map[string]caches.Status, len(namespaces))
+	for _, ns := range namespaces {
+		status[ns.Name()] = ns.Status()
+	}
+	return status
+}
+
 type Server interface {
+	// Run 开始监听并处理请求，调用 Shutdown 之后返回 nil
 	Run() error
+
+	// Shutdown 优雅地关闭服务器：先离开集群，让其他节点不再把请求交给当前节点，
+	// 再停止接收新的请求，并等待正在处理的请求结束，ctx 结束时还没有处理完的连接会被直接关闭
+	// 可以多次调用，重复调用不会 panic
+	Shutdown(ctx context.Context) error
 }
 
 func NewServer(cache *caches.Cache, options Options) (Server, error) {
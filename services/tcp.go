@@ -4,10 +4,13 @@ import (
 	"cache/caches"
 	"cache/helpers"
 	"cache/vex"
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 const (
@@ -16,120 +19,897 @@ const (
 	deleteCommand = byte(3)
 	statusCommand = byte(4)
 	nodesCommand  = byte(5)
+
+	// replicaSetCommand 和 replicaDeleteCommand 是节点之间同步数据使用的命令，不会检查 key 所属的节点
+	replicaSetCommand    = byte(6)
+	replicaDeleteCommand = byte(7)
+
+	// forwardCommand 是代理模式下节点之间转发请求使用的命令，第一个参数是原来的命令，后面是原来的参数
+	forwardCommand = byte(8)
+
+	// getManyCommand、setManyCommand 和 deleteManyCommand 是批量命令，一次请求可以操作多个 key
+	getManyCommand    = byte(9)
+	setManyCommand    = byte(10)
+	deleteManyCommand = byte(11)
+
+	// replicaSetManyCommand 和 replicaDeleteManyCommand 是节点之间批量同步数据使用的命令
+	replicaSetManyCommand    = byte(12)
+	replicaDeleteManyCommand = byte(13)
+
+	// incrementCommand 将 key 对应的整数原子地加上一个数，参数是 ttl | key | delta，响应是相加之后的结果
+	incrementCommand = byte(14)
+
+	// getWithVersionCommand 返回 key 对应的值和版本号，响应是 version (8) | value
+	// compareAndSetCommand 只有在版本号一致时才写入，参数是 ttl | key | value | version，响应是新的版本号
+	// 版本号是每个节点自己分配的，所以这两个命令都只能由主节点处理
+	getWithVersionCommand = byte(15)
+	compareAndSetCommand  = byte(16)
+
+	// setNXCommand 和 setXXCommand 的参数和 setCommand 一样，响应是一个字节，1 表示写入了，0 表示没有写入
+	// getSetCommand 的参数和 setCommand 一样，响应是 旧值是否存在 (1) | 旧值
+	// getAndDeleteCommand 的参数是 key，响应是删除之前的值
+	setNXCommand        = byte(17)
+	setXXCommand        = byte(18)
+	getSetCommand       = byte(19)
+	getAndDeleteCommand = byte(20)
+
+	// scanCommand 扫描当前节点作为主节点的 key，参数是 游标 | 匹配模式 | 个数 (8)，响应是下一次的游标和扫描到的 key
+	scanCommand = byte(21)
+
+	// namespaceCommand 在指定的命名空间中执行命令，参数是 命名空间 | 命令 | 原来的参数
+	// 默认命名空间中的命令不需要包装，所以不支持命名空间的客户端和节点仍然可以使用默认的命名空间
+	namespaceCommand = byte(22)
+
+	// flushNamespaceCommand 清空整个集群中的一个命名空间，参数是命名空间的名字
+	// replicaFlushNamespaceCommand 是节点之间同步清空操作使用的命令，只会清空当前节点上的数据
+	flushNamespaceCommand        = byte(23)
+	replicaFlushNamespaceCommand = byte(24)
+
+	// eventsCommand 是流式命令，订阅当前节点上 key 变化的事件，参数是 命名空间 | 匹配模式，命名空间为空时订阅所有命名空间
+	// 每个事件都是一条 JSON 编码的推送消息
+	eventsCommand = byte(25)
+
+	// publishCommand 将消息发布到频道，参数是 频道 | 消息，集群中所有节点上订阅了这个频道的客户端都会收到
+	// subscribeCommand 是流式命令，订阅匹配模式的频道，参数是匹配模式，每条消息都是一条 频道 | 匹配模式 | 消息 的推送消息
+	// 取消订阅就是取消这个流式请求，同一个连接上可以同时有多个订阅
+	publishCommand   = byte(26)
+	subscribeCommand = byte(27)
+
+	// ttlCommand 查询 key 剩余的有效期，参数是 key，响应是剩余的毫秒数 (8)，caches.NeverDie 表示永不过期
+	// expireCommand 修改 key 的有效期，参数是 key | 有效期 (9)，响应 1 表示修改成功，0 表示 key 不存在，零值的有效期就是移除有效期
+	// replicaExpireCommand 是主节点将有效期的修改同步给副本节点使用的命令，参数和 expireCommand 相同
+	ttlCommand           = byte(28)
+	expireCommand        = byte(29)
+	replicaExpireCommand = byte(30)
 )
 
 var (
 	commandNeedsMoreArgumentsErr = errors.New("command needs more arguments")
 
+	unknownExpiryModeErr = errors.New("unknown expiry mode")
+
 	notFoundErr = errors.New("not found")
 )
 
+// keyHandler 处理命名空间 ns 中和某个 key 相关的命令，forwarded 表示这个请求是不是其他节点转发过来的
+type keyHandler func(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error)
+
+// namespacedHandler 处理在命名空间 ns 中执行的命令
+type namespacedHandler func(ns *caches.Namespace, args [][]byte) (body []byte, err error)
+
 type TCPServer struct {
 	*node
 	cache   *caches.Cache
 	server  *vex.Server
 	options *Options
+	// certs 提供 TLS 使用的证书，为 nil 时不使用 TLS
+	certs *certReloader
+	// acl 记录了用户和他们的权限，为 nil 时不需要认证
+	acl *acl
+	// peers 缓存了到集群中其他节点的连接
+	peers *clientPool
+	// replicator 负责将数据同步到副本节点
+	replicator *replicator
+	// migrator 负责在集群成员变化时迁移数据
+	migrator *migrator
+	// keyHandlers 存储了和 key 相关的命令处理器，这些命令在代理模式下可以被转发
+	keyHandlers map[byte]keyHandler
+	// namespacedHandlers 存储了所有可以在命名空间中执行的命令处理器，包括 keyHandlers 中的命令
+	namespacedHandlers map[byte]namespacedHandler
 }
 
 func NewTcpServer(cache *caches.Cache, options *Options) (*TCPServer, error) {
+	certs, err := newCertReloader(options)
+	if err != nil {
+		return nil, err
+	}
+	accessControl, err := loadACL(options.ACLFile)
+	if err != nil {
+		return nil, err
+	}
 	n, err := newNode(options)
 	if err != nil {
 		return nil, err
 	}
-	return &TCPServer{
+	ts := newTCPServer(n, cache, options, certs, accessControl)
+	ts.migrator.autoMigrate()
+	return ts, nil
+}
+
+// newTCPServer 在已经加入集群的节点 n 上创建 TCP 服务器
+func newTCPServer(n *node, cache *caches.Cache, options *Options, certs *certReloader, accessControl *acl) *TCPServer {
+	ts := &TCPServer{
 		node:    n,
 		cache:   cache,
 		server:  vex.NewServer(),
 		options: options,
-	}, nil
+		certs:   certs,
+		acl:     accessControl,
+	}
+	ts.peers = newClientPool(ts.dialPeer)
+	peer := &tcpPeer{pool: ts.peers}
+	ts.replicator = newReplicator(n, cache, peer)
+	ts.migrator = newMigrator(n, cache, peer)
+	ts.keyHandlers = map[byte]keyHandler{
+		getCommand:    ts.getHandler,
+		setCommand:    ts.setHandler,
+		deleteCommand: ts.deleteHandler,
+
+		getManyCommand:    ts.getManyHandler,
+		setManyCommand:    ts.setManyHandler,
+		deleteManyCommand: ts.deleteManyHandler,
+
+		incrementCommand: ts.incrementHandler,
+
+		getWithVersionCommand: ts.getWithVersionHandler,
+		compareAndSetCommand:  ts.compareAndSetHandler,
+
+		setNXCommand:        ts.conditionalSetHandler(setNXCommand, (*caches.Namespace).SetNX),
+		setXXCommand:        ts.conditionalSetHandler(setXXCommand, (*caches.Namespace).SetXX),
+		getSetCommand:       ts.getSetHandler,
+		getAndDeleteCommand: ts.getAndDeleteHandler,
+
+		ttlCommand:    ts.ttlHandler,
+		expireCommand: ts.expireHandler,
+	}
+	ts.namespacedHandlers = map[byte]namespacedHandler{
+		forwardCommand:           ts.forwardHandler,
+		scanCommand:              ts.scanHandler,
+		replicaSetCommand:        ts.replicaSetHandler,
+		replicaDeleteCommand:     ts.replicaDeleteHandler,
+		replicaSetManyCommand:    ts.replicaSetManyHandler,
+		replicaDeleteManyCommand: ts.replicaDeleteManyHandler,
+		replicaExpireCommand:     ts.replicaExpireHandler,
+	}
+	for command, handler := range ts.keyHandlers {
+		ts.namespacedHandlers[command] = withoutForwarded(handler)
+	}
+	return ts
 }
 
 func (ts *TCPServer) Run() error {
-	ts.server.RegisterHandler(getCommand, ts.getHandler)
-	ts.server.RegisterHandler(setCommand, ts.setHandler)
-	ts.server.RegisterHandler(deleteCommand, ts.deleteHandler)
+	for command, handler := range ts.namespacedHandlers {
+		ts.server.RegisterHandler(command, ts.inDefaultNamespace(handler))
+	}
+	ts.server.RegisterHandler(namespaceCommand, ts.namespaceHandler)
+	ts.server.RegisterHandler(flushNamespaceCommand, ts.flushNamespaceHandler)
+	ts.server.RegisterHandler(replicaFlushNamespaceCommand, ts.replicaFlushNamespaceHandler)
 	ts.server.RegisterHandler(statusCommand, ts.statusHandler)
 	ts.server.RegisterHandler(nodesCommand, ts.nodesHandler)
-	return ts.server.ListenAndServer("tcp", helpers.JoinAddressAndPort(ts.options.Address, ts.options.Port))
+	ts.server.RegisterStreamHandler(eventsCommand, ts.eventsHandler)
+	ts.server.RegisterHandler(publishCommand, ts.publishHandler)
+	ts.server.RegisterStreamHandler(subscribeCommand, ts.subscribeHandler)
+	if ts.acl != nil {
+		ts.server.SetAuthenticator(&tcpAuthenticator{acl: ts.acl})
+	}
+	address := helpers.JoinAddressAndPort(ts.options.Address, ts.options.Port)
+	if ts.certs != nil {
+		return ts.server.ListenAndServerTLS("tcp", address, ts.certs.serverConfig())
+	}
+	return ts.server.ListenAndServer("tcp", address)
+}
+
+func (ts *TCPServer) Shutdown(ctx context.Context) error {
+	leaveErr := ts.leave(ctx)
+	err := ts.server.Shutdown(ctx)
+	ts.peers.closeAll()
+	if err != nil {
+		return err
+	}
+	return leaveErr
 }
 
-func (ts *TCPServer) getHandler(args [][]byte) (body []byte, err error) {
+// dialPeer 创建到其他节点的连接，开启了 ACL 时使用集群用户认证
+func (ts *TCPServer) dialPeer(address string) (*vex.Client, error) {
+	client, err := ts.certs.dial(address)
+	if err != nil {
+		return nil, err
+	}
+	if err = ts.acl.login(client); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return client, nil
+}
+
+// withoutForwarded 将 handler 包装成处理客户端请求的命令处理器
+func withoutForwarded(handler keyHandler) namespacedHandler {
+	return func(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+		return handler(ns, args, false)
+	}
+}
+
+// inDefaultNamespace 将 handler 包装成在默认命名空间中执行的命令处理器
+func (ts *TCPServer) inDefaultNamespace(handler namespacedHandler) func(args [][]byte) (body []byte, err error) {
+	return func(args [][]byte) (body []byte, err error) {
+		return handler(ts.cache.Namespace, args)
+	}
+}
+
+// namespaceHandler 在参数指定的命名空间中执行被包装的命令
+func (ts *TCPServer) namespaceHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 2 || len(args[1]) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	handler, ok := ts.namespacedHandlers[args[1][0]]
+	if !ok {
+		return nil, fmt.Errorf("command %d can't be used in namespace", args[1][0])
+	}
+	return handler(ts.cache.NamespaceOf(string(args[0])), args[2:])
+}
+
+// namespacedCommand 将 command 包装成在 namespace 中执行的命令，默认的命名空间不需要包装
+func namespacedCommand(namespace string, command byte, args [][]byte) (byte, [][]byte) {
+	if namespace == "" || namespace == caches.DefaultNamespace {
+		return command, args
+	}
+	return namespaceCommand, append([][]byte{[]byte(namespace), {command}}, args...)
+}
+
+// forwardHandler 处理其他节点转发过来的请求
+func (ts *TCPServer) forwardHandler(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+	if len(args) < 1 || len(args[0]) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	handler, ok := ts.keyHandlers[args[0][0]]
+	if !ok {
+		return nil, fmt.Errorf("command %d can't be forwarded", args[0][0])
+	}
+	return handler(ns, args[1:], true)
+}
+
+// routeTo 将请求交给 owner 节点处理
+// 重定向模式下会返回重定向错误，由客户端重新发送请求；代理模式下由当前节点转发请求，并将结果返回给客户端
+// 已经被转发过的请求不会再次转发，避免节点之间的一致性哈希不一致时请求被来回转发
+func (ts *TCPServer) routeTo(ns *caches.Namespace, owner string, command byte, args [][]byte, forwarded bool) (body []byte, err error) {
+	if ts.options.RoutingMode != ProxyRouting || forwarded {
+		return nil, fmt.Errorf("redirect to node %s", owner)
+	}
+	command, args = namespacedCommand(ns.Name(), forwardCommand, append([][]byte{{command}}, args...))
+	return ts.peers.do(owner, command, args)
+}
+
+func (ts *TCPServer) getHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
 
 	if len(args) < 1 {
 		return nil, commandNeedsMoreArgumentsErr
 	}
 
-	// 使用一致性哈希选择出这个 key 所属的物理节点
+	// 使用一致性哈希选择出保存这个 key 的所有物理节点
 	key := string(args[0])
-	node, err := ts.selectNode(key)
+	owners, err := ts.ownersOf(key)
 	if err != nil {
 		return nil, err
 	}
 
-	// 判断这个 key 所属的节点
-	if !ts.isCurrentNode(node) {
-		return nil, fmt.Errorf("redirect to node %s", node)
+	// 主节点和副本节点都可以处理读请求，这样主节点故障时副本节点可以继续提供服务
+	if !ts.isOwnerOf(owners) {
+		return ts.routeTo(ns, owners[0], getCommand, args, forwarded)
 	}
-	value, ok := ts.cache.Get(string(args[0]))
+	value, ok := ns.Get(string(args[0]))
 	if !ok {
 		return value, notFoundErr
 	}
 	return value, nil
 }
 
-func (ts *TCPServer) setHandler(args [][]byte) (body []byte, err error) {
-	if len(args) < 3 {
+// setHandler 写入键值对，参数是 ttl (8) | key | value，第四个参数是可选的完整有效期，格式和 expireCommand 相同，存在时会代替 ttl
+// 有效期和数据一起原子地写入，不需要再发送一次 expireCommand，不认识第四个参数的旧节点会使用 ttl 写入
+func (ts *TCPServer) setHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 3 || len(args[0]) != 8 {
 		return nil, commandNeedsMoreArgumentsErr
 	}
 
-	// 使用一致性哈希选择出这个 key 所属的物理节点
+	// 使用一致性哈希选择出保存这个 key 的所有物理节点
 	key := string(args[1])
-	node, err := ts.selectNode(key)
+	owners, err := ts.ownersOf(key)
 	if err != nil {
 		return nil, err
 	}
 
-	// 判断这个 key 所属的节点
-	if !ts.isCurrentNode(node) {
-		return nil, fmt.Errorf("redirect to node %s", node)
+	// 写请求只能由主节点处理，再由主节点同步给副本节点
+	if !ts.isCurrentNode(owners[0]) {
+		return ts.routeTo(ns, owners[0], setCommand, args, forwarded)
 	}
 
-	ttl := int64(binary.BigEndian.Uint64(args[0]))
-	err = ts.cache.SetWithTTL(string(args[1]), args[2], ttl)
+	if len(args) > 3 {
+		var expiration caches.Expiration
+		if expiration, err = expirationOfArg(args[3]); err != nil {
+			return nil, err
+		}
+		err = ns.SetWithExpiration(key, args[2], expiration)
+	} else {
+		ttl := int64(binary.BigEndian.Uint64(args[0]))
+		err = ns.SetWithTTL(key, args[2], ttl)
+	}
 	if err != nil {
 		return nil, err
 	}
+	ts.replicator.replicate(ns.Name(), owners, key)
 	return nil, nil
 }
 
-func (ts *TCPServer) deleteHandler(args [][]byte) (body []byte, err error) {
+func (ts *TCPServer) deleteHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
 	if len(args) < 1 {
 		return nil, commandNeedsMoreArgumentsErr
 	}
 
-	// 使用一致性哈希选择出这个 key 所属的物理节点
+	// 使用一致性哈希选择出保存这个 key 的所有物理节点
 	key := string(args[0])
-	node, err := ts.selectNode(key)
+	owners, err := ts.ownersOf(key)
 	if err != nil {
 		return nil, err
 	}
 
-	// 判断这个 key 所属的节点
-	if !ts.isCurrentNode(node) {
-		return nil, fmt.Errorf("redirect to node %s", node)
+	// 写请求只能由主节点处理，再由主节点同步给副本节点
+	if !ts.isCurrentNode(owners[0]) {
+		return ts.routeTo(ns, owners[0], deleteCommand, args, forwarded)
 	}
 
-	err = ts.cache.Delete(string(args[0]))
+	err = ns.Delete(string(args[0]))
 	if err != nil {
 		return nil, err
 	}
+	ts.replicator.replicate(ns.Name(), owners, key)
+	return nil, nil
+}
+
+func (ts *TCPServer) incrementHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 3 || len(args[0]) != 8 || len(args[2]) != 8 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+
+	// 使用一致性哈希选择出保存这个 key 的所有物理节点
+	key := string(args[1])
+	owners, err := ts.ownersOf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 自增是写请求，只能由主节点处理，再将结果同步给副本节点
+	if !ts.isCurrentNode(owners[0]) {
+		return ts.routeTo(ns, owners[0], incrementCommand, args, forwarded)
+	}
+
+	ttl := int64(binary.BigEndian.Uint64(args[0]))
+	delta := int64(binary.BigEndian.Uint64(args[2]))
+	result, err := ns.Increment(key, delta, ttl)
+	if err != nil {
+		return nil, err
+	}
+	ts.replicator.replicate(ns.Name(), owners, key)
+
+	body = make([]byte, 8)
+	binary.BigEndian.PutUint64(body, uint64(result))
+	return body, nil
+}
+
+func (ts *TCPServer) getWithVersionHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+
+	// 使用一致性哈希选择出保存这个 key 的所有物理节点
+	key := string(args[0])
+	owners, err := ts.ownersOf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 副本节点上的数据可能落后于主节点，读到的版本号不一定能用于比较并设置，所以只能由主节点处理
+	if !ts.isCurrentNode(owners[0]) {
+		return ts.routeTo(ns, owners[0], getWithVersionCommand, args, forwarded)
+	}
+
+	value, version, ok := ns.GetWithVersion(key)
+	if !ok {
+		return nil, notFoundErr
+	}
+	body = make([]byte, 8, 8+len(value))
+	binary.BigEndian.PutUint64(body, version)
+	return append(body, value...), nil
+}
+
+func (ts *TCPServer) compareAndSetHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 4 || len(args[0]) != 8 || len(args[3]) != 8 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+
+	// 使用一致性哈希选择出保存这个 key 的所有物理节点
+	key := string(args[1])
+	owners, err := ts.ownersOf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 写请求只能由主节点处理，再由主节点同步给副本节点
+	if !ts.isCurrentNode(owners[0]) {
+		return ts.routeTo(ns, owners[0], compareAndSetCommand, args, forwarded)
+	}
+
+	ttl := int64(binary.BigEndian.Uint64(args[0]))
+	expectedVersion := binary.BigEndian.Uint64(args[3])
+	version, err := ns.CompareAndSet(key, args[2], expectedVersion, ttl)
+	if err != nil {
+		return nil, err
+	}
+	ts.replicator.replicate(ns.Name(), owners, key)
+
+	body = make([]byte, 8)
+	binary.BigEndian.PutUint64(body, version)
+	return body, nil
+}
+
+// onPrimary 只在 key 的主节点上执行 handle，当前节点不是主节点时将请求交给主节点处理
+func (ts *TCPServer) onPrimary(ns *caches.Namespace, command byte, key string, args [][]byte, forwarded bool, handle func(owners []string) ([]byte, error)) (body []byte, err error) {
+	owners, err := ts.ownersOf(key)
+	if err != nil {
+		return nil, err
+	}
+	if !ts.isCurrentNode(owners[0]) {
+		return ts.routeTo(ns, owners[0], command, args, forwarded)
+	}
+	return handle(owners)
+}
+
+// conditionalSetHandler 处理只有满足条件时才写入的命令，set 是具体的写入方式
+func (ts *TCPServer) conditionalSetHandler(command byte, set func(ns *caches.Namespace, key string, value []byte, ttl int64) (bool, error)) keyHandler {
+	return func(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+		if len(args) < 3 || len(args[0]) != 8 {
+			return nil, commandNeedsMoreArgumentsErr
+		}
+		key := string(args[1])
+		return ts.onPrimary(ns, command, key, args, forwarded, func(owners []string) ([]byte, error) {
+			ttl := int64(binary.BigEndian.Uint64(args[0]))
+			ok, err := set(ns, key, args[2], ttl)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				return []byte{0}, nil
+			}
+			ts.replicator.replicate(ns.Name(), owners, key)
+			return []byte{1}, nil
+		})
+	}
+}
+
+func (ts *TCPServer) getSetHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 3 || len(args[0]) != 8 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	key := string(args[1])
+	return ts.onPrimary(ns, getSetCommand, key, args, forwarded, func(owners []string) ([]byte, error) {
+		ttl := int64(binary.BigEndian.Uint64(args[0]))
+		old, ok, err := ns.GetSet(key, args[2], ttl)
+		if err != nil {
+			return nil, err
+		}
+		ts.replicator.replicate(ns.Name(), owners, key)
+		if !ok {
+			return []byte{0}, nil
+		}
+		return append([]byte{1}, old...), nil
+	})
+}
+
+func (ts *TCPServer) getAndDeleteHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	key := string(args[0])
+	return ts.onPrimary(ns, getAndDeleteCommand, key, args, forwarded, func(owners []string) ([]byte, error) {
+		value, ok, err := ns.GetAndDelete(key)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, notFoundErr
+		}
+		ts.replicator.replicate(ns.Name(), owners, key)
+		return value, nil
+	})
+}
+
+func (ts *TCPServer) ttlHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	key := string(args[0])
+	owners, err := ts.ownersOf(key)
+	if err != nil {
+		return nil, err
+	}
+
+	// 和读请求一样，主节点和副本节点都可以查询有效期
+	if !ts.isOwnerOf(owners) {
+		return ts.routeTo(ns, owners[0], ttlCommand, args, forwarded)
+	}
+	ttl, ok := ns.PTTL(key)
+	if !ok {
+		return nil, notFoundErr
+	}
+	body = make([]byte, 8)
+	binary.BigEndian.PutUint64(body, uint64(ttl))
+	return body, nil
+}
+
+func (ts *TCPServer) expireHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	if len(args) < 2 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	expiration, err := expirationOfArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+	key := string(args[0])
+	return ts.onPrimary(ns, expireCommand, key, args, forwarded, func(owners []string) ([]byte, error) {
+		ok, err := ns.Expire(key, expiration)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return []byte{0}, nil
+		}
+		ts.replicator.replicate(ns.Name(), owners, key)
+		return []byte{1}, nil
+	})
+}
+
+// expirationArgOf 将 expiration 编码成 方式 (1) | 毫秒数 (8)
+// 绝对过期时间的毫秒数是过期时间点的 Unix 时间，其他方式是有效期，毫秒数为 0 表示永不过期
+func expirationArgOf(expiration caches.Expiration) []byte {
+	arg := make([]byte, 9)
+	arg[0] = byte(expiration.Mode)
+	binary.BigEndian.PutUint64(arg[1:], uint64(millisecondsOfExpiration(expiration)))
+	return arg
+}
+
+// millisecondsOfExpiration 返回 expiration 编码时使用的毫秒数，含义见 expirationArgOf
+func millisecondsOfExpiration(expiration caches.Expiration) int64 {
+	if expiration.Mode != caches.AbsoluteExpiry {
+		return int64(expiration.TTL / time.Millisecond)
+	}
+	if expiration.Deadline.IsZero() {
+		return 0
+	}
+	return expiration.Deadline.UnixNano() / int64(time.Millisecond)
+}
+
+// expirationOfArg 解码 expirationArgOf 编码的有效期
+func expirationOfArg(arg []byte) (caches.Expiration, error) {
+	if len(arg) < 9 {
+		return caches.Expiration{}, commandNeedsMoreArgumentsErr
+	}
+	return expirationOf(caches.ExpiryMode(arg[0]), int64(binary.BigEndian.Uint64(arg[1:])))
+}
+
+// expirationOf 使用方式 mode 和毫秒数 milliseconds 创建有效期，毫秒数的含义和 expirationArgOf 相同
+func expirationOf(mode caches.ExpiryMode, milliseconds int64) (caches.Expiration, error) {
+	switch mode {
+	case caches.FixedExpiry:
+		return caches.FixedTTL(time.Duration(milliseconds) * time.Millisecond), nil
+	case caches.SlidingExpiry:
+		return caches.SlidingTTL(time.Duration(milliseconds) * time.Millisecond), nil
+	case caches.AbsoluteExpiry:
+		if milliseconds == 0 {
+			return caches.ExpireAt(time.Time{}), nil
+		}
+		return caches.ExpireAt(time.Unix(0, milliseconds*int64(time.Millisecond))), nil
+	default:
+		return caches.Expiration{}, unknownExpiryModeErr
+	}
+}
+
+// routeBatch 将批量命令中不属于当前节点的 key 按照节点分组，交给各自的节点处理，groups 中不能包含当前节点
+// 重定向模式下会返回重定向错误，客户端更新一致性哈希之后会重新拆分批量命令；代理模式下由当前节点并发转发给各个节点
+func (ts *TCPServer) routeBatch(ns *caches.Namespace, command byte, groups map[string][]string, forwarded bool, argsOf func(keys []string) [][]byte, handle func(keys []string, body []byte) error) error {
+	lock := &sync.Mutex{}
+	return fanOut(groups, func(owner string, keys []string) error {
+		body, err := ts.routeTo(ns, owner, command, argsOf(keys), forwarded)
+		if err != nil {
+			return err
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		return handle(keys, body)
+	})
+}
+
+// localKeysOf 从 groups 中取出属于当前节点的 key，剩下的都是需要交给其他节点处理的
+func (ts *TCPServer) localKeysOf(groups map[string][]string) []string {
+	keys := groups[ts.address]
+	delete(groups, ts.address)
+	return keys
+}
+
+func (ts *TCPServer) getManyHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	keys := keysOf(args)
+	groups, _, err := ts.groupByOwner(keys, false)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先处理其他节点的 key，这样重定向的时候就不需要读取当前节点的数据了
+	localKeys := ts.localKeysOf(groups)
+	values := map[string][]byte{}
+	err = ts.routeBatch(ns, getManyCommand, groups, forwarded, keyArgsOf, func(keys []string, body []byte) error {
+		return decodeValues(body, keys, values)
+	})
+	if err != nil {
+		return nil, err
+	}
+	for key, value := range ns.GetMany(localKeys) {
+		values[key] = value
+	}
+	return encodeValues(keys, values), nil
+}
+
+func (ts *TCPServer) setManyHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	ttl, keys, entries, err := entriesOf(args)
+	if err != nil {
+		return nil, err
+	}
+	groups, owners, err := ts.groupByOwner(keys, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先处理其他节点的 key，这样重定向的时候当前节点不会写入一半的数据
+	localKeys := ts.localKeysOf(groups)
+	argsOf := func(keys []string) [][]byte {
+		return entryArgsOf(ttl, keys, entries)
+	}
+	err = ts.routeBatch(ns, setManyCommand, groups, forwarded, argsOf, func(keys []string, body []byte) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	localEntries := make(map[string][]byte, len(localKeys))
+	for _, key := range localKeys {
+		localEntries[key] = entries[key]
+	}
+	err = ns.SetManyWithTTL(localEntries, ttl)
+	if err != nil {
+		return nil, err
+	}
+	ts.replicator.replicateMany(ns.Name(), localKeys, owners)
+	return nil, nil
+}
+
+func (ts *TCPServer) deleteManyHandler(ns *caches.Namespace, args [][]byte, forwarded bool) (body []byte, err error) {
+	keys := keysOf(args)
+	groups, owners, err := ts.groupByOwner(keys, true)
+	if err != nil {
+		return nil, err
+	}
+
+	// 先处理其他节点的 key，这样重定向的时候当前节点不会删除一半的数据
+	localKeys := ts.localKeysOf(groups)
+	err = ts.routeBatch(ns, deleteManyCommand, groups, forwarded, keyArgsOf, func(keys []string, body []byte) error {
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = ns.DeleteMany(localKeys)
+	if err != nil {
+		return nil, err
+	}
+	ts.replicator.replicateMany(ns.Name(), localKeys, owners)
 	return nil, nil
 }
 
 func (ts *TCPServer) statusHandler(args [][]byte) (body []byte, err error) {
-	return json.Marshal(ts.cache.Status())
+	return json.Marshal(serverStatus{
+		Status:      ts.cache.Status(),
+		Namespaces:  namespaceStatusOf(ts.cache),
+		Migration:   ts.migrator.currentStatus(),
+		Replication: ts.replicator.currentStatus(),
+	})
+}
+
+// flushNamespaceHandler 清空集群中的一个命名空间
+// 命名空间的数据分布在集群的所有节点上，所以当前节点清空之后还需要通知其他所有节点
+func (ts *TCPServer) flushNamespaceHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	namespace := string(args[0])
+	if err = ts.cache.FlushNamespace(namespace); err != nil {
+		return nil, err
+	}
+	return nil, ts.replicator.replicateFlushNamespace(namespace)
+}
+
+// eventsHandler 将当前节点上 key 变化的事件推送给客户端，直到客户端取消订阅或者连接关闭
+// 副本节点也会产生事件，所以同一个 key 的变化可能从多个节点收到
+func (ts *TCPServer) eventsHandler(args [][]byte, stream *vex.Stream) error {
+	if len(args) < 2 {
+		return commandNeedsMoreArgumentsErr
+	}
+	subscription, err := ts.cache.Subscribe(string(args[0]), string(args[1]))
+	if err != nil {
+		return err
+	}
+	defer subscription.Close()
+
+	for {
+		select {
+		case event := <-subscription.Events():
+			body, err := json.Marshal(event)
+			if err != nil {
+				return err
+			}
+			if err = stream.Send(body); err != nil {
+				return err
+			}
+		case <-stream.Done():
+			return nil
+		}
+	}
+}
+
+// publishHandler 将消息发布到频道
+func (ts *TCPServer) publishHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 2 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	return nil, ts.pubsub.publish(string(args[0]), args[1])
+}
+
+// subscribeHandler 将匹配模式的频道上的消息推送给客户端，直到客户端取消订阅或者连接关闭
+func (ts *TCPServer) subscribeHandler(args [][]byte, stream *vex.Stream) error {
+	if len(args) < 1 {
+		return commandNeedsMoreArgumentsErr
+	}
+	subscription, err := ts.pubsub.subscribe(string(args[0]))
+	if err != nil {
+		return err
+	}
+	defer ts.pubsub.unsubscribe(subscription)
+
+	for {
+		select {
+		case message := <-subscription.messages:
+			if err = stream.Send(encodeChannelMessage(message)); err != nil {
+				return err
+			}
+		case <-stream.Done():
+			return nil
+		}
+	}
+}
+
+// replicaFlushNamespaceHandler 处理其他节点同步过来的清空操作
+func (ts *TCPServer) replicaFlushNamespaceHandler(args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	return nil, ts.cache.FlushNamespace(string(args[0]))
+}
+
+func (ts *TCPServer) scanHandler(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+	if len(args) < 3 || len(args[2]) != 8 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	count := int(binary.BigEndian.Uint64(args[2]))
+	result, err := ts.scanPrimaryKeys(ns, string(args[0]), string(args[1]), count)
+	if err != nil {
+		return nil, err
+	}
+	return encodeScanResult(result), nil
 }
 
 func (ts *TCPServer) nodesHandler(args [][]byte) (body []byte, err error) {
 	return json.Marshal(ts.nodes())
 }
+
+// replicaSetHandler 处理其他节点同步过来的键值对，第四个参数是可选的完整有效期，存在时会代替第一个参数的 ttl
+// 第五个参数是可选的版本号 (8)，存在时只有当前节点上没有更新的值才会写入
+func (ts *TCPServer) replicaSetHandler(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+	if len(args) < 3 || len(args[0]) != 8 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	if len(args) > 3 {
+		expiration, err := expirationOfArg(args[3])
+		if err != nil {
+			return nil, err
+		}
+		if len(args) > 4 {
+			if len(args[4]) != 8 {
+				return nil, commandNeedsMoreArgumentsErr
+			}
+			_, err = ns.SetIfNewer(string(args[1]), args[2], expiration, binary.BigEndian.Uint64(args[4]))
+			return nil, err
+		}
+		return nil, ns.SetWithExpiration(string(args[1]), args[2], expiration)
+	}
+	ttl := int64(binary.BigEndian.Uint64(args[0]))
+	return nil, ns.SetWithTTL(string(args[1]), args[2], ttl)
+}
+
+// replicaDeleteHandler 处理其他节点同步过来的删除操作
+func (ts *TCPServer) replicaDeleteHandler(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+	if len(args) < 1 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	return nil, ns.Delete(string(args[0]))
+}
+
+// replicaSetManyHandler 处理其他节点批量同步过来的键值对
+func (ts *TCPServer) replicaSetManyHandler(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+	ttl, _, entries, err := entriesOf(args)
+	if err != nil {
+		return nil, err
+	}
+	return nil, ns.SetManyWithTTL(entries, ttl)
+}
+
+// replicaExpireHandler 处理其他节点同步过来的有效期修改
+func (ts *TCPServer) replicaExpireHandler(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+	if len(args) < 2 {
+		return nil, commandNeedsMoreArgumentsErr
+	}
+	expiration, err := expirationOfArg(args[1])
+	if err != nil {
+		return nil, err
+	}
+	_, err = ns.Expire(string(args[0]), expiration)
+	return nil, err
+}
+
+// replicaDeleteManyHandler 处理其他节点批量同步过来的删除操作
+func (ts *TCPServer) replicaDeleteManyHandler(ns *caches.Namespace, args [][]byte) (body []byte, err error) {
+	return nil, ns.DeleteMany(keysOf(args))
+}
+
+// tcpPeer 使用 vex 协议将数据同步到其他节点
+type tcpPeer struct {
+	pool *clientPool
+}
+
+// setWithExpiration 在 replicaSetCommand 的参数后面加上有效期和版本号，不认识这些参数的旧节点会使用永不过期直接写入
+func (tp *tcpPeer) setWithExpiration(address string, namespace string, key string, value []byte, expiration caches.Expiration, version uint64) error {
+	ttlBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttlBytes, uint64(caches.NeverDie))
+	versionBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(versionBytes, version)
+	command, args := namespacedCommand(namespace, replicaSetCommand, [][]byte{ttlBytes, []byte(key), value, expirationArgOf(expiration), versionBytes})
+	_, err := tp.pool.do(address, command, args)
+	return err
+}
+
+func (tp *tcpPeer) delete(address string, namespace string, key string) error {
+	command, args := namespacedCommand(namespace, replicaDeleteCommand, [][]byte{[]byte(key)})
+	_, err := tp.pool.do(address, command, args)
+	return err
+}
+
+func (tp *tcpPeer) flushNamespace(address string, namespace string) error {
+	_, err := tp.pool.do(address, replicaFlushNamespaceCommand, [][]byte{[]byte(namespace)})
+	return err
+}
@@ -3,19 +3,18 @@ package services
 import (
 	"cache/caches"
 	"cache/vex"
+	"crypto/tls"
 	"encoding/binary"
 	"encoding/json"
 	"errors"
-	"github.com/FishGoddess/cachego"
+	"path"
 	"stathat.com/c/consistent"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	// ttlOfClient 客户端的有效期， 单位: 秒
-	ttlOfClient = 15 * 60
-
 	// redirectPrefix  重定向的前缀，用于判断错误是不是重定向
 	redirectPrefix = "redirect to node"
 
@@ -24,6 +23,9 @@ const (
 
 	// updateCircleDuration  更新节点信息的时间间隔， 主要是用于更新一致性哈希的节点情况
 	updateCircleDuration = 5 * time.Minute
+
+	// maxFailoverNodes 读请求最多尝试的节点个数，主节点不可用时会尝试后面的副本节点
+	maxFailoverNodes = 3
 )
 
 var (
@@ -32,18 +34,146 @@ var (
 
 	// reachMaxRetriedTimesErr  意味着重定向次数超过了最大限制， 说明集群处于不可用状态
 	reachedMaxRetriedTimesErr = errors.New("reached max redirect times")
+
+	// malformedIncrementErr 意味着自增命令的响应格式不正确
+	malformedIncrementErr = errors.New("malformed increment response")
+
+	// malformedVersionErr 意味着带版本号的响应格式不正确
+	malformedVersionErr = errors.New("malformed version response")
+
+	// malformedTtlErr 意味着有效期的响应格式不正确
+	malformedTtlErr = errors.New("malformed ttl response")
+
+	// eventStreamClosedErr 意味着服务端结束了事件的推送，通常是因为节点正在关闭
+	eventStreamClosedErr = errors.New("event stream closed by server")
+
+	// subscriptionClosedErr 意味着服务端结束了订阅，通常是因为节点正在关闭
+	subscriptionClosedErr = errors.New("subscription closed by server")
+
+	// subscriberClosedErr 意味着订阅者已经被关闭了
+	subscriberClosedErr = errors.New("subscriber is closed")
 )
 
 type TCPClient struct {
-	// clients 存储所有的客户端连接  是一个缓存结构
-	clients *cachego.Cache
+	// clients 存储到每个节点的连接
+	clients *nodeClients
 
 	// circle 存储了当前集群的一致性哈希信息 ，用于避免重定向
 	circle *consistent.Consistent
+
+	// namespace 是命令执行的命名空间，为空时表示默认的命名空间
+	namespace string
+
+	// options 是连接每个节点时使用的选项
+	options TCPClientOptions
+
+	// closed 在客户端被关闭时关闭，用于停止定期更新一致性哈希的任务，closeOnce 保证只关闭一次
+	closed    chan struct{}
+	closeOnce *sync.Once
+}
+
+// nodeClients 记录了到集群中每个节点的连接
+// vex.Client 可以被多个 goroutine 同时使用，所以每个节点只需要一个连接，连接会一直使用到出错、节点离开集群或者客户端被关闭
+type nodeClients struct {
+	clients map[string]*vex.Client
+	// dial 创建到某个节点的新连接
+	dial func(address string) (*vex.Client, error)
+	lock *sync.Mutex
+}
+
+func newNodeClients(dial func(address string) (*vex.Client, error)) *nodeClients {
+	return &nodeClients{
+		clients: map[string]*vex.Client{},
+		dial:    dial,
+		lock:    &sync.Mutex{},
+	}
+}
+
+// add 记录到 node 的连接 client，已经有连接时关闭 client 并返回已有的连接
+func (nc *nodeClients) add(node string, client *vex.Client) *vex.Client {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	if existing, ok := nc.clients[node]; ok {
+		client.Close()
+		return existing
+	}
+	nc.clients[node] = client
+	return client
+}
+
+// get 返回到 node 的连接，没有时创建新的连接
+// 创建连接比较耗时，所以不在锁内创建，同时创建的多余连接会被关闭
+func (nc *nodeClients) get(node string) (*vex.Client, error) {
+	nc.lock.Lock()
+	client, ok := nc.clients[node]
+	nc.lock.Unlock()
+	if ok {
+		return client, nil
+	}
+	client, err := nc.dial(node)
+	if err != nil {
+		return nil, err
+	}
+	return nc.add(node, client), nil
+}
+
+// discard 关闭并丢弃到 node 的连接 client，client 已经被替换时只关闭 client
+func (nc *nodeClients) discard(node string, client *vex.Client) {
+	nc.lock.Lock()
+	if nc.clients[node] == client {
+		delete(nc.clients, node)
+	}
+	nc.lock.Unlock()
+	client.Close()
+}
+
+// retain 关闭并丢弃到不在 nodes 中的节点的连接，这些节点已经离开了集群
+func (nc *nodeClients) retain(nodes []string) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	for node, client := range nc.clients {
+		if !containsNode(nodes, node) {
+			delete(nc.clients, node)
+			client.Close()
+		}
+	}
+}
+
+// closeAll 关闭所有的连接，返回最后一个关闭失败的错误
+func (nc *nodeClients) closeAll() (err error) {
+	nc.lock.Lock()
+	defer nc.lock.Unlock()
+	for node, client := range nc.clients {
+		delete(nc.clients, node)
+		if closeErr := client.Close(); closeErr != nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// TCPClientOptions 是 TCPClient 连接节点时使用的选项
+type TCPClientOptions struct {
+	// TLSConfig 为 nil 时不使用 TLS，服务端要求双向认证时，需要在其中设置客户端证书
+	TLSConfig *tls.Config
+
+	// Username 和 Password 用于认证，都为空时不认证，Username 为空时 Password 会被当成令牌
+	Username string
+	Password string
 }
 
 func NewTCPClient(address string) (*TCPClient, error) {
-	client, err := vex.NewClient("tcp", address)
+	return NewTCPClientWith(address, TCPClientOptions{})
+}
+
+// NewTLSTCPClient 创建使用 TLS 连接集群中每个节点的客户端，config 为 nil 时和 NewTCPClient 一样
+func NewTLSTCPClient(address string, config *tls.Config) (*TCPClient, error) {
+	return NewTCPClientWith(address, TCPClientOptions{TLSConfig: config})
+}
+
+// NewTCPClientWith 使用 options 创建客户端
+func NewTCPClientWith(address string, options TCPClientOptions) (*TCPClient, error) {
+	client, err := dial(address, options)
 	if err != nil {
 		return nil, err
 	}
@@ -53,14 +183,17 @@ func NewTCPClient(address string) (*TCPClient, error) {
 	circle.NumberOfReplicas = 1024
 	circle.Set([]string{address})
 
-	// 创建缓存，设置过期数据清理的时间间隔是 10分钟， 并给所有的客户端连接设置15分钟有效期。
-	clients := cachego.NewCache()
-	clients.AutoGc(10 * time.Minute)
-	clients.SetWithTTL(address, client, ttlOfClient)
+	clients := newNodeClients(func(address string) (*vex.Client, error) {
+		return dial(address, options)
+	})
+	clients.add(address, client)
 
 	tc := &TCPClient{
-		clients: clients,
-		circle:  circle,
+		clients:   clients,
+		circle:    circle,
+		options:   options,
+		closed:    make(chan struct{}),
+		closeOnce: &sync.Once{},
 	}
 
 	// 开启一个定时任务， 定期更新一致性哈希信息
@@ -69,23 +202,66 @@ func NewTCPClient(address string) (*TCPClient, error) {
 	return tc, tc.updateCircleAndClients()
 }
 
-// updateCircleAtFixedDuration  定期更新一致性哈希信息
+// WithNamespace 返回一个在命名空间 namespace 中执行命令的客户端
+// 返回的客户端和原来的客户端共用连接和一致性哈希，所以只需要关闭其中一个
+func (tc *TCPClient) WithNamespace(namespace string) *TCPClient {
+	return &TCPClient{
+		clients:   tc.clients,
+		circle:    tc.circle,
+		namespace: namespace,
+		options:   tc.options,
+		closed:    tc.closed,
+		closeOnce: tc.closeOnce,
+	}
+}
+
+// dial 使用 options 创建连接到 address 的客户端，并在需要时完成认证
+func dial(address string, options TCPClientOptions) (*vex.Client, error) {
+	var client *vex.Client
+	var err error
+	if options.TLSConfig == nil {
+		client, err = vex.NewClient("tcp", address)
+	} else {
+		client, err = vex.NewTLSClient("tcp", address, options.TLSConfig)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if options.Username != "" || options.Password != "" {
+		if err = client.Auth(options.Username, options.Password); err != nil {
+			client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
+}
+
+// updateCircleAtFixedDuration  定期更新一致性哈希信息，客户端被关闭之后停止
 func (tc *TCPClient) updateCircleAtFixedDuration(duration time.Duration) {
 	go func() {
 		ticker := time.NewTicker(duration)
+		defer ticker.Stop()
 		for {
 			select {
 			case <-ticker.C:
 				// 获取集群节点信息， 并更新到一致性哈希中
 				nodes, err := tc.nodes()
 				if err == nil {
-					tc.circle.Set(nodes)
+					tc.setNodes(nodes)
 				}
+			case <-tc.closed:
+				return
 			}
 		}
 	}()
 }
 
+// setNodes 使用集群中的节点 nodes 更新一致性哈希，并关闭到已经离开集群的节点的连接
+func (tc *TCPClient) setNodes(nodes []string) {
+	tc.circle.Set(nodes)
+	tc.clients.retain(nodes)
+}
+
 func (tc *TCPClient) nodes() ([]string, error) {
 
 	// 获取一致性哈希成员，
@@ -107,22 +283,9 @@ func (tc *TCPClient) nodes() ([]string, error) {
 	return nil, noClientIsAvailableErr
 }
 
-// getOrCreateClient  从缓存中弄到某个客户端节点的连接
+// getOrCreateClient 返回到某个节点的连接，还没有连接时创建一个
 func (tc *TCPClient) getOrCreateClient(node string) (*vex.Client, error) {
-
-	// 如果拿不到，说明这个节点的客户端连接要么没有，要么过期了，所以需要新创建一个
-	client, ok := tc.clients.Get(node)
-	if !ok {
-		var err error
-		client, err := vex.NewClient("tcp", node)
-		if err != nil {
-			return nil, err
-		}
-
-		// 注意，新创建的连接需要设置有效性
-		tc.clients.SetWithTTL(node, client, ttlOfClient)
-	}
-	return client.(*vex.Client), nil
+	return tc.clients.get(node)
 }
 
 // updateCircleAndClients 更新一致性哈希和客户端连接
@@ -134,81 +297,636 @@ func (tc *TCPClient) updateCircleAndClients() error {
 	}
 
 	// 更新一致性哈希，并根据节点信息更新客户端连接信息
-	tc.circle.Set(nodes)
+	tc.setNodes(nodes)
 	for _, node := range nodes {
 		tc.getOrCreateClient(node)
 	}
 	return nil
 }
 
-// clientOf 返回某个 key 的客户端连接
-func (tc *TCPClient) clientOf(key string) (*vex.Client, error) {
+// nodeOf 返回某个 key 所属的节点
+func (tc *TCPClient) nodeOf(key string) (string, error) {
 
-	// 使用一致性哈希环判断这个 key 属于哪一个节点， 然后获取这个节点的客户端连接
+	// 使用一致性哈希环判断这个 key 属于哪一个节点
 	// 所以一致性哈希环的准确性直接关系到重定向问题的解决。
-	node, err := tc.circle.Get(key)
-	if err != nil {
-		return nil, err
-	}
-	return tc.getOrCreateClient(node)
+	return tc.circle.Get(key)
 }
 
-func (tc *TCPClient) doCommand(client *vex.Client, command byte, args [][]byte) (body []byte, err error) {
+// doCommand 在 node 节点上执行命令，并处理重定向
+func (tc *TCPClient) doCommand(node string, command byte, args [][]byte) (body []byte, err error) {
 
 	// 因为可能存在重定向，所以使用循环， 但是不能一直重定向，所以设置了最大的重定向次数
 	for i := 0; i < maxRedirectTime; i++ {
-		body, err = client.Do(command, args)
+		client, err := tc.getOrCreateClient(node)
+		if err != nil {
+			return nil, err
+		}
+		body, err = client.Do(namespacedCommand(tc.namespace, command, args))
+		if err == nil {
+			return body, nil
+		}
 
-		// 判断发生的错误是不是重定向错误，如果是，就从错误中获取正确的节点地址，并拿到这个节点的客户端连接，再次执行命令
-		if err != nil && strings.HasPrefix(err.Error(), redirectPrefix) {
-			node := strings.TrimPrefix(err.Error(), redirectPrefix)
-			rightClient, err := tc.getOrCreateClient(node)
+		// 判断发生的错误是不是重定向错误，如果是，就从错误中获取正确的节点地址，再次执行命令
+		if strings.HasPrefix(err.Error(), redirectPrefix) {
+			node = strings.TrimSpace(strings.TrimPrefix(err.Error(), redirectPrefix))
+			continue
+		}
+
+		// 如果错误不是服务端返回的，而是连接出了问题，说明节点很可能已经不可用了，需要丢弃这个连接并更新集群的节点信息
+		if !vex.IsReplyError(err) {
+			tc.discardClient(node, client)
+		}
+		return body, err
+	}
+	return body, reachedMaxRetriedTimesErr
+}
+
+// discardClient 丢弃 node 节点不可用的连接，并更新集群的节点信息
+func (tc *TCPClient) discardClient(node string, client *vex.Client) {
+	tc.clients.discard(node, client)
+	if nodes, err := tc.nodes(); err == nil {
+		tc.setNodes(nodes)
+	}
+}
+
+// doBatch 将 keys 按照所属的节点拆分，并发地在各个节点上执行批量命令，argsOf 生成每个节点的参数，handle 处理每个节点的响应
+// 某个节点返回重定向错误说明一致性哈希已经过期了，需要更新之后重新拆分这部分 key，同样不能一直重定向
+func (tc *TCPClient) doBatch(command byte, keys []string, argsOf func(keys []string) [][]byte, handle func(keys []string, body []byte) error) error {
+	lock := &sync.Mutex{}
+	for i := 0; i < maxRedirectTime; i++ {
+		groups := map[string][]string{}
+		for _, key := range keys {
+			node, err := tc.nodeOf(key)
 			if err != nil {
-				continue
+				return err
 			}
-			client = rightClient
-			continue
+			groups[node] = append(groups[node], key)
 		}
 
-		// 如果错误不是重定向错误，而是连接关闭的错误，说明节点出了问题，很可能是节点的信息已经不准确了，需要更新集群的节点信息
-		if err != nil && strings.HasSuffix(err.Error(), "closed by the remote host.") {
-			nodes, err := tc.nodes()
+		var redirected []string
+		err := fanOut(groups, func(node string, keys []string) error {
+			client, err := tc.getOrCreateClient(node)
 			if err != nil {
-				tc.circle.Set(nodes)
+				return err
+			}
+			body, err := client.Do(namespacedCommand(tc.namespace, command, argsOf(keys)))
+			if err != nil && strings.HasPrefix(err.Error(), redirectPrefix) {
+				lock.Lock()
+				redirected = append(redirected, keys...)
+				lock.Unlock()
+				return nil
 			}
+			if err != nil {
+				if !vex.IsReplyError(err) {
+					tc.discardClient(node, client)
+				}
+				return err
+			}
+			lock.Lock()
+			defer lock.Unlock()
+			return handle(keys, body)
+		})
+		if err != nil {
+			return err
+		}
+		if len(redirected) == 0 {
+			return nil
+		}
+
+		keys = redirected
+		if nodes, err := tc.nodes(); err == nil {
+			tc.setNodes(nodes)
 		}
 	}
-	return body, err
+	return reachedMaxRetriedTimesErr
+}
+
+// GetMany 批量获取 keys 对应的值，返回值中只包含存在的 key
+func (tc *TCPClient) GetMany(keys []string) (map[string][]byte, error) {
+	values := make(map[string][]byte, len(keys))
+	err := tc.doBatch(getManyCommand, keys, keyArgsOf, func(keys []string, body []byte) error {
+		return decodeValues(body, keys, values)
+	})
+	return values, err
+}
+
+// SetMany 使用同样的有效期批量设置 entries 中的键值对
+func (tc *TCPClient) SetMany(entries map[string][]byte, ttl int64) error {
+	argsOf := func(keys []string) [][]byte {
+		return entryArgsOf(ttl, keys, entries)
+	}
+	return tc.doBatch(setManyCommand, keysOfEntries(entries), argsOf, func(keys []string, body []byte) error {
+		return nil
+	})
+}
+
+// DeleteMany 批量删除 keys
+func (tc *TCPClient) DeleteMany(keys []string) error {
+	return tc.doBatch(deleteManyCommand, keys, keyArgsOf, func(keys []string, body []byte) error {
+		return nil
+	})
 }
 
 func (tc *TCPClient) Get(key string) ([]byte, error) {
-	client, err := tc.clientOf(key)
+
+	// 开启了复制的话，副本节点也可以处理读请求，所以主节点连接不上时，依次尝试环上后面的节点
+	nodes, err := tc.circle.GetN(key, maxFailoverNodes)
 	if err != nil {
 		return nil, err
 	}
-	return tc.doCommand(client, getCommand, [][]byte{[]byte(key)})
+	var body []byte
+	for _, node := range nodes {
+		body, err = tc.doCommand(node, getCommand, [][]byte{[]byte(key)})
+		if err == nil || vex.IsReplyError(err) {
+			return body, err
+		}
+	}
+	return body, err
 }
 
 func (tc *TCPClient) Set(key string, value []byte, ttl int64) error {
-	client, err := tc.clientOf(key)
+	node, err := tc.nodeOf(key)
 	if err != nil {
 		return err
 	}
 	ttlBytes := make([]byte, 8)
 	binary.BigEndian.PutUint64(ttlBytes, uint64(ttl))
-	_, err = tc.doCommand(client, setCommand, [][]byte{ttlBytes, []byte(key), value})
+	_, err = tc.doCommand(node, setCommand, [][]byte{ttlBytes, []byte(key), value})
 	return err
 }
 
+// SetWithExpiration 写入键值对，有效期和数据一起原子地写入，有效期会被精确到毫秒
+// 和 Set 不同，expiration 可以是滑动有效期或者绝对过期时间，不需要在写入之后再调用 Expire
+func (tc *TCPClient) SetWithExpiration(key string, value []byte, expiration caches.Expiration) error {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return err
+	}
+	args := append(setArgsOf(key, value, caches.NeverDie), expirationArgOf(expiration))
+	_, err = tc.doCommand(node, setCommand, args)
+	return err
+}
+
+// setArgsOf 返回写入命令的参数：ttl | key | value
+func setArgsOf(key string, value []byte, ttl int64) [][]byte {
+	ttlBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttlBytes, uint64(ttl))
+	return [][]byte{ttlBytes, []byte(key), value}
+}
+
+// conditionalSet 执行只有满足条件时才写入的命令，返回是否写入
+func (tc *TCPClient) conditionalSet(command byte, key string, value []byte, ttl int64) (bool, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return false, err
+	}
+	body, err := tc.doCommand(node, command, setArgsOf(key, value, ttl))
+	if err != nil {
+		return false, err
+	}
+	return len(body) > 0 && body[0] == 1, nil
+}
+
+// SetNX 只有在 key 不存在时才写入，返回是否写入
+func (tc *TCPClient) SetNX(key string, value []byte, ttl int64) (bool, error) {
+	return tc.conditionalSet(setNXCommand, key, value, ttl)
+}
+
+// SetXX 只有在 key 存在时才写入，返回是否写入
+func (tc *TCPClient) SetXX(key string, value []byte, ttl int64) (bool, error) {
+	return tc.conditionalSet(setXXCommand, key, value, ttl)
+}
+
+// GetSet 写入新的值并返回旧的值，旧的值不存在时返回 false
+func (tc *TCPClient) GetSet(key string, value []byte, ttl int64) ([]byte, bool, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return nil, false, err
+	}
+	body, err := tc.doCommand(node, getSetCommand, setArgsOf(key, value, ttl))
+	if err != nil {
+		return nil, false, err
+	}
+	if len(body) < 1 || body[0] == 0 {
+		return nil, false, nil
+	}
+	return body[1:], true, nil
+}
+
+// GetAndDelete 删除 key 并返回删除之前的值，key 不存在时返回 not found 错误
+func (tc *TCPClient) GetAndDelete(key string) ([]byte, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return nil, err
+	}
+	return tc.doCommand(node, getAndDeleteCommand, [][]byte{[]byte(key)})
+}
+
+// TTL 返回 key 剩余的有效期，单位是秒，不足一秒的部分按一秒计算，caches.NeverDie 表示永不过期，key 不存在时返回 not found 错误
+func (tc *TCPClient) TTL(key string) (int64, error) {
+	ttl, err := tc.PTTL(key)
+	if err != nil || ttl == caches.NeverDie {
+		return ttl, err
+	}
+	return (ttl + 999) / 1000, nil
+}
+
+// PTTL 返回 key 剩余的有效期，单位是毫秒，caches.NeverDie 表示永不过期，key 不存在时返回 not found 错误
+func (tc *TCPClient) PTTL(key string) (int64, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return 0, err
+	}
+	body, err := tc.doCommand(node, ttlCommand, [][]byte{[]byte(key)})
+	if err != nil {
+		return 0, err
+	}
+	if len(body) < 8 {
+		return 0, malformedTtlErr
+	}
+	return int64(binary.BigEndian.Uint64(body)), nil
+}
+
+// Expire 将 key 的有效期修改为 expiration，有效期会被精确到毫秒，返回 key 是否存在
+func (tc *TCPClient) Expire(key string, expiration caches.Expiration) (bool, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return false, err
+	}
+	body, err := tc.doCommand(node, expireCommand, [][]byte{[]byte(key), expirationArgOf(expiration)})
+	if err != nil {
+		return false, err
+	}
+	return len(body) > 0 && body[0] == 1, nil
+}
+
+// Persist 移除 key 的有效期，让 key 永不过期，返回 key 是否存在
+func (tc *TCPClient) Persist(key string) (bool, error) {
+	return tc.Expire(key, caches.Expiration{})
+}
+
+// GetWithVersion 返回 key 对应的值和版本号，版本号可以用于 CompareAndSet
+func (tc *TCPClient) GetWithVersion(key string) ([]byte, uint64, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return nil, 0, err
+	}
+	body, err := tc.doCommand(node, getWithVersionCommand, [][]byte{[]byte(key)})
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(body) < 8 {
+		return nil, 0, malformedVersionErr
+	}
+	return body[8:], binary.BigEndian.Uint64(body), nil
+}
+
+// CompareAndSet 只有在 key 当前的版本号等于 expectedVersion 时才写入，成功时返回新的版本号
+// expectedVersion 为 0 表示只有 key 不存在时才写入
+func (tc *TCPClient) CompareAndSet(key string, value []byte, expectedVersion uint64, ttl int64) (uint64, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return 0, err
+	}
+	ttlBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttlBytes, uint64(ttl))
+	versionBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(versionBytes, expectedVersion)
+	body, err := tc.doCommand(node, compareAndSetCommand, [][]byte{ttlBytes, []byte(key), value, versionBytes})
+	if err != nil {
+		return 0, err
+	}
+	if len(body) < 8 {
+		return 0, malformedVersionErr
+	}
+	return binary.BigEndian.Uint64(body), nil
+}
+
+// Incr 将 key 对应的整数原子地加上 delta，并返回相加之后的结果，ttl 是结果的有效期
+func (tc *TCPClient) Incr(key string, delta int64, ttl int64) (int64, error) {
+	node, err := tc.nodeOf(key)
+	if err != nil {
+		return 0, err
+	}
+	ttlBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(ttlBytes, uint64(ttl))
+	deltaBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(deltaBytes, uint64(delta))
+	body, err := tc.doCommand(node, incrementCommand, [][]byte{ttlBytes, []byte(key), deltaBytes})
+	if err != nil {
+		return 0, err
+	}
+	if len(body) < 8 {
+		return 0, malformedIncrementErr
+	}
+	return int64(binary.BigEndian.Uint64(body)), nil
+}
+
+// Decr 将 key 对应的整数原子地减去 delta，并返回相减之后的结果，ttl 是结果的有效期
+func (tc *TCPClient) Decr(key string, delta int64, ttl int64) (int64, error) {
+	return tc.Incr(key, -delta, ttl)
+}
+
 func (tc *TCPClient) Delete(key string) error {
-	client, err := tc.clientOf(key)
+	node, err := tc.nodeOf(key)
 	if err != nil {
 		return err
 	}
-	_, err = tc.doCommand(client, deleteCommand, [][]byte{[]byte(key)})
+	_, err = tc.doCommand(node, deleteCommand, [][]byte{[]byte(key)})
+	return err
+}
+
+// Scan 依次扫描集群中的每个节点，将匹配 pattern 的 key 交给 fn 处理，fn 返回 false 时停止扫描
+// 每个节点只返回自己作为主节点的 key，所以集群没有变化时每个 key 只会出现一次；扫描期间集群发生变化的话，key 可能重复或者遗漏
+func (tc *TCPClient) Scan(pattern string, fn func(key string) bool) error {
+	countBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(countBytes, defaultScanCount)
+	for _, node := range tc.circle.Members() {
+		cursor := ""
+		for {
+			body, err := tc.doCommand(node, scanCommand, [][]byte{[]byte(cursor), []byte(pattern), countBytes})
+			if err != nil {
+				return err
+			}
+			result, err := decodeScanResult(body)
+			if err != nil {
+				return err
+			}
+			for _, key := range result.Keys {
+				if !fn(key) {
+					return nil
+				}
+			}
+			if result.Cursor == "" {
+				break
+			}
+			cursor = result.Cursor
+		}
+	}
+	return nil
+}
+
+// FlushNamespace 清空整个集群中的命名空间 namespace，收到请求的节点会通知其他所有节点
+func (tc *TCPClient) FlushNamespace(namespace string) error {
+	_, err := tc.doOnAnyNode(flushNamespaceCommand, [][]byte{[]byte(namespace)})
+	return err
+}
+
+// Publish 将 message 发布到频道 channel，集群中所有订阅了这个频道的客户端都会收到
+func (tc *TCPClient) Publish(channel string, message []byte) error {
+	_, err := tc.doOnAnyNode(publishCommand, [][]byte{[]byte(channel), message})
+	return err
+}
+
+// doOnAnyNode 将请求发送给集群中任意一个可以连接的节点
+func (tc *TCPClient) doOnAnyNode(command byte, args [][]byte) (body []byte, err error) {
+	for _, node := range tc.circle.Members() {
+		client, err := tc.getOrCreateClient(node)
+		if err != nil {
+			continue
+		}
+		return client.Do(command, args)
+	}
+	return nil, noClientIsAvailableErr
+}
+
+// Events 订阅集群中所有节点上匹配 pattern 的 key 变化的事件，并交给 fn 处理，fn 返回 false 时取消订阅
+// 使用 WithNamespace 的客户端只会收到这个命名空间的事件，否则会收到所有命名空间的事件
+// 每个节点的订阅都使用单独的连接，某个节点的连接出错时会取消所有的订阅并返回错误
+// 副本节点也会产生事件，所以同一个 key 的变化可能会收到多次
+func (tc *TCPClient) Events(pattern string, fn func(event caches.Event) bool) error {
+	events := make(chan caches.Event)
+	errs := make(chan error, 1)
+	done := make(chan struct{})
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer close(done)
+
+	for _, node := range tc.circle.Members() {
+		client, err := dial(node, tc.options)
+		if err != nil {
+			return err
+		}
+		stream, err := client.Stream(eventsCommand, [][]byte{[]byte(tc.namespace), []byte(pattern)})
+		if err != nil {
+			client.Close()
+			return err
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer client.Close()
+			err := receiveEvents(stream, events, done)
+			select {
+			case errs <- err:
+			default:
+			}
+		}()
+	}
+
+	for {
+		select {
+		case event := <-events:
+			if !fn(event) {
+				return nil
+			}
+		case err := <-errs:
+			return err
+		}
+	}
+}
+
+// receiveEvents 将 stream 推送的事件放入 events，直到 done 被关闭或者流式请求结束
+func receiveEvents(stream *vex.ClientStream, events chan<- caches.Event, done <-chan struct{}) error {
+	for {
+		select {
+		case message, ok := <-stream.Messages():
+			if !ok {
+				if err := stream.Err(); err != nil {
+					return err
+				}
+				return eventStreamClosedErr
+			}
+			event := caches.Event{}
+			if err := json.Unmarshal(message, &event); err != nil {
+				return err
+			}
+			select {
+			case events <- event:
+			case <-done:
+				return nil
+			}
+		case <-done:
+			return nil
+		}
+	}
+}
+
+// Subscribe 订阅集群中匹配 patterns 的频道，匹配模式的语法和 path.Match 相同
+// 消息会被广播到集群中的所有节点，所以订阅者只需要连接其中一个节点，订阅者使用单独的连接，不再需要时必须调用 Close
+func (tc *TCPClient) Subscribe(patterns ...string) (*Subscriber, error) {
+	var client *vex.Client
+	var err error = noClientIsAvailableErr
+	for _, node := range tc.circle.Members() {
+		if client, err = dial(node, tc.options); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	subscriber := &Subscriber{
+		client:   client,
+		streams:  map[string]*vex.ClientStream{},
+		messages: make(chan ChannelMessage, channelBufferSize),
+		done:     make(chan struct{}),
+		wg:       &sync.WaitGroup{},
+		once:     &sync.Once{},
+		lock:     &sync.Mutex{},
+	}
+	if err = subscriber.Subscribe(patterns...); err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+	return subscriber, nil
+}
+
+// Subscriber 是一个频道的订阅者，每个匹配模式都是同一个连接上的一个流式请求，取消订阅就是取消这个请求
+// 多个匹配模式都匹配一个频道时，这个频道上的每条消息都会收到多次
+type Subscriber struct {
+	client *vex.Client
+	// streams 记录了每个匹配模式对应的流式请求
+	streams  map[string]*vex.ClientStream
+	messages chan ChannelMessage
+	// err 是连接出错的原因，出错之后订阅者会被关闭
+	err error
+	// done 在订阅者被关闭时被关闭
+	done chan struct{}
+	wg   *sync.WaitGroup
+	once *sync.Once
+	lock *sync.Mutex
+}
+
+// Subscribe 增加订阅匹配 patterns 的频道，已经订阅过的匹配模式会被忽略
+func (s *Subscriber) Subscribe(patterns ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	select {
+	case <-s.done:
+		return subscriberClosedErr
+	default:
+	}
+	for _, pattern := range patterns {
+		if _, ok := s.streams[pattern]; ok {
+			continue
+		}
+		// 服务端拒绝订阅时会结束流式请求，这会被当成连接出错，所以需要先检查匹配模式
+		if _, err := path.Match(pattern, ""); err != nil {
+			return err
+		}
+		stream, err := s.client.Stream(subscribeCommand, [][]byte{[]byte(pattern)})
+		if err != nil {
+			return err
+		}
+		s.streams[pattern] = stream
+		s.wg.Add(1)
+		go s.receive(stream)
+	}
+	return nil
+}
+
+// Unsubscribe 取消订阅匹配 patterns 的频道，没有指定 patterns 时取消所有的订阅，订阅者仍然可以继续订阅其他频道
+func (s *Subscriber) Unsubscribe(patterns ...string) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if len(patterns) == 0 {
+		for pattern := range s.streams {
+			patterns = append(patterns, pattern)
+		}
+	}
+	var err error
+	for _, pattern := range patterns {
+		stream, ok := s.streams[pattern]
+		if !ok {
+			continue
+		}
+		delete(s.streams, pattern)
+		if closeErr := stream.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
 	return err
 }
 
+// Messages 返回接收消息的管道，订阅者被关闭或者连接出错之后管道会被关闭
+func (s *Subscriber) Messages() <-chan ChannelMessage {
+	return s.messages
+}
+
+// Err 返回连接出错的原因，主动关闭的订阅者返回 nil
+func (s *Subscriber) Err() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.err
+}
+
+// Close 取消所有的订阅并关闭连接，可以多次调用
+func (s *Subscriber) Close() error {
+	return s.closeWith(nil)
+}
+
+// closeWith 关闭订阅者，err 是关闭的原因
+func (s *Subscriber) closeWith(err error) (closeErr error) {
+	s.once.Do(func() {
+		s.lock.Lock()
+		s.err = err
+		close(s.done)
+		s.lock.Unlock()
+
+		closeErr = s.client.Close()
+		s.wg.Wait()
+		close(s.messages)
+	})
+	return closeErr
+}
+
+// receive 将 stream 推送的消息放入 messages，直到订阅被取消或者订阅者被关闭，连接出错时会关闭订阅者
+func (s *Subscriber) receive(stream *vex.ClientStream) {
+	defer s.wg.Done()
+	for body := range stream.Messages() {
+		message, err := decodeChannelMessage(body)
+		if err != nil {
+			continue
+		}
+		select {
+		case s.messages <- message:
+		case <-s.done:
+			return
+		}
+	}
+	err := stream.Err()
+	if err == nil && s.owns(stream) {
+		err = subscriptionClosedErr
+	}
+	if err != nil {
+		go s.closeWith(err)
+	}
+}
+
+// owns 判断 stream 是不是还没有被取消的订阅，没有被取消却结束了说明是服务端结束了订阅
+func (s *Subscriber) owns(stream *vex.ClientStream) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, current := range s.streams {
+		if current == stream {
+			return true
+		}
+	}
+	return false
+}
+
 func (tc *TCPClient) Status() (*caches.Status, error) {
 
 	// 由于缓存服务器可能是一个集群，这里需要获取所有的节点，然后做一个汇总
@@ -231,20 +949,24 @@ func (tc *TCPClient) Status() (*caches.Status, error) {
 		totalStatus.Count += status.Count
 		totalStatus.ValueSize += status.ValueSize
 		totalStatus.KeySize += status.KeySize
+		totalStatus.StoredValueSize += status.StoredValueSize
+		totalStatus.Evictions += status.Evictions
+		totalStatus.Expired += status.Expired
+		totalStatus.MemorySize += status.MemorySize
+		totalStatus.MaxMemory += status.MaxMemory
+		totalStatus.HighWatermark += status.HighWatermark
+		totalStatus.LowWatermark += status.LowWatermark
 	}
 	return totalStatus, nil
 }
 
+// Close 关闭到所有节点的连接，并停止定期更新一致性哈希的任务，可以多次调用
+// WithNamespace 返回的客户端共用连接，所以关闭其中任何一个都会关闭所有的客户端
 func (tc *TCPClient) Close() (err error) {
-	nodes := tc.circle.Members()
-	for _, node := range nodes {
-		client, ok := tc.clients.Get(node)
-		if ok {
-			err = client.(*vex.Client).Close()
-		}
-	}
-	tc.clients.RemoveAll()
-	return err
+	tc.closeOnce.Do(func() {
+		close(tc.closed)
+	})
+	return tc.clients.closeAll()
 }
 
 func (tc *TCPClient) Nodes() ([]string, error) {
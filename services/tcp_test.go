@@ -0,0 +1,594 @@
+package services
+
+import (
+	"cache/caches"
+	"cache/vex"
+	"encoding/binary"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testTCPServer 是 startTCPServers 启动的一个节点
+type testTCPServer struct {
+	*TCPServer
+}
+
+// dial 创建一个连接到这个节点的客户端，测试结束时自动关闭
+func (ts *testTCPServer) dial(t *testing.T) *vex.Client {
+	t.Helper()
+	client, err := vex.NewClient("tcp", ts.address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// startTCPServers 在本地启动 count 个 TCP 服务器，它们的一致性哈希中包含了所有的服务器，configure 用于修改选项
+// 和 startHTTPServers 一样，节点不会真的加入集群，集群成员由测试通过 setMembers 控制
+// 虚拟节点个数使用默认值，和 TCPClient 的一致性哈希相同，这样客户端不会被重定向
+func startTCPServers(t *testing.T, count int, configure func(options *Options)) []*testTCPServer {
+	t.Helper()
+	members := make([]string, count)
+	for i := range members {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		members[i] = listener.Addr().String()
+		listener.Close()
+	}
+
+	result := make([]*testTCPServer, count)
+	for i, member := range members {
+		host, port, err := net.SplitHostPort(member)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options := DefaultOptions()
+		options.Address = host
+		options.Port, _ = strconv.Atoi(port)
+		if configure != nil {
+			configure(&options)
+		}
+		accessControl, err := loadACL(options.ACLFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache, err := caches.OpenCache()
+		if err != nil {
+			t.Fatal(err)
+		}
+		n := newTestNode(&options, members)
+		ts := newTCPServer(n, cache, &options, nil, accessControl)
+		go ts.Run()
+		t.Cleanup(func() {
+			stopTestNode(n)
+			ts.server.Close()
+			ts.peers.closeAll()
+		})
+		result[i] = &testTCPServer{TCPServer: ts}
+	}
+
+	// Run 在后台监听端口，等到所有的服务器都可以连接之后再返回
+	for _, member := range members {
+		var err error
+		for i := 0; i < 100; i++ {
+			var conn net.Conn
+			if conn, err = net.Dial("tcp", member); err == nil {
+				conn.Close()
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return result
+}
+
+// newTestTCPClient 创建一个连接到 address 所在集群的 TCPClient，测试结束时自动关闭
+func newTestTCPClient(t *testing.T, address string) *TCPClient {
+	t.Helper()
+	client, err := NewTCPClient(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client
+}
+
+// testEntries 返回 count 个键值对和排好序的 key，值和 key 相同
+func testEntries(count int) (map[string][]byte, []string) {
+	entries := make(map[string][]byte, count)
+	for i := 0; i < count; i++ {
+		key := "key-" + strconv.Itoa(i)
+		entries[key] = []byte(key)
+	}
+	keys := keysOfEntries(entries)
+	sort.Strings(keys)
+	return entries, keys
+}
+
+// checkStoredOnPrimary 检查 keys 只保存在自己的主节点上，nodeCaches 是每个节点的缓存
+func checkStoredOnPrimary(t *testing.T, n *node, nodeCaches map[string]*caches.Cache, keys []string) {
+	t.Helper()
+	for _, key := range keys {
+		primary, err := n.selectNode(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for address, cache := range nodeCaches {
+			if _, _, _, ok := cache.Peek(key); ok != (address == primary) {
+				t.Fatalf("%s owned by %s should be stored on %s: %v", key, primary, address, address == primary)
+			}
+		}
+	}
+}
+
+func TestTCPBatch(t *testing.T) {
+	servers := startTCPServers(t, 2, nil)
+	client := newTestTCPClient(t, servers[0].address)
+
+	// 客户端按照一致性哈希把批量命令拆分给各个主节点
+	entries, keys := testEntries(20)
+	if err := client.SetMany(entries, 60); err != nil {
+		t.Fatal(err)
+	}
+	nodeCaches := map[string]*caches.Cache{servers[0].address: servers[0].cache, servers[1].address: servers[1].cache}
+	checkStoredOnPrimary(t, servers[0].node, nodeCaches, keys)
+	values, err := client.GetMany(append(keys, "missing"))
+	if err != nil || len(values) != len(keys) {
+		t.Fatalf("all keys except missing should be found but got %d, %v", len(values), err)
+	}
+	for key, value := range entries {
+		if string(values[key]) != string(value) {
+			t.Fatalf("%s should be %s but got %s", key, value, values[key])
+		}
+	}
+	if err = client.DeleteMany(keys[:10]); err != nil {
+		t.Fatal(err)
+	}
+	if values, err = client.GetMany(keys); err != nil || len(values) != 10 {
+		t.Fatalf("10 keys should be left but got %d, %v", len(values), err)
+	}
+
+	// 重定向模式下，包含其他节点的 key 的批量命令会被整体重定向，当前节点不会写入一半的数据
+	local, remote := ownedBy(t, servers[0].node, "local-"), ownedBy(t, servers[1].node, "remote-")
+	batch := map[string][]byte{local: nil, remote: nil}
+	_, err = servers[0].dial(t).Do(setManyCommand, entryArgsOf(60, []string{local, remote}, batch))
+	if err == nil || !strings.HasPrefix(err.Error(), redirectPrefix) {
+		t.Fatalf("batch with remote keys should be redirected but got %v", err)
+	}
+	if _, _, _, ok := servers[0].cache.Peek(local); ok {
+		t.Fatal("redirected batch should not be partly written")
+	}
+}
+
+func TestTCPProxyBatch(t *testing.T) {
+	servers := startTCPServers(t, 2, func(options *Options) {
+		options.RoutingMode = ProxyRouting
+	})
+
+	// 代理模式下由收到命令的节点转发给其他节点，客户端只需要连接一个节点
+	entries, keys := testEntries(20)
+	client := servers[0].dial(t)
+	if _, err := client.Do(setManyCommand, entryArgsOf(60, keys, entries)); err != nil {
+		t.Fatal(err)
+	}
+	nodeCaches := map[string]*caches.Cache{servers[0].address: servers[0].cache, servers[1].address: servers[1].cache}
+	checkStoredOnPrimary(t, servers[0].node, nodeCaches, keys)
+
+	body, err := servers[1].dial(t).Do(getManyCommand, keyArgsOf(keys))
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := map[string][]byte{}
+	if err = decodeValues(body, keys, values); err != nil || len(values) != len(keys) {
+		t.Fatalf("all keys should be found but got %d, %v", len(values), err)
+	}
+	if _, err = client.Do(deleteManyCommand, keyArgsOf(keys)); err != nil {
+		t.Fatal(err)
+	}
+	if count := servers[0].cache.Status().Count + servers[1].cache.Status().Count; count != 0 {
+		t.Fatalf("all keys should be deleted but got %d", count)
+	}
+}
+
+func TestTCPClientClosesClients(t *testing.T) {
+	servers := startTCPServers(t, 2, nil)
+	client, err := NewTCPClient(servers[0].address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	removed, err := client.getOrCreateClient(servers[1].address)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 节点离开集群之后，更新一致性哈希时会关闭到这个节点的连接
+	for _, server := range servers {
+		setMembers(server.node, []string{servers[0].address})
+	}
+	if err = client.updateCircleAndClients(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = removed.Do(nodesCommand, nil); err == nil {
+		t.Fatal("client of the removed node should be closed")
+	}
+
+	// 关闭客户端会关闭所有的连接，并停止更新一致性哈希
+	kept, err := client.getOrCreateClient(servers[0].address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = client.WithNamespace("team-a").Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = kept.Do(nodesCommand, nil); err == nil {
+		t.Fatal("all clients should be closed")
+	}
+	select {
+	case <-client.closed:
+	default:
+		t.Fatal("updating circle should be stopped")
+	}
+	if err = client.Close(); err != nil {
+		t.Fatalf("closing twice should succeed but got %v", err)
+	}
+}
+
+func TestTCPIncrement(t *testing.T) {
+	servers := startTCPServers(t, 2, nil)
+	client := newTestTCPClient(t, servers[0].address)
+	key := ownedBy(t, servers[1].node, "counter-")
+
+	// 不存在的 key 从 0 开始，结果会使用 ttl 作为新的有效期
+	if result, err := client.Incr(key, 5, 60); err != nil || result != 5 {
+		t.Fatalf("incr should return 5 but got %d, %v", result, err)
+	}
+	if result, err := client.Decr(key, 7, 0); err != nil || result != -2 {
+		t.Fatalf("decr should return -2 but got %d, %v", result, err)
+	}
+	if value, err := client.Get(key); err != nil || string(value) != "-2" {
+		t.Fatalf("counter should be stored as decimal string but got %s, %v", value, err)
+	}
+	if ttl, ok := servers[1].cache.TTL(key); !ok || ttl != caches.NeverDie {
+		t.Fatalf("ttl should be replaced by the last increment but got %d, %v", ttl, ok)
+	}
+
+	// 不是整数的值不能自增，错误会原样返回给客户端
+	if err := client.Set(key, []byte("abc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Incr(key, 1, 0); !vex.IsReplyError(err) {
+		t.Fatalf("incrementing a non-integer should fail but got %v", err)
+	}
+
+	// 不是主节点的节点在重定向模式下返回重定向错误
+	_, err := servers[0].dial(t).Do(incrementCommand, [][]byte{make([]byte, 8), []byte(key), make([]byte, 8)})
+	if err == nil || !strings.HasPrefix(err.Error(), redirectPrefix+" "+servers[1].address) {
+		t.Fatalf("increment on other node should be redirected but got %v", err)
+	}
+	if _, err = servers[1].dial(t).Do(incrementCommand, [][]byte{make([]byte, 8), []byte(key)}); err == nil || err.Error() != commandNeedsMoreArgumentsErr.Error() {
+		t.Fatalf("increment without delta should fail with %v but got %v", commandNeedsMoreArgumentsErr, err)
+	}
+}
+
+func TestTCPCompareAndSet(t *testing.T) {
+	servers := startTCPServers(t, 2, func(options *Options) {
+		options.ReplicaCount = 2
+	})
+	client := newTestTCPClient(t, servers[0].address)
+	key := ownedBy(t, servers[1].node, "user:")
+
+	if _, _, err := client.GetWithVersion(key); err == nil {
+		t.Fatal("missing key should not be found")
+	}
+
+	// 期望的版本号为 0 表示只有 key 不存在时才写入
+	version, err := client.CompareAndSet(key, []byte("a"), 0, 0)
+	if err != nil || version == 0 {
+		t.Fatalf("set if absent should succeed but got %d, %v", version, err)
+	}
+	if _, err = client.CompareAndSet(key, []byte("b"), 0, 0); !vex.IsReplyError(err) {
+		t.Fatalf("set if absent should fail when key exists but got %v", err)
+	}
+	value, current, err := client.GetWithVersion(key)
+	if err != nil || string(value) != "a" || current != version {
+		t.Fatalf("value a with version %d should be read but got %s, %d, %v", version, value, current, err)
+	}
+
+	// 版本号一致时写入并返回新的版本号，旧的版本号之后就不能再用了
+	newVersion, err := client.CompareAndSet(key, []byte("b"), version, 0)
+	if err != nil || newVersion <= version {
+		t.Fatalf("compare and set should return a newer version but got %d, %v", newVersion, err)
+	}
+	if _, err = client.CompareAndSet(key, []byte("c"), version, 0); !vex.IsReplyError(err) {
+		t.Fatalf("compare and set with old version should fail but got %v", err)
+	}
+	if value, err = client.Get(key); err != nil || string(value) != "b" {
+		t.Fatalf("value should be b but got %s, %v", value, err)
+	}
+
+	// 副本节点可以读取，但是带版本号的读取只能由主节点处理
+	eventually(t, "value should be replicated", func() bool {
+		value, _, _, ok := servers[0].cache.Peek(key)
+		return ok && string(value) == "b"
+	})
+	_, err = servers[0].dial(t).Do(getWithVersionCommand, [][]byte{[]byte(key)})
+	if err == nil || !strings.HasPrefix(err.Error(), redirectPrefix+" "+servers[1].address) {
+		t.Fatalf("get with version on replica should be redirected but got %v", err)
+	}
+}
+
+func TestTCPConditionalWrites(t *testing.T) {
+	servers := startTCPServers(t, 2, nil)
+	client := newTestTCPClient(t, servers[0].address)
+	key := ownedBy(t, servers[1].node, "user:")
+
+	// nx 只有 key 不存在时才写入，xx 只有 key 存在时才写入
+	if ok, err := client.SetXX(key, []byte("a"), 0); ok || err != nil {
+		t.Fatalf("set if exists should not write a missing key but got %v, %v", ok, err)
+	}
+	if ok, err := client.SetNX(key, []byte("a"), 60); !ok || err != nil {
+		t.Fatalf("set if absent should write a missing key but got %v, %v", ok, err)
+	}
+	if ok, err := client.SetNX(key, []byte("b"), 0); ok || err != nil {
+		t.Fatalf("set if absent should not overwrite but got %v, %v", ok, err)
+	}
+	if ok, err := client.SetXX(key, []byte("b"), 0); !ok || err != nil {
+		t.Fatalf("set if exists should overwrite but got %v, %v", ok, err)
+	}
+
+	// GetSet 返回旧的值，GetAndDelete 返回删除之前的值
+	if old, ok, err := client.GetSet(key, []byte("c"), 0); !ok || err != nil || string(old) != "b" {
+		t.Fatalf("get set should return b but got %s, %v, %v", old, ok, err)
+	}
+	if value, err := client.GetAndDelete(key); err != nil || string(value) != "c" {
+		t.Fatalf("get and delete should return c but got %s, %v", value, err)
+	}
+	if _, err := client.GetAndDelete(key); !vex.IsReplyError(err) {
+		t.Fatalf("get and delete should fail on a missing key but got %v", err)
+	}
+	if old, ok, err := client.GetSet(key, []byte("d"), 0); ok || err != nil || old != nil {
+		t.Fatalf("get set on a missing key should return nothing but got %s, %v, %v", old, ok, err)
+	}
+	if value, ok := servers[1].cache.Get(key); !ok || string(value) != "d" {
+		t.Fatalf("value should be written on primary but got %s, %v", value, ok)
+	}
+
+	// 条件写入也是写请求，不是主节点的节点会重定向
+	for _, command := range []byte{setNXCommand, setXXCommand, getSetCommand} {
+		_, err := servers[0].dial(t).Do(command, setArgsOf(key, []byte("e"), 0))
+		if err == nil || !strings.HasPrefix(err.Error(), redirectPrefix) {
+			t.Fatalf("command %d on other node should be redirected but got %v", command, err)
+		}
+	}
+}
+
+func TestTCPScan(t *testing.T) {
+	servers := startTCPServers(t, 2, func(options *Options) {
+		options.ReplicaCount = 2
+	})
+	client := newTestTCPClient(t, servers[0].address)
+	entries, keys := testEntries(30)
+	if err := client.SetMany(entries, 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Set("other", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	eventually(t, "keys should be replicated", func() bool {
+		return servers[0].cache.Status().Count == 31 && servers[1].cache.Status().Count == 31
+	})
+
+	// 每个节点只返回自己作为主节点的 key，所以副本节点上的 key 不会重复出现
+	scanned := map[string]int{}
+	err := client.Scan("key-*", func(key string) bool {
+		scanned[key]++
+		return true
+	})
+	if err != nil || len(scanned) != len(keys) {
+		t.Fatalf("%d keys should be scanned but got %d, %v", len(keys), len(scanned), err)
+	}
+	for key, count := range scanned {
+		if _, ok := entries[key]; !ok || count != 1 {
+			t.Fatalf("%s should be scanned once but got %d", key, count)
+		}
+	}
+
+	count := 0
+	if err = client.Scan("*", func(key string) bool { count++; return false }); err != nil || count != 1 {
+		t.Fatalf("scan should stop after fn returns false but got %d, %v", count, err)
+	}
+
+	// 单个节点分页扫描，游标为空时结束
+	countBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(countBytes, 7)
+	conn := servers[1].dial(t)
+	cursor, pages, primaryKeys := "", 0, 0
+	for {
+		body, err := conn.Do(scanCommand, [][]byte{[]byte(cursor), []byte("key-*"), countBytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := decodeScanResult(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, key := range result.Keys {
+			if primary, _ := servers[1].selectNode(key); !servers[1].isCurrentNode(primary) {
+				t.Fatalf("%s is not owned by %s and should not be scanned", key, servers[1].address)
+			}
+		}
+		pages++
+		primaryKeys += len(result.Keys)
+		if cursor = result.Cursor; cursor == "" {
+			break
+		}
+	}
+	if pages < 2 || primaryKeys == 0 || primaryKeys == len(keys) {
+		t.Fatalf("primary keys should be scanned in pages but got %d keys in %d pages", primaryKeys, pages)
+	}
+
+	if _, err = conn.Do(scanCommand, [][]byte{nil, []byte("["), countBytes}); !vex.IsReplyError(err) {
+		t.Fatalf("malformed pattern should fail but got %v", err)
+	}
+}
+
+// syncEvents 反复调用 write 写入 keys，直到收到了每个 key 的事件，返回在这之前收到的其他事件
+// 每个节点上的事件是按顺序推送的，keys 覆盖了所有节点时，在这之前产生的事件都已经收到了，订阅刚建立时也可以用它等待订阅生效
+func syncEvents(t *testing.T, events <-chan caches.Event, keys []string, write func(key string) error) []caches.Event {
+	t.Helper()
+	var others []caches.Event
+	syncing, pending := map[string]bool{}, map[string]bool{}
+	for _, key := range keys {
+		syncing[key] = true
+		pending[key] = true
+	}
+	for i := 0; i < 300 && len(pending) > 0; i++ {
+		for key := range pending {
+			if err := write(key); err != nil {
+				t.Fatal(err)
+			}
+		}
+		timeout := time.After(10 * time.Millisecond)
+		for waiting := true; waiting; {
+			select {
+			case event := <-events:
+				if syncing[event.Key] {
+					delete(pending, event.Key)
+				} else {
+					others = append(others, event)
+				}
+			case <-timeout:
+				waiting = false
+			}
+		}
+	}
+	if len(pending) > 0 {
+		t.Fatalf("events of %v are not received", pending)
+	}
+	return others
+}
+
+func TestTCPEvents(t *testing.T) {
+	servers := startTCPServers(t, 2, nil)
+	client := newTestTCPClient(t, servers[0].address)
+	teamA := client.WithNamespace("team-a")
+
+	// 订阅会连接所有节点，fn 在 stop 关闭之后返回 false 取消订阅
+	events := make(chan caches.Event, 64)
+	stop := make(chan struct{})
+	result := make(chan error, 1)
+	go func() {
+		result <- teamA.Events("user:*", func(event caches.Event) bool {
+			select {
+			case <-stop:
+				return false
+			default:
+			}
+			events <- event
+			return true
+		})
+	}()
+
+	// 每个节点上各有一个用于同步的 key
+	syncKeys := []string{ownedBy(t, servers[0].node, "user:sync-"), ownedBy(t, servers[1].node, "user:sync-")}
+	setSyncKey := func(key string) error { return teamA.Set(key, nil, 0) }
+	syncEvents(t, events, syncKeys, setSyncKey)
+
+	// 其他命名空间和不匹配的 key 不会产生事件
+	if err := client.Set("user:1", []byte("default"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := teamA.Set("order:1", nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{ownedBy(t, servers[0].node, "user:"), ownedBy(t, servers[1].node, "user:")}
+	for _, key := range keys {
+		if err := teamA.Set(key, []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+		if err := teamA.Delete(key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := map[string][]string{}
+	for _, event := range syncEvents(t, events, syncKeys, setSyncKey) {
+		if event.Namespace != "team-a" {
+			t.Fatalf("event of namespace %s should not be received", event.Namespace)
+		}
+		received[event.Key] = append(received[event.Key], event.Reason)
+	}
+	if len(received) != len(keys) {
+		t.Fatalf("events of %v should be received but got %v", keys, received)
+	}
+	for _, key := range keys {
+		if reasons := strings.Join(received[key], ","); reasons != caches.SetEvent+","+caches.DeleteEvent {
+			t.Fatalf("events of %s should be set and delete but got %s", key, reasons)
+		}
+	}
+
+	// fn 返回 false 之后订阅结束，没有错误
+	close(stop)
+	if err := teamA.Set(syncKeys[0], nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-result:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("events should stop after fn returns false")
+	}
+
+	// 匹配模式不合法时订阅失败
+	if err := client.Events("[", func(event caches.Event) bool { return true }); !vex.IsReplyError(err) {
+		t.Fatalf("invalid pattern should be rejected but got %v", err)
+	}
+}
+
+func TestTCPSetWithExpiration(t *testing.T) {
+	servers := startTCPServers(t, 2, func(options *Options) {
+		options.ReplicaCount = 2
+	})
+	client := newTestTCPClient(t, servers[0].address).WithNamespace("team-a")
+	for name, expiration := range testExpirations() {
+		key := name + "-key"
+		if err := client.SetWithExpiration(key, []byte(name), expiration); err != nil {
+			t.Fatal(err)
+		}
+		eventually(t, key+" should be replicated", func() bool {
+			_, _, _, ok0 := servers[0].cache.NamespaceOf("team-a").Peek(key)
+			_, _, _, ok1 := servers[1].cache.NamespaceOf("team-a").Peek(key)
+			return ok0 && ok1
+		})
+		for _, server := range servers {
+			checkExpiration(t, server.cache.NamespaceOf("team-a"), key, name)
+		}
+	}
+
+	// 以秒为单位的 ttl 仍然可以使用
+	if err := client.Set("seconds", []byte("value"), 60); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := client.TTL("seconds"); err != nil || ttl <= 0 || ttl > 60 {
+		t.Fatalf("seconds should expire in a minute but got %d, %v", ttl, err)
+	}
+
+	conn := servers[0].dial(t)
+	key := ownedBy(t, servers[0].node, "invalid-")
+	args := append(setArgsOf(key, []byte("value"), caches.NeverDie), []byte{byte(caches.SlidingExpiry)})
+	if _, err := conn.Do(setCommand, args); !vex.IsReplyError(err) {
+		t.Fatalf("set with a malformed expiration should be rejected but got %v", err)
+	}
+}
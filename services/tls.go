@@ -0,0 +1,228 @@
+package services
+
+import (
+	"cache/vex"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// certCheckInterval 是检查证书文件有没有被修改的最小间隔，握手很频繁，没必要每次都检查
+	certCheckInterval = time.Second
+)
+
+var (
+	// tlsCertMissingErr 意味着配置了 TLS 相关的文件，但是没有同时配置证书和私钥
+	tlsCertMissingErr = errors.New("both tls cert file and tls key file are required")
+)
+
+// certificates 是某一时刻从文件中读取出来的证书，重新读取时整个替换，所以读取之后不会再被修改
+type certificates struct {
+	// certificate 是当前节点的证书，作为服务端和作为客户端连接其他节点时都使用这个证书
+	certificate *tls.Certificate
+	// clientCAs 用于校验客户端的证书，为 nil 时不要求客户端提供证书
+	clientCAs *x509.CertPool
+	// rootCAs 用于校验其他节点的证书，为 nil 时使用系统的根证书
+	rootCAs *x509.CertPool
+}
+
+// certReloader 从 options 中配置的文件读取证书，文件被修改之后的下一次握手就会使用新的证书，不需要重启服务器
+// 新的文件读取失败时继续使用之前的证书，比如证书和私钥只替换了一个，之后会再次尝试读取
+type certReloader struct {
+	options *Options
+	// current 是正在使用的证书
+	current *certificates
+	// modTimes 是读取 current 时每个文件的修改时间
+	modTimes []time.Time
+	// checkedAt 是上次检查文件有没有被修改的时间
+	checkedAt time.Time
+	lock      *sync.Mutex
+}
+
+// newCertReloader 读取 options 中配置的证书，没有配置证书时返回 nil，表示不使用 TLS
+func newCertReloader(options *Options) (*certReloader, error) {
+	if options.TLSCertFile == "" && options.TLSKeyFile == "" && options.TLSClientCAFile == "" && options.TLSCAFile == "" {
+		return nil, nil
+	}
+	if options.TLSCertFile == "" || options.TLSKeyFile == "" {
+		return nil, tlsCertMissingErr
+	}
+	cr := &certReloader{
+		options: options,
+		lock:    &sync.Mutex{},
+	}
+	modTimes, err := cr.stat()
+	if err != nil {
+		return nil, err
+	}
+	if cr.current, err = cr.load(); err != nil {
+		return nil, err
+	}
+	cr.modTimes = modTimes
+	cr.checkedAt = time.Now()
+	return cr, nil
+}
+
+// files 返回所有配置了的证书相关的文件
+func (cr *certReloader) files() []string {
+	files := []string{cr.options.TLSCertFile, cr.options.TLSKeyFile}
+	if cr.options.TLSClientCAFile != "" {
+		files = append(files, cr.options.TLSClientCAFile)
+	}
+	if cr.options.TLSCAFile != "" {
+		files = append(files, cr.options.TLSCAFile)
+	}
+	return files
+}
+
+// stat 返回每个文件的修改时间
+func (cr *certReloader) stat() ([]time.Time, error) {
+	files := cr.files()
+	modTimes := make([]time.Time, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes[i] = info.ModTime()
+	}
+	return modTimes, nil
+}
+
+// load 从文件中读取证书
+func (cr *certReloader) load() (*certificates, error) {
+	certificate, err := tls.LoadX509KeyPair(cr.options.TLSCertFile, cr.options.TLSKeyFile)
+	if err != nil {
+		return nil, err
+	}
+	result := &certificates{certificate: &certificate}
+	if cr.options.TLSClientCAFile != "" {
+		if result.clientCAs, err = loadCertPool(cr.options.TLSClientCAFile); err != nil {
+			return nil, err
+		}
+	}
+	if cr.options.TLSCAFile != "" {
+		if result.rootCAs, err = loadCertPool(cr.options.TLSCAFile); err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// loadCertPool 读取 file 中 PEM 格式的 CA 证书
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate is found in %s", file)
+	}
+	return pool, nil
+}
+
+// latest 返回当前使用的证书，距离上次检查超过 certCheckInterval 并且文件被修改过时会先重新读取
+func (cr *certReloader) latest() *certificates {
+	cr.lock.Lock()
+	defer cr.lock.Unlock()
+	if time.Since(cr.checkedAt) < certCheckInterval {
+		return cr.current
+	}
+	cr.checkedAt = time.Now()
+
+	modTimes, err := cr.stat()
+	if err != nil || !modified(cr.modTimes, modTimes) {
+		return cr.current
+	}
+	if current, err := cr.load(); err == nil {
+		cr.current = current
+		cr.modTimes = modTimes
+	}
+	return cr.current
+}
+
+// modified 判断文件的修改时间有没有变化
+func modified(before []time.Time, after []time.Time) bool {
+	for i := range before {
+		if !before[i].Equal(after[i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// serverConfig 返回服务端使用的 TLS 配置，每次握手都会通过 certReloader 获取最新的证书
+// 配置了 TLSClientCAFile 时要求客户端提供由这些 CA 签发的证书，也就是双向认证
+func (cr *certReloader) serverConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return cr.latest().certificate, nil
+		},
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			current := cr.latest()
+			if current.clientCAs == nil {
+				return nil, nil
+			}
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*current.certificate},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    current.clientCAs,
+			}, nil
+		},
+	}
+}
+
+// clientConfig 返回连接其他节点时使用的 TLS 配置，当前节点的证书会作为客户端证书发送给对方
+func (cr *certReloader) clientConfig() *tls.Config {
+	current := cr.latest()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		RootCAs:    current.rootCAs,
+		GetClientCertificate: func(request *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return current.certificate, nil
+		},
+	}
+}
+
+// dial 创建连接到 address 节点的客户端，没有配置证书时使用普通的连接
+func (cr *certReloader) dial(address string) (*vex.Client, error) {
+	if cr == nil {
+		return vex.NewClient("tcp", address)
+	}
+	return vex.NewTLSClient("tcp", address, cr.clientConfig())
+}
+
+// scheme 返回访问其他节点的 HTTP 服务时使用的协议
+func (cr *certReloader) scheme() string {
+	if cr == nil {
+		return "http"
+	}
+	return "https"
+}
+
+// transport 返回访问其他节点的 HTTP 服务时使用的 http.RoundTripper，每个新连接都会使用最新的证书
+func (cr *certReloader) transport() http.RoundTripper {
+	if cr == nil {
+		return http.DefaultTransport
+	}
+	return &http.Transport{
+		DialTLSContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			dialer := &tls.Dialer{Config: cr.clientConfig()}
+			return dialer.DialContext(ctx, network, address)
+		},
+		MaxIdleConnsPerHost: maxIdleClientsPerNode,
+		IdleConnTimeout:     90 * time.Second,
+	}
+}
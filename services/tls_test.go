@@ -0,0 +1,232 @@
+package services
+
+import (
+	"cache/vex"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCA 是测试用的 CA，用来签发服务端和客户端的证书
+type testCA struct {
+	certificate *x509.Certificate
+	key         *ecdsa.PrivateKey
+	pem         []byte
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "kafo test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{
+		certificate: certificate,
+		key:         key,
+		pem:         pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+	}
+}
+
+// issue 签发一个 127.0.0.1 的证书，可以同时用作服务端和客户端证书，返回 PEM 格式的证书和私钥
+func (ca *testCA) issue(t *testing.T, serial int64) ([]byte, []byte) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.certificate, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+}
+
+// writeCerts 将 ca 签发的编号为 serial 的证书写入 options 中配置的文件，修改时间设置为 modTime
+func writeCerts(t *testing.T, ca *testCA, options *Options, serial int64, modTime time.Time) {
+	t.Helper()
+	cert, key := ca.issue(t, serial)
+	files := map[string][]byte{options.TLSCertFile: cert, options.TLSKeyFile: key, options.TLSCAFile: ca.pem}
+	if options.TLSClientCAFile != "" {
+		files[options.TLSClientCAFile] = ca.pem
+	}
+	for file, data := range files {
+		if err := ioutil.WriteFile(file, data, 0600); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(file, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// newTestTLSOptions 返回证书文件都在临时目录中的选项
+func newTestTLSOptions(t *testing.T) *Options {
+	dir := t.TempDir()
+	options := DefaultOptions()
+	options.TLSCertFile = filepath.Join(dir, "node.crt")
+	options.TLSKeyFile = filepath.Join(dir, "node.key")
+	options.TLSCAFile = filepath.Join(dir, "ca.crt")
+	return &options
+}
+
+// serveTLS 使用 config 接收连接并完成握手，握手失败的连接会被关闭
+func serveTLS(t *testing.T, config *tls.Config) string {
+	t.Helper()
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+// serialOf 连接到 address 并返回服务端证书的编号
+func serialOf(t *testing.T, address string, config *tls.Config) int64 {
+	t.Helper()
+	conn, err := tls.Dial("tcp", address, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+}
+
+func TestCertReloader(t *testing.T) {
+	if _, err := newCertReloader(&Options{TLSCertFile: "node.crt"}); err != tlsCertMissingErr {
+		t.Fatalf("cert without key should fail with %v but got %v", tlsCertMissingErr, err)
+	}
+	if certs, err := newCertReloader(&Options{}); certs != nil || err != nil {
+		t.Fatalf("no tls should be used without certs but got %v, %v", certs, err)
+	}
+
+	ca := newTestCA(t)
+	options := newTestTLSOptions(t)
+	modTime := time.Now().Add(-time.Minute)
+	writeCerts(t, ca, options, 2, modTime)
+	certs, err := newCertReloader(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := serveTLS(t, certs.serverConfig())
+	if serial := serialOf(t, address, certs.clientConfig()); serial != 2 {
+		t.Fatalf("server should use cert 2 but got %d", serial)
+	}
+
+	// 替换证书文件之后，下一次握手就会使用新的证书
+	writeCerts(t, ca, options, 3, modTime.Add(time.Second))
+	certs.lock.Lock()
+	certs.checkedAt = time.Now().Add(-certCheckInterval)
+	certs.lock.Unlock()
+	if serial := serialOf(t, address, certs.clientConfig()); serial != 3 {
+		t.Fatalf("server should reload cert 3 but got %d", serial)
+	}
+
+	// 新的文件读取失败时继续使用之前的证书
+	if err = ioutil.WriteFile(options.TLSKeyFile, []byte("broken"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Chtimes(options.TLSKeyFile, modTime.Add(2*time.Second), modTime.Add(2*time.Second))
+	certs.lock.Lock()
+	certs.checkedAt = time.Now().Add(-certCheckInterval)
+	certs.lock.Unlock()
+	if serial := serialOf(t, address, certs.clientConfig()); serial != 3 {
+		t.Fatalf("server should keep cert 3 when the new files are broken but got %d", serial)
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	ca := newTestCA(t)
+	options := newTestTLSOptions(t)
+	options.TLSClientCAFile = filepath.Join(filepath.Dir(options.TLSCAFile), "client-ca.crt")
+	writeCerts(t, ca, options, 2, time.Now())
+	certs, err := newCertReloader(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := vex.NewServer()
+	server.RegisterHandler(getCommand, func(args [][]byte) ([]byte, error) {
+		return []byte("value"), nil
+	})
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+	go server.ListenAndServerTLS("tcp", address, certs.serverConfig())
+	defer server.Close()
+
+	var client *vex.Client
+	for i := 0; i < 100; i++ {
+		if client, err = certs.dial(address); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if body, err := client.Do(getCommand, [][]byte{[]byte("key")}); err != nil || string(body) != "value" {
+		t.Fatalf("client with cert should be served but got %s, %v", body, err)
+	}
+
+	// 客户端没有提供证书时握手失败
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca.pem)
+	if _, err = vex.NewTLSClient("tcp", address, &tls.Config{RootCAs: pool}); err == nil {
+		t.Fatal("client without cert should be rejected")
+	}
+}
@@ -2,15 +2,71 @@ package vex
 
 import (
 	"bufio"
+	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"io"
 	"net"
+	"sync"
+	"sync/atomic"
 )
 
+var (
+	// clientClosedErr 意味着连接已经关闭或者出错，正在等待的请求都不会再收到响应了
+	clientClosedErr = errors.New("client is closed")
+)
+
+const (
+	// streamBufferSize 是流式请求可以缓冲的推送消息个数
+	streamBufferSize = 64
+)
+
+// ReplyError 是服务端返回的错误响应，用于和连接出错的情况区分开
+type ReplyError struct {
+	message string
+}
+
+func (re *ReplyError) Error() string {
+	return re.message
+}
+
+// IsReplyError 判断 err 是不是服务端返回的错误响应，不是的话说明连接很可能已经不可用了
+func IsReplyError(err error) bool {
+	_, ok := err.(*ReplyError)
+	return ok
+}
+
+// Client 是 vex 的客户端，可以被多个 goroutine 同时使用
+// 使用第二版协议时，所有请求共用一个连接同时发送，由后台的 goroutine 读取响应并按照请求编号分发
+// 服务端只支持第一版协议时，请求会排队一个一个地执行
 type Client struct {
 	conn net.Conn
 
 	reader io.Reader
+
+	// version 和服务端协商出来的协议版本
+	version byte
+
+	// nextID 下一个请求的编号
+	nextID uint32
+
+	// pending 存储还没有收到响应的请求，key 是请求编号
+	pending map[uint32]chan *response
+
+	// streams 存储还没有结束的流式请求，key 是请求编号
+	streams map[uint32]*ClientStream
+
+	// err 是连接出错的原因，出错之后所有的请求都会直接返回这个错误
+	err error
+
+	// failed 在连接出错或者关闭时被关闭
+	failed chan struct{}
+
+	// lock 保护 pending、streams 和 err
+	lock *sync.Mutex
+
+	// writeLock 保证请求完整地写入连接，第一版协议还需要用它保证请求和响应一一对应
+	writeLock *sync.Mutex
 }
 
 func NewClient(network string, address string) (*Client, error) {
@@ -18,31 +74,290 @@ func NewClient(network string, address string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &Client{
-		conn:   conn,
-		reader: bufio.NewReader(conn),
-	}, nil
+	return newClient(conn)
+}
+
+// NewTLSClient 创建使用 TLS 加密连接的客户端，config 中没有设置 ServerName 时使用 address 中的主机名校验服务端证书
+func NewTLSClient(network string, address string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return newClient(conn)
+}
+
+// newClient 在已经建立好的连接上和服务端协商协议版本，并创建客户端
+func newClient(conn net.Conn) (*Client, error) {
+	c := &Client{
+		conn:      conn,
+		reader:    bufio.NewReader(conn),
+		version:   protocolVersion1,
+		pending:   map[uint32]chan *response{},
+		streams:   map[uint32]*ClientStream{},
+		failed:    make(chan struct{}),
+		lock:      &sync.Mutex{},
+		writeLock: &sync.Mutex{},
+	}
+	if err := c.negotiate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if c.version != protocolVersion1 {
+		go c.readResponses()
+	}
+	return c, nil
+}
+
+// negotiate 使用第一版协议和服务端协商协议版本，旧的服务端不认识协商命令，会返回错误响应，这时继续使用第一版协议
+func (c *Client) negotiate() error {
+	body, err := c.doInOrder(negotiateCommand, [][]byte{{ProtocolVersion}})
+	if IsReplyError(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(body) < 1 || !isSupportedVersion(body[0]) {
+		return ProtocolVersionMismatchErr
+	}
+	c.version = body[0]
+	return nil
+}
+
+// Auth 使用用户名和密码认证这个连接，之后这个连接上的所有请求都以这个用户的身份执行
+func (c *Client) Auth(username string, password string) error {
+	_, err := c.Do(authCommand, [][]byte{[]byte(username), []byte(password)})
+	return err
+}
+
+// Version 返回和服务端协商出来的协议版本
+func (c *Client) Version() byte {
+	return c.version
 }
 
 func (c *Client) Do(command byte, args [][]byte) (body []byte, err error) {
+	if c.version == protocolVersion1 {
+		return c.doInOrder(command, args)
+	}
+
+	// 先登记请求，再发送给服务端，保证响应到达时一定能找到对应的请求
+	id, responses, err := c.register()
+	if err != nil {
+		return nil, err
+	}
+
+	c.writeLock.Lock()
+	_, err = writeRequestTo(c.conn, c.version, id, command, args)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+
+	resp, ok := <-responses
+	if !ok {
+		return nil, c.failure()
+	}
+	return resultOf(resp)
+}
+
+// doInOrder 使用第一版协议执行命令，发送请求之后直接读取响应，同一时间只能有一个请求
+func (c *Client) doInOrder(command byte, args [][]byte) (body []byte, err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+
 	// 包装请求，然后发送给服务端
-	_, err = writeRequestTo(c.conn, command, args)
+	_, err = writeRequestTo(c.conn, protocolVersion1, 0, command, args)
 	if err != nil {
 		return nil, err
 	}
 
 	// 读取服务端的响应
-	reply, body, err := readResponseFrom(c.reader)
+	resp, err := readResponseFrom(c.reader)
 	if err != nil {
-		return body, err
+		return nil, err
 	}
+	return resultOf(resp)
+}
 
-	if reply == ErrorReply {
-		return body, errors.New(string(body))
+// register 为新的请求分配编号，并登记用于接收响应的管道
+func (c *Client) register() (uint32, chan *response, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return 0, nil, c.err
+	}
+	id := atomic.AddUint32(&c.nextID, 1)
+	responses := make(chan *response, 1)
+	c.pending[id] = responses
+	return id, responses, nil
+}
+
+// readResponses 不断读取服务端的响应，并交给对应编号的请求，连接出错之后所有等待中的请求都会失败
+// 流式请求的管道只在这里关闭，这样推送消息时就不会遇到已经关闭的管道
+func (c *Client) readResponses() {
+	for {
+		resp, err := readResponseFrom(c.reader)
+		if err != nil {
+			c.fail(err)
+			c.finishStreams()
+			return
+		}
+
+		c.lock.Lock()
+		if stream, ok := c.streams[resp.id]; ok {
+			if resp.reply != StreamReply {
+				delete(c.streams, resp.id)
+			}
+			c.lock.Unlock()
+			stream.receive(resp)
+			continue
+		}
+		responses, ok := c.pending[resp.id]
+		delete(c.pending, resp.id)
+		c.lock.Unlock()
+		if ok {
+			responses <- resp
+		}
+	}
+}
+
+// fail 记录连接出错的原因，关闭连接并唤醒所有等待中的请求
+func (c *Client) fail(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	close(c.failed)
+	c.conn.Close()
+	for id, responses := range c.pending {
+		delete(c.pending, id)
+		close(responses)
 	}
-	return body, nil
+}
+
+// finishStreams 在连接出错之后结束所有的流式请求
+func (c *Client) finishStreams() {
+	c.lock.Lock()
+	streams := c.streams
+	c.streams = map[uint32]*ClientStream{}
+	c.lock.Unlock()
+	for _, stream := range streams {
+		stream.finish(c.err)
+	}
+}
+
+// Stream 发送流式请求，服务端推送的消息可以从返回值的 Messages 中读取，只有第二版协议支持
+// 读取响应的 goroutine 会等待推送的消息被取走，所以一直不读取消息会阻塞同一个连接上的其他请求，长期使用的流式请求最好独占一个连接
+func (c *Client) Stream(command byte, args [][]byte) (*ClientStream, error) {
+	if c.version == protocolVersion1 {
+		return nil, streamNeedsVersion2Err
+	}
+
+	c.lock.Lock()
+	if c.err != nil {
+		c.lock.Unlock()
+		return nil, c.err
+	}
+	stream := &ClientStream{
+		client:   c,
+		id:       atomic.AddUint32(&c.nextID, 1),
+		messages: make(chan []byte, streamBufferSize),
+		closing:  make(chan struct{}),
+		once:     &sync.Once{},
+	}
+	c.streams[stream.id] = stream
+	c.lock.Unlock()
+
+	c.writeLock.Lock()
+	_, err := writeRequestTo(c.conn, c.version, stream.id, command, args)
+	c.writeLock.Unlock()
+	if err != nil {
+		c.fail(err)
+		return nil, err
+	}
+	return stream, nil
+}
+
+// failure 返回连接出错的原因
+func (c *Client) failure() error {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.err
+}
+
+// resultOf 将响应转换成响应体和错误
+func resultOf(resp *response) ([]byte, error) {
+	if resp.reply == ErrorReply {
+		return resp.body, &ReplyError{message: string(resp.body)}
+	}
+	return resp.body, nil
 }
 
 func (c *Client) Close() error {
-	return c.conn.Close()
+	if c.version == protocolVersion1 {
+		return c.conn.Close()
+	}
+	c.fail(clientClosedErr)
+	return nil
+}
+
+// ClientStream 是客户端的一个流式请求
+type ClientStream struct {
+	client *Client
+	id     uint32
+
+	// messages 接收服务端推送的消息，流式请求结束之后会被关闭
+	messages chan []byte
+
+	// err 是流式请求结束的原因，正常结束时为 nil，只有 messages 被关闭之后才能读取
+	err error
+
+	// closing 在调用 Close 之后被关闭，之后推送过来的消息都会被丢弃，连接出错之后的消息也会被丢弃
+	closing chan struct{}
+	once    *sync.Once
+}
+
+// Messages 返回接收推送消息的管道，流式请求结束之后管道会被关闭
+func (cs *ClientStream) Messages() <-chan []byte {
+	return cs.messages
+}
+
+// Err 返回流式请求结束的原因，需要在 Messages 被关闭之后调用
+func (cs *ClientStream) Err() error {
+	return cs.err
+}
+
+// receive 处理服务端发来的响应，推送的消息放入 messages，其他响应表示流式请求结束了
+func (cs *ClientStream) receive(resp *response) {
+	if resp.reply != StreamReply {
+		_, err := resultOf(resp)
+		cs.finish(err)
+		return
+	}
+	select {
+	case cs.messages <- resp.body:
+	case <-cs.closing:
+	case <-cs.client.failed:
+	}
+}
+
+// finish 记录结束的原因并关闭 messages
+func (cs *ClientStream) finish(err error) {
+	cs.err = err
+	close(cs.messages)
+}
+
+// Close 通知服务端取消流式请求，服务端确认之后 Messages 会被关闭
+func (cs *ClientStream) Close() error {
+	var err error
+	cs.once.Do(func() {
+		close(cs.closing)
+		id := make([]byte, requestIDInProtocol)
+		binary.BigEndian.PutUint32(id, cs.id)
+		_, err = cs.client.Do(cancelCommand, [][]byte{id})
+	})
+	return err
 }
@@ -3,13 +3,39 @@ package vex
 import "errors"
 
 const (
-	ProtocolVersion        = byte(1) // 协议版本号
+	ProtocolVersion        = byte(2) // 协议版本号，服务端和客户端会协商出双方都支持的最高版本
+	protocolVersion1       = byte(1) // 第一版协议，请求和响应没有编号，同一个连接上只能一问一答
 	headerLengthInProtocol = 6       // 头部占用字节
 	argsLengthInProtocol   = 4       // 参数个数占用字节
 	argLengthInProtocol    = 4       // 协议中参数长度占用字节
 	bodyLengthInProtocol   = 4       // 协议体长度占用字节数
+	requestIDInProtocol    = 4       // 第二版协议中请求编号占用字节数
+
+	// negotiateCommand 是协商协议版本的命令，由 vex 内部处理，客户端建立连接之后会使用第一版协议发送这个命令
+	// 参数是客户端支持的最高版本，响应体是双方都支持的最高版本。不支持这个命令的旧服务端会返回错误，这时使用第一版协议
+	negotiateCommand = byte(0)
+
+	// authCommand 是认证的命令，由 vex 内部交给 Authenticator 处理，参数是 用户名 | 密码
+	// 服务端设置了 Authenticator 时，客户端必须先认证才能执行除了协商和认证之外的命令，同一个连接可以重新认证成其他用户
+	authCommand = byte(254)
+
+	// cancelCommand 是取消流式请求的命令，由 vex 内部处理，参数是流式请求的编号
+	cancelCommand = byte(255)
 )
 
 var (
 	ProtocolVersionMismatchErr = errors.New("protocol version between client and server doesn't match")
 )
+
+// headerLengthOf 返回 version 版本的协议中头部占用的字节数，第二版协议的头部多了请求编号
+func headerLengthOf(version byte) int {
+	if version == protocolVersion1 {
+		return headerLengthInProtocol
+	}
+	return headerLengthInProtocol + requestIDInProtocol
+}
+
+// isSupportedVersion 判断是否支持 version 版本的协议
+func isSupportedVersion(version byte) bool {
+	return version == protocolVersion1 || version == ProtocolVersion
+}
@@ -1,56 +1,136 @@
 package vex
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"io"
 )
 
-func readRequestFrom(reader io.Reader) (command byte, args [][]byte, err error) {
-	// 读取头部
-	header := make([]byte, headerLengthInProtocol)
+const (
+	// maxArgsInRequest 是一个请求中参数个数的上限
+	maxArgsInRequest = 1 << 20
+	// maxRequestSize 是一个请求中所有参数的总长度上限，单个参数的长度也不能超过它
+	maxRequestSize = 512 << 20
+	// argChunkSize 是读取参数时一次性分配的最大长度，更长的参数边读边扩容，避免只发送了头部的请求占用大量内存
+	argChunkSize = 64 << 10
+)
+
+var (
+	// requestTooLargeErr 意味着请求的参数个数或者长度超过了上限
+	requestTooLargeErr = errors.New("request is too large")
+)
+
+// request 是客户端发送的一个请求
+type request struct {
+	// version 请求使用的协议版本，响应需要使用同样的版本
+	version byte
+	// id 请求编号，只有第二版协议才有，响应会带上同样的编号
+	id uint32
+	// command 命令
+	command byte
+	// args 参数
+	args [][]byte
+}
+
+func readRequestFrom(reader io.Reader) (req *request, err error) {
+	// 头部第一个字节是协议版本号，取出来判断是否支持这个版本
 	// ReadFull 方法，如果数据没有读满，会等待
-	_, err = io.ReadFull(reader, header)
+	version := make([]byte, 1)
+	_, err = io.ReadFull(reader, version)
 	if err != nil {
-		return 0, nil, err
+		return nil, err
+	}
+	if !isSupportedVersion(version[0]) {
+		return nil, ProtocolVersionMismatchErr
 	}
-	// 头部第一个字节是协议版本号，取出来判断协议版本号是否一致
-	version := header[0]
-	if version != ProtocolVersion {
-		return 0, nil, ProtocolVersionMismatchErr
+
+	// 读取头部剩下的部分
+	header := make([]byte, headerLengthOf(version[0])-1)
+	_, err = io.ReadFull(reader, header)
+	if err != nil {
+		return nil, err
 	}
 
-	// 头部的第二个字节是命令 ,后面四个字节是参数
-	command = header[1]
-	header = header[2:]
+	// 头部的第二个字节是命令，第二版协议接下来的四个字节是请求编号，最后四个字节是参数个数
+	req = &request{
+		version: version[0],
+		command: header[0],
+	}
+	header = header[1:]
+	if req.version != protocolVersion1 {
+		req.id = binary.BigEndian.Uint32(header)
+		header = header[requestIDInProtocol:]
+	}
 
 	// 所有整数到字节数组的转换使用大端形式，所以这里使用 BigEndian 将头部后四个字节转换成一个uint32 数字
 	// argsLength: 参数的个数
+	// 头部来自还没有认证的客户端，所以分配内存之前需要检查上限，超过上限时返回的 req 只有版本号、编号和命令，用于发送错误响应
 	argsLength := binary.BigEndian.Uint32(header)
-	args = make([][]byte, argsLength)
+	if argsLength > maxArgsInRequest {
+		return req, requestTooLargeErr
+	}
+	// 参数列表同样随着读取逐步扩容，每个参数至少要发送长度的四个字节，所以占用的内存和实际发送的数据成正比
+	req.args = make([][]byte, 0, minUint32(argsLength, 64))
 	if argsLength > 0 {
 		// 读取参数长度，同样使用大端形式处理
 		argLength := make([]byte, argLengthInProtocol)
+		remaining := int64(maxRequestSize)
 		for i := uint32(0); i < argsLength; i++ {
 			_, err = io.ReadFull(reader, argLength)
 			if err != nil {
-				return 0, nil, err
+				return nil, err
+			}
+			length := int64(binary.BigEndian.Uint32(argLength))
+			if length > remaining {
+				return &request{version: req.version, id: req.id, command: req.command}, requestTooLargeErr
 			}
-			arg := make([]byte, binary.BigEndian.Uint32(argLength))
-			_, err = io.ReadFull(reader, arg)
+			remaining -= length
+			arg, err := readArg(reader, length)
 			if err != nil {
-				return 0, nil, err
+				return nil, err
 			}
-			args[i] = arg
+			req.args = append(req.args, arg)
+		}
+	}
+	return req, nil
+}
+
+func minUint32(a uint32, b uint32) uint32 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// readArg 读取长度为 length 的参数，较长的参数随着读取到的数据逐步扩容
+func readArg(reader io.Reader, length int64) ([]byte, error) {
+	if length <= argChunkSize {
+		arg := make([]byte, length)
+		_, err := io.ReadFull(reader, arg)
+		return arg, err
+	}
+	buffer := bytes.NewBuffer(make([]byte, 0, argChunkSize))
+	if _, err := io.CopyN(buffer, reader, length); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
+		return nil, err
 	}
-	return command, args, nil
+	return buffer.Bytes(), nil
 }
 
-func writeRequestTo(writer io.Writer, command byte, args [][]byte) (int, error) {
-	request := make([]byte, headerLengthInProtocol)
-	request[0] = ProtocolVersion
+func writeRequestTo(writer io.Writer, version byte, id uint32, command byte, args [][]byte) (int, error) {
+	request := make([]byte, 2, headerLengthOf(version))
+	request[0] = version
 	request[1] = command
-	binary.BigEndian.PutUint32(request[2:], uint32(len(args)))
+	if version != protocolVersion1 {
+		request = request[:2+requestIDInProtocol]
+		binary.BigEndian.PutUint32(request[2:], id)
+	}
+	argsLength := make([]byte, argsLengthInProtocol)
+	binary.BigEndian.PutUint32(argsLength, uint32(len(args)))
+	request = append(request, argsLength...)
 
 	if len(args) > 0 {
 		// 将参数都添加到缓冲区
@@ -0,0 +1,162 @@
+package vex
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+func TestRequestRoundTrip(t *testing.T) {
+	large := bytes.Repeat([]byte("v"), 3*argChunkSize+1)
+	for _, version := range []byte{protocolVersion1, ProtocolVersion} {
+		buffer := &bytes.Buffer{}
+		args := [][]byte{[]byte("key"), {}, large}
+		if _, err := writeRequestTo(buffer, version, 7, echoCommand, args); err != nil {
+			t.Fatal(err)
+		}
+		req, err := readRequestFrom(buffer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectedID := uint32(7)
+		if version == protocolVersion1 {
+			expectedID = 0
+		}
+		if req.version != version || req.id != expectedID || req.command != echoCommand || len(req.args) != len(args) {
+			t.Fatalf("wrong request %+v", req)
+		}
+		for i := range args {
+			if !bytes.Equal(req.args[i], args[i]) {
+				t.Fatalf("arg %d of version %d is wrong", i, version)
+			}
+		}
+	}
+}
+
+// header 返回第二版协议的请求头部，参数个数是 argsLength
+func header(id uint32, argsLength uint32) []byte {
+	data := []byte{ProtocolVersion, echoCommand, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(data[2:], id)
+	binary.BigEndian.PutUint32(data[6:], argsLength)
+	return data
+}
+
+// argHeader 返回参数长度的四个字节
+func argHeader(length uint32) []byte {
+	data := make([]byte, argLengthInProtocol)
+	binary.BigEndian.PutUint32(data, length)
+	return data
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	// 参数个数和长度都在分配内存之前检查，返回的请求只用于发送错误响应
+	req, err := readRequestFrom(bytes.NewReader(header(9, maxArgsInRequest+1)))
+	if err != requestTooLargeErr || req.id != 9 || req.args != nil {
+		t.Fatalf("too many args should fail with %v but got %+v, %v", requestTooLargeErr, req, err)
+	}
+	req, err = readRequestFrom(bytes.NewReader(append(header(9, 1), argHeader(maxRequestSize+1)...)))
+	if err != requestTooLargeErr || req.id != 9 || req.args != nil {
+		t.Fatalf("too large arg should fail with %v but got %+v, %v", requestTooLargeErr, req, err)
+	}
+
+	// 只发送了头部的请求不会分配声明的长度，读取到的数据不够时返回错误
+	if _, err = readRequestFrom(bytes.NewReader(append(header(9, 1), argHeader(maxRequestSize)...))); err != io.ErrUnexpectedEOF {
+		t.Fatalf("truncated arg should fail with %v but got %v", io.ErrUnexpectedEOF, err)
+	}
+}
+
+func TestTooLargeRequestResponse(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go newTestServer(nil).handleConn(serverConn)
+
+	// 过大的请求后面的数据没办法解析，服务端发送错误响应之后关闭连接
+	go clientConn.Write(append(header(3, 1), argHeader(maxRequestSize+1)...))
+	resp, err := readResponseFrom(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.id != 3 || resp.reply != ErrorReply || string(resp.body) != requestTooLargeErr.Error() {
+		t.Fatalf("wrong response %+v", resp)
+	}
+	if _, err = readResponseFrom(clientConn); err != io.EOF {
+		t.Fatalf("connection should be closed but got %v", err)
+	}
+}
+
+// testAuthenticator 只有 admin 可以执行 blockCommand，user 可以执行其他命令
+type testAuthenticator struct{}
+
+func (testAuthenticator) Authenticate(username string, password string) (string, error) {
+	if password != username+"-password" {
+		return "", errors.New("wrong password")
+	}
+	return username, nil
+}
+
+func (testAuthenticator) Authorize(user string, command byte, args [][]byte) error {
+	if command == blockCommand && user != "admin" {
+		return errors.New("permission denied")
+	}
+	return nil
+}
+
+func TestAuthentication(t *testing.T) {
+	release := make(chan struct{})
+	close(release)
+	s := newTestServer(release)
+	s.SetAuthenticator(testAuthenticator{})
+	client := pipeClient(t, s)
+	defer client.Close()
+
+	// 协商版本不需要认证，其他命令都需要
+	if client.Version() != ProtocolVersion {
+		t.Fatalf("negotiation should not need authentication but got version %d", client.Version())
+	}
+	if _, err := client.Do(echoCommand, nil); err == nil || err.Error() != authenticationRequiredErr.Error() {
+		t.Fatalf("command should need authentication but got %v", err)
+	}
+	stream, err := client.Stream(streamCommand, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range stream.Messages() {
+	}
+	if stream.Err() == nil || stream.Err().Error() != authenticationRequiredErr.Error() {
+		t.Fatalf("stream should need authentication but got %v", stream.Err())
+	}
+	if err := client.Auth("user", "wrong"); !IsReplyError(err) {
+		t.Fatalf("wrong password should be rejected but got %v", err)
+	}
+
+	if err := client.Auth("user", "user-password"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(echoCommand, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(blockCommand, nil); err == nil || err.Error() != "permission denied" {
+		t.Fatalf("user should not be allowed to block but got %v", err)
+	}
+
+	// 同一个连接可以重新认证成其他用户，认证失败时保持原来的用户
+	if err := client.Auth("admin", "admin-password"); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Auth("user", "wrong"); err == nil {
+		t.Fatal("wrong password should be rejected")
+	}
+	if body, err := client.Do(blockCommand, nil); err != nil || string(body) != "released" {
+		t.Fatalf("admin should be allowed to block but got %s, %v", body, err)
+	}
+
+	// 没有开启认证的服务端拒绝认证命令
+	plain := pipeClient(t, newTestServer(nil))
+	defer plain.Close()
+	if err := plain.Auth("user", "user-password"); err == nil || err.Error() != authenticationDisabledErr.Error() {
+		t.Fatalf("auth should fail with %v but got %v", authenticationDisabledErr, err)
+	}
+}
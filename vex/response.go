@@ -9,48 +9,78 @@ import (
 const (
 	SuccessReply = 0
 	ErrorReply   = 1
+	// StreamReply 是流式请求推送的消息，一个流式请求可以收到任意多个推送，最后以一个成功或者失败的响应结束
+	// 只有第二版协议支持，因为客户端需要通过请求编号找到对应的流
+	StreamReply = 2
 )
 
-func readResponseFrom(reader io.Reader) (reply byte, body []byte, err error) {
+// response 是服务端返回的一个响应
+type response struct {
+	// version 响应使用的协议版本
+	version byte
+	// id 对应的请求编号，只有第二版协议才有
+	id uint32
+	// reply 响应的结果，成功或者失败
+	reply byte
+	// body 响应体
+	body []byte
+}
+
+func readResponseFrom(reader io.Reader) (resp *response, err error) {
 	// 读取指定字节数据
-	header := make([]byte, headerLengthInProtocol)
+	version := make([]byte, 1)
+	_, err = io.ReadFull(reader, version)
+	if err != nil {
+		return nil, err
+	}
+	if !isSupportedVersion(version[0]) {
+		return nil, errors.New("response " + ProtocolVersionMismatchErr.Error())
+	}
+	header := make([]byte, headerLengthOf(version[0])-1)
 	_, err = io.ReadFull(reader, header)
 	if err != nil {
-		return ErrorReply, nil, err
+		return nil, err
 	}
 
-	version := header[0]
-	if version != ProtocolVersion {
-		return ErrorReply, nil, errors.New("response " + ProtocolVersionMismatchErr.Error())
+	// reply: 命令
+	resp = &response{
+		version: version[0],
+		reply:   header[0],
+	}
+	header = header[1:]
+	if resp.version != protocolVersion1 {
+		resp.id = binary.BigEndian.Uint32(header)
+		header = header[requestIDInProtocol:]
 	}
 
-	// reply: 命令
-	reply = header[1]
 	// 响应体长度
-	header = header[2:]
-	body = make([]byte, binary.BigEndian.Uint32(header))
-	_, err = io.ReadFull(reader, body)
+	resp.body = make([]byte, binary.BigEndian.Uint32(header))
+	_, err = io.ReadFull(reader, resp.body)
 	if err != nil {
-		return ErrorReply, nil, err
+		return nil, err
 	}
-
-	return reply, body, nil
+	return resp, nil
 }
 
 // 将响应写入到writer
-func writeResponseTo(writer io.Writer, reply byte, body []byte) (int, error) {
+func writeResponseTo(writer io.Writer, version byte, id uint32, reply byte, body []byte) (int, error) {
 	bodyLengthBytes := make([]byte, bodyLengthInProtocol)
 	binary.BigEndian.PutUint32(bodyLengthBytes, uint32(len(body)))
 
-	response := make([]byte, 2, headerLengthInProtocol+len(body))
-	response[0] = ProtocolVersion
+	response := make([]byte, 2, headerLengthOf(version)+len(body))
+	response[0] = version
 	response[1] = reply
+	if version != protocolVersion1 {
+		idBytes := make([]byte, requestIDInProtocol)
+		binary.BigEndian.PutUint32(idBytes, id)
+		response = append(response, idBytes...)
+	}
 	response = append(response, bodyLengthBytes...)
 	response = append(response, body...)
 	return writer.Write(response)
 }
 
 // 向writer 写入错误信息为msg 的响应
-func writeErrorResponseTo(writer io.Writer, msg string) (int, error) {
-	return writeResponseTo(writer, ErrorReply, []byte(msg))
+func writeErrorResponseTo(writer io.Writer, version byte, id uint32, msg string) (int, error) {
+	return writeResponseTo(writer, version, id, ErrorReply, []byte(msg))
 }
@@ -2,27 +2,82 @@ package vex
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
+	"log"
 	"net"
 	"strings"
 	"sync"
+	"time"
+)
+
+const (
+	// maxInflightRequestsPerConn 是一个连接上同时处理的普通请求数量的上限
+	// 达到上限之后不再读取新的请求，直到有请求处理完，避免一个连接创建出无限多的协程
+	maxInflightRequestsPerConn = 256
+
+	// maxStreamsPerConn 是一个连接上同时处理的流式请求数量的上限
+	// 流式请求不会自己结束，等待它们会让连接再也读不到取消请求，所以超过上限的流式请求直接返回错误
+	maxStreamsPerConn = 64
 )
 
 var (
 	commandHandlerNotFoundErr = errors.New("failed to find a handler of command")
+
+	// streamNeedsVersion2Err 意味着客户端使用第一版协议发送了流式请求，第一版协议的响应没有编号，不支持推送
+	streamNeedsVersion2Err = errors.New("stream needs protocol version 2")
+
+	// authenticationRequiredErr 意味着服务端要求认证，但是连接上还没有认证过
+	authenticationRequiredErr = errors.New("authentication required")
+
+	// authenticationDisabledErr 意味着客户端发送了认证命令，但是服务端没有开启认证
+	authenticationDisabledErr = errors.New("authentication is not enabled")
+
+	// tooManyStreamsErr 意味着连接上的流式请求数量已经达到了 maxStreamsPerConn
+	tooManyStreamsErr = errors.New("too many streams on connection")
 )
 
+// Authenticator 负责认证连接上的用户，并判断用户能不能执行某个命令
+// 设置了 Authenticator 的服务端会在执行每个命令之前调用 Authorize，返回的错误会作为错误响应发送给客户端
+type Authenticator interface {
+	// Authenticate 校验认证命令中的用户名和密码，返回认证通过的用户
+	Authenticate(username string, password string) (user string, err error)
+
+	// Authorize 判断 user 能不能使用参数 args 执行命令 command
+	Authorize(user string, command byte, args [][]byte) error
+}
+
 type Server struct {
 	// 监听器
 	listener net.Listener
 
 	// 命令处理器
 	handlers map[byte]func(args [][]byte) (body []byte, err error)
+
+	// streamHandlers 是流式命令的处理器
+	streamHandlers map[byte]func(args [][]byte, stream *Stream) error
+
+	// authenticator 为 nil 时不需要认证
+	authenticator Authenticator
+
+	// conns 记录了所有正在处理的连接，wg 用于等待这些连接处理完
+	conns map[net.Conn]struct{}
+	wg    *sync.WaitGroup
+	// shuttingDown 表示服务器正在关闭，之后接收到的连接会被直接关闭
+	shuttingDown bool
+	// lock 保护 listener、conns 和 shuttingDown
+	lock *sync.Mutex
 }
 
 func NewServer() *Server {
 	return &Server{
-		handlers: map[byte]func(args [][]byte) (body []byte, err error){},
+		handlers:       map[byte]func(args [][]byte) (body []byte, err error){},
+		streamHandlers: map[byte]func(args [][]byte, stream *Stream) error{},
+		conns:          map[net.Conn]struct{}{},
+		wg:             &sync.WaitGroup{},
+		lock:           &sync.Mutex{},
 	}
 }
 
@@ -30,62 +85,204 @@ func (s *Server) RegisterHandler(command byte, handler func(args [][]byte) (body
 	s.handlers[command] = handler
 }
 
+// RegisterStreamHandler 注册流式命令的处理器，处理器可以通过 stream 不断地推送消息，返回时流式请求结束
+// 客户端取消请求或者连接关闭时 stream.Done() 会被关闭，处理器需要在这之后尽快返回
+func (s *Server) RegisterStreamHandler(command byte, handler func(args [][]byte, stream *Stream) error) {
+	s.streamHandlers[command] = handler
+}
+
+// SetAuthenticator 开启认证，需要在开始监听之前调用
+func (s *Server) SetAuthenticator(authenticator Authenticator) {
+	s.authenticator = authenticator
+}
+
 func (s *Server) ListenAndServer(network string, address string) (err error) {
-	s.listener, err = net.Listen(network, address)
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	return s.serve(listener)
+}
+
+// ListenAndServerTLS 和 ListenAndServer 一样，但是所有的连接都使用 TLS 加密
+// config 中的证书可以通过 GetCertificate 或者 GetConfigForClient 动态提供，这样更换证书时不需要重启服务器
+func (s *Server) ListenAndServerTLS(network string, address string, config *tls.Config) (err error) {
+	listener, err := net.Listen(network, address)
 	if err != nil {
 		return err
 	}
+	return s.serve(tls.NewListener(listener, config))
+}
+
+// serve 不断地从 listener 接收新的连接并处理，监听器关闭之后等待所有连接处理完再返回
+func (s *Server) serve(listener net.Listener) error {
+	s.lock.Lock()
+	if s.shuttingDown {
+		s.lock.Unlock()
+		listener.Close()
+		return nil
+	}
+	s.listener = listener
+	s.lock.Unlock()
 
-	wg := sync.WaitGroup{}
 	for {
-		conn, err := s.listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
 			if strings.Contains(err.Error(), "use of closed network connection") {
 				break
 			}
 			continue
 		}
-		wg.Add(1)
+		if !s.track(conn) {
+			conn.Close()
+			continue
+		}
 		go func() {
-			defer wg.Done()
+			defer s.untrack(conn)
 			s.handleConn(conn)
 		}()
 	}
-	wg.Wait()
+	s.wg.Wait()
 	return nil
 }
 
+// track 记录新的连接，服务器正在关闭时返回 false
+func (s *Server) track(conn net.Conn) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.shuttingDown {
+		return false
+	}
+	s.conns[conn] = struct{}{}
+	s.wg.Add(1)
+	return true
+}
+
+// untrack 移除已经处理完的连接
+func (s *Server) untrack(conn net.Conn) {
+	s.lock.Lock()
+	delete(s.conns, conn)
+	s.lock.Unlock()
+	s.wg.Done()
+}
+
 // 处理连接
+// 第一版协议的请求按顺序处理，第二版协议的请求带有编号，会并发处理，响应的顺序和请求的顺序可以不一致
 func (s *Server) handleConn(conn net.Conn) {
 	// 将连接包装成缓冲处理器，提高读取性能
 	reader := bufio.NewReader(conn)
+	sess := newSession(conn)
 	defer conn.Close()
 
+	// 关闭连接之前等待正在处理的请求，保证它们的响应能写回去
+	// 流式请求不会自己结束，所以在等待之前需要先通知它们连接已经关闭了
+	wg := &sync.WaitGroup{}
+	defer wg.Wait()
+	defer sess.close()
+
+	// inflight 和 streams 限制了同时处理的请求数量，每个请求在开始处理之前占用一个位置，处理完之后释放
+	inflight := make(chan struct{}, maxInflightRequestsPerConn)
+	streams := make(chan struct{}, maxStreamsPerConn)
+
 	for {
-		command, args, err := readRequestFrom(reader)
+		req, err := readRequestFrom(reader)
 		if err != nil {
 			if err == ProtocolVersionMismatchErr {
-				continue
+				// 不认识的版本无法知道请求的长度，后面的数据已经没办法解析了，只能关闭连接
+				sess.writer.writeError(protocolVersion1, 0, err.Error())
+			}
+			if err == requestTooLargeErr {
+				// 过大的请求没有被完整读取，后面的数据同样没办法解析了
+				sess.writer.writeError(req.version, req.id, err.Error())
 			}
 			return
 		}
 
-		// 处理请求
-		reply, body, err := s.handleRequest(command, args)
-		if err != nil {
-			writeErrorResponseTo(conn, err.Error())
+		// 认证命令需要在读取下一个请求之前处理，这样之后的请求一定能看到认证的结果
+		// 取消命令也直接处理，这样正在处理的请求达到上限时依然可以取消流式请求来释放位置
+		if req.version == protocolVersion1 || req.command == authCommand || req.command == cancelCommand {
+			s.serveRequest(sess, req)
 			continue
 		}
 
-		// 发送处理结果响应
-		_, err = writeResponseTo(conn, reply, body)
-		if err != nil {
+		// 流式请求需要在读取下一个请求之前登记，这样之后的取消请求一定能找到它
+		if handler, ok := s.streamHandlers[req.command]; ok {
+			select {
+			case streams <- struct{}{}:
+			default:
+				sess.writer.writeError(req.version, req.id, tooManyStreamsErr.Error())
+				continue
+			}
+			stream := sess.open(req)
+			wg.Add(1)
+			go func(req *request) {
+				defer func() {
+					<-streams
+					wg.Done()
+				}()
+				s.serveStream(sess, req, stream, handler)
+			}(req)
 			continue
 		}
+
+		inflight <- struct{}{}
+		wg.Add(1)
+		go func(req *request) {
+			defer func() {
+				<-inflight
+				wg.Done()
+			}()
+			s.serveRequest(sess, req)
+		}(req)
+	}
+}
+
+// recoverTo 恢复处理请求时发生的 panic，并将它作为错误响应发送给客户端，避免一个错误的请求让整个进程崩溃
+// 需要直接在 defer 中调用
+func recoverTo(writer *connWriter, req *request) {
+	if r := recover(); r != nil {
+		log.Printf("vex: panic while serving command %d: %v", req.command, r)
+		writer.writeError(req.version, req.id, fmt.Sprintf("internal error: %v", r))
 	}
 }
 
-func (s *Server) handleRequest(command byte, args [][]byte) (reply byte, body []byte, err error) {
+// serveRequest 处理请求并将响应写回连接
+func (s *Server) serveRequest(sess *session, req *request) {
+	writer := sess.writer
+	defer recoverTo(writer, req)
+	if req.command == cancelCommand {
+		sess.cancel(req.args)
+		writer.write(req.version, req.id, SuccessReply, nil)
+		return
+	}
+	if _, ok := s.streamHandlers[req.command]; ok {
+		writer.writeError(req.version, req.id, streamNeedsVersion2Err.Error())
+		return
+	}
+
+	// 处理请求
+	reply, body, err := s.handleRequest(sess, req.command, req.args)
+	if err != nil {
+		writer.writeError(req.version, req.id, err.Error())
+		return
+	}
+
+	// 发送处理结果响应
+	writer.write(req.version, req.id, reply, body)
+}
+
+func (s *Server) handleRequest(sess *session, command byte, args [][]byte) (reply byte, body []byte, err error) {
+	// 协商协议版本和认证的命令由 vex 自己处理
+	if command == negotiateCommand {
+		return negotiate(args)
+	}
+	if command == authCommand {
+		return s.authenticate(sess, args)
+	}
+	if err = s.authorize(sess, command, args); err != nil {
+		return ErrorReply, nil, err
+	}
+
 	// 从命令集合中选出对应的处理器
 	handle, ok := s.handlers[command]
 	if !ok {
@@ -100,9 +297,129 @@ func (s *Server) handleRequest(command byte, args [][]byte) (reply byte, body []
 	return SuccessReply, body, err
 }
 
+// serveStream 处理流式请求，处理器返回之后发送结束的响应
+func (s *Server) serveStream(sess *session, req *request, stream *Stream, handler func(args [][]byte, stream *Stream) error) {
+	defer sess.finish(stream)
+	defer recoverTo(sess.writer, req)
+	if err := s.authorize(sess, req.command, req.args); err != nil {
+		sess.writer.writeError(req.version, req.id, err.Error())
+		return
+	}
+	if err := handler(req.args, stream); err != nil {
+		sess.writer.writeError(req.version, req.id, err.Error())
+		return
+	}
+	sess.writer.write(req.version, req.id, SuccessReply, nil)
+}
+
+// authenticate 使用 authenticator 认证连接上的用户，认证失败时连接上原来的用户保持不变
+func (s *Server) authenticate(sess *session, args [][]byte) (reply byte, body []byte, err error) {
+	if s.authenticator == nil {
+		return ErrorReply, nil, authenticationDisabledErr
+	}
+	if len(args) < 2 {
+		return ErrorReply, nil, authenticationRequiredErr
+	}
+	user, err := s.authenticator.Authenticate(string(args[0]), string(args[1]))
+	if err != nil {
+		return ErrorReply, nil, err
+	}
+	sess.login(user)
+	return SuccessReply, nil, nil
+}
+
+// authorize 判断连接上认证通过的用户能不能执行命令，没有设置 authenticator 时所有命令都可以执行
+func (s *Server) authorize(sess *session, command byte, args [][]byte) error {
+	if s.authenticator == nil {
+		return nil
+	}
+	user, ok := sess.userOf()
+	if !ok {
+		return authenticationRequiredErr
+	}
+	return s.authenticator.Authorize(user, command, args)
+}
+
+// negotiate 从客户端支持的最高版本和服务端支持的最高版本中选出较低的那个
+func negotiate(args [][]byte) (reply byte, body []byte, err error) {
+	if len(args) < 1 || len(args[0]) < 1 {
+		return ErrorReply, nil, ProtocolVersionMismatchErr
+	}
+	version := args[0][0]
+	if version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+	if !isSupportedVersion(version) {
+		return ErrorReply, nil, ProtocolVersionMismatchErr
+	}
+	return SuccessReply, []byte{version}, nil
+}
+
+// connWriter 保证同一个连接上的响应一个一个地完整写入，不会交错在一起
+type connWriter struct {
+	conn net.Conn
+	lock *sync.Mutex
+}
+
+func newConnWriter(conn net.Conn) *connWriter {
+	return &connWriter{
+		conn: conn,
+		lock: &sync.Mutex{},
+	}
+}
+
+func (cw *connWriter) write(version byte, id uint32, reply byte, body []byte) error {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	_, err := writeResponseTo(cw.conn, version, id, reply, body)
+	return err
+}
+
+func (cw *connWriter) writeError(version byte, id uint32, msg string) error {
+	cw.lock.Lock()
+	defer cw.lock.Unlock()
+	_, err := writeErrorResponseTo(cw.conn, version, id, msg)
+	return err
+}
+
 func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
 	if s.listener == nil {
 		return nil
 	}
 	return s.listener.Close()
 }
+
+// Shutdown 优雅地关闭服务器：先停止接收新的连接，再让每个连接停止读取新的请求，
+// 已经读取的请求处理完并写回响应之后连接才会关闭，流式请求会收到连接关闭的通知
+// ctx 结束时还没有处理完的连接会被直接关闭，这时返回 ctx 的错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.lock.Lock()
+	s.shuttingDown = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	// 读取超时会让 handleConn 中阻塞的读取立即返回，写入不受影响
+	for conn := range s.conns {
+		conn.SetReadDeadline(time.Now())
+	}
+	s.lock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		s.lock.Lock()
+		for conn := range s.conns {
+			conn.Close()
+		}
+		s.lock.Unlock()
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,367 @@
+package vex
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	echoCommand   = byte(1)
+	blockCommand  = byte(2)
+	panicCommand  = byte(3)
+	streamCommand = byte(4)
+)
+
+// newTestServer 创建注册了测试命令的服务端，blockCommand 会一直等到 release 被关闭才返回
+// streamCommand 推送三条消息之后一直等到被取消
+func newTestServer(release <-chan struct{}) *Server {
+	s := NewServer()
+	s.RegisterHandler(echoCommand, func(args [][]byte) ([]byte, error) {
+		return bytes.Join(args, []byte(" ")), nil
+	})
+	s.RegisterHandler(blockCommand, func(args [][]byte) ([]byte, error) {
+		<-release
+		return []byte("released"), nil
+	})
+	s.RegisterHandler(panicCommand, func(args [][]byte) ([]byte, error) {
+		return args[1], nil
+	})
+	s.RegisterStreamHandler(streamCommand, func(args [][]byte, stream *Stream) error {
+		for i := 0; i < 3; i++ {
+			if err := stream.Send([]byte{byte(i)}); err != nil {
+				return err
+			}
+		}
+		<-stream.Done()
+		return nil
+	})
+	return s
+}
+
+// pipeClient 使用 net.Pipe 连接到 s，连接的服务端在后台由 s 处理
+func pipeClient(t *testing.T, s *Server) *Client {
+	t.Helper()
+	serverConn, clientConn := net.Pipe()
+	go s.handleConn(serverConn)
+	client, err := newClient(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// waitFor 等待 done 被关闭，超时说明服务端没有按照预期处理
+func waitFor(t *testing.T, done <-chan struct{}, what string) {
+	t.Helper()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for %s", what)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	cases := []struct {
+		args    [][]byte
+		version byte
+		ok      bool
+	}{
+		{args: [][]byte{{protocolVersion1}}, version: protocolVersion1, ok: true},
+		{args: [][]byte{{ProtocolVersion}}, version: ProtocolVersion, ok: true},
+		{args: [][]byte{{ProtocolVersion + 1}}, version: ProtocolVersion, ok: true},
+		{args: [][]byte{{0}}, ok: false},
+		{args: nil, ok: false},
+	}
+	for _, c := range cases {
+		reply, body, err := negotiate(c.args)
+		if !c.ok {
+			if err == nil || reply != ErrorReply {
+				t.Fatalf("negotiating with %v should fail", c.args)
+			}
+			continue
+		}
+		if err != nil || reply != SuccessReply || len(body) != 1 || body[0] != c.version {
+			t.Fatalf("negotiating with %v should choose version %d but got %v, %v", c.args, c.version, body, err)
+		}
+	}
+
+	client := pipeClient(t, newTestServer(nil))
+	defer client.Close()
+	if client.Version() != ProtocolVersion {
+		t.Fatalf("client should use version %d but got %d", ProtocolVersion, client.Version())
+	}
+}
+
+func TestVersion1Request(t *testing.T) {
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	go newTestServer(nil).handleConn(serverConn)
+
+	// 旧的客户端不协商版本，直接使用第一版协议，请求按顺序处理
+	for _, arg := range []string{"a", "b"} {
+		if _, err := writeRequestTo(clientConn, protocolVersion1, 0, echoCommand, [][]byte{[]byte(arg)}); err != nil {
+			t.Fatal(err)
+		}
+		resp, err := readResponseFrom(clientConn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.version != protocolVersion1 || resp.reply != SuccessReply || string(resp.body) != arg {
+			t.Fatalf("wrong response %+v", resp)
+		}
+	}
+
+	// 第一版协议的响应没有编号，不能用来推送
+	if _, err := writeRequestTo(clientConn, protocolVersion1, 0, streamCommand, nil); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := readResponseFrom(clientConn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.reply != ErrorReply || string(resp.body) != streamNeedsVersion2Err.Error() {
+		t.Fatalf("stream over version 1 should fail but got %+v", resp)
+	}
+}
+
+func TestMultiplexedResponses(t *testing.T) {
+	release := make(chan struct{})
+	client := pipeClient(t, newTestServer(release))
+	defer client.Close()
+
+	// 慢的请求还没有返回时，同一个连接上后发送的请求可以先收到响应
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		if body, err := client.Do(blockCommand, nil); err != nil || string(body) != "released" {
+			t.Errorf("blocked request should be released but got %s, %v", body, err)
+		}
+	}()
+	for i := 0; i < 10; i++ {
+		body, err := client.Do(echoCommand, [][]byte{[]byte("hello"), []byte("vex")})
+		if err != nil || string(body) != "hello vex" {
+			t.Fatalf("echo should return hello vex but got %s, %v", body, err)
+		}
+	}
+	select {
+	case <-blocked:
+		t.Fatal("blocked request should not finish before it is released")
+	default:
+	}
+	close(release)
+	waitFor(t, blocked, "the blocked request")
+
+	if _, err := client.Do(byte(100), nil); !IsReplyError(err) || err.Error() != commandHandlerNotFoundErr.Error() {
+		t.Fatalf("unknown command should fail with %v but got %v", commandHandlerNotFoundErr, err)
+	}
+}
+
+func TestHandlerPanic(t *testing.T) {
+	client := pipeClient(t, newTestServer(nil))
+	defer client.Close()
+
+	// 处理器访问了不存在的参数，panic 会变成错误响应，连接可以继续使用
+	_, err := client.Do(panicCommand, [][]byte{[]byte("only one")})
+	if !IsReplyError(err) || !strings.HasPrefix(err.Error(), "internal error") {
+		t.Fatalf("panic should be returned as an internal error but got %v", err)
+	}
+	if body, err := client.Do(echoCommand, [][]byte{[]byte("alive")}); err != nil || string(body) != "alive" {
+		t.Fatalf("connection should still work after a panic but got %s, %v", body, err)
+	}
+}
+
+func TestStreamCancel(t *testing.T) {
+	client := pipeClient(t, newTestServer(nil))
+	defer client.Close()
+
+	stream, err := client.Stream(streamCommand, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		select {
+		case message := <-stream.Messages():
+			if len(message) != 1 || message[0] != byte(i) {
+				t.Fatalf("message %d should be %d but got %v", i, i, message)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("timed out waiting for a message")
+		}
+	}
+
+	// 取消之后服务端的处理器结束，发送的结束响应会关闭 Messages
+	if err = stream.Close(); err != nil {
+		t.Fatal(err)
+	}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for range stream.Messages() {
+		}
+	}()
+	waitFor(t, finished, "the stream to finish")
+	if stream.Err() != nil {
+		t.Fatalf("cancelled stream should finish without error but got %v", stream.Err())
+	}
+	if body, err := client.Do(echoCommand, [][]byte{[]byte("after")}); err != nil || string(body) != "after" {
+		t.Fatalf("connection should still work after cancelling but got %s, %v", body, err)
+	}
+}
+
+func TestTooManyStreams(t *testing.T) {
+	client := pipeClient(t, newTestServer(nil))
+	defer client.Close()
+
+	streams := make([]*ClientStream, 0, maxStreamsPerConn)
+	for i := 0; i < maxStreamsPerConn; i++ {
+		stream, err := client.Stream(streamCommand, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		streams = append(streams, stream)
+	}
+	// 等所有流式请求都开始推送，保证它们都已经被服务端登记了
+	for _, stream := range streams {
+		<-stream.Messages()
+	}
+
+	rejected, err := client.Stream(streamCommand, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for range rejected.Messages() {
+		}
+	}()
+	waitFor(t, finished, "the rejected stream")
+	if rejected.Err() == nil || rejected.Err().Error() != tooManyStreamsErr.Error() {
+		t.Fatalf("stream over the limit should fail with %v but got %v", tooManyStreamsErr, rejected.Err())
+	}
+
+	// 达到上限时普通请求和取消请求仍然可以处理
+	if _, err = client.Do(echoCommand, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, stream := range streams {
+		if err = stream.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// serveTestServer 在本地的随机端口上启动 s，返回监听的地址和 serve 的结果
+func serveTestServer(t *testing.T, s *Server) (string, <-chan error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	served := make(chan error, 1)
+	go func() {
+		served <- s.serve(listener)
+	}()
+	return listener.Addr().String(), served
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{})
+	s := newTestServer(release)
+	s.RegisterHandler(blockCommand, func(args [][]byte) ([]byte, error) {
+		close(entered)
+		<-release
+		return []byte("released"), nil
+	})
+	address, served := serveTestServer(t, s)
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	stream, err := client.Stream(streamCommand, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-stream.Messages()
+	blocked := make(chan struct{})
+	go func() {
+		defer close(blocked)
+		if body, err := client.Do(blockCommand, nil); err != nil || string(body) != "released" {
+			t.Errorf("request in flight should be finished before closing but got %s, %v", body, err)
+		}
+	}()
+	waitFor(t, entered, "the request to start")
+
+	// 关闭时先等正在处理的请求结束，流式请求会收到连接关闭的通知
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- s.Shutdown(context.Background())
+	}()
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for range stream.Messages() {
+		}
+	}()
+	waitFor(t, finished, "the stream to finish")
+	select {
+	case err = <-shutdown:
+		t.Fatalf("shutdown should wait for the request in flight but returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	waitFor(t, blocked, "the request in flight")
+	select {
+	case err = <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("timed out waiting for shutdown")
+	}
+	if err = <-served; err != nil {
+		t.Fatalf("serve should return nil after shutdown but got %v", err)
+	}
+	if _, err = NewClient("tcp", address); err == nil {
+		t.Fatal("new connections should be refused after shutdown")
+	}
+	if err = s.Shutdown(context.Background()); err != nil {
+		t.Fatalf("shutting down again should succeed but got %v", err)
+	}
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	s := newTestServer(release)
+	address, _ := serveTestServer(t, s)
+	client, err := NewClient("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	failed := make(chan struct{})
+	go func() {
+		defer close(failed)
+		if _, err := client.Do(blockCommand, nil); err == nil || IsReplyError(err) {
+			t.Errorf("request should fail when the connection is closed but got %v", err)
+		}
+	}()
+
+	// 请求一直没有处理完，ctx 结束之后连接被直接关闭
+	time.Sleep(50 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = s.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("shutdown should fail with %v but got %v", context.DeadlineExceeded, err)
+	}
+	waitFor(t, failed, "the request to fail")
+}
@@ -0,0 +1,128 @@
+package vex
+
+import (
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// Stream 是服务端的一个流式请求，处理器通过它向客户端推送消息
+type Stream struct {
+	writer  *connWriter
+	version byte
+	id      uint32
+
+	// done 在客户端取消请求或者连接关闭时被关闭
+	done chan struct{}
+	once *sync.Once
+}
+
+// Send 向客户端推送一条消息，连接出错时返回错误
+func (s *Stream) Send(body []byte) error {
+	return s.writer.write(s.version, s.id, StreamReply, body)
+}
+
+// Done 返回一个管道，客户端取消请求或者连接关闭时这个管道会被关闭
+func (s *Stream) Done() <-chan struct{} {
+	return s.done
+}
+
+// stop 通知处理器结束这个流式请求，可以多次调用
+func (s *Stream) stop() {
+	s.once.Do(func() {
+		close(s.done)
+	})
+}
+
+// session 记录一个连接上的状态
+type session struct {
+	writer *connWriter
+
+	// streams 记录了连接上还没有结束的流式请求，key 是请求编号
+	streams map[uint32]*Stream
+
+	// closed 表示连接已经关闭了，之后开始的流式请求会直接结束
+	closed bool
+
+	// user 是连接上认证通过的用户，authenticated 表示是否已经认证过
+	user          string
+	authenticated bool
+
+	// lock 保护 streams、closed 和认证的用户
+	lock *sync.Mutex
+}
+
+func newSession(conn net.Conn) *session {
+	return &session{
+		writer:  newConnWriter(conn),
+		streams: map[uint32]*Stream{},
+		lock:    &sync.Mutex{},
+	}
+}
+
+// open 开始 req 对应的流式请求
+func (s *session) open(req *request) *Stream {
+	stream := &Stream{
+		writer:  s.writer,
+		version: req.version,
+		id:      req.id,
+		done:    make(chan struct{}),
+		once:    &sync.Once{},
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		stream.stop()
+		return stream
+	}
+	s.streams[req.id] = stream
+	return stream
+}
+
+// finish 移除已经结束的流式请求
+func (s *session) finish(stream *Stream) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.streams[stream.id] == stream {
+		delete(s.streams, stream.id)
+	}
+	stream.stop()
+}
+
+// cancel 取消参数中编号对应的流式请求，请求已经结束时什么也不做
+func (s *session) cancel(args [][]byte) {
+	if len(args) < 1 || len(args[0]) < requestIDInProtocol {
+		return
+	}
+	id := binary.BigEndian.Uint32(args[0])
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if stream, ok := s.streams[id]; ok {
+		stream.stop()
+	}
+}
+
+// close 在连接关闭时结束所有的流式请求
+func (s *session) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closed = true
+	for _, stream := range s.streams {
+		stream.stop()
+	}
+}
+
+// login 记录连接上认证通过的用户
+func (s *session) login(user string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.user = user
+	s.authenticated = true
+}
+
+// userOf 返回连接上认证通过的用户，还没有认证时返回 false
+func (s *session) userOf() (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.user, s.authenticated
+}